@@ -0,0 +1,136 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+var ErrAMQPNotConfirmed = errors.New("AMQP broker did not confirm published stats")
+
+// AMQPChannel is the part of an AMQP channel used by AMQPStatsFlusher. It is
+// usually a thin wrapper around a channel from the application's AMQP client
+// library, put in publisher confirm mode.
+type AMQPChannel interface {
+	// Publish publishes a JSON message to the exchange with the routing key.
+	Publish(exchange, routingKey string, body []byte) error
+	// WaitForConfirms blocks until every message published since the last
+	// call has been confirmed, returning false if any was nacked.
+	WaitForConfirms() (bool, error)
+	Close() error
+}
+
+// AMQPDialFunc opens a new AMQPChannel.
+type AMQPDialFunc func() (AMQPChannel, error)
+
+// AMQPStatsFlusher is used to flush stats to an AMQP (e.g. RabbitMQ) exchange.
+// Each datum is published as a JSON message with a routing key of
+// stats.<type>.<name>.
+type AMQPStatsFlusher struct {
+	log      appwrap.Logging
+	exchange string
+	dial     AMQPDialFunc
+
+	mtx sync.Mutex
+	ch  AMQPChannel
+}
+
+func NewAMQPStatsFlusher(c context.Context, exchange string, dial AMQPDialFunc) *AMQPStatsFlusher {
+	log := appwrap.NewStackdriverLogging(c)
+	return &AMQPStatsFlusher{log: log, exchange: exchange, dial: dial}
+}
+
+// Flush publishes every datum and waits for the broker to confirm them. The
+// channel is opened on first use and kept for later flushes; if publishing
+// fails, the channel is reopened and the whole batch is published once more,
+// so a datum may be delivered twice.
+func (af *AMQPStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
+
+	af.mtx.Lock()
+	defer af.mtx.Unlock()
+
+	data = emittedData(data, cfg)
+	err := af.publish(data)
+	if err != nil && err != ErrAMQPNotConfirmed {
+		af.log.Warningf("Failed to publish stats to AMQP exchange %s, reconnecting: %s", af.exchange, err)
+		err = af.publish(data)
+	}
+
+	if err != nil {
+		af.log.Errorf("Failed to flush events to AMQP exchange %s: %s", af.exchange, err)
+	}
+	return err
+}
+
+func (af *AMQPStatsFlusher) publish(data []interface{}) error {
+
+	if af.ch == nil {
+		ch, err := af.dial()
+		if err != nil {
+			return err
+		}
+		af.ch = ch
+	}
+
+	for i := range data {
+		sc, ok := statConfigOf(data[i])
+		if !ok {
+			af.log.Warningf("Skipping stat of unknown type %T", data[i])
+			continue
+		}
+		body, err := marshalStatDatum(data[i], periodStartOf(data[i]))
+		if err != nil {
+			return err
+		}
+		if err := af.ch.Publish(af.exchange, fmt.Sprintf("stats.%s.%s", sc.Type, sc.Name), body); err != nil {
+			af.resetChannel()
+			return err
+		}
+	}
+
+	if ok, err := af.ch.WaitForConfirms(); err != nil {
+		af.resetChannel()
+		return err
+	} else if !ok {
+		return ErrAMQPNotConfirmed
+	}
+
+	return nil
+}
+
+// Close closes the flusher's channel, if it has one open.
+func (af *AMQPStatsFlusher) Close() error {
+	af.mtx.Lock()
+	defer af.mtx.Unlock()
+
+	if af.ch == nil {
+		return nil
+	}
+	err := af.ch.Close()
+	af.ch = nil
+	return err
+}
+
+func (af *AMQPStatsFlusher) resetChannel() {
+	if err := af.ch.Close(); err != nil {
+		af.log.Debugf("Failed to close AMQP channel: %s", err)
+	}
+	af.ch = nil
+}
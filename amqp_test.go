@@ -0,0 +1,120 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"encoding/json"
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+type amqpPublishing struct {
+	exchange   string
+	routingKey string
+	body       []byte
+}
+
+type fakeAMQPChannel struct {
+	published  []amqpPublishing
+	publishErr error
+	nack       bool
+	closed     bool
+}
+
+func (f *fakeAMQPChannel) Publish(exchange, routingKey string, body []byte) error {
+	if f.publishErr != nil {
+		return f.publishErr
+	}
+	f.published = append(f.published, amqpPublishing{exchange, routingKey, body})
+	return nil
+}
+
+func (f *fakeAMQPChannel) WaitForConfirms() (bool, error) {
+	return !f.nack, nil
+}
+
+func (f *fakeAMQPChannel) Close() error {
+	f.closed = true
+	return nil
+}
+
+func amqpTestData() []interface{} {
+	return []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "a", Type: scTypeCounter}, Count: 12},
+		StatDataTiming{StatConfig: StatConfig{Name: "latency", Type: scTypeTiming}, Count: 2, Min: 10, Max: 15.5, Sum: 25.5},
+	}
+}
+
+func (s *StatStashTest) TestAMQPStatsFlusher(c *C) {
+
+	var channels []*fakeAMQPChannel
+	flusher := NewAMQPStatsFlusher(s.Context, "metrics", func() (AMQPChannel, error) {
+		ch := &fakeAMQPChannel{}
+		channels = append(channels, ch)
+		return ch, nil
+	})
+
+	c.Assert(flusher.Flush(amqpTestData(), nil), IsNil)
+	c.Assert(channels, HasLen, 1)
+	c.Assert(channels[0].published, HasLen, 2)
+	c.Check(channels[0].published[0].exchange, Equals, "metrics")
+	c.Check(channels[0].published[0].routingKey, Equals, "stats.counter.requests")
+	c.Check(channels[0].published[1].routingKey, Equals, "stats.timing.latency")
+
+	var msg struct {
+		Period string
+		Stat   struct {
+			Name   string
+			Source string
+			Count  int
+			Max    float64
+		}
+	}
+	c.Assert(json.Unmarshal(channels[0].published[1].body, &msg), IsNil)
+	c.Check(msg.Period, Not(Equals), "")
+	c.Check(msg.Stat.Name, Equals, "latency")
+	c.Check(msg.Stat.Count, Equals, 2)
+	c.Check(msg.Stat.Max, Equals, 15.5)
+
+	// The channel is reused across flushes
+	c.Assert(flusher.Flush(amqpTestData(), nil), IsNil)
+	c.Check(channels, HasLen, 1)
+	c.Check(channels[0].published, HasLen, 4)
+
+	// A broken channel is replaced
+	channels[0].publishErr = errors.New("channel closed")
+	c.Assert(flusher.Flush(amqpTestData(), nil), IsNil)
+	c.Check(channels[0].closed, Equals, true)
+	c.Assert(channels, HasLen, 2)
+	c.Check(channels[1].published, HasLen, 2)
+
+	// Unconfirmed publishes are an error
+	channels[1].nack = true
+	c.Check(flusher.Flush(amqpTestData(), nil), Equals, ErrAMQPNotConfirmed)
+
+}
+
+func (s *StatStashTest) TestAMQPStatsFlusherClose(c *C) {
+
+	ch := &fakeAMQPChannel{}
+	flusher := NewAMQPStatsFlusher(s.Context, "metrics", func() (AMQPChannel, error) { return ch, nil })
+
+	c.Assert(flusher.Close(), IsNil)
+	c.Assert(flusher.Flush(amqpTestData(), nil), IsNil)
+	c.Assert(flusher.Close(), IsNil)
+	c.Check(ch.closed, Equals, true)
+
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// GCSClient is the part of Google Cloud Storage used by GCSStatsFlusher, so
+// it can be backed by cloud.google.com/go/storage or a fake in tests.
+type GCSClient interface {
+	// Exists returns whether the object exists in the bucket.
+	Exists(bucket, object string) (bool, error)
+	// Write creates or replaces the object with data.
+	Write(bucket, object string, data []byte) error
+	// Compose replaces dst with the concatenation of the srcs objects,
+	// which may include dst itself.
+	Compose(bucket, dst string, srcs []string) error
+	// Delete removes the object.
+	Delete(bucket, object string) error
+}
+
+// GCSStatsFlusher is used to archive stats to Google Cloud Storage as
+// newline-delimited JSON, one message per datum as the NATS flusher sends
+// them, in an object per hour: gs://bucket/prefix/YYYY/MM/DD/HH.json (UTC,
+// by period start). Each flush is written as its own part object, which is
+// composed onto the end of the hour's object and then deleted, so objects
+// are never rewritten by the flusher. Flushes of the same hour must not run
+// concurrently, or one's part can be lost.
+type GCSStatsFlusher struct {
+	log    appwrap.Logging
+	client GCSClient
+	bucket string
+	prefix string
+}
+
+// NewGCSStatsFlusher returns a flusher archiving to bucket, under prefix
+// (without leading or trailing slashes; none if empty).
+func NewGCSStatsFlusher(c context.Context, client GCSClient, bucket, prefix string) StatsFlusher {
+	log := appwrap.NewStackdriverLogging(c)
+	return GCSStatsFlusher{log, client, bucket, strings.Trim(prefix, "/")}
+}
+
+// object returns the name of the hour's object a datum belongs in.
+func (gf GCSStatsFlusher) object(datum interface{}) string {
+	object := periodStartOf(datum).UTC().Format("2006/01/02/15") + ".json"
+	if gf.prefix != "" {
+		object = gf.prefix + "/" + object
+	}
+	return object
+}
+
+func (gf GCSStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
+
+	data = emittedData(data, cfg)
+	parts := make(map[string][]interface{})
+	bodies := make(map[string]*bytes.Buffer)
+	for i := range data {
+		if _, ok := statConfigOf(data[i]); !ok {
+			gf.log.Warningf("Not archiving stat of unknown type %T to GCS", data[i])
+			continue
+		}
+		body, err := marshalStatDatum(data[i], periodStartOf(data[i]))
+		if err != nil {
+			return err
+		}
+		object := gf.object(data[i])
+		if bodies[object] == nil {
+			bodies[object] = &bytes.Buffer{}
+		}
+		bodies[object].Write(body)
+		bodies[object].WriteByte('\n')
+		parts[object] = append(parts[object], data[i])
+	}
+
+	objects := make([]string, 0, len(bodies))
+	for object := range bodies {
+		objects = append(objects, object)
+	}
+	sort.Strings(objects)
+
+	for _, object := range objects {
+		part := object + ".part-" + periodKey("gcs", parts[object])
+		if err := gf.append(object, part, bodies[object].Bytes()); err != nil {
+			gf.log.Errorf("Failed to archive stats to gs://%s/%s: %s", gf.bucket, object, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// append writes body as the part object, then composes it onto the end of
+// object.
+func (gf GCSStatsFlusher) append(object, part string, body []byte) error {
+	if err := gf.client.Write(gf.bucket, part, body); err != nil {
+		return err
+	}
+
+	srcs := []string{part}
+	if exists, err := gf.client.Exists(gf.bucket, object); err != nil {
+		return err
+	} else if exists {
+		srcs = []string{object, part}
+	}
+	if err := gf.client.Compose(gf.bucket, object, srcs); err != nil {
+		return err
+	}
+
+	if err := gf.client.Delete(gf.bucket, part); err != nil {
+		// The data is already in the hour's object
+		gf.log.Warningf("Failed to delete part gs://%s/%s: %s", gf.bucket, part, err)
+	}
+	return nil
+}
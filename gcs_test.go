@@ -0,0 +1,108 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeGCSClient holds objects in memory, keyed by bucket/object.
+type fakeGCSClient struct {
+	objects  map[string][]byte
+	writeErr error
+}
+
+func (f *fakeGCSClient) Exists(bucket, object string) (bool, error) {
+	_, found := f.objects[bucket+"/"+object]
+	return found, nil
+}
+
+func (f *fakeGCSClient) Write(bucket, object string, data []byte) error {
+	if f.writeErr != nil {
+		return f.writeErr
+	}
+	f.objects[bucket+"/"+object] = append([]byte(nil), data...)
+	return nil
+}
+
+func (f *fakeGCSClient) Compose(bucket, dst string, srcs []string) error {
+	var composed []byte
+	for _, src := range srcs {
+		data, found := f.objects[bucket+"/"+src]
+		if !found {
+			return errors.New("no such object " + src)
+		}
+		composed = append(composed, data...)
+	}
+	f.objects[bucket+"/"+dst] = composed
+	return nil
+}
+
+func (f *fakeGCSClient) Delete(bucket, object string) error {
+	delete(f.objects, bucket+"/"+object)
+	return nil
+}
+
+func (s *StatStashTest) TestGCSStatsFlusher(c *C) {
+
+	client := &fakeGCSClient{objects: make(map[string][]byte)}
+	flusher := NewGCSStatsFlusher(s.Context, client, "archive", "/stats/")
+
+	period := time.Date(2024, 3, 7, 14, 25, 0, 0, time.UTC)
+	flush := func(count uint64) {
+		data := []interface{}{
+			StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "api", Type: scTypeCounter}, Count: count, PeriodStart: period},
+		}
+		c.Assert(flusher.Flush(data, nil), IsNil)
+	}
+	flush(3)
+	period = period.Add(5 * time.Minute)
+	flush(4)
+
+	// Both flushes are appended to the hour's object, and the parts removed
+	c.Assert(client.objects, HasLen, 1)
+	body, found := client.objects["archive/stats/2024/03/07/14.json"]
+	c.Assert(found, Equals, true)
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	c.Assert(lines, HasLen, 2)
+
+	var msg struct {
+		Period time.Time       `json:"period"`
+		Stat   StatDataCounter `json:"stat"`
+	}
+	c.Assert(json.Unmarshal([]byte(lines[0]), &msg), IsNil)
+	c.Check(msg.Period.Equal(time.Date(2024, 3, 7, 14, 25, 0, 0, time.UTC)), Equals, true)
+	c.Check(msg.Stat.Name, Equals, "requests")
+	c.Check(msg.Stat.Source, Equals, "api")
+	c.Check(msg.Stat.Count, Equals, uint64(3))
+	c.Assert(json.Unmarshal([]byte(lines[1]), &msg), IsNil)
+	c.Check(msg.Stat.Count, Equals, uint64(4))
+
+	// The next hour gets its own object
+	period = period.Add(time.Hour)
+	flush(5)
+	c.Check(client.objects, HasLen, 2)
+	_, found = client.objects["archive/stats/2024/03/07/15.json"]
+	c.Check(found, Equals, true)
+
+	client.writeErr = errors.New("bucket unavailable")
+	c.Check(flusher.Flush([]interface{}{StatDataCounter{StatConfig: StatConfig{Name: "requests"}, Count: 1}}, nil), ErrorMatches, "bucket unavailable")
+
+}
@@ -0,0 +1,167 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// GraphiteOptions configures a GraphiteStatsFlusher.
+type GraphiteOptions struct {
+	// Prefix is prepended to every metric path, e.g. "myapp"; none if empty.
+	Prefix string
+
+	// UseTags makes series be sent tagged (Graphite 1.1+), as
+	// name;source=value, rather than with the source in the dotted path, as
+	// name.source, so the source can be queried as a dimension.
+	UseTags bool
+
+	// Tags are added to every tagged series, e.g. env=prod. They're only
+	// sent with UseTags.
+	Tags map[string]string
+}
+
+// GraphiteStatsFlusher is used to flush stats to Graphite (carbon) using the
+// plaintext protocol. Counters and gauges are sent as one series each;
+// timings are fanned out into <name>.count, .sum, .min, .max, .median, .p90
+// and .p999 series.
+type GraphiteStatsFlusher struct {
+	log     appwrap.Logging
+	network string
+	addr    string
+	opts    GraphiteOptions
+}
+
+// NewGraphiteStatsFlusher returns a flusher sending to the carbon server at
+// addr over network ("tcp", or "udp" for flushes small enough to fit in one
+// datagram).
+func NewGraphiteStatsFlusher(c context.Context, network, addr string, opts GraphiteOptions) StatsFlusher {
+	log := appwrap.NewStackdriverLogging(c)
+	return GraphiteStatsFlusher{log, network, addr, opts}
+}
+
+// graphitePathReplacer replaces the characters which would split or break a
+// dotted path component.
+var graphitePathReplacer = strings.NewReplacer(".", "_", " ", "_", "\t", "_", "\n", "_")
+
+// graphiteTagReplacer replaces the characters Graphite doesn't allow in tag
+// values.
+var graphiteTagReplacer = strings.NewReplacer(";", "_", "~", "_", " ", "_", "\t", "_", "\n", "_")
+
+// path returns the series name for sc with the sub-metric suffix, e.g.
+// "prefix.service.name.source.p90", or
+// "prefix.name.p90;service=service;source=source;env=prod" with tags.
+func (gf GraphiteStatsFlusher) path(sc StatConfig, suffix string) string {
+	name := sc.Name
+	if !gf.opts.UseTags {
+		name = sc.serviceName()
+	}
+	path := strings.Replace(name, " ", "_", -1)
+	if gf.opts.Prefix != "" {
+		path = gf.opts.Prefix + "." + path
+	}
+
+	if !gf.opts.UseTags {
+		if hasSource(sc.Source) {
+			path += "." + graphitePathReplacer.Replace(sc.Source)
+		}
+		return path + suffix
+	}
+
+	path += suffix
+	tags := make(map[string]string, len(gf.opts.Tags)+1)
+	for name, value := range gf.opts.Tags {
+		tags[name] = value
+	}
+	if hasSource(sc.Source) {
+		tags["source"] = sc.Source
+	}
+	if sc.Service != "" {
+		tags["service"] = sc.Service
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if tags[name] == "" {
+			continue // Graphite rejects empty tag values
+		}
+		path += ";" + graphiteTagReplacer.Replace(name) + "=" + graphiteTagReplacer.Replace(tags[name])
+	}
+	return path
+}
+
+// lines renders the flushed data in the plaintext protocol.
+func (gf GraphiteStatsFlusher) lines(data []interface{}) []byte {
+	var buf bytes.Buffer
+	for i := range data {
+		timestamp := periodStartOf(data[i]).Unix()
+		line := func(sc StatConfig, suffix string, value float64) {
+			fmt.Fprintf(&buf, "%s %s %d\n", gf.path(sc, suffix), strconv.FormatFloat(value, 'g', -1, 64), timestamp)
+		}
+
+		switch d := data[i].(type) {
+		case StatDataCounter:
+			line(d.StatConfig, "", float64(d.Count))
+		case StatDataFloatCounter:
+			line(d.StatConfig, "", d.Value)
+		case StatDataGauge:
+			line(d.StatConfig, "", d.Value)
+		case StatDataTiming:
+			line(d.StatConfig, ".count", float64(d.Count))
+			line(d.StatConfig, ".sum", d.Sum)
+			line(d.StatConfig, ".min", d.Min)
+			line(d.StatConfig, ".max", d.Max)
+			line(d.StatConfig, ".median", d.Median)
+			line(d.StatConfig, ".p90", d.NinthDecileValue)
+			line(d.StatConfig, ".p999", d.ThreeNinesValue)
+		default:
+			gf.log.Warningf("Not sending stat of unknown type %T to Graphite", data[i])
+		}
+	}
+	return buf.Bytes()
+}
+
+func (gf GraphiteStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
+
+	lines := gf.lines(emittedData(data, cfg))
+	if len(lines) == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial(gf.network, gf.addr)
+	if err != nil {
+		gf.log.Errorf("Failed to connect to Graphite server %s/%s: %s", gf.network, gf.addr, err)
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(lines); err != nil {
+		gf.log.Errorf("Failed to write stats to Graphite server %s/%s: %s", gf.network, gf.addr, err)
+		return err
+	}
+
+	return nil
+}
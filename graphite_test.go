@@ -0,0 +1,97 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func graphiteTestData(period time.Time) []interface{} {
+	return []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "api.v2", Type: scTypeCounter}, Count: 12, PeriodStart: period},
+		StatDataGauge{StatConfig: StatConfig{Name: "queue.depth", Type: scTypeGauge}, Value: 2.5, PeriodStart: period},
+		StatDataTiming{StatConfig: StatConfig{Name: "latency", Source: "api", Type: scTypeTiming}, Count: 3, Sum: 60, Min: 10, Max: 30,
+			Median: 20, NinthDecileValue: 30, ThreeNinesValue: 30, PeriodStart: period},
+	}
+}
+
+// flushToGraphite flushes data with the options and returns the lines the
+// server received.
+func (s *StatStashTest) flushToGraphite(c *C, opts GraphiteOptions, data []interface{}) []string {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer conn.Close()
+		body, _ := ioutil.ReadAll(conn)
+		received <- string(body)
+	}()
+
+	flusher := NewGraphiteStatsFlusher(s.Context, "tcp", listener.Addr().String(), opts)
+	c.Assert(flusher.Flush(data, nil), IsNil)
+
+	return strings.Split(strings.TrimSuffix(<-received, "\n"), "\n")
+
+}
+
+func (s *StatStashTest) TestGraphiteStatsFlusher(c *C) {
+
+	period := getStartOfFlushPeriod(time.Now(), -1)
+	lines := s.flushToGraphite(c, GraphiteOptions{Prefix: "app"}, graphiteTestData(period))
+
+	ts := period.Unix()
+	c.Check(lines, DeepEquals, []string{
+		fmt.Sprintf("app.requests.api_v2 12 %d", ts),
+		fmt.Sprintf("app.queue.depth 2.5 %d", ts),
+		fmt.Sprintf("app.latency.api.count 3 %d", ts),
+		fmt.Sprintf("app.latency.api.sum 60 %d", ts),
+		fmt.Sprintf("app.latency.api.min 10 %d", ts),
+		fmt.Sprintf("app.latency.api.max 30 %d", ts),
+		fmt.Sprintf("app.latency.api.median 20 %d", ts),
+		fmt.Sprintf("app.latency.api.p90 30 %d", ts),
+		fmt.Sprintf("app.latency.api.p999 30 %d", ts),
+	})
+
+}
+
+func (s *StatStashTest) TestGraphiteStatsFlusherTags(c *C) {
+
+	period := getStartOfFlushPeriod(time.Now(), -1)
+	opts := GraphiteOptions{Prefix: "app", UseTags: true, Tags: map[string]string{"env": "prod"}}
+	lines := s.flushToGraphite(c, opts, graphiteTestData(period))
+
+	ts := period.Unix()
+	c.Assert(lines, HasLen, 9)
+	c.Check(lines[0], Equals, fmt.Sprintf("app.requests;env=prod;source=api.v2 12 %d", ts))
+	c.Check(lines[1], Equals, fmt.Sprintf("app.queue.depth;env=prod 2.5 %d", ts))
+	// Timings keep their dotted sub-metrics
+	c.Check(lines[2], Equals, fmt.Sprintf("app.latency.count;env=prod;source=api 3 %d", ts))
+	c.Check(lines[7], Equals, fmt.Sprintf("app.latency.p90;env=prod;source=api 30 %d", ts))
+
+}
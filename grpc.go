@@ -0,0 +1,70 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/proto"
+)
+
+// GRPCConvertFunc converts flushed stat data into the request message of an
+// application defined gRPC metrics service.
+type GRPCConvertFunc func(data []interface{}) (proto.Message, error)
+
+// GRPCPushFunc sends a request made by a GRPCConvertFunc through the
+// application's generated client for its metrics service, e.g.
+//
+//	func(ctx context.Context, req proto.Message) error {
+//		_, err := client.Push(ctx, req.(*metricspb.PushRequest))
+//		return err
+//	}
+type GRPCPushFunc func(ctx context.Context, req proto.Message) error
+
+// GRPCStatsFlusher is used to flush stats to an application defined gRPC
+// metrics service. Since the service's proto is application specific, the
+// conversion into a request message is left to a GRPCConvertFunc, and the
+// call to its generated client to a GRPCPushFunc.
+type GRPCStatsFlusher struct {
+	c       context.Context
+	log     appwrap.Logging
+	convert GRPCConvertFunc
+	push    GRPCPushFunc
+}
+
+// NewGRPCStatsFlusher returns a flusher which converts the data of every
+// flush with convert and sends it with push.
+func NewGRPCStatsFlusher(c context.Context, convert GRPCConvertFunc, push GRPCPushFunc) StatsFlusher {
+	log := appwrap.NewStackdriverLogging(c)
+	return GRPCStatsFlusher{c, log, convert, push}
+}
+
+func (gf GRPCStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
+
+	req, err := gf.convert(emittedData(data, cfg))
+	if err != nil {
+		gf.log.Errorf("Failed to convert stats for gRPC: %s", err)
+		return err
+	}
+
+	gf.log.Debugf("Flushing data to gRPC: %v", req)
+
+	if err := gf.push(gf.c, req); err != nil {
+		gf.log.Errorf("Failed to flush events to gRPC: %s", err)
+		return err
+	}
+
+	return nil
+}
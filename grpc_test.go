@@ -0,0 +1,124 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"net"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	. "gopkg.in/check.v1"
+)
+
+// fakeMetricsServer is an in-process gRPC server with a single unary
+// "/statstash.test.Metrics/Push" method accepting a structpb.Struct.
+type fakeMetricsServer struct {
+	received []*structpb.Struct
+	err      error
+}
+
+func (f *fakeMetricsServer) start(c *C) *grpc.ClientConn {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "statstash.test.Metrics",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Push",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := &structpb.Struct{}
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				f.received = append(f.received, in)
+				if f.err != nil {
+					return nil, f.err
+				}
+				return &emptypb.Empty{}, nil
+			},
+		}},
+	}, f)
+	go server.Serve(listener)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	c.Assert(err, IsNil)
+	return conn
+}
+
+// metricsClient is a client for fakeMetricsServer, as protoc-gen-go-grpc
+// would generate it.
+type metricsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func (c *metricsClient) Push(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	if err := c.cc.Invoke(ctx, "/statstash.test.Metrics/Push", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func countersToStruct(data []interface{}) (proto.Message, error) {
+	fields := make(map[string]interface{})
+	for _, datum := range data {
+		if counter, ok := datum.(StatDataCounter); ok {
+			fields[counter.Name+"/"+counter.Source] = float64(counter.Count)
+		}
+	}
+	return structpb.NewStruct(fields)
+}
+
+func (s *StatStashTest) TestGRPCStatsFlusher(c *C) {
+
+	server := &fakeMetricsServer{}
+	conn := server.start(c)
+	defer conn.Close()
+
+	client := &metricsClient{conn}
+	flusher := NewGRPCStatsFlusher(s.Context, countersToStruct, func(ctx context.Context, req proto.Message) error {
+		_, err := client.Push(ctx, req.(*structpb.Struct))
+		return err
+	})
+
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "TestGRPCStatsFlusher.foo", Source: "a"}, Count: 2},
+		StatDataCounter{StatConfig: StatConfig{Name: "TestGRPCStatsFlusher.bar"}, Count: 12},
+	}
+
+	c.Assert(flusher.Flush(data, nil), IsNil)
+	c.Assert(server.received, HasLen, 1)
+	c.Check(server.received[0].AsMap(), DeepEquals, map[string]interface{}{
+		"TestGRPCStatsFlusher.foo/a": 2.0,
+		"TestGRPCStatsFlusher.bar/":  12.0,
+	})
+
+	server.err = status.Error(codes.Unavailable, "ingestion paused")
+	err := flusher.Flush(data, nil)
+	c.Assert(err, NotNil)
+	c.Check(status.Code(err), Equals, codes.Unavailable)
+
+}
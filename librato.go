@@ -18,30 +18,375 @@ package statstash
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/pendo-io/appwrap"
 	"golang.org/x/net/context"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 )
 
 const (
-	libratoApiEndpoint = "https://metrics-api.librato.com/v1/metrics"
+	libratoApiEndpoint         = "https://metrics-api.librato.com/v1/metrics"
+	libratoAnnotationsEndpoint = "https://metrics-api.librato.com/v1/annotations/"
+	libratoDefaultBatchSize    = 300
+	libratoDefaultConcurrency  = 1
+	libratoDefaultEventStream  = "statstash"
 )
 
+// ErrLibratoEventsNotConfigured is returned by LibratoStatsFlusher.EmitEvent
+// when LibratoOptions.EventConfig isn't set.
+var ErrLibratoEventsNotConfigured = errors.New("Librato events need LibratoOptions.EventConfig")
+
+// ErrLibratoMissingConfig is returned by LibratoStatsFlusher.Flush when it's
+// given a nil FlusherConfig, or one without credentials.
+var ErrLibratoMissingConfig = errors.New("Librato flusher needs a FlusherConfig with a Username and Password")
+
 // LibratoStatsFlusher is used to flush stats to the Librato metrics service.
+// Librato has no tags, so stats with a service have it prefixed to their
+// name.
 type LibratoStatsFlusher struct {
-	c   context.Context
-	log appwrap.Logging
+	c    context.Context
+	log  appwrap.Logging
+	opts LibratoOptions
+}
+
+// LibratoOptions controls optional behaviour of LibratoStatsFlusher.
+type LibratoOptions struct {
+	// Client sends the requests to Librato; http.DefaultClient if nil.
+	Client HTTPDoer
+
+	// EmitVariance makes timings also be sent with their variance, as a
+	// separate <name>.variance gauge.
+	EmitVariance bool
+
+	// BatchSize is the most measurements sent in one request; larger
+	// flushes are split over several requests. Zero means 300.
+	BatchSize int
+
+	// EventConfig holds the credentials EmitEvent uses, since it isn't given
+	// a FlusherConfig. Events can't be emitted without it.
+	EventConfig *FlusherConfig
+
+	// EventStream is the annotation stream events are added to; "statstash"
+	// if empty.
+	EventStream string
+
+	// Compress makes requests be sent gzip compressed, which Librato
+	// accepts, to cut the egress of large flushes.
+	Compress bool
+
+	// DefaultSource is sent as the source of measurements whose stat has
+	// none, for Librato accounts which drop measurements without a source.
+	// Sourceless measurements are sent without one if it's empty.
+	DefaultSource string
+
+	// Precision is the number of decimal places values are sent with. Zero
+	// sends the fewest digits which represent each value exactly.
+	Precision int
+
+	// Concurrency is the most batches sent at once. A batch rate limited by
+	// Librato (HTTP 429) halves it for the rest of the flush, and is sent
+	// again; once it's down to one, rate limited batches fail. Zero means 1,
+	// sending the batches one at a time.
+	Concurrency int
+
+	// Router, if set, picks the FlusherConfig, and so the Librato account,
+	// each stat is flushed with, for organizations which split their
+	// metrics over several accounts. Stats it returns nil for use the
+	// FlusherConfig given to Flush. Stats are batched by account. Only the
+	// credentials of the FlusherConfigs it returns are used; the stats are
+	// named and counted by the FlusherConfig given to Flush, and routed by
+	// their names before its NameMapper renames them.
+	Router func(StatConfig) *FlusherConfig
+
+	// CounterEmitMode is how counters' values are sent; CounterEmitRaw, the
+	// default, sends each period's count.
+	CounterEmitMode CounterEmitMode
+}
+
+// CounterEmitMode is how the Librato flusher sends counters. The rate modes
+// post counters as gauges under the same names, which Librato rejects for a
+// metric that already exists as a counter, so switching the counters of an
+// existing account to a rate mode needs their metrics deleted (or renamed
+// with FlusherConfig.NameMapper) first.
+type CounterEmitMode int
+
+const (
+	// CounterEmitRaw sends the count of each aggregation period as a
+	// Librato counter.
+	CounterEmitRaw CounterEmitMode = iota
+	// CounterEmitPerSecond sends the count divided into a rate per second,
+	// as a gauge since rates aren't whole numbers.
+	CounterEmitPerSecond
+	// CounterEmitPerMinute sends the count divided into a rate per minute,
+	// as a gauge, for dashboards built on per-minute rates.
+	CounterEmitPerMinute
+)
+
+// rate converts a period's count to the mode's rate.
+func (mode CounterEmitMode) rate(count uint64) float64 {
+	switch mode {
+	case CounterEmitPerSecond:
+		return float64(count) / defaultAggregationPeriod.Seconds()
+	case CounterEmitPerMinute:
+		return float64(count) / defaultAggregationPeriod.Minutes()
+	}
+	return float64(count)
 }
 
 func NewLibratoStatsFlusher(c context.Context) StatsFlusher {
+	return NewLibratoStatsFlusherWithOptions(c, LibratoOptions{})
+}
+
+// NewLibratoStatsFlusherWithClient returns a Librato flusher which sends its
+// requests through client.
+func NewLibratoStatsFlusherWithClient(c context.Context, client HTTPDoer) StatsFlusher {
+	return NewLibratoStatsFlusherWithOptions(c, LibratoOptions{Client: client})
+}
+
+// NewLibratoStatsFlusherWithOptions returns a Librato flusher configured by
+// opts.
+func NewLibratoStatsFlusherWithOptions(c context.Context, opts LibratoOptions) StatsFlusher {
 	log := appwrap.NewStackdriverLogging(c)
-	return LibratoStatsFlusher{c, log}
+	return LibratoStatsFlusher{c, log, opts}
 }
 
 func (lf LibratoStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
+	_, err := lf.FlushWithStats(data, cfg)
+	return err
+}
+
+func (lf LibratoStatsFlusher) FlushWithStats(data []interface{}, cfg *FlusherConfig) (FlushStats, error) {
+
+	meter := &flushMeter{}
+	if lf.opts.Router == nil && !libratoConfigured(cfg) {
+		lf.log.Errorf("Not flushing %d stats to Librato: %s", len(data), ErrLibratoMissingConfig)
+		return meter.stats, ErrLibratoMissingConfig
+	}
+
+	var errs BatchErrors
+	var batches [][]interface{}
+	var batchCfgs []*FlusherConfig
+	for _, dest := range lf.destinations(data, emittedData(data, cfg), cfg) {
+		if !libratoConfigured(dest.cfg) {
+			lf.log.Errorf("Not flushing %d stats to Librato: %s", len(dest.data), ErrLibratoMissingConfig)
+			errs = append(errs, ErrLibratoMissingConfig)
+			continue
+		}
+		for _, batch := range lf.batches(dest.data) {
+			batches = append(batches, batch)
+			batchCfgs = append(batchCfgs, dest.cfg)
+		}
+	}
+	errs = append(errs, lf.sendBatches(batches, batchCfgs, meter)...)
+
+	if len(errs) == 1 {
+		return meter.stats, errs[0]
+	} else if len(errs) > 0 {
+		lf.log.Errorf("Failed to flush %d of %d batches to Librato", len(errs), len(batches))
+		return meter.stats, errs
+	}
+	return meter.stats, nil
+}
+
+// source returns the source measurements of a stat with the source are sent
+// with; see LibratoOptions.DefaultSource.
+func (lf LibratoStatsFlusher) source(source string) string {
+	if !hasSource(source) {
+		return lf.opts.DefaultSource
+	}
+	return source
+}
+
+// formatFloat formats a measurement's value; see LibratoOptions.Precision.
+func (lf LibratoStatsFlusher) formatFloat(value float64) string {
+	precision := -1
+	if lf.opts.Precision > 0 {
+		precision = lf.opts.Precision
+	}
+	return strconv.FormatFloat(value, 'f', precision, 64)
+}
+
+// measurements returns how many Librato measurements a datum is sent as.
+func (lf LibratoStatsFlusher) measurements(datum interface{}) int {
+	switch datum.(type) {
+	case StatDataCounter, StatDataFloatCounter, StatDataGauge:
+		return 1
+	case StatDataTiming:
+		if lf.opts.EmitVariance {
+			return 4
+		}
+		return 3
+	case StatDataHistogram:
+		return 4
+	}
+	return 0
+}
+
+// batches splits data so that no batch has more than BatchSize measurements,
+// keeping each datum's measurements together. Each batch only holds data for
+// a single period, which is sent as its measure_time.
+func (lf LibratoStatsFlusher) batches(data []interface{}) [][]interface{} {
+	batchSize := lf.opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = libratoDefaultBatchSize
+	}
+
+	var batches [][]interface{}
+	start, size := 0, 0
+	for i := range data {
+		n := lf.measurements(data[i])
+		if size > 0 && (size+n > batchSize || !periodStartOf(data[i]).Equal(periodStartOf(data[start]))) {
+			batches = append(batches, data[start:i])
+			start, size = i, 0
+		}
+		size += n
+	}
+	if start < len(data) {
+		batches = append(batches, data[start:])
+	}
+	return batches
+}
+
+// libratoDestination is the data flushed to one Librato account.
+type libratoDestination struct {
+	cfg  *FlusherConfig
+	data []interface{}
+}
+
+// destinations splits emitted, the emittedData of data, by the account
+// LibratoOptions.Router picks for the same datum of data, keeping the data's
+// order; without a router, everything goes to cfg's account.
+func (lf LibratoStatsFlusher) destinations(data, emitted []interface{}, cfg *FlusherConfig) []libratoDestination {
+	if lf.opts.Router == nil {
+		return []libratoDestination{{cfg, emitted}}
+	}
+
+	var dests []libratoDestination
+	index := make(map[[3]string]int)
+	for i, datum := range data {
+		sc, _ := statConfigOf(datum)
+		destCfg := lf.opts.Router(sc)
+		if destCfg == nil {
+			destCfg = cfg
+		}
+		var account [3]string
+		if destCfg != nil {
+			account = [3]string{destCfg.Username, destCfg.Password, destCfg.ApiKey}
+		}
+		d, found := index[account]
+		if !found {
+			d = len(dests)
+			index[account] = d
+			dests = append(dests, libratoDestination{cfg: destCfg})
+		}
+		dests[d].data = append(dests[d].data, emitted[i])
+	}
+	return dests
+}
+
+// sendBatches posts the batches, each with the FlusherConfig of the same
+// index in cfgs, up to LibratoOptions.Concurrency at once, returning the
+// errors of those which failed in batch order. Rate limited batches are
+// queued again after lowering the concurrency, until it's down to one.
+func (lf LibratoStatsFlusher) sendBatches(batches [][]interface{}, cfgs []*FlusherConfig, meter *flushMeter) BatchErrors {
+	limit := lf.opts.Concurrency
+	if limit <= 0 {
+		limit = libratoDefaultConcurrency
+	}
+
+	queue := make([]int, len(batches))
+	for i := range queue {
+		queue[i] = i
+	}
+
+	var mtx sync.Mutex
+	slots := sync.NewCond(&mtx)
+	inFlight := 0
+	batchErrs := make([]error, len(batches))
+	mtx.Lock()
+	for len(queue) > 0 || inFlight > 0 {
+		if len(queue) == 0 || inFlight >= limit {
+			slots.Wait()
+			continue
+		}
+		i := queue[0]
+		queue = queue[1:]
+		inFlight++
+
+		go func(i int) {
+			err := lf.post(lf.postData(batches[i]), idempotencyKey("librato", batches[i]), cfgs[i], meter)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			batchErrs[i] = err
+			if statusErr, ok := err.(libratoStatusError); ok && statusErr.code == http.StatusTooManyRequests && limit > 1 {
+				limit /= 2
+				lf.log.Warningf("Rate limited by Librato, sending %d batches at once", limit)
+				batchErrs[i] = nil
+				queue = append(queue, i)
+			}
+			inFlight--
+			slots.Broadcast()
+		}(i)
+	}
+	mtx.Unlock()
+
+	var errs BatchErrors
+	for _, err := range batchErrs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// libratoStatusError is the error for a request Librato answered with an
+// unsuccessful HTTP status.
+type libratoStatusError struct {
+	code int
+}
+
+func (e libratoStatusError) Error() string {
+	return fmt.Sprintf("librato returned HTTP status %d", e.code)
+}
+
+// post sends one batch of measurements to Librato, measuring the request
+// with meter.
+func (lf LibratoStatsFlusher) post(postdata url.Values, key string, cfg *FlusherConfig, meter *flushMeter) error {
+
+	lf.log.Debugf("Flushing data to Librato: %#v", postdata)
+
+	req, err := lf.newRequest(libratoApiEndpoint, postdata, cfg)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := meter.do(lf.getHttpClient(), req)
+	if err != nil {
+		lf.log.Errorf("Failed to flush events to Librato: HTTP error: %s", err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		if body, err := ioutil.ReadAll(resp.Body); err != nil {
+			lf.log.Errorf("Failed to flush events to Librato, and failed to read the response body: %s", err)
+		} else {
+			lf.log.Errorf("Failed to flush events to Librato: HTTP status code %d, response body: %s", resp.StatusCode, body)
+		}
+		return libratoStatusError{resp.StatusCode}
+	}
+
+	return nil
+}
+
+// postData builds the form values posted to Librato for the flushed data.
+func (lf LibratoStatsFlusher) postData(data []interface{}) url.Values {
 
 	postdata := make(url.Values)
 
@@ -49,6 +394,10 @@ func (lf LibratoStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) erro
 		return fmt.Sprintf("%s[%d][%s]", typ, i, field)
 	}
 
+	if len(data) > 0 {
+		postdata.Set("measure_time", strconv.FormatInt(periodStartOf(data[0]).Unix(), 10))
+	}
+
 	gaugeCount := 0
 	counterCount := 0
 
@@ -56,71 +405,184 @@ func (lf LibratoStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) erro
 		switch data[i].(type) {
 		case StatDataCounter:
 			sdc := data[i].(StatDataCounter)
-			postdata.Add(getPostKey("counters", "name", counterCount), sdc.Name)
+			if lf.opts.CounterEmitMode != CounterEmitRaw {
+				postdata.Add(getPostKey("gauges", "name", gaugeCount), sdc.serviceName())
+				postdata.Add(getPostKey("gauges", "value", gaugeCount), lf.formatFloat(lf.opts.CounterEmitMode.rate(sdc.Count)))
+				if source := lf.source(sdc.Source); hasSource(source) {
+					postdata.Add(getPostKey("gauges", "source", gaugeCount), source)
+				}
+				gaugeCount++
+				break
+			}
+			postdata.Add(getPostKey("counters", "name", counterCount), sdc.serviceName())
 			postdata.Add(getPostKey("counters", "value", counterCount), fmt.Sprintf("%d", sdc.Count))
-			if sdc.Source != "" {
-				postdata.Add(getPostKey("counters", "source", counterCount), sdc.Source)
+			if source := lf.source(sdc.Source); hasSource(source) {
+				postdata.Add(getPostKey("counters", "source", counterCount), source)
 			}
 			counterCount++
+		case StatDataFloatCounter:
+			// Librato counters are integers, so float counters are sent as
+			// gauges of the period's total
+			sdf := data[i].(StatDataFloatCounter)
+			postdata.Add(getPostKey("gauges", "name", gaugeCount), sdf.serviceName())
+			postdata.Add(getPostKey("gauges", "value", gaugeCount), lf.formatFloat(sdf.Value))
+			if source := lf.source(sdf.Source); hasSource(source) {
+				postdata.Add(getPostKey("gauges", "source", gaugeCount), source)
+			}
+			gaugeCount++
 		case StatDataGauge:
 			sdg := data[i].(StatDataGauge)
-			postdata.Add(getPostKey("gauges", "name", gaugeCount), sdg.Name)
-			postdata.Add(getPostKey("gauges", "value", gaugeCount), fmt.Sprintf("%f", sdg.Value))
-			if sdg.Source != "" {
-				postdata.Add(getPostKey("gauges", "source", gaugeCount), sdg.Source)
+			postdata.Add(getPostKey("gauges", "name", gaugeCount), sdg.serviceName())
+			postdata.Add(getPostKey("gauges", "value", gaugeCount), lf.formatFloat(sdg.Value))
+			if source := lf.source(sdg.Source); hasSource(source) {
+				postdata.Add(getPostKey("gauges", "source", gaugeCount), source)
 			}
 			gaugeCount++
 		case StatDataTiming:
 			sdt := data[i].(StatDataTiming)
-			postdata.Add(getPostKey("gauges", "name", gaugeCount), sdt.Name)
+			postdata.Add(getPostKey("gauges", "name", gaugeCount), sdt.serviceName())
 			postdata.Add(getPostKey("gauges", "count", gaugeCount), fmt.Sprintf("%d", sdt.Count))
-			postdata.Add(getPostKey("gauges", "min", gaugeCount), fmt.Sprintf("%f", sdt.Min))
-			postdata.Add(getPostKey("gauges", "max", gaugeCount), fmt.Sprintf("%f", sdt.Max))
-			postdata.Add(getPostKey("gauges", "sum", gaugeCount), fmt.Sprintf("%f", sdt.Sum))
-			postdata.Add(getPostKey("gauges", "sum_squares", gaugeCount), fmt.Sprintf("%f", sdt.SumSquares))
-			if sdt.Source != "" {
-				postdata.Add(getPostKey("gauges", "source", gaugeCount), sdt.Source)
+			postdata.Add(getPostKey("gauges", "min", gaugeCount), lf.formatFloat(sdt.Min))
+			postdata.Add(getPostKey("gauges", "max", gaugeCount), lf.formatFloat(sdt.Max))
+			postdata.Add(getPostKey("gauges", "sum", gaugeCount), lf.formatFloat(sdt.Sum))
+			postdata.Add(getPostKey("gauges", "sum_squares", gaugeCount), lf.formatFloat(sdt.SumSquares))
+			if source := lf.source(sdt.Source); hasSource(source) {
+				postdata.Add(getPostKey("gauges", "source", gaugeCount), source)
 			}
 			gaugeCount++
 			// Send a 90th percentile (9th decile) metric, too
-			postdata.Add(getPostKey("gauges", "name", gaugeCount), sdt.Name+".90")
+			postdata.Add(getPostKey("gauges", "name", gaugeCount), sdt.serviceName()+".90")
 			postdata.Add(getPostKey("gauges", "count", gaugeCount), fmt.Sprintf("%d", sdt.NinthDecileCount))
-			postdata.Add(getPostKey("gauges", "max", gaugeCount), fmt.Sprintf("%f", sdt.NinthDecileValue))
-			postdata.Add(getPostKey("gauges", "sum", gaugeCount), fmt.Sprintf("%f", sdt.NinthDecileSum))
+			postdata.Add(getPostKey("gauges", "max", gaugeCount), lf.formatFloat(sdt.NinthDecileValue))
+			postdata.Add(getPostKey("gauges", "sum", gaugeCount), lf.formatFloat(sdt.NinthDecileSum))
 			gaugeCount++
 
 			// Send a 99.9th percentile metric
-			postdata.Add(getPostKey("gauges", "name", gaugeCount), sdt.Name+".99.9")
+			postdata.Add(getPostKey("gauges", "name", gaugeCount), sdt.serviceName()+".99.9")
 			postdata.Add(getPostKey("gauges", "count", gaugeCount), fmt.Sprintf("%d", sdt.ThreeNinesCount))
-			postdata.Add(getPostKey("gauges", "max", gaugeCount), fmt.Sprintf("%f", sdt.ThreeNinesValue))
-			postdata.Add(getPostKey("gauges", "sum", gaugeCount), fmt.Sprintf("%f", sdt.ThreeNinesSum))
-			if sdt.Source != "" {
-				postdata.Add(getPostKey("gauges", "source", gaugeCount), sdt.Source)
+			postdata.Add(getPostKey("gauges", "max", gaugeCount), lf.formatFloat(sdt.ThreeNinesValue))
+			postdata.Add(getPostKey("gauges", "sum", gaugeCount), lf.formatFloat(sdt.ThreeNinesSum))
+			if source := lf.source(sdt.Source); hasSource(source) {
+				postdata.Add(getPostKey("gauges", "source", gaugeCount), source)
+			}
+			gaugeCount++
+
+			if lf.opts.EmitVariance {
+				postdata.Add(getPostKey("gauges", "name", gaugeCount), sdt.serviceName()+".variance")
+				postdata.Add(getPostKey("gauges", "value", gaugeCount), lf.formatFloat(sdt.Variance))
+				if source := lf.source(sdt.Source); hasSource(source) {
+					postdata.Add(getPostKey("gauges", "source", gaugeCount), source)
+				}
+				gaugeCount++
+			}
+		case StatDataHistogram:
+			sdh := data[i].(StatDataHistogram)
+			summary := sdh.summarize()
+			postdata.Add(getPostKey("gauges", "name", gaugeCount), sdh.serviceName())
+			postdata.Add(getPostKey("gauges", "count", gaugeCount), fmt.Sprintf("%d", summary.count))
+			postdata.Add(getPostKey("gauges", "min", gaugeCount), lf.formatFloat(summary.min))
+			postdata.Add(getPostKey("gauges", "max", gaugeCount), lf.formatFloat(summary.max))
+			postdata.Add(getPostKey("gauges", "sum", gaugeCount), lf.formatFloat(sdh.Sum))
+			if source := lf.source(sdh.Source); hasSource(source) {
+				postdata.Add(getPostKey("gauges", "source", gaugeCount), source)
 			}
 			gaugeCount++
+			// Send the estimated percentiles as their own metrics
+			for _, p := range []struct {
+				suffix string
+				value  float64
+			}{{".50", summary.median}, {".90", summary.ninthDecile}, {".99.9", summary.threeNines}} {
+				postdata.Add(getPostKey("gauges", "name", gaugeCount), sdh.serviceName()+p.suffix)
+				postdata.Add(getPostKey("gauges", "value", gaugeCount), lf.formatFloat(p.value))
+				if source := lf.source(sdh.Source); hasSource(source) {
+					postdata.Add(getPostKey("gauges", "source", gaugeCount), source)
+				}
+				gaugeCount++
+			}
+		default:
+			lf.log.Warningf("Not flushing stat of unknown type %T to Librato", data[i])
 		}
 	}
 
-	lf.log.Debugf("Flushing data to Librato: %#v", postdata)
+	return postdata
+}
 
-	req, _ := http.NewRequest("POST", libratoApiEndpoint, bytes.NewBuffer([]byte(postdata.Encode())))
-	req.Header = map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}}
-	req.SetBasicAuth(cfg.Username, cfg.Password)
-	if resp, err := lf.getHttpClient().Do(req); err != nil {
-		lf.log.Errorf("Failed to flush events to Librato: HTTP error: %s", err.Error())
+// EmitEvent adds an annotation to the configured Librato annotation stream.
+// Librato annotations don't have tags, so only a "source" tag is used, as the
+// annotation's source.
+func (lf LibratoStatsFlusher) EmitEvent(title, text string, tags map[string]string) error {
+
+	if !libratoConfigured(lf.opts.EventConfig) {
+		return ErrLibratoEventsNotConfigured
+	}
+
+	stream := lf.opts.EventStream
+	if stream == "" {
+		stream = libratoDefaultEventStream
+	}
+
+	postdata := make(url.Values)
+	postdata.Add("title", title)
+	if text != "" {
+		postdata.Add("description", text)
+	}
+	if source := tags["source"]; hasSource(source) {
+		postdata.Add("source", source)
+	}
+
+	req, err := lf.newRequest(libratoAnnotationsEndpoint+url.PathEscape(stream), postdata, lf.opts.EventConfig)
+	if err != nil {
 		return err
-	} else if resp.StatusCode != 200 && resp.StatusCode != 204 {
-		defer resp.Body.Close()
-		if body, err := ioutil.ReadAll(resp.Body); err != nil {
-			lf.log.Errorf("Failed to flush events to Librato, and failed to read the response body: %s", err)
-		} else {
-			lf.log.Errorf("Failed to flush events to Librato: HTTP status code %d, response body: %s", resp.StatusCode, body)
-		}
+	}
+	resp, err := lf.getHttpClient().Do(req)
+	if err != nil {
+		lf.log.Errorf("Failed to add Librato annotation: HTTP error: %s", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		lf.log.Errorf("Failed to add Librato annotation: HTTP status code %d, response body: %s", resp.StatusCode, body)
+		return fmt.Errorf("librato returned HTTP status %d", resp.StatusCode)
 	}
 
 	return nil
 }
 
-func (lf LibratoStatsFlusher) getHttpClient() *http.Client {
-	return http.DefaultClient
+// newRequest builds a form POST to a Librato endpoint, compressing it if
+// LibratoOptions.Compress is set.
+func (lf LibratoStatsFlusher) newRequest(endpoint string, postdata url.Values, cfg *FlusherConfig) (*http.Request, error) {
+	body := []byte(postdata.Encode())
+	if lf.opts.Compress {
+		var err error
+		if body, err = gzipBytes(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}}
+	if lf.opts.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.SetBasicAuth(cfg.Username, cfg.Password)
+	return req, nil
+}
+
+// libratoConfigured returns whether cfg has the credentials Librato needs.
+func libratoConfigured(cfg *FlusherConfig) bool {
+	return cfg != nil && cfg.Username != "" && cfg.Password != ""
+}
+
+func (lf LibratoStatsFlusher) FlusherName() string { return "librato" }
+
+func (lf LibratoStatsFlusher) getHttpClient() HTTPDoer {
+	if lf.opts.Client == nil {
+		return http.DefaultClient
+	}
+	return lf.opts.Client
 }
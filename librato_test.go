@@ -0,0 +1,553 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// recordingRoundTripper records the requests sent through it and answers
+// each with an empty response, with status 204 unless status is set.
+type recordingRoundTripper struct {
+	mtx      sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	status   int
+}
+
+func (rt *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	rt.mtx.Lock()
+	defer rt.mtx.Unlock()
+	rt.requests = append(rt.requests, req)
+	rt.bodies = append(rt.bodies, string(body))
+	status := rt.status
+	if status == 0 {
+		status = http.StatusNoContent
+	}
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func (s *StatStashTest) TestLibratoCustomClient(c *C) {
+
+	rt := &recordingRoundTripper{}
+	flusher := NewLibratoStatsFlusherWithClient(s.Context, &http.Client{Transport: rt})
+
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "api"}, Count: 3},
+	}
+	c.Assert(flusher.Flush(data, &FlusherConfig{Username: "user", Password: "secret"}), IsNil)
+
+	c.Assert(rt.requests, HasLen, 1)
+	c.Check(rt.requests[0].Method, Equals, "POST")
+	c.Check(rt.requests[0].URL.String(), Equals, libratoApiEndpoint)
+	username, password, ok := rt.requests[0].BasicAuth()
+	c.Check(ok, Equals, true)
+	c.Check(username, Equals, "user")
+	c.Check(password, Equals, "secret")
+	c.Check(rt.bodies[0], Matches, ".*counters%5B0%5D%5Bname%5D=requests.*")
+
+}
+
+func (s *StatStashTest) TestLibratoEmitEvent(c *C) {
+
+	rt := &recordingRoundTripper{}
+	lf := NewLibratoStatsFlusherWithClient(s.Context, &http.Client{Transport: rt}).(LibratoStatsFlusher)
+	c.Check(lf.EmitEvent("Deployed", "", nil), Equals, ErrLibratoEventsNotConfigured)
+
+	flusher := NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{
+		Client:      &http.Client{Transport: rt},
+		EventConfig: &FlusherConfig{Username: "user", Password: "secret"},
+		EventStream: "deploys",
+	})
+	c.Assert(EmitEvent(flusher, "Deployed v42", "Rolled out by CI", map[string]string{"source": "web"}), IsNil)
+
+	c.Assert(rt.requests, HasLen, 1)
+	c.Check(rt.requests[0].URL.String(), Equals, libratoAnnotationsEndpoint+"deploys")
+	values, err := url.ParseQuery(rt.bodies[0])
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, url.Values{
+		"title":       {"Deployed v42"},
+		"description": {"Rolled out by CI"},
+		"source":      {"web"},
+	})
+
+}
+
+func (s *StatStashTest) TestLibratoMeasureTime(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	// Record into a period which has long ended, as when catching up
+	period := getStartOfFlushPeriod(time.Now(), -3)
+	ssi.opts.Clock = func() time.Time { return period.Add(time.Second) }
+	c.Assert(ssi.IncrementCounter("TestLibratoMeasureTime.requests", "api"), IsNil)
+	c.Assert(ssi.RecordTiming("TestLibratoMeasureTime.latency", "api", 12.5, 1.0), IsNil)
+	ssi.opts.Clock = nil
+
+	rt := &recordingRoundTripper{}
+	flusher := NewLibratoStatsFlusherWithClient(s.Context, &http.Client{Transport: rt})
+	c.Assert(ssi.UpdateBackend(period, flusher, &FlusherConfig{Username: "user", Password: "secret"}, true), IsNil)
+
+	c.Assert(rt.bodies, HasLen, 1)
+	values, err := url.ParseQuery(rt.bodies[0])
+	c.Assert(err, IsNil)
+	c.Check(values.Get("measure_time"), Equals, strconv.FormatInt(period.Unix(), 10))
+	c.Check(values.Get("counters[0][name]"), Equals, "TestLibratoMeasureTime.requests")
+
+}
+
+func (s *StatStashTest) TestLibratoCompress(c *C) {
+
+	rt := &recordingRoundTripper{}
+	flusher := NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{Client: &http.Client{Transport: rt}, Compress: true})
+
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "api"}, Count: 3},
+		StatDataGauge{StatConfig: StatConfig{Name: "queue.depth"}, Value: 12},
+	}
+	c.Assert(flusher.Flush(data, &FlusherConfig{Username: "user", Password: "secret"}), IsNil)
+
+	c.Assert(rt.requests, HasLen, 1)
+	c.Check(rt.requests[0].Header.Get("Content-Encoding"), Equals, "gzip")
+	c.Check(rt.requests[0].Header.Get("Content-Type"), Equals, "application/x-www-form-urlencoded")
+
+	r, err := gzip.NewReader(strings.NewReader(rt.bodies[0]))
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	values, err := url.ParseQuery(string(body))
+	c.Assert(err, IsNil)
+	c.Check(values.Get("counters[0][name]"), Equals, "requests")
+	c.Check(values.Get("counters[0][value]"), Equals, "3")
+	c.Check(values.Get("counters[0][source]"), Equals, "api")
+	c.Check(values.Get("gauges[0][name]"), Equals, "queue.depth")
+	c.Check(values.Get("gauges[0][value]"), Equals, "12")
+
+}
+
+func (s *StatStashTest) TestLibratoBatchErrorsRetried(c *C) {
+
+	ssi := s.newTestStatsStash()
+	c.Assert(ssi.IncrementCounter("TestLibratoBatchErrorsRetried.foo", ""), IsNil)
+	c.Assert(ssi.IncrementCounter("TestLibratoBatchErrorsRetried.bar", ""), IsNil)
+	period := getStartOfFlushPeriod(time.Now(), 0)
+
+	rt := &recordingRoundTripper{status: http.StatusBadRequest}
+	flusher := NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{Client: &http.Client{Transport: rt}, BatchSize: 1})
+	cfg := &FlusherConfig{Username: "user", Password: "secret"}
+
+	// Failed batches fail the flush, so the period isn't marked flushed
+	err := ssi.UpdateBackend(period, flusher, cfg, false)
+	c.Assert(err, FitsTypeOf, BatchErrors{})
+	c.Check(err.(BatchErrors), HasLen, 2)
+
+	rt.status = 0
+	c.Assert(ssi.UpdateBackend(period, flusher, cfg, false), IsNil)
+	c.Check(rt.requests, HasLen, 4)
+
+}
+
+func (s *StatStashTest) TestLibratoIdempotencyKey(c *C) {
+
+	rt := &recordingRoundTripper{status: 503}
+	flusher := NewLibratoStatsFlusherWithClient(s.Context, &http.Client{Transport: rt})
+	cfg := &FlusherConfig{Username: "user", Password: "secret"}
+
+	period := getStartOfFlushPeriod(time.Now(), -1)
+	data := func(period time.Time, count uint64) []interface{} {
+		return []interface{}{
+			StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "api"}, Count: count, PeriodStart: period},
+			StatDataGauge{StatConfig: StatConfig{Name: "queue.depth"}, Value: 12, PeriodStart: period},
+		}
+	}
+
+	// A failed flush and its retry send the same key
+	c.Check(flusher.Flush(data(period, 3), cfg), NotNil)
+	rt.status = 0
+	c.Assert(flusher.Flush(data(period, 3), cfg), IsNil)
+	// but a corrected re-flush of the period, or another period, don't
+	c.Assert(flusher.Flush(data(period, 4), cfg), IsNil)
+	c.Assert(flusher.Flush(data(period.Add(defaultAggregationPeriod), 3), cfg), IsNil)
+
+	c.Assert(rt.requests, HasLen, 4)
+	first := rt.requests[0].Header.Get("Idempotency-Key")
+	c.Check(first, HasLen, 32)
+	c.Check(rt.requests[1].Header.Get("Idempotency-Key"), Equals, first)
+	c.Check(rt.requests[2].Header.Get("Idempotency-Key"), Not(Equals), first)
+	c.Check(rt.requests[3].Header.Get("Idempotency-Key"), Not(Equals), first)
+
+}
+
+func (s *StatStashTest) TestLibratoMissingConfig(c *C) {
+
+	rt := &recordingRoundTripper{}
+	flusher := NewLibratoStatsFlusherWithClient(s.Context, &http.Client{Transport: rt})
+
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "api"}, Count: 3},
+	}
+	c.Check(flusher.Flush(data, nil), Equals, ErrLibratoMissingConfig)
+	c.Check(flusher.Flush(data, &FlusherConfig{}), Equals, ErrLibratoMissingConfig)
+	c.Check(flusher.Flush(data, &FlusherConfig{Username: "user"}), Equals, ErrLibratoMissingConfig)
+	c.Check(ErrLibratoMissingConfig, ErrorMatches, ".*FlusherConfig.*")
+	c.Check(rt.requests, HasLen, 0)
+
+}
+
+func (s *StatStashTest) TestLibratoBatches(c *C) {
+
+	rt := &recordingRoundTripper{}
+	flusher := NewLibratoStatsFlusherWithClient(s.Context, &http.Client{Transport: rt})
+	cfg := &FlusherConfig{Username: "user", Password: "secret"}
+
+	var data []interface{}
+	for i := 0; i < 650; i++ {
+		data = append(data, StatDataCounter{StatConfig: StatConfig{Name: fmt.Sprintf("counter%d", i)}, Count: 1})
+	}
+	c.Assert(flusher.Flush(data, cfg), IsNil)
+
+	batchNames := func() [][]string {
+		batches := make([][]string, len(rt.bodies))
+		for i, body := range rt.bodies {
+			values, err := url.ParseQuery(body)
+			c.Assert(err, IsNil)
+			for key, value := range values {
+				if strings.HasSuffix(key, "[name]") {
+					batches[i] = append(batches[i], value[0])
+				}
+			}
+		}
+		return batches
+	}
+
+	batches := batchNames()
+	c.Assert(batches, HasLen, 3)
+	c.Check(batches[0], HasLen, 300)
+	c.Check(batches[1], HasLen, 300)
+	c.Check(batches[2], HasLen, 50)
+
+	// A timing's three measurements are never split across batches
+	rt = &recordingRoundTripper{}
+	flusher = NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{Client: &http.Client{Transport: rt}, BatchSize: 7})
+	data = nil
+	for i := 0; i < 5; i++ {
+		data = append(data, StatDataTiming{StatConfig: StatConfig{Name: fmt.Sprintf("timing%d", i)}, Count: 1})
+	}
+	c.Assert(flusher.Flush(data, cfg), IsNil)
+
+	batches = batchNames()
+	c.Assert(batches, HasLen, 3)
+	c.Check(batches[0], HasLen, 6)
+	c.Check(batches[1], HasLen, 6)
+	c.Check(batches[2], HasLen, 3)
+
+	rt.status = http.StatusBadRequest
+	err := flusher.Flush(data, cfg)
+	c.Assert(err, FitsTypeOf, BatchErrors{})
+	c.Check(err.(BatchErrors), HasLen, 3)
+
+}
+
+func (s *StatStashTest) TestLibratoVariance(c *C) {
+
+	timing := StatDataTiming{
+		StatConfig: StatConfig{Name: "subroutine", Source: "B"},
+		Count:      2, Min: 10.0, Max: 15.5, Sum: 25.5, SumSquares: 340.25, Median: 12.75,
+		Variance: 7.5625,
+	}
+
+	postdata := NewLibratoStatsFlusher(s.Context).(LibratoStatsFlusher).postData([]interface{}{timing})
+	for key, values := range postdata {
+		c.Check(values, Not(DeepEquals), []string{"subroutine.variance"}, Commentf("key %s", key))
+	}
+
+	lf := NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{EmitVariance: true}).(LibratoStatsFlusher)
+	postdata = lf.postData([]interface{}{timing})
+	c.Check(postdata.Get("gauges[3][name]"), Equals, "subroutine.variance")
+	c.Check(postdata.Get("gauges[3][value]"), Equals, "7.5625")
+	c.Check(postdata.Get("gauges[3][source]"), Equals, "B")
+
+}
+
+func (s *StatStashTest) TestLibratoHistogram(c *C) {
+
+	lf := NewLibratoStatsFlusher(s.Context).(LibratoStatsFlusher)
+
+	// 100 values: 50 in (0, 10], 40 in (10, 20], 9 in (20, 50], 1 above 50
+	histogram := StatDataHistogram{
+		StatConfig: StatConfig{Name: "latency", Source: "api"},
+		Bounds:     []float64{10, 20, 50},
+		Counts:     []uint64{50, 40, 9, 1},
+		Sum:        1234.5,
+	}
+
+	postdata := lf.postData([]interface{}{histogram, struct{}{}})
+
+	c.Check(postdata.Get("gauges[0][name]"), Equals, "latency")
+	c.Check(postdata.Get("gauges[0][source]"), Equals, "api")
+	c.Check(postdata.Get("gauges[0][count]"), Equals, "100")
+	c.Check(postdata.Get("gauges[0][min]"), Equals, "0")
+	c.Check(postdata.Get("gauges[0][max]"), Equals, "50")
+	c.Check(postdata.Get("gauges[0][sum]"), Equals, "1234.5")
+
+	c.Check(postdata.Get("gauges[1][name]"), Equals, "latency.50")
+	c.Check(postdata.Get("gauges[1][value]"), Equals, "10")
+	c.Check(postdata.Get("gauges[2][name]"), Equals, "latency.90")
+	c.Check(postdata.Get("gauges[2][value]"), Equals, "20")
+	c.Check(postdata.Get("gauges[3][name]"), Equals, "latency.99.9")
+	c.Check(postdata.Get("gauges[3][value]"), Equals, "50")
+	c.Check(postdata.Get("gauges[3][source]"), Equals, "api")
+
+	// The unknown type is skipped
+	c.Check(postdata.Get("gauges[4][name]"), Equals, "")
+
+}
+
+func (s *StatStashTest) TestLibratoDefaultSource(c *C) {
+
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "requests"}, Count: 3},
+		StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "api"}, Count: 2},
+		StatDataGauge{StatConfig: StatConfig{Name: "connections"}, Value: 4},
+	}
+
+	postdata := NewLibratoStatsFlusher(s.Context).(LibratoStatsFlusher).postData(data)
+	_, found := postdata["counters[0][source]"]
+	c.Check(found, Equals, false)
+	_, found = postdata["gauges[0][source]"]
+	c.Check(found, Equals, false)
+
+	lf := NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{DefaultSource: "unknown"}).(LibratoStatsFlusher)
+	postdata = lf.postData(data)
+	c.Check(postdata.Get("counters[0][name]"), Equals, "requests")
+	c.Check(postdata.Get("counters[0][source]"), Equals, "unknown")
+	c.Check(postdata.Get("counters[1][source]"), Equals, "api")
+	c.Check(postdata.Get("gauges[0][source]"), Equals, "unknown")
+
+}
+
+func (s *StatStashTest) TestLibratoPrecision(c *C) {
+
+	data := []interface{}{
+		StatDataGauge{StatConfig: StatConfig{Name: "grand_total"}, Value: 7264534001},
+		StatDataGauge{StatConfig: StatConfig{Name: "ratio"}, Value: 0.1234567891},
+	}
+
+	postdata := NewLibratoStatsFlusher(s.Context).(LibratoStatsFlusher).postData(data)
+	c.Check(postdata.Get("gauges[0][value]"), Equals, "7264534001")
+	c.Check(postdata.Get("gauges[1][value]"), Equals, "0.1234567891")
+
+	lf := NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{Precision: 3}).(LibratoStatsFlusher)
+	postdata = lf.postData(data)
+	c.Check(postdata.Get("gauges[0][value]"), Equals, "7264534001.000")
+	c.Check(postdata.Get("gauges[1][value]"), Equals, "0.123")
+
+}
+
+func (s *StatStashTest) TestLibratoCounterEmitMode(c *C) {
+
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "api"}, Count: 600},
+	}
+
+	postdata := NewLibratoStatsFlusher(s.Context).(LibratoStatsFlusher).postData(data)
+	c.Check(postdata.Get("counters[0][value]"), Equals, "600")
+
+	// A count over the default 5 minute period is sent as a rate gauge
+	lf := NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{CounterEmitMode: CounterEmitPerMinute}).(LibratoStatsFlusher)
+	postdata = lf.postData(data)
+	_, found := postdata["counters[0][name]"]
+	c.Check(found, Equals, false)
+	c.Check(postdata.Get("gauges[0][name]"), Equals, "requests")
+	c.Check(postdata.Get("gauges[0][value]"), Equals, "120")
+	c.Check(postdata.Get("gauges[0][source]"), Equals, "api")
+
+	lf = NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{CounterEmitMode: CounterEmitPerSecond}).(LibratoStatsFlusher)
+	postdata = lf.postData(data)
+	c.Check(postdata.Get("gauges[0][value]"), Equals, "2")
+
+}
+
+// concurrentRoundTripper answers requests after a delay, with the status
+// statusFor returns for the request body, tracking how many are in flight.
+type concurrentRoundTripper struct {
+	mtx         sync.Mutex
+	inFlight    int
+	maxInFlight int
+	started     []int // requests in flight as each was sent
+	statusFor   func(body string) int
+}
+
+func (rt *concurrentRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	rt.mtx.Lock()
+	rt.inFlight++
+	if rt.inFlight > rt.maxInFlight {
+		rt.maxInFlight = rt.inFlight
+	}
+	rt.started = append(rt.started, rt.inFlight)
+	rt.mtx.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	rt.mtx.Lock()
+	rt.inFlight--
+	rt.mtx.Unlock()
+	return &http.Response{
+		StatusCode: rt.statusFor(string(body)),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func (s *StatStashTest) TestLibratoConcurrency(c *C) {
+
+	cfg := &FlusherConfig{Username: "user", Password: "secret"}
+	var data []interface{}
+	for i := 0; i < 8; i++ {
+		data = append(data, StatDataCounter{StatConfig: StatConfig{Name: fmt.Sprintf("counter%d", i)}, Count: 1})
+	}
+
+	// A failing batch's error is returned, whichever batch it is
+	rt := &concurrentRoundTripper{statusFor: func(body string) int {
+		if strings.Contains(body, "counter5") {
+			return http.StatusInternalServerError
+		}
+		return http.StatusNoContent
+	}}
+	flusher := NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{Client: &http.Client{Transport: rt}, BatchSize: 1, Concurrency: 3})
+	err := flusher.Flush(data, cfg)
+	c.Check(err, ErrorMatches, "librato returned HTTP status 500")
+	c.Check(rt.started, HasLen, 8)
+	c.Check(rt.maxInFlight, Equals, 3)
+
+	// Rate limiting drops the concurrency, here to one batch at a time once
+	// the first batches have been answered, and the batches which lowered
+	// it are sent again
+	rt = &concurrentRoundTripper{statusFor: func(string) int { return http.StatusTooManyRequests }}
+	flusher = NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{Client: &http.Client{Transport: rt}, BatchSize: 1, Concurrency: 4})
+	err = flusher.Flush(data, cfg)
+	c.Assert(err, FitsTypeOf, BatchErrors{})
+	c.Check(err.(BatchErrors), HasLen, 8)
+	c.Assert(rt.started, HasLen, 10)
+	c.Check(rt.started[4:], DeepEquals, []int{1, 1, 1, 1, 1, 1})
+
+	// so a batch which was only rate limited once still gets through
+	var mtx sync.Mutex
+	limited := false
+	rt = &concurrentRoundTripper{statusFor: func(body string) int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if strings.Contains(body, "counter0") && !limited {
+			limited = true
+			return http.StatusTooManyRequests
+		}
+		return http.StatusNoContent
+	}}
+	flusher = NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{Client: &http.Client{Transport: rt}, BatchSize: 1, Concurrency: 2})
+	c.Assert(flusher.Flush(data, cfg), IsNil)
+	c.Check(rt.started, HasLen, 9)
+
+}
+
+func (s *StatStashTest) TestLibratoRouter(c *C) {
+
+	teamCfg := &FlusherConfig{Username: "team", Password: "team-secret"}
+	rt := &recordingRoundTripper{}
+	flusher := NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{
+		Client: &http.Client{Transport: rt},
+		Router: func(sc StatConfig) *FlusherConfig {
+			if strings.HasPrefix(sc.Name, "team.") {
+				return teamCfg
+			}
+			return nil
+		},
+	})
+
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "api"}, Count: 3},
+		StatDataCounter{StatConfig: StatConfig{Name: "team.jobs", Source: "worker"}, Count: 5},
+		StatDataGauge{StatConfig: StatConfig{Name: "team.queue", Source: "worker"}, Value: 2},
+	}
+	c.Assert(flusher.Flush(data, &FlusherConfig{Username: "user", Password: "secret"}), IsNil)
+
+	// Stats are batched by account, in the order their accounts first appear
+	c.Assert(rt.requests, HasLen, 2)
+	username, password, _ := rt.requests[0].BasicAuth()
+	c.Check(username, Equals, "user")
+	c.Check(password, Equals, "secret")
+	c.Check(rt.bodies[0], Matches, ".*=requests.*")
+	c.Check(strings.Contains(rt.bodies[0], "team."), Equals, false)
+
+	username, password, _ = rt.requests[1].BasicAuth()
+	c.Check(username, Equals, "team")
+	c.Check(password, Equals, "team-secret")
+	c.Check(rt.bodies[1], Matches, ".*=team.jobs.*")
+	c.Check(rt.bodies[1], Matches, ".*=team.queue.*")
+	c.Check(strings.Contains(rt.bodies[1], "=requests"), Equals, false)
+
+	// Stats routed to an account without credentials aren't sent, but the
+	// rest are
+	rt = &recordingRoundTripper{}
+	flusher = NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{
+		Client: &http.Client{Transport: rt},
+		Router: func(sc StatConfig) *FlusherConfig {
+			if strings.HasPrefix(sc.Name, "team.") {
+				return teamCfg
+			}
+			return nil
+		},
+	})
+	c.Check(flusher.Flush(data, nil), Equals, ErrLibratoMissingConfig)
+	c.Assert(rt.requests, HasLen, 1)
+	username, _, _ = rt.requests[0].BasicAuth()
+	c.Check(username, Equals, "team")
+
+	// Stats are routed by their own names, but named by the FlusherConfig
+	// given to Flush, whichever account they're sent to
+	rt = &recordingRoundTripper{}
+	flusher = NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{
+		Client: &http.Client{Transport: rt},
+		Router: func(sc StatConfig) *FlusherConfig {
+			if strings.HasPrefix(sc.Name, "team.") {
+				return teamCfg
+			}
+			return nil
+		},
+	})
+	mapped := &FlusherConfig{Username: "user", Password: "secret", NameMapper: func(sc StatConfig) string { return "prod." + sc.Name }}
+	c.Assert(flusher.Flush(data, mapped), IsNil)
+	c.Assert(rt.requests, HasLen, 2)
+	c.Check(rt.bodies[0], Matches, ".*=prod.requests.*")
+	username, _, _ = rt.requests[1].BasicAuth()
+	c.Check(username, Equals, "team")
+	c.Check(rt.bodies[1], Matches, ".*=prod.team.jobs.*")
+
+}
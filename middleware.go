@@ -0,0 +1,76 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// InstrumentHandler wraps next so every request it serves is recorded in
+// stats: the <name>.count counter and the <name>.latency timing (in
+// milliseconds), both with the response's status code as their source, and
+// a <name>.status.<code> counter (e.g. "api.status.500") without a source,
+// for backends which can't group by source. Failures to record are ignored,
+// so stats never fail a request.
+func InstrumentHandler(stats StatInterface, name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		status := sw.statusCode()
+		source := strconv.Itoa(status)
+		stats.IncrementCounter(name+".count", source)
+		stats.RecordTiming(name+".latency", source, float64(time.Since(start))/float64(time.Millisecond), 1.0)
+		stats.IncrementCounter(fmt.Sprintf("%s.status.%d", name, status), "")
+	})
+}
+
+// statusResponseWriter remembers the status code written through it.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusResponseWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusResponseWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the wrapped writer.
+func (sw *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// statusCode returns the status code written, which is 200 if the handler
+// wrote nothing.
+func (sw *statusResponseWriter) statusCode() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
@@ -0,0 +1,70 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/mock"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StatStashTest) TestInstrumentHandler(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	handler := InstrumentHandler(ssi, "TestInstrumentHandler.api", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusOK) // ignored by net/http too
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	for _, path := range []string{"/", "/", "/missing", "/broken"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	}
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(ssi.now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	counts := make(map[string]uint64)
+	for _, counter := range mockFlusher.counters {
+		counts[counter.Name+"/"+counter.Source] = counter.Count
+	}
+	c.Check(counts, DeepEquals, map[string]uint64{
+		"TestInstrumentHandler.api.count/200":   2,
+		"TestInstrumentHandler.api.count/404":   1,
+		"TestInstrumentHandler.api.count/500":   1,
+		"TestInstrumentHandler.api.status.200/": 2,
+		"TestInstrumentHandler.api.status.404/": 1,
+		"TestInstrumentHandler.api.status.500/": 1,
+	})
+
+	latencies := make(map[string]int)
+	for _, timing := range mockFlusher.timings {
+		c.Check(timing.Name, Equals, "TestInstrumentHandler.api.latency")
+		latencies[timing.Source] = timing.Count
+	}
+	c.Check(latencies, DeepEquals, map[string]int{"200": 2, "404": 1, "500": 1})
+
+}
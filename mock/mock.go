@@ -48,3 +48,13 @@ func (m *MockStatImplementation) UpdateBackend(at time.Time, flusher StatsFlushe
 	rargs := m.Called(at, flusher, cfg, force)
 	return rargs.Error(0)
 }
+
+func (m *MockStatImplementation) UpdateBackendWithReport(at time.Time, flusher StatsFlusher, cfg *FlusherConfig, force bool) (FlushReport, error) {
+	rargs := m.Called(at, flusher, cfg, force)
+	return rargs.Get(0).(FlushReport), rargs.Error(1)
+}
+
+func (m *MockStatImplementation) Close() error {
+	rargs := m.Called()
+	return rargs.Error(0)
+}
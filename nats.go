@@ -0,0 +1,81 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// NATSConn is the part of a NATS connection used by NATSStatsFlusher; a
+// *nats.Conn satisfies it.
+type NATSConn interface {
+	Publish(subject string, data []byte) error
+	Flush() error
+}
+
+// NATSStatsFlusher is used to flush stats to NATS. Each datum is published as
+// a JSON message to the subject <prefix>.<type>.<name>.
+type NATSStatsFlusher struct {
+	log    appwrap.Logging
+	conn   NATSConn
+	prefix string
+}
+
+func NewNATSStatsFlusher(c context.Context, conn NATSConn, prefix string) StatsFlusher {
+	log := appwrap.NewStackdriverLogging(c)
+	return NATSStatsFlusher{log, conn, prefix}
+}
+
+// natsToken replaces the characters which can't be used in a NATS subject.
+func natsToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n', '*', '>':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func (nf NATSStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
+
+	data = emittedData(data, cfg)
+	for i := range data {
+		sc, ok := statConfigOf(data[i])
+		if !ok {
+			nf.log.Warningf("Skipping stat of unknown type %T", data[i])
+			continue
+		}
+		body, err := marshalStatDatum(data[i], periodStartOf(data[i]))
+		if err != nil {
+			return err
+		}
+		subject := nf.prefix + "." + sc.Type + "." + natsToken(sc.Name)
+		if err := nf.conn.Publish(subject, body); err != nil {
+			nf.log.Errorf("Failed to publish stats to NATS subject %s: %s", subject, err)
+			return err
+		}
+	}
+
+	if err := nf.conn.Flush(); err != nil {
+		nf.log.Errorf("Failed to flush NATS connection: %s", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type fakeNATSConn struct {
+	published  map[string][][]byte
+	publishErr error
+	flushes    int
+}
+
+func (f *fakeNATSConn) Publish(subject string, data []byte) error {
+	if f.publishErr != nil {
+		return f.publishErr
+	}
+	f.published[subject] = append(f.published[subject], data)
+	return nil
+}
+
+func (f *fakeNATSConn) Flush() error {
+	f.flushes++
+	return nil
+}
+
+func (s *StatStashTest) TestNATSStatsFlusher(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	c.Assert(ssi.IncrementCounter("TestNATSStatsFlusher.foo", "a"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestNATSStatsFlusher.foo", "a"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestNATSStatsFlusher.foo", "b"), IsNil)
+	c.Assert(ssi.RecordGauge("TestNATSStatsFlusher.temperature", "raleigh", 24.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestNATSStatsFlusher.subroutine", "B", 10.0, 1.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestNATSStatsFlusher.subroutine", "B", 15.5, 1.0), IsNil)
+
+	conn := &fakeNATSConn{published: make(map[string][][]byte)}
+	flusher := NewNATSStatsFlusher(s.Context, conn, "stats")
+
+	c.Assert(ssi.UpdateBackend(time.Now(), flusher, nil, true), IsNil)
+	c.Check(conn.flushes, Equals, 1)
+	c.Assert(conn.published, HasLen, 3)
+	c.Check(conn.published["stats.counter.TestNATSStatsFlusher.foo"], HasLen, 2)
+	c.Check(conn.published["stats.gauge.TestNATSStatsFlusher.temperature"], HasLen, 1)
+	c.Assert(conn.published["stats.timing.TestNATSStatsFlusher.subroutine"], HasLen, 1)
+
+	var msg struct {
+		Period time.Time
+		Stat   StatDataTiming
+	}
+	c.Assert(json.Unmarshal(conn.published["stats.timing.TestNATSStatsFlusher.subroutine"][0], &msg), IsNil)
+	c.Check(msg.Period.IsZero(), Equals, false)
+	c.Check(msg.Stat.Source, Equals, "B")
+	c.Check(msg.Stat.Count, Equals, 2)
+	c.Check(msg.Stat.Median, Equals, 12.75)
+
+	conn.publishErr = errors.New("nats: connection closed")
+	c.Check(flusher.Flush([]interface{}{StatDataGauge{StatConfig: StatConfig{Name: "x", Type: scTypeGauge}}}, nil), Equals, conn.publishErr)
+
+}
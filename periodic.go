@@ -14,6 +14,8 @@
 package statstash
 
 import (
+	"encoding/json"
+	"math/rand"
 	"net/http"
 	"time"
 
@@ -29,11 +31,135 @@ func PeriodicStatsFlushHandlerCustom(log appwrap.Logging, stats StatInterface, f
 	doFlush(log, stats, flusher, cfg)
 }
 
-func doFlush(log appwrap.Logging, stats StatInterface, flusher StatsFlusher, cfg *FlusherConfig) {
-	startOfLastPeriod := getStartOfFlushPeriod(time.Now(), -1)
-	if err := stats.UpdateBackend(startOfLastPeriod, flusher, cfg, false); err != nil {
+// ForceStatsFlushHandler flushes the current and previous periods
+// immediately; see StatImplementation.ForceFlushNow.
+func ForceStatsFlushHandler(ds appwrap.Datastore, flusher StatsFlusher, cfg *FlusherConfig, r *http.Request, cache appwrap.Memcache, log appwrap.Logging) {
+	stats := NewStatInterface(log, ds, cache, false).(StatImplementation)
+	if err := stats.ForceFlushNow(flusher, cfg); err != nil {
+		log.Errorf("Failed force flushing stats backend: %s", err)
+	} else {
+		log.Infof("Force flushed stats backend")
+	}
+}
+
+// CatchUpStatsFlushHandler flushes every period missed since the last flush;
+// see StatImplementation.CatchUp.
+func CatchUpStatsFlushHandler(ds appwrap.Datastore, flusher StatsFlusher, cfg *FlusherConfig, r *http.Request, cache appwrap.Memcache, log appwrap.Logging) {
+	stats := NewStatInterface(log, ds, cache, false).(StatImplementation)
+	if err := stats.CatchUp(flusher, cfg); err != nil {
+		log.Errorf("Failed catching up stats backend: %s", err)
+	} else {
+		log.Infof("Caught up stats backend")
+	}
+}
+
+// pubSubPushEnvelope is the body of a Pub/Sub push subscription's request.
+type pubSubPushEnvelope struct {
+	Message struct {
+		Data       []byte            `json:"data"`
+		Attributes map[string]string `json:"attributes"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// PeriodicStatsFlushPubSubHandler flushes the last period when a Pub/Sub push
+// subscription delivers a message, such as one published by Cloud Scheduler;
+// see PeriodicStatsFlushPubSubHandlerCustom.
+func PeriodicStatsFlushPubSubHandler(ds appwrap.Datastore, flusher StatsFlusher, cfg *FlusherConfig, w http.ResponseWriter, r *http.Request, cache appwrap.Memcache, log appwrap.Logging) {
+	stats := NewStatInterface(log, ds, cache, false)
+	PeriodicStatsFlushPubSubHandlerCustom(log, stats, flusher, cfg, w, r)
+}
+
+// PeriodicStatsFlushPubSubHandlerCustom validates the Pub/Sub push message in
+// the request, flushes the last period, and acknowledges the message with
+// 204 No Content once the period is flushed (or was already flushed). Flush
+// failures return 500 so Pub/Sub redelivers the message and the flush is
+// retried; requests which aren't push messages get 400 or 405.
+func PeriodicStatsFlushPubSubHandlerCustom(log appwrap.Logging, stats StatInterface, flusher StatsFlusher, cfg *FlusherConfig, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Pub/Sub push messages must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var envelope pubSubPushEnvelope
+	if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+		log.Warningf("Ignoring invalid Pub/Sub push message: %s", err)
+		http.Error(w, "invalid Pub/Sub push message", http.StatusBadRequest)
+		return
+	} else if envelope.Message.MessageID == "" {
+		log.Warningf("Ignoring Pub/Sub push message without a message ID")
+		http.Error(w, "invalid Pub/Sub push message", http.StatusBadRequest)
+		return
+	}
+	log.Debugf("Flushing stats for Pub/Sub message %s from %s", envelope.Message.MessageID, envelope.Subscription)
+
+	err := doFlush(log, stats, flusher, cfg)
+	if _, partial := err.(FlushErrors); err != nil && !partial && err != ErrStatFlushTooSoon {
+		http.Error(w, "failed to flush stats", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// flushSleep waits out the jitter before a flush; tests replace it.
+var flushSleep = time.Sleep
+
+// PeriodicStatsFlushHandlerJittered is like PeriodicStatsFlushHandlerCustom,
+// but waits a random delay of up to maxJitter before flushing, so instances
+// triggered at the same moment don't all hit datastore and memcache at once.
+// The period to flush is decided before waiting, and the delay never runs
+// past the end of the current aggregation period.
+func PeriodicStatsFlushHandlerJittered(log appwrap.Logging, stats StatInterface, flusher StatsFlusher, cfg *FlusherConfig, maxJitter time.Duration) {
+	now := time.Now()
+	startOfLastPeriod := getStartOfFlushPeriod(now, -1)
+	delay := flushJitter(now, maxJitter, rand.Int63n)
+	log.Debugf("Waiting %s before flushing stats for period %s", delay, startOfLastPeriod)
+	flushSleep(delay)
+	flushPeriod(log, stats, flusher, cfg, startOfLastPeriod)
+}
+
+// flushJitter picks a random delay of up to maxJitter, capped so a flush
+// triggered at now still happens within the current aggregation period.
+func flushJitter(now time.Time, maxJitter time.Duration, int63n func(int64) int64) time.Duration {
+	bound := maxJitter
+	if window := getStartOfFlushPeriod(now, 1).Sub(now); bound > window {
+		bound = window
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return time.Duration(int63n(int64(bound)))
+}
+
+func doFlush(log appwrap.Logging, stats StatInterface, flusher StatsFlusher, cfg *FlusherConfig) error {
+	return flushPeriod(log, stats, flusher, cfg, getStartOfFlushPeriod(time.Now(), -1))
+}
+
+func flushPeriod(log appwrap.Logging, stats StatInterface, flusher StatsFlusher, cfg *FlusherConfig, startOfLastPeriod time.Time) error {
+	err := stats.UpdateBackend(startOfLastPeriod, flusher, cfg, false)
+	if err == ErrStatFlushTooSoon {
+		// a redundant trigger for a period which was already flushed, not
+		// a failure
+		log.Infof("Skipped updating stats backend for period %s: %s", startOfLastPeriod, err)
+		recordFlushSkipped(log, stats)
+	} else if err != nil {
 		log.Errorf("Failed updating stats backend: %s", err)
 	} else {
 		log.Infof("Updated stats backend")
 	}
+	return err
+}
+
+// recordFlushSkipped counts a flush skipped as too soon in the
+// statstash.flush.skipped self-metric, if StatOptions.SelfMetrics is set.
+func recordFlushSkipped(log appwrap.Logging, stats StatInterface) {
+	ssi, ok := stats.(StatImplementation)
+	if !ok || !ssi.opts.SelfMetrics {
+		return
+	}
+	if err := ssi.IncrementCounter(selfMetricSkipped, ""); err != nil {
+		log.Warningf("Failed to record skipped flush: %s", err)
+	}
 }
@@ -0,0 +1,172 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"github.com/stretchr/testify/mock"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StatStashTest) TestFlushJitterBounds(c *C) {
+
+	randGen := rand.New(rand.NewSource(time.Now().UnixNano()))
+	start := getStartOfFlushPeriod(time.Now(), 0)
+
+	for _, elapsed := range []time.Duration{0, time.Second, 4 * time.Minute, defaultAggregationPeriod - time.Second} {
+		now := start.Add(elapsed)
+		for i := 0; i < 100; i++ {
+			delay := flushJitter(now, time.Minute, randGen.Int63n)
+			c.Assert(delay >= 0, Equals, true)
+			c.Assert(delay < time.Minute, Equals, true)
+			c.Assert(getStartOfFlushPeriod(now.Add(delay), 0).Equal(start), Equals, true)
+		}
+	}
+
+	// The largest possible delay is used when the random source allows it
+	maxInt63n := func(n int64) int64 { return n - 1 }
+	c.Check(flushJitter(start, time.Minute, maxInt63n), Equals, time.Minute-1)
+	c.Check(flushJitter(start, time.Hour, maxInt63n), Equals, defaultAggregationPeriod-1)
+	c.Check(flushJitter(start, 0, maxInt63n), Equals, time.Duration(0))
+
+}
+
+func (s *StatStashTest) TestPeriodicStatsFlushHandlerJittered(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	lastPeriod := getStartOfFlushPeriod(time.Now(), -1)
+	ssi.opts.Clock = func() time.Time { return lastPeriod.Add(time.Second) }
+	c.Assert(ssi.IncrementCounterBy("TestPeriodicStatsFlushHandlerJittered.foo", "", 4), IsNil)
+
+	var slept []time.Duration
+	flushSleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { flushSleep = time.Sleep }()
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	PeriodicStatsFlushHandlerJittered(ssi.log, ssi, mockFlusher, nil, 30*time.Second)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(slept, HasLen, 1)
+	c.Check(slept[0] < 30*time.Second, Equals, true)
+	c.Assert(mockFlusher.counters, HasLen, 1)
+	c.Check(mockFlusher.counters[0].Count, Equals, uint64(4))
+	c.Check(ssi.getLastPeriodFlushed().Equal(lastPeriod), Equals, true)
+
+}
+
+func (s *StatStashTest) TestPeriodicStatsFlushPubSubHandler(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	lastPeriod := getStartOfFlushPeriod(time.Now(), -1)
+	ssi.opts.Clock = func() time.Time { return lastPeriod.Add(time.Second) }
+	c.Assert(ssi.IncrementCounterBy("TestPeriodicStatsFlushPubSubHandler.foo", "", 3), IsNil)
+
+	push := func(flusher StatsFlusher, body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/_stats/flush", strings.NewReader(body))
+		PeriodicStatsFlushPubSubHandlerCustom(ssi.log, ssi, flusher, nil, w, r)
+		return w.Code
+	}
+	const message = `{"message": {"data": "Zmx1c2g=", "messageId": "136969346945"}, "subscription": "projects/myproject/subscriptions/stats-flush"}`
+
+	// Malformed messages are rejected without flushing
+	c.Check(push(&MockFlusher{}, `{"message": {}}`), Equals, http.StatusBadRequest)
+	c.Check(push(&MockFlusher{}, `not json`), Equals, http.StatusBadRequest)
+
+	// A failed flush is retried when Pub/Sub redelivers the message
+	failing := &MockFlusher{}
+	failing.On("Flush", mock.Anything, mock.Anything).Return(errors.New("backend down")).Once()
+	c.Check(push(failing, message), Equals, http.StatusInternalServerError)
+	failing.AssertExpectations(c)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Check(push(mockFlusher, message), Equals, http.StatusNoContent)
+	mockFlusher.AssertExpectations(c)
+	c.Assert(mockFlusher.counters, HasLen, 1)
+	c.Check(mockFlusher.counters[0].Count, Equals, uint64(3))
+
+	// Redelivery after the period was flushed is acknowledged
+	c.Check(push(&MockFlusher{}, message), Equals, http.StatusNoContent)
+
+	w := httptest.NewRecorder()
+	PeriodicStatsFlushPubSubHandlerCustom(ssi.log, ssi, &MockFlusher{}, nil, w, httptest.NewRequest("GET", "/_stats/flush", nil))
+	c.Check(w.Code, Equals, http.StatusMethodNotAllowed)
+
+}
+
+func (s *StatStashTest) TestCatchUpSkipsExpiredPeriods(c *C) {
+
+	ssi := s.newTestStatsStash()
+	buf := &bytes.Buffer{}
+	ssi.log = appwrap.NewWriterLogger(buf)
+
+	now := getStartOfFlushPeriod(time.Now(), 0).Add(time.Minute)
+	ssi.updateLastPeriodFlushed(getStartOfFlushPeriod(now, -288))
+
+	// Values recorded long ago are still in the (local) memcache, but are
+	// past the catch-up age
+	for _, offset := range []int{-6, -2, -1} {
+		ssi.opts.Clock = func() time.Time { return getStartOfFlushPeriod(now, offset).Add(time.Second) }
+		c.Assert(ssi.IncrementCounterBy("TestCatchUpSkipsExpiredPeriods.foo", "", int64(-offset)), IsNil)
+	}
+	ssi.opts.Clock = func() time.Time { return now }
+
+	var flushed []uint64
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		for _, datum := range args.Get(0).([]interface{}) {
+			flushed = append(flushed, datum.(StatDataCounter).Count)
+		}
+	}).Twice()
+	c.Assert(ssi.CatchUp(mockFlusher, nil), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Check(flushed, DeepEquals, []uint64{2, 1})
+	c.Check(ssi.getLastPeriodFlushed().Equal(getStartOfFlushPeriod(now, -1)), Equals, true)
+	c.Check(buf.String(), Matches, "(?s).*Skipping catch-up of the periods from .* which ended more than 10m0s ago.*")
+
+}
+
+func (s *StatStashTest) TestDoFlushTooSoon(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.SelfMetrics = true
+	buf := &bytes.Buffer{}
+
+	now := time.Now()
+	ssi.updateLastPeriodFlushed(getStartOfFlushPeriod(now, -1))
+
+	err := doFlush(appwrap.NewWriterLogger(buf), ssi, &MockFlusher{}, nil)
+	c.Check(err, Equals, ErrStatFlushTooSoon)
+	c.Check(buf.String(), Matches, "(?s).*INFO: Skipped updating stats backend.*")
+	c.Check(strings.Contains(buf.String(), "ERROR:"), Equals, false)
+
+	skipped, err := ssi.peekCounter(selfMetricSkipped, "", now)
+	c.Assert(err, IsNil)
+	c.Check(skipped, Equals, uint64(1))
+
+}
@@ -0,0 +1,256 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+// prometheusName turns a metric name into a valid Prometheus metric name by
+// replacing every unsupported character with an underscore.
+func prometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func prometheusFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writePrometheusText renders the flushed data in the Prometheus text
+// exposition format. Counters hold the count for the flushed period rather
+// than a running total, so they're exposed as gauges. Timings are exposed as
+// summaries with the median, 90th and 99.9th percentiles. When withSource
+// is set, non-empty sources are rendered as a "source" label; services always
+// are, as a "service" label. The samples of each metric name are written
+// together under a single TYPE line, in the order the names first appear,
+// since a repeated TYPE line makes the whole exposition invalid.
+func writePrometheusText(w io.Writer, data []interface{}, withSource bool) {
+
+	labels := func(sc StatConfig, extra string) string {
+		var l []string
+		if withSource && hasSource(sc.Source) {
+			l = append(l, fmt.Sprintf("source=%q", sc.Source))
+		}
+		if sc.Service != "" {
+			l = append(l, fmt.Sprintf("service=%q", sc.Service))
+		}
+		if extra != "" {
+			l = append(l, extra)
+		}
+		if len(l) == 0 {
+			return ""
+		}
+		return "{" + strings.Join(l, ",") + "}"
+	}
+
+	var names []string
+	types := make(map[string]string)
+	samples := make(map[string]*bytes.Buffer)
+	metric := func(name, typ string) *bytes.Buffer {
+		if _, found := samples[name]; !found {
+			names = append(names, name)
+			types[name] = typ
+			samples[name] = &bytes.Buffer{}
+		}
+		return samples[name]
+	}
+
+	for i := range data {
+		switch d := data[i].(type) {
+		case StatDataCounter:
+			name := prometheusName(d.Name)
+			fmt.Fprintf(metric(name, "gauge"), "%s%s %d\n", name, labels(d.StatConfig, ""), d.Count)
+		case StatDataFloatCounter:
+			name := prometheusName(d.Name)
+			fmt.Fprintf(metric(name, "gauge"), "%s%s %s\n", name, labels(d.StatConfig, ""), prometheusFloat(d.Value))
+		case StatDataGauge:
+			name := prometheusName(d.Name)
+			fmt.Fprintf(metric(name, "gauge"), "%s%s %s\n", name, labels(d.StatConfig, ""), prometheusFloat(d.Value))
+		case StatDataTiming:
+			name := prometheusName(d.Name)
+			buf := metric(name, "summary")
+			fmt.Fprintf(buf, "%s%s %s\n", name, labels(d.StatConfig, `quantile="0.5"`), prometheusFloat(d.Median))
+			fmt.Fprintf(buf, "%s%s %s\n", name, labels(d.StatConfig, `quantile="0.9"`), prometheusFloat(d.NinthDecileValue))
+			fmt.Fprintf(buf, "%s%s %s\n", name, labels(d.StatConfig, `quantile="0.999"`), prometheusFloat(d.ThreeNinesValue))
+			fmt.Fprintf(buf, "%s_sum%s %s\n", name, labels(d.StatConfig, ""), prometheusFloat(d.Sum))
+			fmt.Fprintf(buf, "%s_count%s %d\n", name, labels(d.StatConfig, ""), d.Count)
+		}
+	}
+
+	for _, name := range names {
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, types[name])
+		w.Write(samples[name].Bytes())
+	}
+}
+
+// PushgatewayStatsFlusher is used to push stats to a Prometheus Pushgateway,
+// for jobs which don't live long enough to be scraped. Each source is pushed
+// as its own group, with the source as a grouping label.
+type PushgatewayStatsFlusher struct {
+	c        context.Context
+	log      appwrap.Logging
+	url      string
+	job      string
+	instance string
+	opts     PushgatewayOptions
+}
+
+// PushgatewayOptions controls optional behaviors of a
+// PushgatewayStatsFlusher. The zero value gives the default behavior.
+type PushgatewayOptions struct {
+	// Client sends the requests; http.DefaultClient if nil.
+	Client HTTPDoer
+
+	// Compress makes pushes be sent gzip compressed, which the Pushgateway
+	// accepts, to cut the egress of large flushes.
+	Compress bool
+}
+
+// NewPushgatewayStatsFlusher returns a flusher pushing to the Pushgateway at
+// baseUrl (e.g. "http://pushgateway:9091") under the given job and instance.
+// If the FlusherConfig passed to Flush has a Username, it's used for basic
+// authentication.
+func NewPushgatewayStatsFlusher(c context.Context, baseUrl, job, instance string) StatsFlusher {
+	return NewPushgatewayStatsFlusherWithClient(c, baseUrl, job, instance, http.DefaultClient)
+}
+
+// NewPushgatewayStatsFlusherWithClient is like NewPushgatewayStatsFlusher,
+// but sends its requests through client.
+func NewPushgatewayStatsFlusherWithClient(c context.Context, baseUrl, job, instance string, client HTTPDoer) StatsFlusher {
+	return NewPushgatewayStatsFlusherWithOptions(c, baseUrl, job, instance, PushgatewayOptions{Client: client})
+}
+
+// NewPushgatewayStatsFlusherWithOptions is like NewPushgatewayStatsFlusher,
+// but configured by opts.
+func NewPushgatewayStatsFlusherWithOptions(c context.Context, baseUrl, job, instance string, opts PushgatewayOptions) StatsFlusher {
+	log := appwrap.NewStackdriverLogging(c)
+	return PushgatewayStatsFlusher{c, log, strings.TrimRight(baseUrl, "/"), job, instance, opts}
+}
+
+func (pf PushgatewayStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
+	_, err := pf.FlushWithStats(data, cfg)
+	return err
+}
+
+func (pf PushgatewayStatsFlusher) FlushWithStats(data []interface{}, cfg *FlusherConfig) (FlushStats, error) {
+
+	meter := &flushMeter{}
+	data = emittedData(data, cfg)
+	groups := make(map[string][]interface{})
+	for i := range data {
+		if sc, ok := statConfigOf(data[i]); ok {
+			groups[sc.Source] = append(groups[sc.Source], data[i])
+		}
+	}
+
+	sources := make([]string, 0, len(groups))
+	for source := range groups {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	for _, source := range sources {
+		var body bytes.Buffer
+		writePrometheusText(&body, groups[source], false)
+		if err := pf.push(pf.groupUrl(source), body.Bytes(), idempotencyKey("pushgateway", groups[source]), cfg, meter); err != nil {
+			return meter.stats, err
+		}
+	}
+
+	return meter.stats, nil
+}
+
+func (pf PushgatewayStatsFlusher) groupUrl(source string) string {
+	u := pf.url + "/metrics" + pushgatewayLabel("job", pf.job) + pushgatewayLabel("instance", pf.instance)
+	if hasSource(source) {
+		u += pushgatewayLabel("source", source)
+	}
+	return u
+}
+
+// pushgatewayLabel renders a grouping label as a URL path segment, base64
+// encoding values which can't be used in a path as-is.
+func pushgatewayLabel(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return fmt.Sprintf("/%s@base64/%s", name, base64.RawURLEncoding.EncodeToString([]byte(value)))
+	}
+	return fmt.Sprintf("/%s/%s", name, url.PathEscape(value))
+}
+
+func (pf PushgatewayStatsFlusher) push(groupUrl string, body []byte, key string, cfg *FlusherConfig, meter *flushMeter) error {
+
+	pf.log.Debugf("Pushing data to Pushgateway %s: %s", groupUrl, body)
+
+	if pf.opts.Compress {
+		var err error
+		if body, err = gzipBytes(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("PUT", groupUrl, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	if pf.opts.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set("Idempotency-Key", key)
+	if cfg != nil && cfg.Username != "" {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+
+	resp, err := meter.do(pf.getHttpClient(), req)
+	if err != nil {
+		pf.log.Errorf("Failed to push stats to Pushgateway: HTTP error: %s", err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		pf.log.Errorf("Failed to push stats to Pushgateway: HTTP status code %d, response body: %s", resp.StatusCode, respBody)
+		return fmt.Errorf("pushgateway returned HTTP status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (pf PushgatewayStatsFlusher) FlusherName() string { return "pushgateway" }
+
+func (pf PushgatewayStatsFlusher) getHttpClient() HTTPDoer {
+	if pf.opts.Client == nil {
+		return http.DefaultClient
+	}
+	return pf.opts.Client
+}
@@ -0,0 +1,176 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *StatStashTest) TestPushgatewayStatsFlusher(c *C) {
+
+	pushes := make(map[string]string)
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "PUT")
+		body, _ := ioutil.ReadAll(r.Body)
+		pushes[r.URL.Path] = string(body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	flusher := NewPushgatewayStatsFlusher(s.Context, server.URL, "nightly-export", "worker-1")
+
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "export.rows", Source: "accounts"}, Count: 12},
+		StatDataGauge{StatConfig: StatConfig{Name: "export.lag"}, Value: 7264534001},
+		StatDataTiming{StatConfig: StatConfig{Name: "export.batch", Source: "accounts"},
+			Count: 2, Sum: 25.5, Median: 12.75, NinthDecileValue: 15.5, ThreeNinesValue: 15.5},
+	}
+
+	c.Assert(flusher.Flush(data, nil), IsNil)
+	c.Assert(pushes, HasLen, 2)
+
+	c.Check(pushes["/metrics/job/nightly-export/instance/worker-1/source/accounts"], Equals,
+		"# TYPE export_rows gauge\n"+
+			"export_rows 12\n"+
+			"# TYPE export_batch summary\n"+
+			"export_batch{quantile=\"0.5\"} 12.75\n"+
+			"export_batch{quantile=\"0.9\"} 15.5\n"+
+			"export_batch{quantile=\"0.999\"} 15.5\n"+
+			"export_batch_sum 25.5\n"+
+			"export_batch_count 2\n")
+	c.Check(pushes["/metrics/job/nightly-export/instance/worker-1"], Equals,
+		"# TYPE export_lag gauge\n"+
+			"export_lag 7.264534001e+09\n")
+
+	status = http.StatusBadRequest
+	c.Check(flusher.Flush(data, nil), ErrorMatches, "pushgateway returned HTTP status 400")
+
+}
+
+func (s *StatStashTest) TestPushgatewayCompress(c *C) {
+
+	var encoding, pushed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		zr, err := gzip.NewReader(r.Body)
+		c.Assert(err, IsNil)
+		body, _ := ioutil.ReadAll(zr)
+		pushed = string(body)
+	}))
+	defer server.Close()
+
+	flusher := NewPushgatewayStatsFlusherWithOptions(s.Context, server.URL, "web", "a", PushgatewayOptions{Compress: true})
+	data := []interface{}{StatDataGauge{StatConfig: StatConfig{Name: "queue.depth"}, Value: 12}}
+	c.Assert(flusher.Flush(data, nil), IsNil)
+
+	c.Check(encoding, Equals, "gzip")
+	c.Check(pushed, Equals, "# TYPE queue_depth gauge\nqueue_depth 12\n")
+
+}
+
+func (s *StatStashTest) TestPrometheusTextTypeOnce(c *C) {
+
+	data := []interface{}{
+		StatDataGauge{StatConfig: StatConfig{Name: "queue.depth", Source: "a"}, Value: 1},
+		StatDataCounter{StatConfig: StatConfig{Name: "jobs", Source: "a"}, Count: 3},
+		StatDataGauge{StatConfig: StatConfig{Name: "queue.depth", Source: "b"}, Value: 2},
+	}
+
+	var buf bytes.Buffer
+	writePrometheusText(&buf, data, true)
+	c.Check(buf.String(), Equals,
+		"# TYPE queue_depth gauge\n"+
+			"queue_depth{source=\"a\"} 1\n"+
+			"queue_depth{source=\"b\"} 2\n"+
+			"# TYPE jobs gauge\n"+
+			"jobs{source=\"a\"} 3\n")
+
+}
+
+func (s *StatStashTest) TestFlusherSelfMetrics(c *C) {
+
+	var mtx sync.Mutex
+	var pushedBytes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mtx.Lock()
+		pushedBytes += len(body)
+		mtx.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.SelfMetrics = true
+	now := time.Now()
+
+	c.Assert(ssi.IncrementCounter("TestFlusherSelfMetrics.hits", ""), IsNil)
+	flusher := NewPushgatewayStatsFlusher(s.Context, server.URL, "web", "a")
+	c.Assert(ssi.UpdateBackend(now, flusher, nil, true), IsNil)
+
+	// The flush's request is measured for the next flush
+	data, err := ssi.Snapshot(now)
+	c.Assert(err, IsNil)
+	var latency *StatDataTiming
+	var bytes *StatDataGauge
+	for i := range data {
+		switch d := data[i].(type) {
+		case StatDataTiming:
+			if d.Name == selfMetricBackendLatency {
+				latency = &d
+			}
+		case StatDataGauge:
+			if d.Name == selfMetricBytes {
+				bytes = &d
+			}
+		}
+	}
+	c.Assert(latency, NotNil)
+	c.Check(latency.Source, Equals, "pushgateway")
+	c.Check(latency.Count, Equals, 1)
+	c.Check(latency.Max >= 0, Equals, true)
+	c.Assert(bytes, NotNil)
+	c.Check(bytes.Source, Equals, "pushgateway")
+	c.Check(bytes.Value, Equals, float64(pushedBytes))
+	c.Check(pushedBytes > 0, Equals, true)
+
+	// Each flush gets the stats of its own requests, even when flushes
+	// through the same flusher overlap
+	var wg sync.WaitGroup
+	results := make([]FlushStats, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			results[i], err = flusher.(InstrumentedStatsFlusher).FlushWithStats(data[:1], nil)
+			c.Check(err, IsNil)
+		}(i)
+	}
+	wg.Wait()
+	for _, stats := range results {
+		c.Check(stats.Requests, Equals, 1)
+	}
+
+}
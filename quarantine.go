@@ -0,0 +1,104 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+)
+
+// decodeFailures counts the failed decodes of each memcache item since it
+// was last quarantined or decoded, when StatOptions.QuarantineAfter is set.
+type decodeFailures struct {
+	mtx    sync.Mutex
+	counts map[string]decodeFailure
+}
+
+type decodeFailure struct {
+	count int
+	last  time.Time
+}
+
+// fail records a failed decode of key at now, returning how many there have
+// been. Items which last failed more than expiration before now have
+// expired from memcache, so their counts are dropped.
+func (df *decodeFailures) fail(key string, now time.Time, expiration time.Duration) int {
+	df.mtx.Lock()
+	defer df.mtx.Unlock()
+	if df.counts == nil {
+		df.counts = make(map[string]decodeFailure)
+	}
+	for k, failure := range df.counts {
+		if now.Sub(failure.last) > expiration {
+			delete(df.counts, k)
+		}
+	}
+	failure := df.counts[key]
+	failure.count++
+	failure.last = now
+	df.counts[key] = failure
+	return failure.count
+}
+
+// forget drops the count for key.
+func (df *decodeFailures) forget(key string) {
+	df.mtx.Lock()
+	defer df.mtx.Unlock()
+	delete(df.counts, key)
+}
+
+// badItem logs that the memcache item at key couldn't be decoded, with msg
+// describing the failure. Without StatOptions.QuarantineAfter, every
+// failure is logged as an error. With it, only the first is; later ones are
+// logged at debug level until the item has failed QuarantineAfter times,
+// when it's deleted from memcache with a single warning, so a corrupt item
+// stops failing every flush until it expires.
+func (s StatImplementation) badItem(key, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if s.opts.QuarantineAfter <= 0 {
+		s.log.Errorf("%s", msg)
+		return
+	}
+
+	expiration := s.bucketExpiration(scTypeGauge)
+	if counterExpiration := s.bucketExpiration(scTypeCounter); counterExpiration > expiration {
+		expiration = counterExpiration
+	}
+	failures := s.failures.fail(key, s.now(), expiration)
+	switch {
+	case failures >= s.opts.QuarantineAfter:
+		if err := s.cache.Delete(key); err != nil && err != appwrap.ErrCacheMiss {
+			s.log.Warningf("%s; failed to quarantine it after %d failures: %s", msg, failures, err)
+			return
+		}
+		s.failures.forget(key)
+		s.log.Warningf("%s; quarantined it by deleting it after %d failures", msg, failures)
+	case failures == 1:
+		s.log.Errorf("%s", msg)
+	default:
+		s.debugf("%s (failure %d of %d before quarantine)", msg, failures, s.opts.QuarantineAfter)
+	}
+}
+
+// goodItem records that the memcache item at key was decoded, so earlier
+// failures to decode it don't count towards quarantining it.
+func (s StatImplementation) goodItem(key string) {
+	if s.opts.QuarantineAfter > 0 {
+		s.failures.forget(key)
+	}
+}
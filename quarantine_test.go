@@ -0,0 +1,154 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"github.com/stretchr/testify/mock"
+	. "gopkg.in/check.v1"
+)
+
+// countingLogger counts the errors and warnings logged through it.
+type countingLogger struct {
+	appwrap.Logging
+	mtx      sync.Mutex
+	errors   int
+	warnings int
+}
+
+func (l *countingLogger) Errorf(format string, args ...interface{}) {
+	l.mtx.Lock()
+	l.errors++
+	l.mtx.Unlock()
+	l.Logging.Errorf(format, args...)
+}
+
+func (l *countingLogger) Warningf(format string, args ...interface{}) {
+	l.mtx.Lock()
+	l.warnings++
+	l.mtx.Unlock()
+	l.Logging.Warningf(format, args...)
+}
+
+func (s *StatStashTest) TestQuarantineAfter(c *C) {
+
+	ssi := s.newTestStatsStash()
+	log := &countingLogger{Logging: ssi.log}
+	ssi.log = log
+	ssi.opts.QuarantineAfter = 3
+	now := time.Now()
+
+	c.Assert(ssi.RecordGauge("TestQuarantineAfter.queue", "", 7), IsNil)
+	bucketKey, err := ssi.getBucketKey(scTypeGauge, "TestQuarantineAfter.queue", "", now)
+	c.Assert(err, IsNil)
+	c.Assert(ssi.cache.Set(&appwrap.CacheItem{Key: bucketKey, Value: []byte("corrupt")}), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil)
+	flush := func() {
+		ssi.UpdateBackend(now, mockFlusher, nil, true)
+		c.Check(mockFlusher.gauges, HasLen, 0)
+	}
+
+	// The first failure is an error, the next just debug logging
+	flush()
+	c.Check(log.errors, Equals, 1)
+	c.Check(log.warnings, Equals, 0)
+	flush()
+	c.Check(log.errors, Equals, 1)
+	c.Check(log.warnings, Equals, 0)
+	_, err = ssi.cache.Get(bucketKey)
+	c.Check(err, IsNil)
+
+	// The third deletes the bucket with a warning
+	flush()
+	c.Check(log.errors, Equals, 1)
+	c.Check(log.warnings, Equals, 1)
+	_, err = ssi.cache.Get(bucketKey)
+	c.Check(err, Equals, appwrap.ErrCacheMiss)
+
+	// and later flushes have nothing to complain about
+	flush()
+	flush()
+	c.Check(log.errors, Equals, 1)
+	c.Check(log.warnings, Equals, 1)
+
+}
+
+func (s *StatStashTest) TestQuarantineAfterResets(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.QuarantineAfter = 2
+	now := time.Now()
+
+	c.Assert(ssi.RecordGauge("TestQuarantineAfterResets.queue", "", 7), IsNil)
+	bucketKey, err := ssi.getBucketKey(scTypeGauge, "TestQuarantineAfterResets.queue", "", now)
+	c.Assert(err, IsNil)
+	good, err := ssi.cache.Get(bucketKey)
+	c.Assert(err, IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil)
+
+	// Failures separated by a successful decode aren't counted together
+	for i := 0; i < 2; i++ {
+		c.Assert(ssi.cache.Set(&appwrap.CacheItem{Key: bucketKey, Value: []byte("corrupt")}), IsNil)
+		ssi.UpdateBackend(now, mockFlusher, nil, true)
+		c.Assert(ssi.cache.Set(&appwrap.CacheItem{Key: bucketKey, Value: good.Value}), IsNil)
+		ssi.UpdateBackend(now, mockFlusher, nil, true)
+		c.Check(mockFlusher.gauges, HasLen, 1)
+	}
+	_, err = ssi.cache.Get(bucketKey)
+	c.Check(err, IsNil)
+	c.Check(ssi.failures.counts, HasLen, 0)
+
+	// and counts of buckets which have since expired are dropped
+	expiration := ssi.bucketExpiration(scTypeCounter)
+	c.Check(ssi.failures.fail("expired", now, expiration), Equals, 1)
+	c.Check(ssi.failures.fail("live", now.Add(expiration), expiration), Equals, 1)
+	c.Check(ssi.failures.fail("live", now.Add(expiration+time.Second), expiration), Equals, 2)
+	c.Check(ssi.failures.counts, HasLen, 1)
+
+}
+
+func (s *StatStashTest) TestQuarantineGaugeLevel(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.QuarantineAfter = 2
+	clock := getStartOfFlushPeriod(time.Now(), -1).Add(time.Second)
+	ssi.opts.Clock = func() time.Time { return clock }
+
+	c.Assert(ssi.AdjustGauge("TestQuarantineGaugeLevel.connections", "", 1), IsNil)
+	cfg, err := ssi.getStatConfig(scTypeGauge, "TestQuarantineGaugeLevel.connections", "")
+	c.Assert(err, IsNil)
+	levelKey := ssi.getGaugeLevelMemcacheKey(cfg)
+	c.Assert(ssi.cache.Set(&appwrap.CacheItem{Key: levelKey, Value: []byte("corrupt")}), IsNil)
+
+	// The level is carried into periods the gauge isn't adjusted in, where
+	// a corrupt one is quarantined like a bucket
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil)
+	for i := 0; i < 2; i++ {
+		clock = clock.Add(defaultAggregationPeriod)
+		ssi.UpdateBackend(getStartOfFlushPeriod(clock, 0), mockFlusher, nil, true)
+		c.Check(mockFlusher.gauges, HasLen, 0)
+	}
+	_, err = ssi.cache.Get(levelKey)
+	c.Check(err, Equals, appwrap.ErrCacheMiss)
+
+}
@@ -0,0 +1,202 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteSeries is one time series of a Prometheus remote write request,
+// with a single sample.
+type remoteWriteSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp time.Time
+}
+
+// appendRemoteWriteRequest appends the series encoded as a
+// prometheus.WriteRequest protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func appendRemoteWriteRequest(b []byte, series []remoteWriteSeries) []byte {
+	for _, s := range series {
+		var ts []byte
+
+		// Labels must be sorted by name
+		names := make([]string, 0, len(s.labels))
+		for name := range s.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, s.labels[name])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp.UnixNano()/int64(time.Millisecond)))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
+
+// RemoteWriteStatsFlusher is used to flush stats to a Prometheus remote write
+// endpoint, such as Thanos, Cortex or Mimir. Counters and gauges are written
+// as one series each; timings are written as <name>_count, <name>_sum and
+// <name>_p90 series. Non-empty sources and services become "source" and
+// "service" labels. Requests are always snappy compressed, as the remote
+// write protocol requires, so unlike the Librato and Pushgateway flushers it
+// has no Compress option.
+type RemoteWriteStatsFlusher struct {
+	c      context.Context
+	log    appwrap.Logging
+	url    string
+	labels map[string]string
+	client HTTPDoer
+}
+
+// NewRemoteWriteStatsFlusher returns a flusher writing to the remote write
+// endpoint at url. The given labels (e.g. job or cluster) are added to every
+// series. If the FlusherConfig passed to Flush has a Username, it's used for
+// basic authentication.
+func NewRemoteWriteStatsFlusher(c context.Context, url string, labels map[string]string) StatsFlusher {
+	return NewRemoteWriteStatsFlusherWithClient(c, url, labels, http.DefaultClient)
+}
+
+// NewRemoteWriteStatsFlusherWithClient is like NewRemoteWriteStatsFlusher,
+// but sends its requests through client.
+func NewRemoteWriteStatsFlusherWithClient(c context.Context, url string, labels map[string]string, client HTTPDoer) StatsFlusher {
+	log := appwrap.NewStackdriverLogging(c)
+	return RemoteWriteStatsFlusher{c, log, url, labels, client}
+}
+
+// series converts the flushed data into remote write series.
+func (rf RemoteWriteStatsFlusher) series(data []interface{}) []remoteWriteSeries {
+
+	var timestamp time.Time
+	newSeries := func(sc StatConfig, suffix string, value float64) remoteWriteSeries {
+		labels := make(map[string]string, len(rf.labels)+2)
+		for name, value := range rf.labels {
+			labels[name] = value
+		}
+		if hasSource(sc.Source) {
+			labels["source"] = sc.Source
+		}
+		if sc.Service != "" {
+			labels["service"] = sc.Service
+		}
+		labels["__name__"] = prometheusName(sc.Name) + suffix
+		return remoteWriteSeries{labels, value, timestamp}
+	}
+
+	var series []remoteWriteSeries
+	for i := range data {
+		timestamp = periodStartOf(data[i])
+		switch d := data[i].(type) {
+		case StatDataCounter:
+			series = append(series, newSeries(d.StatConfig, "", float64(d.Count)))
+		case StatDataFloatCounter:
+			series = append(series, newSeries(d.StatConfig, "", d.Value))
+		case StatDataGauge:
+			series = append(series, newSeries(d.StatConfig, "", d.Value))
+		case StatDataTiming:
+			series = append(series,
+				newSeries(d.StatConfig, "_count", float64(d.Count)),
+				newSeries(d.StatConfig, "_sum", d.Sum),
+				newSeries(d.StatConfig, "_p90", d.NinthDecileValue))
+		default:
+			rf.log.Warningf("Not writing stat of unknown type %T to Prometheus", data[i])
+		}
+	}
+	return series
+}
+
+func (rf RemoteWriteStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
+	_, err := rf.FlushWithStats(data, cfg)
+	return err
+}
+
+func (rf RemoteWriteStatsFlusher) FlushWithStats(data []interface{}, cfg *FlusherConfig) (FlushStats, error) {
+
+	meter := &flushMeter{}
+	series := rf.series(emittedData(data, cfg))
+	if len(series) == 0 {
+		return meter.stats, nil
+	}
+	body := snappy.Encode(nil, appendRemoteWriteRequest(nil, series))
+
+	req, err := http.NewRequest("POST", rf.url, bytes.NewBuffer(body))
+	if err != nil {
+		return meter.stats, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "statstash")
+	req.Header.Set("Idempotency-Key", idempotencyKey("remotewrite", data))
+	if cfg != nil && cfg.Username != "" {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+
+	resp, err := meter.do(rf.getHttpClient(), req)
+	if err != nil {
+		rf.log.Errorf("Failed to write stats to Prometheus: HTTP error: %s", err)
+		return meter.stats, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		rf.log.Errorf("Failed to write stats to Prometheus: HTTP status code %d, response body: %s", resp.StatusCode, respBody)
+		return meter.stats, fmt.Errorf("remote write endpoint returned HTTP status %d", resp.StatusCode)
+	}
+
+	return meter.stats, nil
+}
+
+func (rf RemoteWriteStatsFlusher) FlusherName() string { return "remotewrite" }
+
+func (rf RemoteWriteStatsFlusher) getHttpClient() HTTPDoer {
+	if rf.client == nil {
+		return http.DefaultClient
+	}
+	return rf.client
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	. "gopkg.in/check.v1"
+)
+
+// decodeRemoteWriteFields splits a protobuf message into its fields, keyed by
+// field number.
+func decodeRemoteWriteFields(c *C, b []byte) map[protowire.Number][][]byte {
+	fields := make(map[protowire.Number][][]byte)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		c.Assert(n > 0, Equals, true)
+		b = b[n:]
+		var value []byte
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			value = b[:n]
+		case protowire.VarintType:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			value = b[:n]
+		}
+		c.Assert(n > 0, Equals, true)
+		fields[num] = append(fields[num], value)
+		b = b[n:]
+	}
+	return fields
+}
+
+// decodeRemoteWrite decodes a WriteRequest into a map of the series'
+// comma separated labels to their value.
+func decodeRemoteWrite(c *C, body []byte) map[string]float64 {
+	series := make(map[string]float64)
+	for _, ts := range decodeRemoteWriteFields(c, body)[1] {
+		tsFields := decodeRemoteWriteFields(c, ts)
+		var labels []string
+		for _, label := range tsFields[1] {
+			labelFields := decodeRemoteWriteFields(c, label)
+			labels = append(labels, string(labelFields[1][0])+"="+string(labelFields[2][0]))
+		}
+		c.Assert(tsFields[2], HasLen, 1)
+		sampleFields := decodeRemoteWriteFields(c, tsFields[2][0])
+		bits, _ := protowire.ConsumeFixed64(sampleFields[1][0])
+		timestamp, _ := protowire.ConsumeVarint(sampleFields[2][0])
+		c.Check(timestamp > 0, Equals, true)
+		series[strings.Join(labels, ",")] = math.Float64frombits(bits)
+	}
+	return series
+}
+
+func (s *StatStashTest) TestRemoteWriteStatsFlusher(c *C) {
+
+	var written map[string]float64
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "POST")
+		c.Check(r.Header.Get("Content-Encoding"), Equals, "snappy")
+		c.Check(r.Header.Get("Content-Type"), Equals, "application/x-protobuf")
+		c.Check(r.Header.Get("X-Prometheus-Remote-Write-Version"), Equals, "0.1.0")
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		c.Assert(err, IsNil)
+		written = decodeRemoteWrite(c, body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	flusher := NewRemoteWriteStatsFlusher(s.Context, server.URL, map[string]string{"job": "web"})
+
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "export.rows", Source: "accounts"}, Count: 12},
+		StatDataGauge{StatConfig: StatConfig{Name: "export.lag"}, Value: 7264534001},
+		StatDataTiming{StatConfig: StatConfig{Name: "export.batch", Source: "accounts"},
+			Count: 2, Sum: 25.5, Median: 12.75, NinthDecileValue: 15.5, ThreeNinesValue: 15.5},
+	}
+
+	c.Assert(flusher.Flush(data, nil), IsNil)
+	c.Check(written, DeepEquals, map[string]float64{
+		"__name__=export_rows,job=web,source=accounts":        12,
+		"__name__=export_lag,job=web":                         7264534001,
+		"__name__=export_batch_count,job=web,source=accounts": 2,
+		"__name__=export_batch_sum,job=web,source=accounts":   25.5,
+		"__name__=export_batch_p90,job=web,source=accounts":   15.5,
+	})
+
+	status = http.StatusBadRequest
+	c.Check(flusher.Flush(data, nil), ErrorMatches, "remote write endpoint returned HTTP status 400")
+
+}
@@ -0,0 +1,95 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"strings"
+)
+
+// RoutingRule sends the data whose StatConfig Match accepts to Flusher.
+type RoutingRule struct {
+	Match   func(StatConfig) bool
+	Flusher StatsFlusher
+}
+
+// MatchNamePrefix returns a RoutingRule matcher for stats whose name starts
+// with prefix.
+func MatchNamePrefix(prefix string) func(StatConfig) bool {
+	return func(sc StatConfig) bool {
+		return strings.HasPrefix(sc.Name, prefix)
+	}
+}
+
+// MatchType returns a RoutingRule matcher for stats of the type, e.g.
+// "counter", "floatcounter", "gauge" or "timing".
+func MatchType(typ string) func(StatConfig) bool {
+	return func(sc StatConfig) bool {
+		return sc.Type == typ
+	}
+}
+
+// RoutingStatsFlusher splits flushed data between flushers, so metrics can
+// be sent to different backends, e.g. by name prefix or type, without
+// changing where they're recorded. Each datum goes to the flusher of the
+// first rule matching it, or to the default flusher if none does.
+type RoutingStatsFlusher struct {
+	rules    []RoutingRule
+	fallback StatsFlusher
+}
+
+// NewRoutingStatsFlusher returns a flusher routing data by rules, in order.
+// Data matching no rule are sent to fallback, or dropped if it's nil.
+func NewRoutingStatsFlusher(fallback StatsFlusher, rules ...RoutingRule) StatsFlusher {
+	return RoutingStatsFlusher{rules, fallback}
+}
+
+// route returns the index of the rule matching datum, which is len(rules)
+// for the default flusher.
+func (rf RoutingStatsFlusher) route(datum interface{}) int {
+	if sc, ok := statConfigOf(datum); ok {
+		for i, rule := range rf.rules {
+			if rule.Match(sc) {
+				return i
+			}
+		}
+	}
+	return len(rf.rules)
+}
+
+// Flush sends each flusher its share of data, in their original order.
+// Every flusher is tried; the first error is returned.
+func (rf RoutingStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
+
+	routed := make([][]interface{}, len(rf.rules)+1)
+	for i := range data {
+		route := rf.route(data[i])
+		routed[route] = append(routed[route], data[i])
+	}
+
+	var finalError error
+	for route, routedData := range routed {
+		flusher := rf.fallback
+		if route < len(rf.rules) {
+			flusher = rf.rules[route].Flusher
+		}
+		if len(routedData) == 0 || flusher == nil {
+			continue
+		}
+		if err := flusher.Flush(routedData, cfg); err != nil && finalError == nil {
+			finalError = err
+		}
+	}
+	return finalError
+}
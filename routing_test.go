@@ -0,0 +1,75 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"errors"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StatStashTest) TestRoutingStatsFlusher(c *C) {
+
+	period := getStartOfFlushPeriod(time.Now(), -1)
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "TestRoutingStatsFlusher.business.signups", Type: scTypeCounter}, Count: 4, PeriodStart: period},
+		StatDataTiming{StatConfig: StatConfig{Name: "TestRoutingStatsFlusher.latency", Type: scTypeTiming}, Count: 1, Sum: 12, PeriodStart: period},
+		StatDataCounter{StatConfig: StatConfig{Name: "TestRoutingStatsFlusher.business.orders", Type: scTypeCounter}, Count: 2, PeriodStart: period},
+		StatDataGauge{StatConfig: StatConfig{Name: "TestRoutingStatsFlusher.connections", Type: scTypeGauge}, Value: 3, PeriodStart: period},
+	}
+
+	flusherA, flusherB, fallback := &MockFlusher{}, &MockFlusher{}, &MockFlusher{}
+	flusherA.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	flusherB.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	fallback.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+
+	flusher := NewRoutingStatsFlusher(fallback,
+		RoutingRule{MatchType(scTypeTiming), flusherA},
+		RoutingRule{MatchNamePrefix("TestRoutingStatsFlusher.business."), flusherB},
+	)
+	c.Assert(flusher.Flush(data, nil), IsNil)
+	flusherA.AssertExpectations(c)
+	flusherB.AssertExpectations(c)
+	fallback.AssertExpectations(c)
+
+	c.Assert(flusherA.timings, HasLen, 1)
+	c.Check(flusherA.timings[0].Name, Equals, "TestRoutingStatsFlusher.latency")
+	c.Check(flusherA.counters, HasLen, 0)
+
+	c.Assert(flusherB.counters, HasLen, 2)
+	c.Check(flusherB.counters[0].Name, Equals, "TestRoutingStatsFlusher.business.signups")
+	c.Check(flusherB.counters[1].Name, Equals, "TestRoutingStatsFlusher.business.orders")
+	c.Check(flusherB.timings, HasLen, 0)
+
+	// The first rule wins, so only the gauge is left for the default
+	c.Check(fallback.counters, HasLen, 0)
+	c.Assert(fallback.gauges, HasLen, 1)
+	c.Check(fallback.gauges[0].Name, Equals, "TestRoutingStatsFlusher.connections")
+
+	// A failing flusher doesn't stop the others
+	flusherA.On("Flush", mock.Anything, mock.Anything).Return(errors.New("unavailable")).Once()
+	flusherB.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	flusher = NewRoutingStatsFlusher(nil,
+		RoutingRule{MatchType(scTypeTiming), flusherA},
+		RoutingRule{MatchType(scTypeCounter), flusherB},
+	)
+	c.Check(flusher.Flush(data, nil), ErrorMatches, "unavailable")
+	flusherA.AssertExpectations(c)
+	flusherB.AssertExpectations(c)
+	c.Check(flusherB.counters, HasLen, 2)
+
+}
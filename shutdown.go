@@ -0,0 +1,104 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RegisterShutdownClose makes stats store what it has buffered in memory
+// (see StatInterface.Close) when ctx is done or the process receives SIGTERM
+// or SIGINT, so a draining instance doesn't lose it. The values are flushed
+// by the next periodic flush, like any others. A signal is sent on to the
+// process again once stats are closed, so it terminates as it would have
+// without this handler; any other handlers registered for it with
+// signal.Notify receive it twice.
+func RegisterShutdownClose(ctx context.Context, stats StatInterface) {
+	onShutdown(ctx, func() {
+		if err := stats.Close(); err != nil {
+			if ssi, ok := stats.(StatImplementation); ok {
+				ssi.log.Errorf("Failed to store buffered stats at shutdown: %s", err)
+			}
+		}
+	})
+}
+
+// RegisterShutdownFlush is like RegisterShutdownClose, but also does a
+// final forced flush of the previous and current periods (see
+// StatImplementation.ForceFlushNow) through flusher. Every instance shares
+// the memcache buckets, so each instance shutting down sends those periods
+// again, and the next periodic flush sends the previous one again too,
+// multiplying counters in the backend. It's only meant for apps with a
+// single instance and no periodic flush; others should use
+// RegisterShutdownClose.
+func RegisterShutdownFlush(ctx context.Context, stats StatInterface, flusher StatsFlusher, cfg *FlusherConfig) {
+	onShutdown(ctx, func() {
+		shutdownFlush(stats, flusher, cfg)
+	})
+}
+
+// onShutdown calls shutdown when ctx is done or the process receives SIGTERM
+// or SIGINT, sending a received signal on to the process again afterwards.
+func onShutdown(ctx context.Context, shutdown func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		var received os.Signal
+		select {
+		case <-ctx.Done():
+		case received = <-signals:
+		}
+		signal.Stop(signals)
+
+		shutdown()
+
+		if received != nil {
+			if process, err := os.FindProcess(os.Getpid()); err == nil {
+				process.Signal(received)
+			}
+		}
+	}()
+}
+
+// shutdownFlush stores what stats has buffered and force flushes it. Stat
+// interfaces other than StatImplementation are flushed with a forced
+// UpdateBackend of their previous and current periods.
+func shutdownFlush(stats StatInterface, flusher StatsFlusher, cfg *FlusherConfig) {
+	ssi, isImplementation := stats.(StatImplementation)
+
+	if err := stats.Close(); err != nil && isImplementation {
+		ssi.log.Errorf("Failed to store buffered stats at shutdown: %s", err)
+	}
+
+	if isImplementation {
+		if err := ssi.ForceFlushNow(flusher, cfg); err != nil {
+			ssi.log.Errorf("Failed the final flush at shutdown: %s", err)
+		} else {
+			ssi.log.Infof("Flushed stats at shutdown")
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, offset := range []int{-1, 0} {
+		stats.UpdateBackend(getStartOfFlushPeriod(now, offset), flusher, cfg, true)
+	}
+}
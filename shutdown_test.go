@@ -0,0 +1,74 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+func (s *StatStashTest) TestRegisterShutdownClose(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.CounterAccumulation = time.Hour
+	c.Assert(ssi.IncrementCounterBy("TestRegisterShutdownClose.foo", "", 3), IsNil)
+
+	ctx, cancel := context.WithCancel(s.Context)
+	RegisterShutdownClose(ctx, ssi)
+	cancel()
+
+	// The accumulated increments are stored, for the next flush to send
+	deadline := time.Now().Add(5 * time.Second)
+	var count uint64
+	for count == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		count, _ = ssi.peekCounter("TestRegisterShutdownClose.foo", "", time.Now())
+	}
+	c.Check(count, Equals, uint64(3))
+
+}
+
+func (s *StatStashTest) TestRegisterShutdownFlush(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.CounterAccumulation = time.Hour
+	c.Assert(ssi.IncrementCounterBy("TestRegisterShutdownFlush.foo", "", 3), IsNil)
+
+	flushed := make(chan []interface{}, 1)
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once().Run(func(args mock.Arguments) {
+		flushed <- args.Get(0).([]interface{})
+	})
+
+	ctx, cancel := context.WithCancel(s.Context)
+	RegisterShutdownFlush(ctx, ssi, mockFlusher, nil)
+	cancel()
+
+	var data []interface{}
+	select {
+	case data = <-flushed:
+	case <-time.After(5 * time.Second):
+		c.Fatal("no flush after the context was cancelled")
+	}
+
+	// The accumulated increments were stored and flushed
+	c.Assert(data, HasLen, 1)
+	c.Check(data[0].(StatDataCounter).Name, Equals, "TestRegisterShutdownFlush.foo")
+	c.Check(data[0].(StatDataCounter).Count, Equals, uint64(3))
+
+}
@@ -0,0 +1,145 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+)
+
+// stateFormatVersion is the version of the format ExportState writes; it's
+// bumped whenever ImportState couldn't read an export in the new format the
+// same way.
+const stateFormatVersion = 1
+
+// ErrStateVersion is returned by ImportState for exports in a format version
+// it doesn't know.
+var ErrStateVersion = errors.New("Stats state was exported in an unknown format version")
+
+// exportedState is what ExportState serializes: every StatConfig, with its
+// datastore key name, and the memcache items of the current and previous
+// periods' buckets.
+type exportedState struct {
+	Version  int              `json:"version"`
+	Exported time.Time        `json:"exported"`
+	Configs  []exportedConfig `json:"configs"`
+	Buckets  []exportedBucket `json:"buckets"`
+}
+
+type exportedConfig struct {
+	Key    string     `json:"key"`
+	Config StatConfig `json:"config"`
+}
+
+type exportedBucket struct {
+	Key        string        `json:"key"`
+	Value      []byte        `json:"value"`
+	Expiration time.Duration `json:"expiration"`
+}
+
+// ExportState serializes every registered StatConfig along with the current
+// and previous periods' buckets, as JSON tagged with a format version, so
+// the state can be backed up and restored by ImportState, e.g. after a
+// memcache flush. Values accumulated in memory are written out first.
+func (s StatImplementation) ExportState() ([]byte, error) {
+	if err := s.FlushCounters(); err != nil {
+		s.log.Warningf("Failed to write accumulated counters before exporting state: %s", err)
+	}
+	if err := s.FlushConfigs(); err != nil {
+		s.log.Warningf("Failed to store buffered stat configs before exporting state: %s", err)
+	}
+
+	keys, cfgs, err := s.getAllConfigsWithKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	state := exportedState{Version: stateFormatVersion, Exported: now}
+	var bucketKeys []string
+	expirations := make(map[string]time.Duration)
+	for i, cfg := range cfgs {
+		state.Configs = append(state.Configs, exportedConfig{keys[i].StringID(), cfg})
+		for _, key := range s.bucketMemcacheKeys(cfg, now) {
+			bucketKeys = append(bucketKeys, key)
+			expirations[key] = s.bucketExpiration(cfg.Type)
+		}
+		if cfg.Type == scTypeGauge {
+			expirations[s.getGaugeLevelMemcacheKey(cfg)] = gaugeLevelExpiration
+		}
+	}
+
+	if len(bucketKeys) > 0 {
+		items, err := s.cache.GetMulti(bucketKeys)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range bucketKeys {
+			if item, found := items[key]; found {
+				state.Buckets = append(state.Buckets, exportedBucket{key, item.Value, expirations[key]})
+			}
+		}
+	}
+
+	return json.Marshal(state)
+}
+
+// ImportState restores state exported by ExportState, storing its
+// StatConfigs in datastore and its buckets in memcache, replacing any values
+// recorded since. Buckets of periods which have ended since the export are
+// restored too, but are only flushed by a forced flush.
+func (s StatImplementation) ImportState(data []byte) error {
+	var state exportedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Version != stateFormatVersion {
+		s.log.Errorf("Not importing stats state exported in format version %d (expected %d)", state.Version, stateFormatVersion)
+		return ErrStateVersion
+	}
+
+	if len(state.Configs) > 0 {
+		keys := make([]*appwrap.DatastoreKey, 0, len(state.Configs))
+		cfgs := make([]StatConfig, 0, len(state.Configs))
+		for _, ec := range state.Configs {
+			keys = append(keys, s.ds.NewKey(dsKindStatConfig, ec.Key, 0, nil))
+			cfgs = append(cfgs, ec.Config)
+		}
+		if err := s.retryDatastore("import stat configs", func() error {
+			_, err := s.ds.PutMulti(keys, cfgs)
+			return err
+		}); err != nil {
+			s.log.Errorf("Failed to import %d stat configs: %s", len(cfgs), err)
+			return err
+		}
+	}
+
+	if len(state.Buckets) > 0 {
+		items := make([]*appwrap.CacheItem, 0, len(state.Buckets))
+		for _, bucket := range state.Buckets {
+			items = append(items, &appwrap.CacheItem{Key: bucket.Key, Value: bucket.Value, Expiration: bucket.Expiration})
+		}
+		if err := s.cache.SetMulti(items); err != nil {
+			s.log.Errorf("Failed to import %d buckets: %s", len(items), err)
+			return err
+		}
+	}
+
+	s.log.Infof("Imported %d stat configs and %d buckets exported at %s", len(state.Configs), len(state.Buckets), state.Exported)
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *StatStashTest) TestExportImportState(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+
+	c.Assert(ssi.IncrementCounterBy("TestExportImportState.hits", "", 3), IsNil)
+	c.Assert(ssi.RecordGauge("TestExportImportState.queue", "a", 7), IsNil)
+	for _, value := range []float64{10, 20} {
+		c.Assert(ssi.RecordTiming("TestExportImportState.latency", "", value, 1), IsNil)
+	}
+	before, err := ssi.Snapshot(now)
+	c.Assert(err, IsNil)
+	c.Assert(before, HasLen, 3)
+
+	state, err := ssi.ExportState()
+	c.Assert(err, IsNil)
+
+	c.Assert(ssi.Purge(NewPurgeToken(testAppID)), IsNil)
+	configs, err := ssi.getAllConfigs()
+	c.Assert(err, IsNil)
+	c.Check(configs, HasLen, 0)
+
+	c.Assert(ssi.ImportState(state), IsNil)
+	configs, err = ssi.getAllConfigs()
+	c.Assert(err, IsNil)
+	c.Check(configs, HasLen, 3)
+
+	// The restored data match, though LastRead loses its location in JSON
+	after, err := ssi.Snapshot(now)
+	c.Assert(err, IsNil)
+	c.Assert(after, HasLen, len(before))
+	for i := range after {
+		restored, _ := statConfigOf(after[i])
+		original, _ := statConfigOf(before[i])
+		c.Check(restored.LastRead.Equal(original.LastRead), Equals, true)
+		restored.LastRead = original.LastRead
+		c.Check(withStatConfig(after[i], restored), DeepEquals, before[i])
+	}
+
+	count, err := ssi.peekCounter("TestExportImportState.hits", "", now)
+	c.Assert(err, IsNil)
+	c.Check(count, Equals, uint64(3))
+
+	c.Check(ssi.ImportState([]byte(`{"version": 99}`)), Equals, ErrStateVersion)
+	c.Check(ssi.ImportState([]byte(`not json`)), NotNil)
+
+}
@@ -18,28 +18,107 @@ package statstash
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"math"
 	"math/rand"
+	"net/http"
+	"os"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	dsKindStatConfig         = "StatConfig"
+	dsKindDeadLetter         = "StatDeadLetter"
 	scTypeTiming             = "timing"
 	scTypeGauge              = "gauge"
 	scTypeCounter            = "counter"
+	scTypeFloatCounter       = "floatcounter"
+	scTypeEvent              = "event"
+	scTypeHistogram          = "histogram"
 	defaultAggregationPeriod = time.Duration(5 * time.Minute)
+	degradedConfigExpiration = time.Duration(1 * time.Minute)
+	maxGaugeHistory          = 1000
+	maxEventsPerPeriod       = 100
+	maxCASAttempts           = 10
+	gaugeLevelExpiration     = time.Duration(24 * time.Hour)
+	maxEvictionSamples       = 1000
+	defaultAggregationBatch  = 500
+	defaultGaugeKeepalive    = time.Duration(1 * time.Hour)
+	defaultDatastoreBackoff  = time.Duration(100 * time.Millisecond)
+	// watermarks further ahead of the period being flushed than this are
+	// treated as bogus (e.g. written by an instance with a skewed clock)
+	maxWatermarkSkew = time.Duration(2 * defaultAggregationPeriod)
 )
 
 var ErrStatFlushTooSoon = errors.New("Too Soon to Flush Stats")
 var ErrStatNotSampled = errors.New("Skipped sample because sample rate given")
+var ErrInvalidSampleRate = errors.New("Sample rate must be greater than 0 and at most 1")
+var ErrInvalidApdexThreshold = errors.New("Apdex threshold must not be negative")
+var ErrInvalidShardCount = errors.New("Counter shard count must be at least 1")
+var ErrShardedCounterDecrement = errors.New("Sharded counters can't be decremented")
+var ErrStatTypeMismatch = errors.New("Stat name/source is already registered as a different type")
+var ErrStatNameTooLong = errors.New("Stat name or source is longer than the configured maximum")
+var ErrStatConfigNotFound = errors.New("No StatConfig is registered for the stat")
+var ErrStatTimeOutOfRange = errors.New("Stat time is outside the periods whose buckets are live")
+var ErrPurgeNotConfirmed = errors.New("Purge token was not made for this app's ID")
+var ErrStatInvalidValue = errors.New("Stat value is NaN or infinite")
+var ErrStatNegativeTiming = errors.New("Timing value is negative")
+var ErrInvalidHistogramBounds = errors.New("Histogram bounds must be given in increasing order")
+var ErrHistogramBoundsMismatch = errors.New("Histogram was already recorded with different bounds this period")
+
+// ConfiguredSampleRate can be passed as the sample rate to RecordTiming to use
+// the default sample rate stored for the metric (see SetDefaultSampleRate),
+// so every call site samples the metric consistently.
+const ConfiguredSampleRate = -1.0
+
+// SourceNone is the source of global stats, which aren't broken down by
+// source. Keys for such stats end in a bare "-" (for example "bar-"), and
+// flushers send them without a source.
+const SourceNone = ""
+
+// hasSource reports whether source is anything other than SourceNone.
+func hasSource(source string) bool {
+	return source != SourceNone
+}
+
+// OverflowSource is the source values are recorded under once a metric has
+// more distinct sources than StatOptions.MaxSourcesPerMetric allows.
+const OverflowSource = "__overflow__"
+
+// The gauges added to flushes when StatOptions.SelfMetrics is set.
+const (
+	selfMetricHeartbeat = "statstash.flush.heartbeat"
+	selfMetricDuration  = "statstash.flush.duration"
+	selfMetricCount     = "statstash.flush.metrics"
+
+	// recorded after each flush through an InstrumentedStatsFlusher, with
+	// the flusher's name as the source
+	selfMetricBackendLatency = "statstash.flush.backend_latency"
+	selfMetricBytes          = "statstash.flush.bytes"
+
+	// counted when a periodic flush is skipped as too soon
+	selfMetricSkipped = "statstash.flush.skipped"
+)
 
 type ErrStatDropped struct {
 	typ    string
@@ -59,11 +138,59 @@ func (e *ErrStatDropped) Error() string {
 		e.typ, e.name, e.source, e.t, e.value, e.err)
 }
 
+// Unwrap returns the error which caused the stat to be dropped.
+func (e *ErrStatDropped) Unwrap() error {
+	return e.err
+}
+
+// FlushErrors is returned by UpdateBackend and UpdateBackendWithReport when
+// the flush succeeded but some buckets couldn't be aggregated (e.g. their
+// value in memcache couldn't be decoded), with an error for each. It means a
+// partial success: everything else was flushed and the period was marked
+// flushed, so the skipped buckets aren't retried. When the flush itself
+// fails, the flusher's error is returned instead.
+type FlushErrors []error
+
+func (fe FlushErrors) Error() string {
+	msgs := make([]string, len(fe))
+	for i, err := range fe {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d stat buckets not flushed: %s", len(fe), strings.Join(msgs, "; "))
+}
+
+// BatchErrors is returned by flushers which send their data in batches, such
+// as Librato's, when more than one batch failed, with an error for each.
+// Unlike FlushErrors it's a failed flush: the period isn't marked flushed,
+// so it's flushed again.
+type BatchErrors []error
+
+func (be BatchErrors) Error() string {
+	msgs := make([]string, len(be))
+	for i, err := range be {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d batches not flushed: %s", len(be), strings.Join(msgs, "; "))
+}
+
 type StatConfig struct {
-	Name     string    `datastore:",noindex" json:"name"`
-	Source   string    `datastore:",noindex" json:"source"`
-	Type     string    `datastore:",noindex" json:"type"`
-	LastRead time.Time `json:"lastread"`
+	// Name is indexed so SnapshotMetric can query for it; configs stored
+	// before it was are indexed when next stored, within a day
+	Name       string    `json:"name"`
+	Source     string    `datastore:",noindex" json:"source"`
+	Service    string    `datastore:",noindex" json:"service,omitempty"`
+	Type       string    `datastore:",noindex" json:"type"`
+	LastRead   time.Time `json:"lastread"`
+	SampleRate float64   `datastore:",noindex" json:"samplerate,omitempty"`
+	// ApdexThreshold, if set on a timing, makes flushes compute its Apdex
+	// score (see SetApdexThreshold)
+	ApdexThreshold float64 `datastore:",noindex" json:"apdexthreshold,omitempty"`
+	// Shards, if more than one on a counter, spreads its increments over
+	// that many memcache keys (see SetCounterShards)
+	Shards int `datastore:",noindex" json:"shards,omitempty"`
+	// Version is the module and version which recorded the stat with
+	// StatOptions.VersionSource set; it's appended to Source when flushed
+	Version string `datastore:",noindex" json:"version,omitempty"`
 }
 
 func (sc StatConfig) String() string {
@@ -71,8 +198,55 @@ func (sc StatConfig) String() string {
 		sc.Name, sc.Source, sc.Type, sc.LastRead)
 }
 
+// defaultSampleRate returns the sample rate used when recording with
+// ConfiguredSampleRate; metrics without a stored rate aren't sampled.
+func (sc StatConfig) defaultSampleRate() float64 {
+	if sc.SampleRate <= 0 {
+		return 1.0
+	}
+	return sc.SampleRate
+}
+
 func (sc StatConfig) BucketKey(t time.Time, offset int) string {
-	return fmt.Sprintf("ss-metric:%s-%s-%s-%d", sc.Type, sc.Name, sc.Source, getStartOfFlushPeriod(t, offset).Unix())
+	if sc.Service != "" {
+		return fmt.Sprintf("ss-metric:%s/%s-%s-%s-%d", sc.Service, sc.Type, sc.Name, sc.versionedSource(), getStartOfFlushPeriod(t, offset).Unix())
+	}
+	return fmt.Sprintf("ss-metric:%s-%s-%s-%d", sc.Type, sc.Name, sc.versionedSource(), getStartOfFlushPeriod(t, offset).Unix())
+}
+
+// versionedSource returns the stat's source with its Version appended, e.g.
+// "api:default.20240101t120000", as it's flushed. Stats recorded by different
+// versions are kept apart by using it in their keys.
+func (sc StatConfig) versionedSource() string {
+	return versionedSource(sc.Source, sc.Version)
+}
+
+func versionedSource(source, version string) string {
+	if version == "" {
+		return source
+	} else if !hasSource(source) {
+		return version
+	}
+	return source + ":" + version
+}
+
+// serviceName returns the stat's name prefixed with its service, if it has
+// one, for backends which have no tags to send the service as.
+func (sc StatConfig) serviceName() string {
+	if sc.Service != "" {
+		return sc.Service + "." + sc.Name
+	}
+	return sc.Name
+}
+
+// shardKeys returns the memcache keys a counter's bucket is spread over; the
+// first is the bucket key itself.
+func (sc StatConfig) shardKeys(bucketKey string) []string {
+	keys := []string{bucketKey}
+	for shard := 1; shard < sc.Shards; shard++ {
+		keys = append(keys, fmt.Sprintf("%s-shard%d", bucketKey, shard))
+	}
+	return keys
 }
 
 // StatInterface defines the interface for the application to
@@ -82,6 +256,12 @@ type StatInterface interface {
 	RecordGauge(name, source string, value float64) error
 	RecordTiming(name, source string, value, sampleRate float64) error
 	UpdateBackend(periodStart time.Time, flusher StatsFlusher, cfg *FlusherConfig, force bool) error
+	// UpdateBackendWithReport flushes like UpdateBackend, and reports the
+	// outcome, including whether the period had no data to flush.
+	UpdateBackendWithReport(periodStart time.Time, flusher StatsFlusher, cfg *FlusherConfig, force bool) (FlushReport, error)
+	// Close stores anything buffered in memory. It should be called when the
+	// instance shuts down.
+	Close() error
 }
 
 func NewNullStatImplementation() StatInterface {
@@ -102,23 +282,387 @@ func (m NullStatImplementation) RecordTiming(name, source string, value, sampleR
 func (m NullStatImplementation) UpdateBackend(periodStart time.Time, flusher StatsFlusher, cfg *FlusherConfig, force bool) error {
 	return nil
 }
+func (m NullStatImplementation) UpdateBackendWithReport(periodStart time.Time, flusher StatsFlusher, cfg *FlusherConfig, force bool) (FlushReport, error) {
+	return FlushReport{Period: periodStart, Empty: true}, nil
+}
+func (m NullStatImplementation) Close() error { return nil }
+
+// StatOptions controls optional behaviors of a StatImplementation. The zero
+// value gives the default behavior.
+type StatOptions struct {
+	// DegradeOnDatastoreError makes recording keep working when datastore is
+	// unavailable. An ephemeral StatConfig is used so values still land in
+	// memcache, but the config won't be discoverable for flushing until
+	// datastore recovers and the config is stored.
+	DegradeOnDatastoreError bool
+
+	// ResetFutureWatermark makes UpdateBackend discard a last-flushed
+	// watermark which is far in the future relative to the period being
+	// flushed, instead of refusing to flush until that time passes.
+	ResetFutureWatermark bool
+
+	// ZeroFill makes UpdateBackend emit a zero value for active counters and
+	// gauges which had nothing recorded in the period being flushed, so
+	// graphs show zero rather than a gap. Timings are never zero filled.
+	ZeroFill bool
+
+	// Clock, if set, is used instead of time.Now to decide which period
+	// values are recorded into.
+	Clock func() time.Time
+
+	// MaxSourcesPerMetric caps the number of distinct sources registered for
+	// each metric type/name. Once a metric has this many sources, values for
+	// new sources are recorded under OverflowSource instead of registering
+	// more configs. The source count is kept in memcache, so the cap is
+	// approximate. Zero means unlimited.
+	MaxSourcesPerMetric int
+
+	// ConfigWriteBehind, if set, buffers StatConfig writes in memory instead
+	// of storing each one as it's first touched. Buffered configs are stored
+	// together with one datastore PutMulti once the oldest has waited this
+	// long (by a timer, so an idle instance still stores them), or when
+	// UpdateBackend, FlushConfigs or Close is called. Until then their
+	// values aren't flushed, so instances using it must call Close before
+	// they exit.
+	ConfigWriteBehind time.Duration
+
+	// CounterAccumulation, if set, sums counter increments in memory instead
+	// of incrementing the memcache bucket every time. The sums are written
+	// to memcache once the oldest has waited this long (by a timer, so an
+	// idle instance still writes them), or when UpdateBackend, FlushCounters
+	// or Close is called. It should be well under the aggregation period, so
+	// the sums are written before their period is flushed; sums written to
+	// periods which were already flushed are logged, since they won't reach
+	// the backend. Instances using it must call Close before they exit.
+	CounterAccumulation time.Duration
+
+	// OnDrop, if set, is called with an *ErrStatDropped whenever a value
+	// can't be stored, and the recording method returns nil instead of the
+	// error. This lets drops be counted or logged in one place rather than
+	// at every call site.
+	OnDrop func(error)
+
+	// OnFlush, if set, is called after UpdateBackend successfully flushes
+	// data for a period, with the flusher used. See NewDeployEventHook.
+	OnFlush func(periodStart time.Time, flusher StatsFlusher, data []interface{})
+
+	// SkipUnchangedGauges makes UpdateBackend leave out gauges whose value
+	// hasn't changed since they were last flushed, re-emitting them only once
+	// GaugeKeepalive has passed. Last flushed values are kept in memcache, so
+	// an evicted gauge is simply flushed again.
+	SkipUnchangedGauges bool
+
+	// GaugeKeepalive is the longest an unchanged gauge goes without being
+	// flushed when SkipUnchangedGauges is set. Zero means one hour.
+	GaugeKeepalive time.Duration
+
+	// RejectTypeMismatch makes recording a name/source already registered as
+	// another stat type (e.g. a gauge recorded under a counter's name) fail
+	// with ErrStatTypeMismatch. Without it, the mismatch is only logged as a
+	// warning and both stats are kept.
+	RejectTypeMismatch bool
+
+	// MaxNameLength and MaxSourceLength limit the length of stat names and
+	// sources, since backends such as Librato reject long metric names. Zero
+	// means unlimited. Longer names and sources are rejected with
+	// ErrStatNameTooLong unless TruncateLongNames is set.
+	MaxNameLength   int
+	MaxSourceLength int
+
+	// TruncateLongNames makes names and sources over the limits above be
+	// truncated instead of rejected. The end of the truncated value is
+	// replaced by a hash of the whole value, so distinct long names stay
+	// distinct.
+	TruncateLongNames bool
+
+	// DatastoreRetries is how many times datastore calls made while
+	// recording, flushing and purging are retried after a retryable error
+	// (see RetryableDatastoreError). Zero means they aren't retried.
+	DatastoreRetries int
+
+	// DatastoreBackoff is how long to wait before the first retry of a
+	// datastore call; the wait doubles with each retry. Zero means 100ms.
+	DatastoreBackoff time.Duration
+
+	// RetryableDatastoreError decides which datastore errors are retried.
+	// If it's nil, aborted, unavailable and deadline exceeded errors are.
+	RetryableDatastoreError func(error) bool
+
+	// AggregationBatchSize is how many stats' buckets UpdateBackend fetches
+	// from memcache and aggregates at once. Only one batch of raw values
+	// (e.g. every value recorded for a timing) is held in memory at a time.
+	// Zero means 500.
+	AggregationBatchSize int
+
+	// SelfMetrics makes every flush include gauges about statstash itself: a
+	// statstash.flush.heartbeat of 1, so a missing heartbeat shows flushing
+	// has stopped; statstash.flush.duration, the seconds spent gathering the
+	// data before flushing it; and statstash.flush.metrics, the number of
+	// other stats flushed. Flushes are made even when nothing was recorded.
+	// Flushes through an InstrumentedStatsFlusher also record, with the
+	// flusher's name as the source, the statstash.flush.backend_latency
+	// timing, the milliseconds its requests took, and the
+	// statstash.flush.bytes gauge, the size of their bodies; these are sent
+	// with the next flush. Periodic flushes skipped because the period was
+	// already flushed are counted in statstash.flush.skipped.
+	SelfMetrics bool
+
+	// VersionSource keeps values recorded by each App Engine module and
+	// version apart, and appends the module and version to their source
+	// when they're flushed, so behavior can be compared across versions;
+	// e.g. source "api" is flushed as "api:default.20240101t120000". Module
+	// and Version are taken from the GAE_SERVICE and GAE_VERSION environment
+	// variables unless they're set. Every deployed version gets its own
+	// configs and buckets, so this multiplies the number of sources by the
+	// number of versions serving at once (and MaxSourcesPerMetric counts
+	// each version's sources). MaxSourceLength applies to the source as
+	// recorded, without the version.
+	VersionSource bool
+	Module        string
+	Version       string
+
+	// NewConfigRate limits how many new StatConfigs each instance creates
+	// per second, so a burst of new sources can't flood datastore. Values
+	// for sources over the limit are recorded under OverflowSource, and the
+	// source is registered once the limit allows. Zero means unlimited.
+	NewConfigRate float64
+
+	// NewConfigBurst is how many new StatConfigs can be created at once
+	// before NewConfigRate applies. Zero means the rate rounded up, or 1.
+	NewConfigBurst int
+
+	// MaxCatchupAge bounds how long ago a period can have ended for CatchUp
+	// to flush it. Older periods' buckets have expired from memcache, so
+	// flushing them would only record gaps (or zeros) as history. Zero means
+	// the shortest memcache bucket lifetime.
+	MaxCatchupAge time.Duration
+
+	// DeadLetter makes UpdateBackend store the data of a period whose flush
+	// failed in datastore, so it can be flushed again with ReplayDeadLetter
+	// rather than being lost. There's one dead letter per period, flusher
+	// and service, replaced by later failed flushes and deleted once the
+	// period is flushed through the flusher.
+	DeadLetter bool
+
+	// EvictionSampleRate is the fraction of bucket writes whose key is
+	// checked for again by CheckEvictions (which UpdateBackend and Close
+	// call). Keys which have vanished before they were due to expire were
+	// most likely evicted, losing values, and are counted by the
+	// statstash.eviction_suspected counter. Zero disables the checks. Keys
+	// are sampled in memory by the instance which wrote them, so on
+	// instances which record but don't flush they're only checked when the
+	// instance is closed, or calls CheckEvictions itself.
+	EvictionSampleRate float64
+
+	// MinFlushInterval is how long after the last flushed period an
+	// unforced UpdateBackend can flush, so flushes can be less frequent
+	// than the aggregation period to batch backend writes. When it's set,
+	// an unforced UpdateBackend flushes every period since the last flushed
+	// one together (within MaxCatchupAge, like CatchUp), so the periods in
+	// between aren't lost. Zero means the aggregation period.
+	MinFlushInterval time.Duration
+
+	// RandSeed seeds the random numbers deciding which sampled values are
+	// recorded, so tests can reproduce the decisions. Zero means a seed
+	// taken from the current time. See also ResetRandSeed.
+	RandSeed int64
+
+	// CounterExpiration is how long counter buckets are kept in memcache,
+	// and BucketExpiration how long gauge and timing buckets are, e.g. so
+	// SnapshotRange can read back more periods. They're never less than two
+	// aggregation periods (the default), nor too short for CatchUp to flush
+	// a bucket MaxCatchupAge after its period ended.
+	CounterExpiration time.Duration
+	BucketExpiration  time.Duration
+
+	// TimingResolution, if set, makes timing values be stored rounded to a
+	// multiple of it (e.g. 1 for whole milliseconds) in a compact varint
+	// encoding rather than gob, shrinking memcache buckets so more values
+	// fit under memcache's item size limit. Buckets in either encoding are
+	// read, so it can be changed while instances are being rolled out.
+	TimingResolution float64
+
+	// Service names the service recording stats, as a dimension separate
+	// from their source, so dashboards can group by service. It's stored on
+	// the StatConfigs this instance creates, which (with their buckets) are
+	// kept apart from other services' for the same name and source, and is
+	// sent as a "service" tag or label by flushers which support them, or
+	// prefixed to the name ("service.name") by the others.
+	Service string
+
+	// AppID is the ID of the app, which the PurgeTokens given to Purge and
+	// ClearBuckets must be made with. It's taken from the
+	// GOOGLE_CLOUD_PROJECT environment variable unless it's set. Purge and
+	// ClearBuckets refuse to run when neither is set.
+	AppID string
+
+	// TopSources, if set, keeps only the (approximately) TopSources most
+	// frequently recorded sources of each metric distinct, and records the
+	// values of all its other sources under OtherSource, bounding the
+	// cardinality of metrics with a long tail of rare sources. Frequencies
+	// are estimated per instance from the values it has recorded, so
+	// instances may briefly disagree on the top sources, and a source
+	// displaced from them keeps the values it was recorded with.
+	TopSources int
+
+	// ConfigKeyShards, if set, prefixes the datastore key of each StatConfig
+	// with a shard number (0 to ConfigKeyShards-1) hashed from its
+	// type/name/source, spreading config writes over the key space rather
+	// than concentrating them in the hot key ranges of common name
+	// prefixes. A stat always hashes to the same shard, and configs are
+	// queried by kind and LastRead, so sharded configs are found like any
+	// others. Changing it registers configs again under their new keys; the
+	// configs under the old keys stop being active after two days.
+	ConfigKeyShards int
+
+	// TimingGroup, if set, makes UpdateBackend emit an extra timing for each
+	// group of timings it returns the same non-empty name for, e.g. an "all
+	// endpoints" latency merging every endpoint's. The group's timing has
+	// that name and no source, and merges the count, min, max, sums and
+	// variance of its timings. Its median and percentiles are computed from
+	// the values recorded for all its timings, so values only recorded as
+	// summaries (see RecordTimingSummary) don't count towards them. It has no
+	// Apdex, since its timings may have different thresholds.
+	TimingGroup func(StatConfig) string
+
+	// RejectNegativeTimings makes negative timing values, which are usually
+	// a bug in how they're measured, be dropped with ErrStatNegativeTiming.
+	// Without it, they're recorded with a warning.
+	RejectNegativeTimings bool
+
+	// QuarantineAfter, if set, makes a memcache bucket which fails to decode
+	// this many times be deleted, with a warning, rather than logging an
+	// error on every flush until it expires. Only its first failure is
+	// logged as an error. Failures are counted per instance, and a bucket
+	// which decodes successfully starts counting again.
+	QuarantineAfter int
+}
 
 func NewStatInterface(log appwrap.Logging, ds appwrap.Datastore, cache appwrap.Memcache, debug bool) StatInterface {
-	return StatImplementation{
-		log:     log,
-		ds:      ds,
-		cache:   cache,
-		randGen: rand.New(rand.NewSource(time.Now().UnixNano())),
-		debug:   debug,
+	return NewStatInterfaceWithOptions(log, ds, cache, debug, StatOptions{})
+}
+
+func NewStatInterfaceWithOptions(log appwrap.Logging, ds appwrap.Datastore, cache appwrap.Memcache, debug bool, opts StatOptions) StatInterface {
+	ssi := StatImplementation{
+		log:      log,
+		ds:       ds,
+		cache:    cache,
+		rng:      newSampleRand(opts.RandSeed),
+		debug:    new(int32),
+		opts:     opts,
+		configs:  &configBuffer{pending: make(map[string]pendingConfig)},
+		counters: &counterBuffer{pending: make(map[pendingCounterKey]int64)},
+		limiter:  &configLimiter{},
+		ratios:   &ratioRegistry{},
+		written:  &writeSampler{keys: make(map[string]time.Time)},
+		sources:  &sourceRanker{},
+		failures: &decodeFailures{},
 	}
+	ssi.SetDebug(debug)
+	return ssi
 }
 
 type StatImplementation struct {
-	log     appwrap.Logging
-	ds      appwrap.Datastore
-	cache   appwrap.Memcache
-	randGen *rand.Rand
-	debug   bool
+	log      appwrap.Logging
+	ds       appwrap.Datastore
+	cache    appwrap.Memcache
+	rng      *sampleRand
+	debug    *int32 // read and written atomically; see SetDebug
+	opts     StatOptions
+	configs  *configBuffer
+	counters *counterBuffer
+	limiter  *configLimiter
+	ratios   *ratioRegistry
+	written  *writeSampler
+	sources  *sourceRanker
+	failures *decodeFailures
+}
+
+// configBuffer holds the StatConfigs waiting to be stored when
+// StatOptions.ConfigWriteBehind is set.
+type configBuffer struct {
+	mtx     sync.Mutex
+	pending map[string]pendingConfig
+	since   time.Time
+	timer   *time.Timer // stores the configs once the oldest is due
+}
+
+// counterBuffer holds the counter increments accumulated in memory when
+// StatOptions.CounterAccumulation is set.
+type counterBuffer struct {
+	mtx     sync.Mutex
+	pending map[pendingCounterKey]int64
+	since   time.Time
+	timer   *time.Timer // writes the sums once the oldest is due
+}
+
+// configLimiter is the token bucket limiting new StatConfigs when
+// StatOptions.NewConfigRate is set.
+type configLimiter struct {
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// sampleRand is the random number generator deciding which sampled values
+// are recorded. rand.Rand isn't safe for concurrent use, so it's locked.
+type sampleRand struct {
+	mtx  sync.Mutex
+	rand *rand.Rand
+	seed int64
+}
+
+func newSampleRand(seed int64) *sampleRand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &sampleRand{rand: rand.New(rand.NewSource(seed)), seed: seed}
+}
+
+func (r *sampleRand) Float64() float64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.rand.Float64()
+}
+
+// ratioRegistry holds the ratios registered with DeriveRatio, and the gauges
+// registered with RegisterDerivedGauge.
+type ratioRegistry struct {
+	mtx    sync.Mutex
+	ratios []derivedRatio
+	gauges []derivedGauge
+}
+
+// writeSampler holds the bucket keys sampled for eviction checks when
+// StatOptions.EvictionSampleRate is set, with the time each is due to expire
+// by at the earliest.
+type writeSampler struct {
+	mtx  sync.Mutex
+	keys map[string]time.Time
+}
+
+type derivedRatio struct {
+	name        string
+	numerator   string
+	denominator string
+	source      string
+}
+
+type derivedGauge struct {
+	name   string
+	source string
+	fn     func(snapshot map[string]interface{}) (float64, bool)
+}
+
+type pendingCounterKey struct {
+	name   string
+	source string
+	period int64
+}
+
+type pendingConfig struct {
+	key *appwrap.DatastoreKey
+	sc  StatConfig
 }
 
 func (s StatImplementation) IncrementCounter(name, source string) error {
@@ -126,246 +670,2399 @@ func (s StatImplementation) IncrementCounter(name, source string) error {
 }
 
 func (s StatImplementation) IncrementCounterBy(name, source string, delta int64) error {
+	return s.incrementCounterAt(name, source, delta, s.now())
+}
+
+// IncrementCounterSampled adds delta to a counter which is only incremented
+// for a sampleRate fraction of events, so the flushed count is scaled up to
+// estimate the total; values which aren't sampled return ErrStatNotSampled.
+// Sampled increments are merged into a payload carrying their value and
+// sample rate with compare-and-swap, so they're slower than IncrementCounter,
+// which a sampleRate of 1 falls back to.
+func (s StatImplementation) IncrementCounterSampled(name, source string, delta int64, sampleRate float64) error {
+	if sampleRate <= 0 || sampleRate > 1 {
+		return ErrInvalidSampleRate
+	} else if sampleRate == 1 {
+		return s.incrementCounterAt(name, source, delta, s.now())
+	}
+
+	if s.rng.Float64() > sampleRate {
+		s.debugf("Not recording value due to sampling rate")
+		return ErrStatNotSampled
+	}
+	return s.handleDrop(s.addSampledCounter(name, source, sampledCounter{delta, sampleRate}, s.now()))
+}
+
+// addSampledCounter merges a sampled contribution into the counter's sampled
+// payload for the period containing at.
+func (s StatImplementation) addSampledCounter(name, source string, contribution sampledCounter, at time.Time) error {
+
+	source = s.rollupSource(scTypeCounter, name, source)
+	s.debugf("Increment sampled counter/%s/%s: delta=%d, samplerate=%f", name, source, contribution.Value, contribution.SampleRate)
+
+	statConfig, err := s.getStatConfig(scTypeCounter, name, source)
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeCounter, name, source, at, float64(contribution.Value), err)
+		s.log.Warningf("%s (getting bucket key)", wrappedErr)
+		return wrappedErr
+	}
+
+	key := counterSampledKey(statConfig.BucketKey(at, 0))
+	err = s.casUpdate(key, s.bucketExpiration(scTypeCounter), func(item *appwrap.CacheItem, found bool) error {
+		merged := contribution
+		if found {
+			stored, err := decodeSampledCounter(item.Value)
+			if err != nil {
+				return err
+			}
+			merged = stored.merge(contribution)
+		}
+		item.Value = merged.encode()
+		return nil
+	})
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeCounter, name, source, at, float64(contribution.Value), err)
+		s.log.Warningf("%s (storing sampled counter)", wrappedErr)
+		return wrappedErr
+	}
+	return nil
+}
+
+// IncrementCounterAt adds delta to the counter for the period containing at,
+// e.g. when importing or replaying past events. It returns
+// ErrStatTimeOutOfRange if that period's bucket has expired or is in the
+// future; values recorded for a period which has already been flushed are
+// only sent by a forced flush of it.
+func (s StatImplementation) IncrementCounterAt(name, source string, delta int64, at time.Time) error {
+	if err := s.checkRecordTime(scTypeCounter, name, source, at); err != nil {
+		return err
+	}
+	return s.incrementCounterAt(name, source, delta, at)
+}
+
+func (s StatImplementation) incrementCounterAt(name, source string, delta int64, at time.Time) error {
+	return s.incrementRolledUpCounter(s.getStatConfig, name, s.rollupSource(scTypeCounter, name, source), delta, at)
+}
+
+// incrementRolledUpCounter adds delta to the counter for the period
+// containing at, once its source has been rolled up, looking its config up
+// with getConfig.
+func (s StatImplementation) incrementRolledUpCounter(getConfig statConfigGetter, name, source string, delta int64, at time.Time) error {
 	s.debugf("Increment counter/%s/%s: delta=%d", name, source, delta)
-	bucketKey, err := s.getBucketKey(scTypeCounter, name, source, time.Now())
+
+	if s.opts.CounterAccumulation > 0 {
+		s.accumulateCounter(name, source, at, delta)
+		return nil
+	}
+
+	if err := s.incrementCounterBucket(getConfig, name, source, at, delta); err != nil {
+		if s.opts.OnDrop != nil {
+			s.opts.OnDrop(NewErrStatDropped(scTypeCounter, name, source, at, float64(delta), err))
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// incrementCounterBucket adds delta to the counter's bucket for the period
+// containing at, looking its config up with getConfig.
+func (s StatImplementation) incrementCounterBucket(getConfig statConfigGetter, name, source string, at time.Time, delta int64) error {
+	statConfig, err := getConfig(scTypeCounter, name, source)
 	if err != nil {
 		return err
 	}
+	bucketKey := statConfig.BucketKey(at, 0)
+	if statConfig.Shards > 1 {
+		if delta < 0 {
+			// A decrement of one shard would be clamped at zero even when
+			// the other shards add up to more than it
+			s.log.Warningf("Dropping decrement of sharded counter %s/%s by %d", name, source, -delta)
+			return ErrShardedCounterDecrement
+		}
+		shardKeys := statConfig.shardKeys(bucketKey)
+		bucketKey = shardKeys[rand.Intn(len(shardKeys))]
+	}
 	s.log.Debugf("record bucketKey: %s", bucketKey)
 
-	if _, err = s.cache.IncrementExisting(bucketKey, delta); err == appwrap.ErrCacheMiss {
+	var value uint64
+	if value, err = s.cache.IncrementExisting(bucketKey, delta); err == appwrap.ErrCacheMiss {
+		// First increment of the period; create the bucket with the delta,
+		// clamped to zero like memcache clamps decrements
+		initial := delta
+		if initial < 0 {
+			initial = 0
+		}
 		cachedItem := &appwrap.CacheItem{
-			Value:      []byte(strconv.FormatInt(delta, 10)),
+			Value:      []byte(strconv.FormatInt(initial, 10)),
 			Key:        bucketKey,
-			Expiration: time.Duration(2 * defaultAggregationPeriod),
+			Expiration: s.bucketExpiration(scTypeCounter),
+		}
+		if err = s.cache.Add(cachedItem); err == appwrap.ErrNotStored {
+			// Someone else created the bucket first, so increment theirs
+			value, err = s.cache.IncrementExisting(bucketKey, delta)
+		} else if err == nil {
+			value = uint64(initial)
+		}
+	}
+
+	if err != nil {
+		s.log.Warningf("Failed to increment %s delta %d: %s", bucketKey, delta, err)
+	} else {
+		s.sampleWrite(bucketKey, at)
+		if delta < 0 && value == 0 {
+			s.markCounterClamped(statConfig, statConfig.BucketKey(at, 0), delta)
 		}
-		err = s.cache.Add(cachedItem)
-	} else if err != nil {
-		s.log.Warningf("Failed to increment %s delta %d", bucketKey, delta)
 	}
 
 	return err
 }
 
-func (s StatImplementation) RecordGauge(name, source string, value float64) error {
-	return s.recordGaugeOrTiming(scTypeGauge, name, source, value, 1.0)
+// markCounterClamped flags the counter's period as clamped after a
+// decrement left its bucket at zero. Memcache counters are unsigned, and
+// decrementing one stops at zero without saying so, so the counter may
+// have lost some of the decrement. A decrement to exactly zero can't be
+// told apart, so it's flagged too.
+func (s StatImplementation) markCounterClamped(statConfig StatConfig, bucketKey string, delta int64) {
+	s.log.Warningf("Counter %s/%s decremented by %d reached zero, and may have been clamped; counters can't go negative", statConfig.Name, statConfig.Source, -delta)
+	err := s.cache.Set(&appwrap.CacheItem{
+		Key:        counterClampedKey(bucketKey),
+		Value:      []byte("1"),
+		Expiration: s.bucketExpiration(scTypeCounter),
+	})
+	if err != nil {
+		s.log.Warningf("Failed to flag %s as clamped: %s", bucketKey, err)
+	}
 }
 
-func (s StatImplementation) RecordTiming(name, source string, value, sampleRate float64) error {
-	return s.recordGaugeOrTiming(scTypeTiming, name, source, value, sampleRate)
+// counterClampedKey returns the memcache key flagging that a decrement of
+// the counter with the bucket key may have been clamped at zero.
+func counterClampedKey(bucketKey string) string {
+	return bucketKey + "-clamped"
 }
 
-func (s StatImplementation) UpdateBackend(periodStart time.Time, flusher StatsFlusher, flushConfig *FlusherConfig, force bool) error {
+// accumulateCounter adds delta to the in-memory total for the counter's
+// period containing at, writing the totals to memcache once the oldest has
+// waited StatOptions.CounterAccumulation.
+func (s StatImplementation) accumulateCounter(name, source string, at time.Time, delta int64) {
+	now := s.now()
+	period := getStartOfFlushPeriod(at, 0)
+	key := pendingCounterKey{name, source, period.Unix()}
 
-	if !force {
-		lastFlushedPeriod := s.getLastPeriodFlushed()
-		if periodStart.Sub(lastFlushedPeriod) < defaultAggregationPeriod {
-			s.log.Warningf("Refusing to update backend since it's too soon (last flush period %s, current period requested %s, aggregation period %s)", lastFlushedPeriod, periodStart, defaultAggregationPeriod)
-			return ErrStatFlushTooSoon
+	s.counters.mtx.Lock()
+	if len(s.counters.pending) == 0 {
+		s.counters.since = now
+		if s.counters.timer == nil {
+			s.counters.timer = time.AfterFunc(s.opts.CounterAccumulation, func() {
+				s.FlushCounters()
+			})
 		}
 	}
+	s.counters.pending[key] += delta
+	due := now.Sub(s.counters.since) >= s.opts.CounterAccumulation
+	s.counters.mtx.Unlock()
 
-	cfgMap, err := s.getActiveConfigs(periodStart, 0)
-	if err != nil {
-		s.log.Errorf("Failed to get active buckets when updating backend: %s", err)
-		return err
+	if due {
+		s.FlushCounters()
 	}
+}
 
-	if len(cfgMap) == 0 {
-		return nil // nothing to do
-	}
+// FlushCounters writes the counter increments accumulated in memory because
+// of StatOptions.CounterAccumulation to memcache. Increments which can't be
+// written are passed to StatOptions.OnDrop, if it's set, and dropped.
+// Increments written to periods which were already flushed are logged, since
+// they're only sent if the period is force flushed again.
+func (s StatImplementation) FlushCounters() error {
 
-	bucketKeys := make([]string, 0, len(cfgMap))
-	for k := range cfgMap {
-		bucketKeys = append(bucketKeys, k)
+	s.counters.mtx.Lock()
+	if s.counters.timer != nil {
+		s.counters.timer.Stop()
+		s.counters.timer = nil
 	}
+	pending := s.counters.pending
+	if len(pending) == 0 {
+		s.counters.mtx.Unlock()
+		return nil
+	}
+	s.counters.pending = make(map[pendingCounterKey]int64)
+	s.counters.mtx.Unlock()
 
-	if itemMap, err := s.cache.GetMulti(bucketKeys); err != nil {
-		s.log.Errorf("Failed to fetch items from memcache when updating backend: %s", err)
-	} else {
-		// Get our data from memcache in one go
-		data := make([]interface{}, 0, len(itemMap))
-		for k, item := range itemMap {
-			var datum interface{}
-			cfgItem := cfgMap[k]
-			switch cfgItem.Type {
-			case scTypeTiming, scTypeGauge:
-				var gm []float64
-				if err := s.gobUnmarshal(item.Value, &gm); err != nil {
-					s.log.Errorf("Bad data found in memcache: key %s, error: %s", k, err)
-					continue
-				}
-				if len(gm) == 0 {
-					panic("Something went terribly wrong; empty list cached!")
-				}
-				if cfgItem.Type == scTypeTiming {
-					var median, sum, sumSquares float64
-					// sort our list
-					sort.Float64s(gm)
-					count := len(gm)
-					min := gm[0]
-					max := gm[count-1]
-					if count == 1 {
-						median = gm[0]
-					} else if count%2 == 0 {
-						median = (gm[(count/2)-1] + gm[count/2]) / 2.0
-					} else {
-						median = gm[(count / 2)]
-					}
-
-					const ninthDecile = 0.9
-					const threeNinesPercentile = 0.999
-					ninthdecileCount, ninthdecileValue :=  getPercentileCount(gm, ninthDecile, count)
-					threeNinesCount, threeNinesValue :=  getPercentileCount(gm, threeNinesPercentile, count)
-
-					ninthdecileSum := 0.0
-					threeNinesSum := 0.0
-					for i, m := range gm {
-						if i < ninthdecileCount {
-							ninthdecileSum += m
-						}
-
-						if i < threeNinesCount {
-							threeNinesSum += m
-						}
-
-						sum += m
-						sumSquares += math.Pow(m, 2.0)
-					}
-					datum = StatDataTiming{
-						StatConfig: cfgItem,
-						Count: count,
-						Min: min,
-						Max: max,
-						Sum: sum,
-						SumSquares: sumSquares,
-						Median: median,
-						NinthDecileCount: ninthdecileCount,
-						NinthDecileSum: ninthdecileSum,
-						NinthDecileValue: ninthdecileValue,
-						ThreeNinesCount: threeNinesCount,
-						ThreeNinesSum: threeNinesSum,
-						ThreeNinesValue: threeNinesValue,
-					}
-				} else {
-					datum = StatDataGauge{StatConfig: cfgItem, Value: gm[0]}
-				}
-			case scTypeCounter:
-				count, _ := strconv.ParseUint(string(item.Value), 10, 64)
-				datum = StatDataCounter{StatConfig: cfgItem, Count: count}
-			default:
-				panic("If this happened, things are horribly wrong.")
-			}
-			data = append(data, datum)
+	lastFlushed := s.getLastPeriodFlushed()
+	var finalError error
+	for key, delta := range pending {
+		at := time.Unix(key.period, 0)
+		if !lastFlushed.IsZero() && !at.After(lastFlushed) {
+			s.log.Warningf("Writing accumulated increment %d of counter %s/%s to period %s, which was already flushed; it won't reach the backend unless the period is flushed again", delta, key.name, key.source, at)
 		}
-
-		if len(data) > 0 {
-			// Now flush to the backend
-			if err := flusher.Flush(data, flushConfig); err != nil {
-				s.log.Errorf("Failed to flush to backend: %s", err)
-				return err
+		if err := s.incrementCounterBucket(s.getStatConfig, key.name, key.source, at, delta); err != nil {
+			dropped := NewErrStatDropped(scTypeCounter, key.name, key.source, at, float64(delta), err)
+			if s.opts.OnDrop != nil {
+				s.opts.OnDrop(dropped)
 			} else {
-				s.updateLastPeriodFlushed(periodStart)
+				s.log.Errorf("%s (flushing accumulated counter)", dropped)
+			}
+			if finalError == nil {
+				finalError = dropped
 			}
 		}
 	}
+	return finalError
+}
 
-	return nil
+func (s StatImplementation) RecordGauge(name, source string, value float64) error {
+	return s.handleDrop(s.recordGaugeOrTiming(scTypeGauge, name, source, value, 1.0, 0, s.now()))
+}
 
+// RecordGaugeAt records a gauge value like RecordGauge, but for the period
+// containing at; see IncrementCounterAt.
+func (s StatImplementation) RecordGaugeAt(name, source string, value float64, at time.Time) error {
+	if err := s.checkRecordTime(scTypeGauge, name, source, at); err != nil {
+		return err
+	}
+	return s.handleDrop(s.recordGaugeOrTiming(scTypeGauge, name, source, value, 1.0, 0, at))
 }
 
-func getPercentileCount(gm []float64, percentile float64, count int) (int, float64) {
-	ninthdecileCount := int(math.Ceil(percentile * float64(count)))
-	ninthdecileValue := gm[ninthdecileCount-1]
-	return ninthdecileCount, ninthdecileValue
+// RecordGaugeWithHistory records a gauge value like RecordGauge, but also
+// keeps the values recorded earlier in the period (up to the most recent
+// maxGaugeHistory), so the flushed StatDataGauge carries the period's
+// min/max alongside the last value.
+func (s StatImplementation) RecordGaugeWithHistory(name, source string, value float64) error {
+	return s.handleDrop(s.recordGaugeOrTiming(scTypeGauge, name, source, value, 1.0, maxGaugeHistory, s.now()))
 }
 
-func (s StatImplementation) Purge() error {
+// RecordOperation records one handled operation, such as a request, which
+// began at start: it increments the <name>.count counter, records the
+// milliseconds since start as the <name>.latency timing, and increments the
+// <name>.errors counter if err is non-nil. It's meant to be deferred by
+// handlers and middleware. The first error recording any of them is
+// returned.
+//
+// The stats' configs are looked up with a single memcache call, and then
+// their buckets are written concurrently (memcache can't increment several
+// keys in one call), so it waits on three round trips rather than the five
+// or seven of recording each stat in turn. With
+// StatOptions.CounterAccumulation set, the counters are written to memcache
+// together with other accumulated increments instead.
+func (s StatImplementation) RecordOperation(name, source string, start time.Time, err error) error {
+	now := s.now()
+	latency := float64(now.Sub(start)) / float64(time.Millisecond)
 
-	sc, err := s.getAllConfigs()
+	stats := []statRef{{scTypeTiming, name + ".latency", ""}, {scTypeCounter, name + ".count", ""}}
 	if err != nil {
-		return err
+		stats = append(stats, statRef{scTypeCounter, name + ".errors", ""})
 	}
-	if len(sc) == 0 {
-		return nil // nothing to do
+	for i := range stats {
+		stats[i].source = s.rollupSource(stats[i].typ, stats[i].name, source)
 	}
 
-	now := time.Now()
-	dsKeys := make([]*appwrap.DatastoreKey, 0, len(sc))
-	memcacheKeys := make([]string, 0, len(sc))
-	for _, cfg := range sc {
-		dsKeys = append(dsKeys, s.getStatConfigDatastoreKey(cfg.Type, cfg.Name, cfg.Source))
-		memcacheKeys = append(memcacheKeys, cfg.BucketKey(now, 0))
-		memcacheKeys = append(memcacheKeys, cfg.BucketKey(now, -1))
-
+	prefetch := stats
+	if s.opts.CounterAccumulation > 0 {
+		// Accumulated increments look their configs up when they're written
+		prefetch = stats[:1]
 	}
+	getConfig := s.prefetchStatConfigs(prefetch)
 
-	if err := s.ds.DeleteMulti(dsKeys); err != nil {
-		s.log.Errorf("Stats: purge datastore failed: %s", err)
-		return err
+	errs := make([]error, len(stats))
+	var wg sync.WaitGroup
+	for i := range stats {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stat := stats[i]
+			if stat.typ == scTypeTiming {
+				errs[i] = s.handleDrop(s.storeGaugeOrTiming(getConfig, stat.typ, stat.name, stat.source, latency, 1.0, 0, now))
+			} else {
+				errs[i] = s.incrementRolledUpCounter(getConfig, stat.name, stat.source, 1, now)
+			}
+		}(i)
 	}
+	wg.Wait()
 
-	s.cache.DeleteMulti(memcacheKeys)
+	for _, recordErr := range errs {
+		if recordErr != nil {
+			return recordErr
+		}
+	}
 	return nil
 }
 
-func (s StatImplementation) getAllConfigs() ([]StatConfig, error) {
-	q := s.ds.NewQuery(dsKindStatConfig)
-	var cfgs []StatConfig
-	_, err := q.GetAll(&cfgs)
-	return cfgs, err
-}
+// RecordDeadlineUsage records how much of ctx's deadline an operation which
+// began at start has used, as the gauge name: the time since start over the
+// time start had left before the deadline, so 1 means the whole budget was
+// used and more than 1 that the deadline passed. Nothing is recorded if ctx
+// has no deadline, or it had already passed at start.
+func (s StatImplementation) RecordDeadlineUsage(ctx context.Context, name, source string, start time.Time) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	budget := deadline.Sub(start)
+	if budget <= 0 {
+		s.debugf("Not recording deadline usage %s/%s, which started after its deadline", name, source)
+		return nil
+	}
 
-func (s StatImplementation) getActiveConfigs(at time.Time, offset int) (map[string]StatConfig, error) {
+	return s.RecordGauge(name, source, float64(s.now().Sub(start))/float64(budget))
+}
 
-	statConfigs := make(map[string]StatConfig)
+// AdjustGauge adds delta, which may be negative, to the current level of a
+// gauge, for state tracked as increments and decrements (such as active
+// connections) rather than absolute readings. The level carries over from
+// period to period, and is flushed every period while the gauge is active,
+// even if it wasn't adjusted; it's kept in memcache, so it's lost if
+// memcache evicts it, or if it goes unflushed and unadjusted for a day. A
+// gauge shouldn't be both adjusted and recorded with RecordGauge.
+func (s StatImplementation) AdjustGauge(name, source string, delta float64) error {
+	return s.handleDrop(s.adjustGauge(name, source, delta))
+}
 
-	var finalError error
-	cutoffTime := at.Add(time.Duration(time.Hour * 24 * -2))
+func (s StatImplementation) adjustGauge(name, source string, delta float64) error {
 
-	q := s.ds.NewQuery(dsKindStatConfig).Filter("LastRead >", cutoffTime)
-	iter := q.Run()
-	for {
-		var sc StatConfig
-		_, err := iter.Next(&sc)
-		if err == appwrap.DatastoreDone {
-			break // end of iteration
-		} else if err != nil {
-			s.log.Warningf("Failed iterating stat config items to get active buckets: %s", err)
-			finalError = err
-			break
-		}
-		bucketKey := sc.BucketKey(at, offset)
-		statConfigs[bucketKey] = sc
+	if err := s.checkValue(scTypeGauge, name, source, s.now(), delta); err != nil {
+		return err
 	}
-	s.debugf("Found %d stat configs (cutoff time %s)", len(statConfigs), cutoffTime)
-	return statConfigs, finalError
-}
+	source = s.rollupSource(scTypeGauge, name, source)
+	s.debugf("Adjusting gauge %s/%s: delta=%f", name, source, delta)
 
-func (s StatImplementation) getBucketKey(typ, name, source string, at time.Time) (string, error) {
-	statConfig, err := s.getStatConfig(typ, name, source)
+	now := s.now()
+	statConfig, err := s.getStatConfig(scTypeGauge, name, source)
 	if err != nil {
-		return "", err
+		wrappedErr := NewErrStatDropped(scTypeGauge, name, source, now, delta, err)
+		s.log.Warningf("%s (getting bucket key)", wrappedErr)
+		return wrappedErr
 	}
+	levelKey := s.getGaugeLevelMemcacheKey(statConfig)
 
-	return statConfig.BucketKey(at, 0), nil
-}
+	err = s.casUpdate(levelKey, gaugeLevelExpiration, func(item *appwrap.CacheItem, found bool) error {
+		var level float64
+		if found {
+			if err := s.gobUnmarshal(item.Value, &level); err != nil {
+				return err
+			}
+		}
+		level += delta
+		b, err := s.gobMarshal(&level)
+		item.Value = b
+		item.Expiration = gaugeLevelExpiration
+		return err
+	})
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeGauge, name, source, now, delta, err)
+		s.log.Warningf("%s (storing gauge level)", wrappedErr)
+		return wrappedErr
+	}
 
-func (s StatImplementation) getStatConfigKeyName(typ, name, source string) string {
-	return fmt.Sprintf("%s-%s-%s", typ, name, source)
+	// Copy the level into the period's bucket. The level is read inside the
+	// compare-and-swap, so whichever adjustment writes the bucket last
+	// writes the latest level.
+	err = s.casUpdate(statConfig.BucketKey(now, 0), s.bucketExpiration(scTypeGauge), func(item *appwrap.CacheItem, found bool) error {
+		levelItem, err := s.cache.Get(levelKey)
+		if err != nil {
+			return err
+		}
+		var level float64
+		if err := s.gobUnmarshal(levelItem.Value, &level); err != nil {
+			return err
+		}
+		values := []float64{level}
+		b, err := s.gobMarshal(&values)
+		item.Value = b
+		return err
+	})
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeGauge, name, source, now, delta, err)
+		s.log.Warningf("%s (storing gauge value)", wrappedErr)
+		return wrappedErr
+	}
+	return nil
 }
 
-func (s StatImplementation) getStatConfigMemcacheKey(typ, name, source string) string {
-	return fmt.Sprintf("ss-conf:%s", s.getStatConfigKeyName(typ, name, source))
+// RecordMonotonicGauge records a reading of a gauge which should only
+// increase, such as a cumulative offset. A reading lower than the one before
+// it usually means whatever produced it restarted; it increments the
+// <name>.resets counter, and the gauge keeps the period's highest reading.
+// The last reading is kept in memcache, so resets are missed if memcache
+// evicts it.
+func (s StatImplementation) RecordMonotonicGauge(name, source string, value float64) error {
+	return s.handleDrop(s.recordMonotonicGauge(name, source, value))
 }
 
-func (s StatImplementation) getStatConfigDatastoreKey(typ, name, source string) *appwrap.DatastoreKey {
-	return s.ds.NewKey(dsKindStatConfig, s.getStatConfigKeyName(typ, name, source), 0, nil)
-}
+func (s StatImplementation) recordMonotonicGauge(name, source string, value float64) error {
 
-func (s StatImplementation) getStatConfig(typ, name, source string) (StatConfig, error) {
+	if err := s.checkValue(scTypeGauge, name, source, s.now(), value); err != nil {
+		return err
+	}
+	source = s.rollupSource(scTypeGauge, name, source)
+	s.debugf("Recording monotonic gauge %s/%s: value=%f", name, source, value)
 
-	var sc StatConfig
+	now := s.now()
+	statConfig, err := s.getStatConfig(scTypeGauge, name, source)
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeGauge, name, source, now, value, err)
+		s.log.Warningf("%s (getting bucket key)", wrappedErr)
+		return wrappedErr
+	}
+
+	var reset bool
+	var last float64
+	lastKey := s.getMonotonicGaugeMemcacheKey(statConfig)
+	err = s.casUpdate(lastKey, gaugeLevelExpiration, func(item *appwrap.CacheItem, found bool) error {
+		reset = false
+		if found {
+			if err := s.gobUnmarshal(item.Value, &last); err != nil {
+				return err
+			}
+			reset = value < last
+		}
+		b, err := s.gobMarshal(&value)
+		item.Value = b
+		return err
+	})
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeGauge, name, source, now, value, err)
+		s.log.Warningf("%s (storing last reading)", wrappedErr)
+		return wrappedErr
+	}
+
+	// Keep the highest reading of the period in its bucket
+	err = s.casUpdate(statConfig.BucketKey(now, 0), s.bucketExpiration(scTypeGauge), func(item *appwrap.CacheItem, found bool) error {
+		values := []float64{value}
+		if found {
+			var stored []float64
+			if err := s.decodeSamples(item.Value, &stored); err != nil {
+				return err
+			}
+			if len(stored) > 0 && stored[len(stored)-1] > value {
+				values[0] = stored[len(stored)-1]
+			}
+		}
+		b, err := s.encodeSamples(scTypeGauge, values)
+		item.Value = b
+		return err
+	})
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeGauge, name, source, now, value, err)
+		s.log.Warningf("%s (storing gauge value)", wrappedErr)
+		return wrappedErr
+	}
+
+	if reset {
+		s.log.Infof("Monotonic gauge %s/%s went down from %f to %f; counting a reset", name, source, last, value)
+		return s.IncrementCounter(name+".resets", source)
+	}
+	return nil
+}
+
+func (s StatImplementation) getMonotonicGaugeMemcacheKey(sc StatConfig) string {
+	if sc.Service != "" {
+		return fmt.Sprintf("ss-gaugelast:%s/%s-%s", sc.Service, sc.Name, sc.versionedSource())
+	}
+	return fmt.Sprintf("ss-gaugelast:%s-%s", sc.Name, sc.versionedSource())
+}
+
+func (s StatImplementation) getGaugeLevelMemcacheKey(sc StatConfig) string {
+	if sc.Service != "" {
+		return fmt.Sprintf("ss-gaugelevel:%s/%s-%s", sc.Service, sc.Name, sc.versionedSource())
+	}
+	return fmt.Sprintf("ss-gaugelevel:%s-%s", sc.Name, sc.versionedSource())
+}
+
+// RecordCounterFloat adds delta, which may be negative or fractional, to a
+// counter which accumulates floats, such as a cost in dollars. It's flushed
+// as a StatDataFloatCounter. Float counters are updated with
+// compare-and-swap, so they're slower than IncrementCounter under contention
+// and integer counts should use it instead.
+func (s StatImplementation) RecordCounterFloat(name, source string, delta float64) error {
+	return s.handleDrop(s.recordCounterFloat(name, source, delta))
+}
+
+func (s StatImplementation) recordCounterFloat(name, source string, delta float64) error {
+
+	if err := s.checkValue(scTypeFloatCounter, name, source, s.now(), delta); err != nil {
+		return err
+	}
+	source = s.rollupSource(scTypeFloatCounter, name, source)
+	s.debugf("Recording float counter %s/%s: delta=%f", name, source, delta)
+
+	now := s.now()
+	statConfig, err := s.getStatConfig(scTypeFloatCounter, name, source)
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeFloatCounter, name, source, now, delta, err)
+		s.log.Warningf("%s (getting bucket key)", wrappedErr)
+		return wrappedErr
+	}
+
+	err = s.casUpdate(statConfig.BucketKey(now, 0), s.bucketExpiration(scTypeFloatCounter), func(item *appwrap.CacheItem, found bool) error {
+		var total float64
+		if found {
+			if err := s.gobUnmarshal(item.Value, &total); err != nil {
+				return err
+			}
+		}
+		total += delta
+		b, err := s.gobMarshal(&total)
+		item.Value = b
+		return err
+	})
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeFloatCounter, name, source, now, delta, err)
+		s.log.Warningf("%s (storing value)", wrappedErr)
+		return wrappedErr
+	}
+	return nil
+}
+
+// RecordEvent records a discrete event, such as a deploy or a config change,
+// with a text payload. Events are flushed as StatDataEvents by
+// UpdateBackend, which emits them as annotations through flushers which are
+// StatsEventEmitters and logs them otherwise. Only the most recent 100
+// events of a name/source are kept for each period.
+func (s StatImplementation) RecordEvent(name, source, text string) error {
+	return s.handleDrop(s.recordEvent(name, source, text))
+}
+
+func (s StatImplementation) recordEvent(name, source, text string) error {
+
+	source = s.rollupSource(scTypeEvent, name, source)
+	s.debugf("Recording event %s/%s: %s", name, source, text)
+
+	now := s.now()
+	statConfig, err := s.getStatConfig(scTypeEvent, name, source)
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeEvent, name, source, now, 0, err)
+		s.log.Warningf("%s (getting bucket key)", wrappedErr)
+		return wrappedErr
+	}
+
+	err = s.casUpdate(statConfig.BucketKey(now, 0), s.bucketExpiration(scTypeEvent), func(item *appwrap.CacheItem, found bool) error {
+		var events []statEvent
+		if found {
+			if err := s.gobUnmarshal(item.Value, &events); err != nil {
+				return err
+			}
+		}
+		events = append(events, statEvent{Text: text, Timestamp: now})
+		if len(events) > maxEventsPerPeriod {
+			events = events[len(events)-maxEventsPerPeriod:]
+		}
+		b, err := s.gobMarshal(&events)
+		item.Value = b
+		return err
+	})
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeEvent, name, source, now, 0, err)
+		s.log.Warningf("%s (storing event)", wrappedErr)
+		return wrappedErr
+	}
+	return nil
+}
+
+// statHistogram is the payload histogram values are counted in: the count of
+// values in each bucket of Bounds, as for StatDataHistogram, and their sum.
+type statHistogram struct {
+	Bounds []float64
+	Counts []uint64
+	Sum    float64
+}
+
+// RecordHistogram counts value into the bucket of the histogram name/source
+// it falls in. bounds are the buckets' upper bounds, in increasing order, and
+// must be the same each time the histogram is recorded in a period; values
+// recorded with other bounds are dropped with ErrHistogramBoundsMismatch.
+// Histograms are flushed as StatDataHistograms. Like float counters they're
+// updated with compare-and-swap, so they're slower than timings under
+// contention, but their size doesn't grow with the number of values.
+func (s StatImplementation) RecordHistogram(name, source string, value float64, bounds []float64) error {
+	return s.handleDrop(s.recordHistogram(name, source, value, bounds))
+}
+
+func (s StatImplementation) recordHistogram(name, source string, value float64, bounds []float64) error {
+
+	if len(bounds) == 0 {
+		return ErrInvalidHistogramBounds
+	}
+	for i := 1; i < len(bounds); i++ {
+		if !(bounds[i] > bounds[i-1]) {
+			return ErrInvalidHistogramBounds
+		}
+	}
+	if err := s.checkValue(scTypeHistogram, name, source, s.now(), value); err != nil {
+		return err
+	}
+	source = s.rollupSource(scTypeHistogram, name, source)
+	s.debugf("Recording histogram %s/%s: value=%f", name, source, value)
+
+	now := s.now()
+	statConfig, err := s.getStatConfig(scTypeHistogram, name, source)
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeHistogram, name, source, now, value, err)
+		s.log.Warningf("%s (getting bucket key)", wrappedErr)
+		return wrappedErr
+	}
+
+	err = s.casUpdate(statConfig.BucketKey(now, 0), s.bucketExpiration(scTypeHistogram), func(item *appwrap.CacheItem, found bool) error {
+		histogram := statHistogram{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+		if found {
+			if err := s.gobUnmarshal(item.Value, &histogram); err != nil {
+				return err
+			}
+			if len(histogram.Bounds) != len(bounds) || len(histogram.Counts) != len(bounds)+1 {
+				return ErrHistogramBoundsMismatch
+			}
+			for i := range bounds {
+				if histogram.Bounds[i] != bounds[i] {
+					return ErrHistogramBoundsMismatch
+				}
+			}
+		}
+		histogram.Counts[sort.SearchFloat64s(bounds, value)]++
+		histogram.Sum += value
+		b, err := s.gobMarshal(&histogram)
+		item.Value = b
+		return err
+	})
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeHistogram, name, source, now, value, err)
+		s.log.Warningf("%s (storing value)", wrappedErr)
+		return wrappedErr
+	}
+	return nil
+}
+
+func (s StatImplementation) RecordTiming(name, source string, value, sampleRate float64) error {
+	return s.handleDrop(s.recordGaugeOrTiming(scTypeTiming, name, source, value, sampleRate, 0, s.now()))
+}
+
+// RecordTimingAt records a timing value like RecordTiming, but for the period
+// containing at; see IncrementCounterAt.
+func (s StatImplementation) RecordTimingAt(name, source string, value, sampleRate float64, at time.Time) error {
+	if err := s.checkRecordTime(scTypeTiming, name, source, at); err != nil {
+		return err
+	}
+	return s.handleDrop(s.recordGaugeOrTiming(scTypeTiming, name, source, value, sampleRate, 0, at))
+}
+
+// checkRecordTime returns ErrStatTimeOutOfRange if values of the stat type
+// can't be recorded for the period containing at, because it's in the future
+// or its bucket would already have expired.
+func (s StatImplementation) checkRecordTime(typ, name, source string, at time.Time) error {
+	now := s.now()
+	oldest := getStartOfFlushPeriod(now.Add(-s.bucketExpiration(typ)), 1)
+	if at.Before(oldest) || !at.Before(getStartOfFlushPeriod(now, 1)) {
+		s.log.Warningf("Not recording %s/%s/%s at %s, which is outside the live periods from %s to now", typ, name, source, at, oldest)
+		return ErrStatTimeOutOfRange
+	}
+	return nil
+}
+
+// handleDrop passes dropped stats to StatOptions.OnDrop, if it's set.
+func (s StatImplementation) handleDrop(err error) error {
+	if _, dropped := err.(*ErrStatDropped); dropped && s.opts.OnDrop != nil {
+		s.opts.OnDrop(err)
+		return nil
+	}
+	return err
+}
+
+func (s StatImplementation) UpdateBackend(periodStart time.Time, flusher StatsFlusher, flushConfig *FlusherConfig, force bool) error {
+	return s.updateBackend(periodStart, flusher, flushConfig, force, nil)
+}
+
+// UpdateBackendWithReport is like UpdateBackend, but also returns the outcome
+// of flushing each datum, e.g. for an admin tool forcing a flush. Flushers
+// which are StatsFlushReporters report each datum's outcome; for others,
+// every datum has the outcome of the whole flush. The report has no results
+// when nothing was flushed, and is marked Empty when the period had no data.
+func (s StatImplementation) UpdateBackendWithReport(periodStart time.Time, flusher StatsFlusher, flushConfig *FlusherConfig, force bool) (FlushReport, error) {
+	report := FlushReport{Period: periodStart}
+	err := s.updateBackend(periodStart, flusher, flushConfig, force, &report)
+	return report, err
+}
+
+func (s StatImplementation) updateBackend(periodStart time.Time, flusher StatsFlusher, flushConfig *FlusherConfig, force bool, report *FlushReport) error {
+
+	started := time.Now()
+
+	periods := []time.Time{periodStart}
+	if !force {
+		lastFlushedPeriod := s.getLastPeriodFlushedFor(flushConfig)
+		if skew := lastFlushedPeriod.Sub(periodStart); skew > maxWatermarkSkew {
+			s.log.Errorf("Last flush period %s is %s ahead of the current period requested %s; the watermark was likely written with a skewed clock", lastFlushedPeriod, skew, periodStart)
+			if s.opts.ResetFutureWatermark {
+				s.log.Warningf("Resetting last flush period watermark")
+				lastFlushedPeriod = time.Time{}
+				s.updateLastPeriodFlushedFor(flushConfig, lastFlushedPeriod)
+			}
+		}
+		minInterval := s.opts.MinFlushInterval
+		if minInterval <= 0 {
+			minInterval = defaultAggregationPeriod
+		}
+		if periodStart.Sub(lastFlushedPeriod) < minInterval {
+			s.log.Warningf("Refusing to update backend since it's too soon (last flush period %s, current period requested %s, minimum flush interval %s)", lastFlushedPeriod, periodStart, minInterval)
+			return ErrStatFlushTooSoon
+		}
+		if s.opts.MinFlushInterval > 0 {
+			// Batch the periods skipped since the last flush in with this one
+			periods = s.unflushedPeriods(lastFlushedPeriod, periodStart)
+		}
+	}
+
+	if err := s.CheckEvictions(); err != nil {
+		s.log.Warningf("Failed to check for memcache evictions before updating backend: %s", err)
+	}
+	if err := s.FlushCounters(); err != nil {
+		s.log.Warningf("Failed to write accumulated counters before updating backend: %s", err)
+	}
+	if err := s.FlushConfigs(); err != nil {
+		s.log.Warningf("Failed to store buffered stat configs before updating backend: %s", err)
+	}
+
+	var data []interface{}
+	var aggErrs FlushErrors
+	active, skipped := false, 0
+	for i, period := range periods {
+		cfgMap, err := s.getActiveConfigs(period, 0)
+		if err != nil {
+			s.log.Errorf("Failed to get active buckets when updating backend: %s", err)
+			return err
+		}
+
+		last := i == len(periods)-1
+		if len(cfgMap) == 0 && !(last && s.opts.SelfMetrics) {
+			continue
+		}
+		active = true
+
+		var groups map[string][]weightedValue
+		if s.opts.TimingGroup != nil {
+			groups = make(map[string][]weightedValue)
+		}
+		periodData, periodErrs, err := s.aggregateBuckets(cfgMap, s.opts.ZeroFill, flushConfig.interpolation(), groups)
+		if err != nil {
+			s.log.Errorf("Failed to fetch items from memcache when updating backend: %s", err)
+			return nil
+		}
+		aggErrs = append(aggErrs, periodErrs...)
+		periodData = append(periodData, s.deriveRatios(periodData)...)
+		periodData = append(periodData, s.deriveGauges(periodData)...)
+		periodData = append(periodData, s.groupTimings(periodData, groups, flushConfig.interpolation())...)
+		applyVersions(periodData)
+		sortStatData(periodData)
+		setPeriodStart(periodData, period)
+
+		if s.opts.SkipUnchangedGauges {
+			unskipped := len(periodData)
+			periodData = s.skipUnchangedGauges(periodData, period)
+			skipped += unskipped - len(periodData)
+		}
+
+		if last && s.opts.SelfMetrics {
+			periodData = append(periodData, s.selfMetrics(periodStart, started, len(data)+len(periodData))...)
+			sortStatData(periodData)
+		}
+		data = append(data, periodData...)
+	}
+
+	if !active {
+		if report != nil {
+			report.Empty = true
+		}
+		return nil // nothing to do
+	}
+
+	data = flushConfig.filterTypes(data)
+	var events []StatDataEvent
+	data, events = splitEvents(data)
+
+	if len(data) > 0 {
+		// Now flush to the backend
+		stats, err := s.flush(flusher, data, flushConfig, report)
+		if s.opts.SelfMetrics {
+			s.recordFlusherStats(flusher, stats)
+		}
+		if err != nil {
+			s.log.Errorf("Failed to flush to backend: %s", err)
+			if s.opts.DeadLetter {
+				s.storeDeadLetters(flusher, data)
+			}
+			if flushConfig != nil && flushConfig.AdvanceOnError {
+				s.log.Warningf("Marking period %s flushed despite the failure", periodStart)
+				s.updateLastPeriodFlushedFor(flushConfig, periodStart)
+			}
+			return err
+		} else {
+			s.updateLastPeriodFlushedFor(flushConfig, periodStart)
+			s.emitEvents(flusher, events)
+			if s.opts.DeadLetter {
+				s.deleteDeadLetters(flusher, periods)
+			}
+			if s.opts.SkipUnchangedGauges {
+				s.updateLastFlushedGauges(data, periodStart)
+			}
+			if s.opts.OnFlush != nil {
+				s.opts.OnFlush(periodStart, flusher, data)
+			}
+		}
+	} else if skipped > 0 || len(events) > 0 {
+		s.updateLastPeriodFlushedFor(flushConfig, periodStart)
+		s.emitEvents(flusher, events)
+	} else if report != nil {
+		report.Empty = true
+	}
+
+	if len(aggErrs) > 0 {
+		return aggErrs
+	}
+
+	return nil
+
+}
+
+// splitEvents separates the events in data from the metrics, which are
+// returned in their original order.
+func splitEvents(data []interface{}) ([]interface{}, []StatDataEvent) {
+	var events []StatDataEvent
+	metrics := data[:0]
+	for i := range data {
+		if event, isEvent := data[i].(StatDataEvent); isEvent {
+			events = append(events, event)
+		} else {
+			metrics = append(metrics, data[i])
+		}
+	}
+	return metrics, events
+}
+
+// emitEvents sends each event through flusher as an annotation, with its
+// source as a "source" tag, if it's a StatsEventEmitter, and logs them
+// otherwise. Failures are logged; they don't fail the flush.
+func (s StatImplementation) emitEvents(flusher StatsFlusher, events []StatDataEvent) {
+	emitter, canEmit := flusher.(StatsEventEmitter)
+	for _, event := range events {
+		if !canEmit {
+			s.log.Infof("%s", event)
+			continue
+		}
+		var tags map[string]string
+		if hasSource(event.Source) {
+			tags = map[string]string{"source": event.Source}
+		}
+		if err := emitter.EmitEvent(event.Name, event.Text, tags); err != nil {
+			s.log.Errorf("Failed to emit event %s: %s", event, err)
+		}
+	}
+}
+
+// recordFlusherStats records the statstash.flush.backend_latency and
+// statstash.flush.bytes self-metrics for a flush through flusher, if it's an
+// InstrumentedStatsFlusher and the flush made any requests.
+func (s StatImplementation) recordFlusherStats(flusher StatsFlusher, stats FlushStats) {
+	instrumented, ok := flusher.(InstrumentedStatsFlusher)
+	if !ok || stats.Requests == 0 {
+		return
+	}
+	name := instrumented.FlusherName()
+	latency := float64(stats.Duration) / float64(time.Millisecond)
+	if err := s.RecordTiming(selfMetricBackendLatency, name, latency, 1.0); err != nil {
+		s.log.Warningf("Failed to record flush latency for %s: %s", name, err)
+	}
+	if err := s.RecordGauge(selfMetricBytes, name, float64(stats.Bytes)); err != nil {
+		s.log.Warningf("Failed to record flush size for %s: %s", name, err)
+	}
+}
+
+// flush sends the data to flusher, recording the outcome for each datum in
+// report if it isn't nil. The requests made are described if flusher is an
+// InstrumentedStatsFlusher (and its FlushWithStatus isn't needed instead).
+func (s StatImplementation) flush(flusher StatsFlusher, data []interface{}, flushConfig *FlusherConfig, report *FlushReport) (FlushStats, error) {
+	var stats FlushStats
+	var statuses []error
+	var err error
+	reporter, reporting := flusher.(StatsFlushReporter)
+	instrumented, measured := flusher.(InstrumentedStatsFlusher)
+	if report != nil && reporting {
+		statuses, err = reporter.FlushWithStatus(data, flushConfig)
+	} else if measured {
+		stats, err = instrumented.FlushWithStats(data, flushConfig)
+	} else {
+		err = flusher.Flush(data, flushConfig)
+	}
+	if report == nil {
+		return stats, err
+	}
+
+	report.Results = make([]FlushResult, len(data))
+	for i := range data {
+		report.Results[i] = FlushResult{Datum: data[i], Err: err}
+		if err == nil && i < len(statuses) {
+			report.Results[i].Err = statuses[i]
+		}
+	}
+	return stats, err
+}
+
+// DeriveRatio makes UpdateBackend emit a gauge called name, with the value of
+// the numeratorName counter divided by the denominatorName counter, both for
+// source; e.g. an error rate from errors and requests counters. The ratio is
+// zero when the denominator is zero, and isn't emitted when neither counter
+// was flushed. Ratios are only kept in memory, so they must be registered on
+// the StatImplementation which calls UpdateBackend.
+func (s StatImplementation) DeriveRatio(name, numeratorName, denominatorName, source string) {
+	if s.ratios == nil {
+		return
+	}
+	s.ratios.mtx.Lock()
+	defer s.ratios.mtx.Unlock()
+	s.ratios.ratios = append(s.ratios.ratios, derivedRatio{name, numeratorName, denominatorName, source})
+}
+
+// deriveRatios computes the gauges registered with DeriveRatio from the
+// counters in data.
+func (s StatImplementation) deriveRatios(data []interface{}) []interface{} {
+	if s.ratios == nil {
+		return nil
+	}
+	s.ratios.mtx.Lock()
+	ratios := append([]derivedRatio(nil), s.ratios.ratios...)
+	s.ratios.mtx.Unlock()
+	if len(ratios) == 0 {
+		return nil
+	}
+
+	counters := make(map[[2]string]uint64)
+	for i := range data {
+		if counter, ok := data[i].(StatDataCounter); ok {
+			counters[[2]string{counter.Name, counter.Source}] = counter.Count
+		}
+	}
+
+	var derived []interface{}
+	for _, ratio := range ratios {
+		numerator, numeratorFound := counters[[2]string{ratio.numerator, ratio.source}]
+		denominator, denominatorFound := counters[[2]string{ratio.denominator, ratio.source}]
+		if !numeratorFound && !denominatorFound {
+			continue
+		}
+
+		var value float64
+		if denominator != 0 {
+			value = float64(numerator) / float64(denominator)
+		}
+		derived = append(derived, StatDataGauge{
+			StatConfig: StatConfig{Name: ratio.name, Source: ratio.source, Type: scTypeGauge},
+			Value:      value,
+			Samples:    1,
+			Min:        value,
+			Max:        value,
+		})
+	}
+	return derived
+}
+
+// groupTimings merges the timings in data into a timing for each group
+// StatOptions.TimingGroup puts them in. The group's percentiles are computed
+// with interpolation from the values aggregateBuckets collected in groups.
+func (s StatImplementation) groupTimings(data []interface{}, groups map[string][]weightedValue, interpolation PercentileInterpolation) []interface{} {
+	if s.opts.TimingGroup == nil {
+		return nil
+	}
+
+	var names []string
+	summaries := make(map[string]*timingSummary)
+	estimated := make(map[string]int)
+	for i := range data {
+		timing, ok := data[i].(StatDataTiming)
+		if !ok || timing.Count == 0 {
+			continue
+		}
+		group := s.opts.TimingGroup(timing.StatConfig)
+		if group == "" {
+			continue
+		}
+		if summaries[group] == nil {
+			names = append(names, group)
+			summaries[group] = &timingSummary{}
+		}
+		summaries[group].merge(timingSummary{timing.Count, timing.Min, timing.Max, timing.Sum, timing.SumSquares})
+		estimated[group] += timing.EstimatedCount
+	}
+
+	grouped := make([]interface{}, 0, len(names))
+	for _, group := range names {
+		cfg := StatConfig{Name: group, Type: scTypeTiming}
+		var timing StatDataTiming
+		if values := groups[group]; len(values) > 0 {
+			timing = aggregateTiming(cfg, values, interpolation)
+		}
+		summary := summaries[group]
+		mean := summary.Sum / float64(summary.Count)
+		timing.StatConfig = cfg
+		timing.Count = summary.Count
+		timing.EstimatedCount = estimated[group]
+		timing.Min, timing.Max = summary.Min, summary.Max
+		timing.Sum, timing.SumSquares = summary.Sum, summary.SumSquares
+		timing.Variance = math.Max(summary.SumSquares/float64(summary.Count)-mean*mean, 0)
+		grouped = append(grouped, timing)
+	}
+	return grouped
+}
+
+// RegisterDerivedGauge makes UpdateBackend emit a gauge called name, for
+// source, with the value fn computes from the period's flushed data, such as
+// a cache hit ratio. The data are keyed by "<name>/<source>" (e.g.
+// "cache.hits/" for a stat without a source), or "<service>/<name>/<source>"
+// for a stat with a StatConfig.Service, and include the gauges of
+// DeriveRatio. The gauge isn't emitted when fn returns false, e.g. because
+// the stats it needs weren't recorded, or a NaN or infinite value. Like
+// ratios, derived gauges are only kept in memory.
+func (s StatImplementation) RegisterDerivedGauge(name string, fn func(snapshot map[string]interface{}) (float64, bool), source string) {
+	if s.ratios == nil {
+		return
+	}
+	s.ratios.mtx.Lock()
+	defer s.ratios.mtx.Unlock()
+	s.ratios.gauges = append(s.ratios.gauges, derivedGauge{name, source, fn})
+}
+
+// deriveGauges computes the gauges registered with RegisterDerivedGauge from
+// data.
+func (s StatImplementation) deriveGauges(data []interface{}) []interface{} {
+	if s.ratios == nil {
+		return nil
+	}
+	s.ratios.mtx.Lock()
+	gauges := append([]derivedGauge(nil), s.ratios.gauges...)
+	s.ratios.mtx.Unlock()
+	if len(gauges) == 0 {
+		return nil
+	}
+
+	snapshot := make(map[string]interface{}, len(data))
+	for _, datum := range data {
+		if sc, ok := statConfigOf(datum); ok {
+			key := sc.Name + "/" + sc.Source
+			if sc.Service != "" {
+				key = sc.Service + "/" + key
+			}
+			snapshot[key] = datum
+		}
+	}
+
+	var derived []interface{}
+	for _, gauge := range gauges {
+		value, ok := gauge.fn(snapshot)
+		if !ok {
+			continue
+		} else if math.IsNaN(value) || math.IsInf(value, 0) {
+			s.log.Warningf("Not emitting derived gauge %s/%s with invalid value %f", gauge.name, gauge.source, value)
+			continue
+		}
+		derived = append(derived, StatDataGauge{
+			StatConfig: StatConfig{Name: gauge.name, Source: gauge.source, Type: scTypeGauge},
+			Value:      value,
+			Samples:    1,
+			Min:        value,
+			Max:        value,
+		})
+	}
+	return derived
+}
+
+// selfMetrics returns the gauges StatOptions.SelfMetrics adds to a flush of
+// metrics data for the period.
+func (s StatImplementation) selfMetrics(periodStart, started time.Time, metrics int) []interface{} {
+	gauge := func(name string, value float64) StatDataGauge {
+		return StatDataGauge{
+			StatConfig:  StatConfig{Name: name, Type: scTypeGauge},
+			Value:       value,
+			Samples:     1,
+			Min:         value,
+			Max:         value,
+			PeriodStart: periodStart,
+		}
+	}
+	return []interface{}{
+		gauge(selfMetricHeartbeat, 1),
+		gauge(selfMetricDuration, time.Since(started).Seconds()),
+		gauge(selfMetricCount, float64(metrics)),
+	}
+}
+
+// lastFlushedGauge is what's remembered about a gauge's last flush when
+// StatOptions.SkipUnchangedGauges is set.
+type lastFlushedGauge struct {
+	Value  float64
+	Period time.Time
+}
+
+func (s StatImplementation) getLastFlushedGaugeMemcacheKey(sc StatConfig) string {
+	if sc.Service != "" {
+		return fmt.Sprintf("ss-lastgauge:%s/%s-%s", sc.Service, sc.Name, sc.versionedSource())
+	}
+	return fmt.Sprintf("ss-lastgauge:%s-%s", sc.Name, sc.versionedSource())
+}
+
+// skipUnchangedGauges removes gauges from data which have the same value as
+// when they were last flushed, unless the keepalive interval has passed.
+func (s StatImplementation) skipUnchangedGauges(data []interface{}, periodStart time.Time) []interface{} {
+	keys := make([]string, 0, len(data))
+	for i := range data {
+		if gauge, ok := data[i].(StatDataGauge); ok {
+			keys = append(keys, s.getLastFlushedGaugeMemcacheKey(gauge.StatConfig))
+		}
+	}
+	if len(keys) == 0 {
+		return data
+	}
+
+	items, err := s.cache.GetMulti(keys)
+	if err != nil {
+		s.log.Warningf("Failed to get last flushed gauge values; flushing all gauges: %s", err)
+		return data
+	}
+
+	keepalive := s.opts.GaugeKeepalive
+	if keepalive == 0 {
+		keepalive = defaultGaugeKeepalive
+	}
+
+	filtered := data[:0]
+	for i := range data {
+		if gauge, ok := data[i].(StatDataGauge); ok {
+			if item, found := items[s.getLastFlushedGaugeMemcacheKey(gauge.StatConfig)]; found {
+				var last lastFlushedGauge
+				if err := s.gobUnmarshal(item.Value, &last); err != nil {
+					s.log.Warningf("Bad last flushed gauge value for %s/%s: %s", gauge.Name, gauge.Source, err)
+				} else if last.Value == gauge.Value && periodStart.Sub(last.Period) < keepalive {
+					s.debugf("Skipping unchanged gauge %s/%s (value %f)", gauge.Name, gauge.Source, gauge.Value)
+					continue
+				}
+			}
+		}
+		filtered = append(filtered, data[i])
+	}
+	return filtered
+}
+
+// updateLastFlushedGauges remembers the values of the gauges just flushed.
+func (s StatImplementation) updateLastFlushedGauges(data []interface{}, periodStart time.Time) {
+	items := make([]*appwrap.CacheItem, 0, len(data))
+	for i := range data {
+		gauge, ok := data[i].(StatDataGauge)
+		if !ok {
+			continue
+		}
+		b, err := s.gobMarshal(&lastFlushedGauge{Value: gauge.Value, Period: periodStart})
+		if err != nil {
+			s.log.Errorf("Failed to encode last flushed gauge value for %s/%s: %s", gauge.Name, gauge.Source, err)
+			continue
+		}
+		items = append(items, &appwrap.CacheItem{
+			Key:   s.getLastFlushedGaugeMemcacheKey(gauge.StatConfig),
+			Value: b,
+		})
+	}
+	if len(items) > 0 {
+		if err := s.cache.SetMulti(items); err != nil {
+			s.log.Warningf("Failed to store last flushed gauge values: %s", err)
+		}
+	}
+}
+
+// ForceFlushNow flushes both the previous and the current period right away,
+// ignoring the last flushed watermark, so a draining instance doesn't lose
+// in-flight data. Values recorded in the current period after this are only
+// flushed if UpdateBackend is forced again, since the watermark now points at
+// the current period.
+func (s StatImplementation) ForceFlushNow(flusher StatsFlusher, flushConfig *FlusherConfig) error {
+	now := s.now()
+	var finalError error
+	for _, offset := range []int{-1, 0} {
+		if err := s.UpdateBackend(getStartOfFlushPeriod(now, offset), flusher, flushConfig, true); err != nil {
+			s.log.Errorf("Failed to force flush period %s: %s", getStartOfFlushPeriod(now, offset), err)
+			if finalError == nil {
+				finalError = err
+			}
+		}
+	}
+	return finalError
+}
+
+// CatchUp flushes every complete period since the last flushed watermark,
+// oldest first, such as after periodic flushes were missed. Periods which
+// ended more than StatOptions.MaxCatchupAge ago are skipped and logged. It
+// stops at the first period which fails to flush, so the watermark never
+// skips over it; buckets which couldn't be aggregated don't stop it.
+func (s StatImplementation) CatchUp(flusher StatsFlusher, flushConfig *FlusherConfig) error {
+	lastPeriod := getStartOfFlushPeriod(s.now(), -1)
+
+	periods := s.unflushedPeriods(s.getLastPeriodFlushedFor(flushConfig), lastPeriod)
+	if s.opts.MinFlushInterval > 0 && len(periods) > 0 {
+		// UpdateBackend flushes the periods since the watermark together
+		periods = periods[len(periods)-1:]
+	}
+	for _, period := range periods {
+		if err := s.UpdateBackend(period, flusher, flushConfig, false); err != nil {
+			if _, partial := err.(FlushErrors); partial {
+				continue
+			}
+			s.log.Errorf("Failed to catch up period %s: %s", period, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// unflushedPeriods returns the start of each period after lastFlushed, up to
+// and including last, oldest first; just last if nothing has been flushed.
+// Periods which ended more than StatOptions.MaxCatchupAge ago are skipped
+// and logged.
+func (s StatImplementation) unflushedPeriods(lastFlushed, last time.Time) []time.Time {
+	maxAge := s.opts.MaxCatchupAge
+	if maxAge <= 0 {
+		maxAge = s.bucketExpiration(scTypeCounter)
+		if expiration := s.bucketExpiration(scTypeTiming); expiration < maxAge {
+			maxAge = expiration
+		}
+	}
+
+	period := last
+	if !lastFlushed.IsZero() {
+		period = getStartOfFlushPeriod(lastFlushed, 1)
+	}
+
+	if expired := getStartOfFlushPeriod(s.now().Add(-maxAge), 0); period.Before(expired) {
+		s.log.Warningf("Skipping catch-up of the periods from %s to %s, which ended more than %s ago", period, expired.Add(-defaultAggregationPeriod), maxAge)
+		period = expired
+	}
+
+	var periods []time.Time
+	for ; !period.After(last); period = period.Add(defaultAggregationPeriod) {
+		periods = append(periods, period)
+	}
+	return periods
+}
+
+// deadLetter is the datastore entity holding the gob encoded data of a failed
+// flush, with the flusher it failed through and the service it was for.
+type deadLetter struct {
+	Period  time.Time
+	Created time.Time
+	Flusher string
+	Service string
+	Data    []byte `datastore:",noindex"`
+}
+
+func init() {
+	// The flushed data is encoded as a []interface{}
+	gob.Register(StatDataCounter{})
+	gob.Register(StatDataFloatCounter{})
+	gob.Register(StatDataGauge{})
+	gob.Register(StatDataTiming{})
+	gob.Register(StatDataHistogram{})
+	gob.Register(StatDataEvent{})
+}
+
+// storeDeadLetters stores the data which failed to flush through flusher for
+// ReplayDeadLetter, as a dead letter for each period, replacing those stored
+// by earlier failures.
+func (s StatImplementation) storeDeadLetters(flusher StatsFlusher, data []interface{}) {
+	var periods []time.Time
+	byPeriod := make(map[time.Time][]interface{})
+	for _, datum := range data {
+		periodStart := periodStartOf(datum)
+		if _, found := byPeriod[periodStart]; !found {
+			periods = append(periods, periodStart)
+		}
+		byPeriod[periodStart] = append(byPeriod[periodStart], datum)
+	}
+	for _, periodStart := range periods {
+		s.storeDeadLetter(flusher, periodStart, byPeriod[periodStart])
+	}
+}
+
+// deadLetterKey returns the key of the dead letter of the period's flush
+// through flusher.
+func (s StatImplementation) deadLetterKey(flusher StatsFlusher, periodStart time.Time) *appwrap.DatastoreKey {
+	keyName := fmt.Sprintf("%d-%s", periodStart.Unix(), deadLetterFlusher(flusher))
+	if s.opts.Service != "" {
+		keyName = s.opts.Service + "/" + keyName
+	}
+	return s.ds.NewKey(dsKindDeadLetter, keyName, 0, nil)
+}
+
+// deadLetterFlusher names flusher for its dead letters: its FlusherName, if
+// it's an InstrumentedStatsFlusher, or its type otherwise.
+func deadLetterFlusher(flusher StatsFlusher) string {
+	if instrumented, ok := flusher.(InstrumentedStatsFlusher); ok {
+		return instrumented.FlusherName()
+	}
+	return fmt.Sprintf("%T", flusher)
+}
+
+// storeDeadLetter stores the data of the period starting at periodStart,
+// which failed to flush through flusher, for ReplayDeadLetter.
+func (s StatImplementation) storeDeadLetter(flusher StatsFlusher, periodStart time.Time, data []interface{}) {
+	encoded, err := s.gobMarshal(data)
+	if err != nil {
+		s.log.Errorf("Failed to encode dead letter for period %s: %s", periodStart, err)
+		return
+	}
+
+	k := s.deadLetterKey(flusher, periodStart)
+	dl := deadLetter{Period: periodStart, Created: s.now(), Flusher: deadLetterFlusher(flusher), Service: s.opts.Service, Data: encoded}
+	if err := s.retryDatastore("put dead letter", func() error {
+		_, err := s.ds.Put(k, &dl)
+		return err
+	}); err != nil {
+		s.log.Errorf("Failed to store dead letter for period %s, its %d stats are lost: %s", periodStart, len(data), err)
+		return
+	}
+	s.log.Warningf("Stored %d stats for period %s as a dead letter", len(data), periodStart)
+}
+
+// deleteDeadLetters deletes the dead letters of the periods, which have now
+// been flushed through flusher, so they aren't replayed.
+func (s StatImplementation) deleteDeadLetters(flusher StatsFlusher, periods []time.Time) {
+	keys := make([]*appwrap.DatastoreKey, len(periods))
+	for i, periodStart := range periods {
+		keys[i] = s.deadLetterKey(flusher, periodStart)
+	}
+	if err := s.retryDatastore("delete dead letters", func() error { return s.ds.DeleteMulti(keys) }); err != nil {
+		s.log.Warningf("Failed to delete the dead letters of flushed periods, so they may be replayed: %s", err)
+	}
+}
+
+// ReplayDeadLetter flushes the data which UpdateBackend stored after failed
+// flushes (see StatOptions.DeadLetter) through flusher, oldest period first,
+// deleting each once it's flushed. Only the dead letters of flushes which
+// failed through the same kind of flusher (by FlusherName, or type), for the
+// same StatOptions.Service, are replayed. It stops at the first flush which
+// fails, leaving the rest to be replayed later. The watermark isn't changed.
+func (s StatImplementation) ReplayDeadLetter(flusher StatsFlusher, flushConfig *FlusherConfig) error {
+	var letters []deadLetter
+	var keys []*appwrap.DatastoreKey
+	q := s.ds.NewQuery(dsKindDeadLetter).Filter("Flusher =", deadLetterFlusher(flusher)).Filter("Service =", s.opts.Service)
+	if err := s.retryDatastore("dead letter query", func() error {
+		letters = nil
+		var err error
+		keys, err = q.GetAll(&letters)
+		return err
+	}); err != nil {
+		s.log.Errorf("Failed to load dead letters: %s", err)
+		return err
+	}
+
+	// Sorted here rather than by the query, which would need a composite index
+	order := make([]int, len(letters))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return letters[order[i]].Period.Before(letters[order[j]].Period) })
+	sortedLetters := make([]deadLetter, len(letters))
+	sortedKeys := make([]*appwrap.DatastoreKey, len(keys))
+	for i, j := range order {
+		sortedLetters[i], sortedKeys[i] = letters[j], keys[j]
+	}
+	letters, keys = sortedLetters, sortedKeys
+
+	for i := range letters {
+		var data []interface{}
+		if err := s.gobUnmarshal(letters[i].Data, &data); err != nil {
+			s.log.Errorf("Skipping undecodable dead letter %s: %s", keys[i].StringID(), err)
+			continue
+		}
+		setPeriodStart(data, letters[i].Period)
+
+		if err := flusher.Flush(data, flushConfig); err != nil {
+			s.log.Errorf("Failed to replay dead letter for period %s: %s", letters[i].Period, err)
+			return err
+		}
+		if err := s.retryDatastore("delete dead letter", func() error { return s.ds.DeleteMulti([]*appwrap.DatastoreKey{keys[i]}) }); err != nil {
+			s.log.Errorf("Failed to delete replayed dead letter %s: %s", keys[i].StringID(), err)
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregateBuckets fetches and aggregates the buckets for the configs in
+// batches of StatOptions.AggregationBatchSize configs, so only one batch of
+// raw bucket values is in memory at a time. With zeroFill, active counters
+// and gauges which have no bucket get a zero datum. Timing percentiles are
+// computed with interpolation. If groups isn't nil, the values of timings
+// StatOptions.TimingGroup puts in a group are added to it, keyed by group.
+func (s StatImplementation) aggregateBuckets(cfgMap map[string]StatConfig, zeroFill bool, interpolation PercentileInterpolation, groups map[string][]weightedValue) ([]interface{}, FlushErrors, error) {
+	batchSize := s.opts.AggregationBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultAggregationBatch
+	}
+
+	keys := make([]string, 0, len(cfgMap))
+	for k := range cfgMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	data := make([]interface{}, 0, len(cfgMap))
+	var errs FlushErrors
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := make(map[string]StatConfig, end-start)
+		for _, k := range keys[start:end] {
+			batch[k] = cfgMap[k]
+		}
+
+		itemMap, err := s.getBuckets(batch)
+		if err != nil {
+			return nil, nil, err
+		}
+		batchData, batchErrs := s.aggregate(batch, itemMap, interpolation, groups)
+		data = append(data, batchData...)
+		errs = append(errs, batchErrs...)
+		data = append(data, s.carryGaugeLevels(batch, itemMap)...)
+
+		if zeroFill {
+			for k, cfgItem := range batch {
+				found := false
+				for _, shardKey := range cfgItem.shardKeys(k) {
+					_, shardFound := itemMap[shardKey]
+					found = found || shardFound
+				}
+				if cfgItem.Type == scTypeGauge {
+					// flushed with its carried over level instead
+					_, levelFound := itemMap[s.getGaugeLevelMemcacheKey(cfgItem)]
+					found = found || levelFound
+				}
+				if found {
+					continue
+				}
+				switch cfgItem.Type {
+				case scTypeCounter:
+					data = append(data, StatDataCounter{StatConfig: cfgItem})
+				case scTypeFloatCounter:
+					data = append(data, StatDataFloatCounter{StatConfig: cfgItem})
+				case scTypeGauge:
+					data = append(data, StatDataGauge{StatConfig: cfgItem})
+				}
+			}
+		}
+	}
+	return data, errs, nil
+}
+
+// getBuckets fetches the memcache buckets for the given configs, keyed by
+// bucket key, in one go. Buckets which have expired or were never written
+// are absent from the result.
+func (s StatImplementation) getBuckets(cfgMap map[string]StatConfig) (map[string]*appwrap.CacheItem, error) {
+	bucketKeys := make([]string, 0, len(cfgMap))
+	for k, cfg := range cfgMap {
+		bucketKeys = append(bucketKeys, k)
+		if cfg.Type == scTypeTiming {
+			bucketKeys = append(bucketKeys, timingSummaryKey(k), timingWeightedKey(k), timingSampledKey(k))
+		} else if cfg.Type == scTypeCounter {
+			bucketKeys = append(bucketKeys, cfg.shardKeys(k)[1:]...)
+			bucketKeys = append(bucketKeys, counterSampledKey(k), counterClampedKey(k))
+		} else if cfg.Type == scTypeGauge {
+			bucketKeys = append(bucketKeys, s.getGaugeLevelMemcacheKey(cfg))
+		}
+	}
+	return s.cache.GetMulti(bucketKeys)
+}
+
+// carryGaugeLevels returns a StatDataGauge with the stored level of each
+// gauge adjusted with AdjustGauge which wasn't adjusted in the period, so
+// its level is flushed every period rather than only when it changes. The
+// level keys read are written back to refresh their expiration, so a gauge
+// which is flushed but rarely adjusted doesn't lose its level.
+func (s StatImplementation) carryGaugeLevels(cfgMap map[string]StatConfig, itemMap map[string]*appwrap.CacheItem) []interface{} {
+	var data []interface{}
+	for k, cfg := range cfgMap {
+		if cfg.Type != scTypeGauge {
+			continue
+		} else if _, found := itemMap[k]; found {
+			continue
+		}
+		item, found := itemMap[s.getGaugeLevelMemcacheKey(cfg)]
+		if !found {
+			continue
+		}
+		var level float64
+		if err := s.gobUnmarshal(item.Value, &level); err != nil {
+			s.badItem(item.Key, "Bad gauge level found in memcache: key %s, error: %s", item.Key, err)
+			continue
+		}
+		s.goodItem(item.Key)
+		data = append(data, StatDataGauge{StatConfig: cfg, Value: level, Samples: 1, Min: level, Max: level})
+
+		// A conflict means it was just adjusted, which refreshed it anyway
+		item.Expiration = gaugeLevelExpiration
+		if err := s.cache.CompareAndSwap(item); err != nil && err != appwrap.ErrCASConflict && err != appwrap.ErrNotStored {
+			s.log.Warningf("Failed refreshing gauge level %s: %s", item.Key, err)
+		}
+	}
+	return data
+}
+
+// aggregate computes the StatData* for each bucket found in itemMap. Buckets
+// which can't be aggregated are logged and skipped, and returned as errors.
+// Timing values are added to groups as for aggregateBuckets.
+func (s StatImplementation) aggregate(cfgMap map[string]StatConfig, itemMap map[string]*appwrap.CacheItem, interpolation PercentileInterpolation, groups map[string][]weightedValue) ([]interface{}, FlushErrors) {
+	data := make([]interface{}, 0, len(itemMap))
+	var errs FlushErrors
+	for k, item := range itemMap {
+		var datum interface{}
+		cfgItem, found := cfgMap[k]
+		if !found {
+			continue // a timing's summary, weighted values or sampled weight, or a counter shard, merged in with it
+		}
+		switch cfgItem.Type {
+		case scTypeTiming, scTypeGauge:
+			var gm []float64
+			if err := s.decodeSamples(item.Value, &gm); err != nil {
+				s.badItem(k, "Bad data found in memcache: key %s, error: %s", k, err)
+				errs = append(errs, fmt.Errorf("bad data in bucket %s: %s", k, err))
+				continue
+			}
+			s.goodItem(k)
+			if len(gm) == 0 {
+				s.log.Errorf("Empty list cached in bucket %s; skipping", k)
+				errs = append(errs, fmt.Errorf("empty list cached in bucket %s", k))
+				continue
+			}
+			if cfgItem.Type == scTypeTiming {
+				values := s.getWeightedValues(itemMap[timingWeightedKey(k)])
+				for _, m := range gm {
+					values = append(values, weightedValue{m, 1})
+				}
+				s.addToGroup(groups, cfgItem, values)
+				datum = s.estimateCount(s.mergeTimingSummary(aggregateTiming(cfgItem, values, interpolation), itemMap[timingSummaryKey(k)]), itemMap[timingSampledKey(k)])
+			} else {
+				min, max := gm[0], gm[0]
+				for _, m := range gm {
+					min = math.Min(min, m)
+					max = math.Max(max, m)
+				}
+				datum = StatDataGauge{StatConfig: cfgItem, Value: gm[len(gm)-1], Samples: len(gm), Min: min, Max: max}
+			}
+		case scTypeFloatCounter:
+			var total float64
+			if err := s.gobUnmarshal(item.Value, &total); err != nil {
+				s.badItem(k, "Bad data found in memcache: key %s, error: %s", k, err)
+				errs = append(errs, fmt.Errorf("bad data in bucket %s: %s", k, err))
+				continue
+			}
+			s.goodItem(k)
+			datum = StatDataFloatCounter{StatConfig: cfgItem, Value: total}
+		case scTypeEvent:
+			var events []statEvent
+			if err := s.gobUnmarshal(item.Value, &events); err != nil {
+				s.badItem(k, "Bad data found in memcache: key %s, error: %s", k, err)
+				errs = append(errs, fmt.Errorf("bad data in bucket %s: %s", k, err))
+				continue
+			}
+			s.goodItem(k)
+			// Each event is its own datum
+			for _, event := range events {
+				data = append(data, StatDataEvent{StatConfig: cfgItem, Text: event.Text, Timestamp: event.Timestamp})
+			}
+			continue
+		case scTypeCounter:
+			// Counters are stored as decimal strings, so memcache can
+			// increment them atomically, unlike gauges and timings which are
+			// gob encoded []float64s
+			count, found, countErrs := s.sumCounterShards(cfgItem, k, itemMap)
+			errs = append(errs, countErrs...)
+			if !found {
+				continue
+			}
+			_, clamped := itemMap[counterClampedKey(k)]
+			datum = StatDataCounter{StatConfig: cfgItem, Count: count, Clamped: clamped}
+		case scTypeHistogram:
+			var histogram statHistogram
+			if err := s.gobUnmarshal(item.Value, &histogram); err != nil {
+				s.badItem(k, "Bad data found in memcache: key %s, error: %s", k, err)
+				errs = append(errs, fmt.Errorf("bad data in bucket %s: %s", k, err))
+				continue
+			}
+			s.goodItem(k)
+			datum = StatDataHistogram{StatConfig: cfgItem, Bounds: histogram.Bounds, Counts: histogram.Counts, Sum: histogram.Sum}
+		default:
+			s.log.Errorf("Unknown stat type %q for bucket %s; skipping", cfgItem.Type, k)
+			errs = append(errs, fmt.Errorf("unknown stat type %q for bucket %s", cfgItem.Type, k))
+			continue
+		}
+		data = append(data, datum)
+	}
+
+	// Counters which were only incremented on other shards, or sampled
+	for k, cfgItem := range cfgMap {
+		if _, found := itemMap[k]; found || cfgItem.Type != scTypeCounter {
+			continue
+		}
+		count, found, countErrs := s.sumCounterShards(cfgItem, k, itemMap)
+		errs = append(errs, countErrs...)
+		if found {
+			_, clamped := itemMap[counterClampedKey(k)]
+			data = append(data, StatDataCounter{StatConfig: cfgItem, Count: count, Clamped: clamped})
+		}
+	}
+
+	// Timings which only had summaries or weighted values recorded
+	for k, cfgItem := range cfgMap {
+		if _, found := itemMap[k]; found || cfgItem.Type != scTypeTiming {
+			continue
+		}
+		summaryItem, weightedItem := itemMap[timingSummaryKey(k)], itemMap[timingWeightedKey(k)]
+		if summaryItem == nil && weightedItem == nil {
+			continue
+		}
+		datum := StatDataTiming{StatConfig: cfgItem}
+		if values := s.getWeightedValues(weightedItem); len(values) > 0 {
+			s.addToGroup(groups, cfgItem, values)
+			datum = aggregateTiming(cfgItem, values, interpolation)
+		}
+		data = append(data, s.estimateCount(s.mergeTimingSummary(datum, summaryItem), itemMap[timingSampledKey(k)]))
+	}
+
+	return data, errs
+}
+
+// addToGroup adds the timing's values to the group StatOptions.TimingGroup
+// puts it in, if any, for groupTimings.
+func (s StatImplementation) addToGroup(groups map[string][]weightedValue, cfg StatConfig, values []weightedValue) {
+	if groups == nil {
+		return
+	}
+	if group := s.opts.TimingGroup(cfg); group != "" {
+		groups[group] = append(groups[group], values...)
+	}
+}
+
+// sumCounterShards adds up the count in each of the counter's shards found in
+// itemMap. Shards with malformed values are logged and skipped.
+func (s StatImplementation) sumCounterShards(cfg StatConfig, bucketKey string, itemMap map[string]*appwrap.CacheItem) (uint64, bool, FlushErrors) {
+	var total uint64
+	var found bool
+	var errs FlushErrors
+	for _, k := range cfg.shardKeys(bucketKey) {
+		item, ok := itemMap[k]
+		if !ok {
+			continue
+		}
+		count, err := strconv.ParseUint(string(item.Value), 10, 64)
+		if err != nil {
+			s.badItem(k, "Bad counter value found in memcache: key %s, value %q, error: %s", k, item.Value, err)
+			errs = append(errs, fmt.Errorf("bad counter value in bucket %s: %s", k, err))
+			continue
+		}
+		s.goodItem(k)
+		total += count
+		found = true
+	}
+
+	// Add the estimated total of the sampled increments
+	if item, ok := itemMap[counterSampledKey(bucketKey)]; ok {
+		if sampled, err := decodeSampledCounter(item.Value); err != nil {
+			s.badItem(item.Key, "Bad sampled counter found in memcache: key %s, error: %s", item.Key, err)
+			errs = append(errs, fmt.Errorf("bad sampled counter in bucket %s: %s", item.Key, err))
+		} else {
+			s.goodItem(item.Key)
+			if estimate := math.Round(sampled.estimate()); estimate > 0 {
+				total += uint64(estimate)
+			}
+			found = true
+		}
+	}
+	return total, found, errs
+}
+
+// counterSampledKey returns the memcache key the sampled increments of a
+// counter are stored under for the counter bucket key.
+func counterSampledKey(bucketKey string) string {
+	return bucketKey + "-sampled"
+}
+
+// sampledCounter is the payload sampled counter increments are merged into:
+// a sum of increments and the sample rate they were made at, so the
+// increments stand for Value/SampleRate in total. Contributions at different
+// rates merge into the effective rate of their combined value (which, for
+// negative increments, needn't be a valid sample rate).
+type sampledCounter struct {
+	Value      int64
+	SampleRate float64
+}
+
+func (sc sampledCounter) estimate() float64 {
+	return float64(sc.Value) / sc.SampleRate
+}
+
+// merge returns the sum of the two payloads. Contributions whose values
+// cancel out give a sample rate of one, losing what's left of the estimate.
+func (sc sampledCounter) merge(other sampledCounter) sampledCounter {
+	merged := sampledCounter{Value: sc.Value + other.Value, SampleRate: 1}
+	if estimate := sc.estimate() + other.estimate(); merged.Value != 0 && estimate != 0 {
+		merged.SampleRate = float64(merged.Value) / estimate
+	}
+	return merged
+}
+
+// encode returns the payload as 16 bytes: the value as a big-endian int64,
+// then the sample rate's big-endian IEEE 754 bits.
+func (sc sampledCounter) encode() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(sc.Value))
+	binary.BigEndian.PutUint64(b[8:], math.Float64bits(sc.SampleRate))
+	return b
+}
+
+func decodeSampledCounter(b []byte) (sampledCounter, error) {
+	if len(b) != 16 {
+		return sampledCounter{}, fmt.Errorf("sampled counter payload is %d bytes, not 16", len(b))
+	}
+	sc := sampledCounter{
+		Value:      int64(binary.BigEndian.Uint64(b)),
+		SampleRate: math.Float64frombits(binary.BigEndian.Uint64(b[8:])),
+	}
+	if sc.SampleRate == 0 || math.IsNaN(sc.SampleRate) || math.IsInf(sc.SampleRate, 0) {
+		return sampledCounter{}, fmt.Errorf("sampled counter has invalid sample rate %f", sc.SampleRate)
+	}
+	return sc, nil
+}
+
+// weightedValue is a timing value which counts as Weight values, recorded
+// with RecordTimingWeighted. Values recorded with RecordTiming have a weight
+// of one.
+type weightedValue struct {
+	Value  float64
+	Weight int
+}
+
+// timingWeightedKey returns the memcache key weighted values are stored under
+// for the timing bucket key.
+func timingWeightedKey(bucketKey string) string {
+	return bucketKey + "-weighted"
+}
+
+// getWeightedValues decodes the weighted values in item, if there is one.
+func (s StatImplementation) getWeightedValues(item *appwrap.CacheItem) []weightedValue {
+	var values []weightedValue
+	if item == nil {
+		return nil
+	} else if err := s.gobUnmarshal(item.Value, &values); err != nil {
+		s.badItem(item.Key, "Bad weighted timing values found in memcache: key %s, error: %s", item.Key, err)
+		return nil
+	}
+	s.goodItem(item.Key)
+	return values
+}
+
+// aggregateTiming computes a timing's aggregates from its values, each
+// counted as many times as its weight. values must not be empty.
+// interpolation picks how the percentile values are computed; the percentile
+// counts and sums always use the nearest rank.
+func aggregateTiming(cfg StatConfig, values []weightedValue, interpolation PercentileInterpolation) StatDataTiming {
+
+	sort.SliceStable(values, func(i, j int) bool { return values[i].Value < values[j].Value })
+
+	count := 0
+	var sum, sumSquares float64
+	for _, v := range values {
+		count += v.Weight
+		sum += v.Value * float64(v.Weight)
+		sumSquares += math.Pow(v.Value, 2.0) * float64(v.Weight)
+	}
+
+	// nth returns the nth (from zero) smallest value, and sumOfFirst the sum
+	// of the n smallest, as if each value were repeated weight times
+	nth := func(n int) float64 {
+		for _, v := range values {
+			if n < v.Weight {
+				return v.Value
+			}
+			n -= v.Weight
+		}
+		return values[len(values)-1].Value
+	}
+	sumOfFirst := func(n int) float64 {
+		total := 0.0
+		for _, v := range values {
+			if n <= 0 {
+				break
+			}
+			w := v.Weight
+			if n < w {
+				w = n
+			}
+			total += v.Value * float64(w)
+			n -= w
+		}
+		return total
+	}
+
+	var median float64
+	if count%2 == 0 {
+		median = (nth((count/2)-1) + nth(count/2)) / 2.0
+	} else {
+		median = nth(count / 2)
+	}
+
+	const ninthDecile = 0.9
+	const threeNinesPercentile = 0.999
+	ninthdecileCount := int(math.Ceil(ninthDecile * float64(count)))
+	threeNinesCount := int(math.Ceil(threeNinesPercentile * float64(count)))
+	ninthDecileValue := nth(ninthdecileCount - 1)
+	threeNinesValue := nth(threeNinesCount - 1)
+
+	if interpolation == PercentileLinear {
+		// Interpolate between the values either side of rank p*(count-1),
+		// as numpy's default method does
+		linear := func(p float64) float64 {
+			rank := p * float64(count-1)
+			lower := int(math.Floor(rank))
+			value := nth(lower)
+			if lower+1 < count {
+				value += (rank - float64(lower)) * (nth(lower+1) - value)
+			}
+			return value
+		}
+		ninthDecileValue = linear(ninthDecile)
+		threeNinesValue = linear(threeNinesPercentile)
+	}
+
+	var apdexScore *float64
+	if cfg.ApdexThreshold > 0 {
+		score := apdex(values, cfg.ApdexThreshold)
+		apdexScore = &score
+	}
+
+	return StatDataTiming{
+		StatConfig:       cfg,
+		Count:            count,
+		Min:              values[0].Value,
+		Max:              values[len(values)-1].Value,
+		Sum:              sum,
+		SumSquares:       sumSquares,
+		Median:           median,
+		NinthDecileCount: ninthdecileCount,
+		NinthDecileSum:   sumOfFirst(ninthdecileCount),
+		NinthDecileValue: ninthDecileValue,
+		ThreeNinesCount:  threeNinesCount,
+		ThreeNinesSum:    sumOfFirst(threeNinesCount),
+		ThreeNinesValue:  threeNinesValue,
+		Apdex:            apdexScore,
+	}
+}
+
+// timingSummary holds a pre-aggregated summary of timing values, recorded
+// with RecordTimingSummary.
+type timingSummary struct {
+	Count      int
+	Min        float64
+	Max        float64
+	Sum        float64
+	SumSquares float64
+}
+
+// timingSummaryKey returns the memcache key summaries are stored under for
+// the timing bucket key.
+func timingSummaryKey(bucketKey string) string {
+	return bucketKey + "-summary"
+}
+
+// merge adds other's values into the summary.
+func (ts *timingSummary) merge(other timingSummary) {
+	if ts.Count == 0 {
+		*ts = other
+		return
+	}
+	ts.Count += other.Count
+	ts.Min = math.Min(ts.Min, other.Min)
+	ts.Max = math.Max(ts.Max, other.Max)
+	ts.Sum += other.Sum
+	ts.SumSquares += other.SumSquares
+}
+
+// mergeTimingSummary folds the summary in summaryItem (if any) into the
+// timing's count, min, max and sums, and computes its variance. The
+// percentiles, median and Apdex only reflect individually recorded values.
+func (s StatImplementation) mergeTimingSummary(datum StatDataTiming, summaryItem *appwrap.CacheItem) StatDataTiming {
+	if summaryItem != nil {
+		var summary timingSummary
+		if err := s.gobUnmarshal(summaryItem.Value, &summary); err != nil {
+			s.badItem(summaryItem.Key, "Bad timing summary found in memcache: key %s, error: %s", summaryItem.Key, err)
+		} else {
+			s.goodItem(summaryItem.Key)
+			merged := timingSummary{datum.Count, datum.Min, datum.Max, datum.Sum, datum.SumSquares}
+			merged.merge(summary)
+			datum.Count, datum.Min, datum.Max, datum.Sum, datum.SumSquares = merged.Count, merged.Min, merged.Max, merged.Sum, merged.SumSquares
+		}
+	}
+	if datum.Count > 0 {
+		mean := datum.Sum / float64(datum.Count)
+		datum.Variance = math.Max(datum.SumSquares/float64(datum.Count)-mean*mean, 0)
+	}
+	return datum
+}
+
+// ActiveBucketKeys returns the sorted memcache keys of the buckets which
+// would be considered when flushing the period at the given offset from at,
+// without reading their values.
+func (s StatImplementation) ActiveBucketKeys(at time.Time, offset int) ([]string, error) {
+	cfgMap, err := s.getActiveConfigs(at, offset)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(cfgMap))
+	for k := range cfgMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Snapshot returns the current aggregates for the period containing at,
+// without flushing them or touching the last flushed watermark.
+func (s StatImplementation) Snapshot(at time.Time) ([]interface{}, error) {
+	return s.snapshotPeriod(at, 0)
+}
+
+// SnapshotRange returns the aggregates for each of the last periods periods
+// up to and including the one containing end, keyed by period start. Periods
+// whose buckets are no longer in memcache are absent from the result.
+func (s StatImplementation) SnapshotRange(end time.Time, periods int) (map[time.Time][]interface{}, error) {
+	snapshots := make(map[time.Time][]interface{})
+	for offset := 0; offset > -periods; offset-- {
+		data, err := s.snapshotPeriod(end, offset)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			snapshots[getStartOfFlushPeriod(end, offset)] = data
+		}
+	}
+	return snapshots, nil
+}
+
+func (s StatImplementation) snapshotPeriod(at time.Time, offset int) ([]interface{}, error) {
+	cfgMap, err := s.getActiveConfigs(at, offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfgMap) == 0 {
+		return nil, nil
+	}
+
+	// unaggregatable buckets are already logged; leave them out of the snapshot
+	data, _, err := s.aggregateBuckets(cfgMap, false, PercentileNearestRank, nil)
+	if err != nil {
+		return nil, err
+	}
+	sortStatData(data)
+	setPeriodStart(data, getStartOfFlushPeriod(at, offset))
+	return data, nil
+}
+
+// SnapshotMetric returns the current aggregates of each source of the metric
+// of type typ (e.g. "gauge") and name for the period containing at, keyed by
+// source, like Snapshot but only reading that metric's buckets. Events give
+// the most recent event of each source. Only the metric's configs are read,
+// by querying for its name.
+func (s StatImplementation) SnapshotMetric(typ, name string, at time.Time) (map[string]interface{}, error) {
+	cfgMap, err := s.getActiveNamedConfigs(name, at, 0)
+	if err != nil {
+		return nil, err
+	}
+	for bucketKey, sc := range cfgMap {
+		if sc.Type != typ || sc.Name != name || sc.Service != s.opts.Service {
+			delete(cfgMap, bucketKey)
+		}
+	}
+
+	bySource := make(map[string]interface{}, len(cfgMap))
+	if len(cfgMap) == 0 {
+		return bySource, nil
+	}
+
+	data, _, err := s.aggregateBuckets(cfgMap, false, PercentileNearestRank, nil)
+	if err != nil {
+		return nil, err
+	}
+	sortStatData(data)
+	setPeriodStart(data, getStartOfFlushPeriod(at, 0))
+	for _, datum := range data {
+		if sc, ok := statConfigOf(datum); ok {
+			bySource[sc.versionedSource()] = datum
+		}
+	}
+	return bySource, nil
+}
+
+// apdex computes the Apdex score of the values: the satisfied values (at
+// most threshold) plus half the tolerating ones (at most four times
+// threshold), over the number of values.
+func apdex(values []weightedValue, threshold float64) float64 {
+	var satisfied, tolerating, count int
+	for _, v := range values {
+		if v.Value <= threshold {
+			satisfied += v.Weight
+		} else if v.Value <= 4*threshold {
+			tolerating += v.Weight
+		}
+		count += v.Weight
+	}
+	return (float64(satisfied) + float64(tolerating)/2) / float64(count)
+}
+
+// PurgeToken confirms a call deleting stats data really is meant for the
+// app; see NewPurgeToken. The zero value confirms nothing.
+type PurgeToken struct {
+	appID     string
+	confirmed bool
+}
+
+// NewPurgeToken returns a token confirming Purge or ClearBuckets for the app
+// with the ID, e.g. one taken from an admin request's form.
+func NewPurgeToken(appID string) PurgeToken {
+	return PurgeToken{appID: appID, confirmed: true}
+}
+
+// confirmPurge returns ErrPurgeNotConfirmed unless token was made for this
+// app's ID (see StatOptions.AppID). Nothing is confirmed when the app's ID
+// isn't known, since a token made for an empty ID would otherwise match it.
+func (s StatImplementation) confirmPurge(token PurgeToken) error {
+	appID := s.opts.AppID
+	if appID == "" {
+		appID = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if appID == "" {
+		s.log.Errorf("Refusing to delete stats data when the app's ID isn't known; set StatOptions.AppID or GOOGLE_CLOUD_PROJECT")
+		return ErrPurgeNotConfirmed
+	}
+	if !token.confirmed || token.appID != appID {
+		s.log.Errorf("Refusing to delete stats data with a purge token for app %q (this app is %q)", token.appID, appID)
+		return ErrPurgeNotConfirmed
+	}
+	return nil
+}
+
+// Purge deletes every StatConfig and the current and previous periods'
+// buckets. It does nothing, returning ErrPurgeNotConfirmed, unless confirm
+// was made with NewPurgeToken for this app's ID.
+func (s StatImplementation) Purge(confirm PurgeToken) error {
+
+	if err := s.confirmPurge(confirm); err != nil {
+		return err
+	}
+
+	dsKeys, sc, err := s.getAllConfigsWithKeys()
+	if err != nil {
+		return err
+	}
+	if len(sc) == 0 {
+		return nil // nothing to do
+	}
+
+	now := s.now()
+	memcacheKeys := make([]string, 0, len(sc))
+	for _, cfg := range sc {
+		memcacheKeys = append(memcacheKeys, s.bucketMemcacheKeys(cfg, now)...)
+		memcacheKeys = append(memcacheKeys, s.getSourceCountMemcacheKey(cfg.Service, cfg.Type, cfg.Name))
+	}
+
+	if err := s.retryDatastore("purge", func() error { return s.ds.DeleteMulti(dsKeys) }); err != nil {
+		s.log.Errorf("Stats: purge datastore failed: %s", err)
+		return err
+	}
+
+	s.cache.DeleteMulti(memcacheKeys)
+	s.forgetSampledWrites()
+	return nil
+}
+
+// ClearBuckets deletes the current and previous periods' buckets of every
+// active stat, along with the values accumulated in memory, so they restart
+// from zero. Unlike Purge, the StatConfigs are kept, so the stats keep their
+// settings and are flushed again as soon as they're recorded. Like Purge, it
+// needs a PurgeToken for this app's ID.
+func (s StatImplementation) ClearBuckets(confirm PurgeToken) error {
+
+	if err := s.confirmPurge(confirm); err != nil {
+		return err
+	}
+
+	now := s.now()
+	cfgMap, err := s.getActiveConfigs(now, 0)
+	if err != nil {
+		return err
+	}
+
+	s.counters.mtx.Lock()
+	s.counters.pending = make(map[pendingCounterKey]int64)
+	s.counters.mtx.Unlock()
+
+	memcacheKeys := make([]string, 0, len(cfgMap))
+	for _, cfg := range cfgMap {
+		memcacheKeys = append(memcacheKeys, s.bucketMemcacheKeys(cfg, now)...)
+	}
+
+	if err := s.cache.DeleteMulti(memcacheKeys); err != nil {
+		// Buckets which were never written are missing anyway
+		if multiErr, ok := err.(appwrap.MultiError); ok {
+			for _, keyErr := range multiErr {
+				if keyErr != nil && keyErr != appwrap.ErrCacheMiss {
+					s.log.Errorf("Stats: clearing buckets failed: %s", keyErr)
+					return err
+				}
+			}
+		} else {
+			s.log.Errorf("Stats: clearing buckets failed: %s", err)
+			return err
+		}
+	}
+	s.forgetSampledWrites()
+	return nil
+}
+
+// bucketMemcacheKeys returns the memcache keys holding the stat's values for
+// the period containing now and the previous one.
+func (s StatImplementation) bucketMemcacheKeys(cfg StatConfig, now time.Time) []string {
+	var keys []string
+	for _, offset := range []int{0, -1} {
+		bucketKey := cfg.BucketKey(now, offset)
+		keys = append(keys, cfg.shardKeys(bucketKey)...)
+		if cfg.Type == scTypeCounter {
+			keys = append(keys, counterSampledKey(bucketKey), counterClampedKey(bucketKey))
+		} else if cfg.Type == scTypeTiming {
+			keys = append(keys, timingSummaryKey(bucketKey), timingWeightedKey(bucketKey), timingSampledKey(bucketKey))
+		}
+	}
+	if cfg.Type == scTypeGauge {
+		keys = append(keys, s.getGaugeLevelMemcacheKey(cfg))
+	}
+	return keys
+}
+
+// forgetSampledWrites drops the keys sampled for CheckEvictions, since
+// deleted buckets weren't evicted.
+func (s StatImplementation) forgetSampledWrites() {
+	if s.written == nil {
+		return
+	}
+	s.written.mtx.Lock()
+	s.written.keys = make(map[string]time.Time)
+	s.written.mtx.Unlock()
+}
+
+func (s StatImplementation) getAllConfigs() ([]StatConfig, error) {
+	_, cfgs, err := s.getAllConfigsWithKeys()
+	return cfgs, err
+}
+
+// getAllConfigsWithKeys returns every StatConfig along with its datastore
+// key, which depends on the service and key sharding it was stored with.
+func (s StatImplementation) getAllConfigsWithKeys() ([]*appwrap.DatastoreKey, []StatConfig, error) {
+	q := s.ds.NewQuery(dsKindStatConfig)
+	var cfgs []StatConfig
+	keys, err := q.GetAll(&cfgs)
+	return keys, cfgs, err
+}
+
+// retryDatastore calls f, retrying it with exponential backoff while it fails
+// with a retryable error, up to StatOptions.DatastoreRetries times.
+func (s StatImplementation) retryDatastore(op string, f func() error) error {
+	backoff := s.opts.DatastoreBackoff
+	if backoff == 0 {
+		backoff = defaultDatastoreBackoff
+	}
+	isRetryable := s.opts.RetryableDatastoreError
+	if isRetryable == nil {
+		isRetryable = isRetryableDatastoreError
+	}
+
+	err := f()
+	for retry := 0; retry < s.opts.DatastoreRetries && err != nil && isRetryable(err); retry++ {
+		s.log.Warningf("Datastore %s failed, retrying in %s: %s", op, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = f()
+	}
+	return err
+}
+
+func isRetryableDatastoreError(err error) bool {
+	switch status.Code(err) {
+	case codes.Aborted, codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+func (s StatImplementation) getActiveConfigs(at time.Time, offset int) (map[string]StatConfig, error) {
+
+	cutoffTime := at.Add(time.Duration(time.Hour * 24 * -2))
+
+	q := s.ds.NewQuery(dsKindStatConfig).Filter("LastRead >", cutoffTime)
+	statConfigs, finalError := s.queryConfigs(q, at, offset, func(StatConfig) bool { return true })
+	if finalError != nil {
+		s.log.Warningf("Failed iterating stat config items to get active buckets: %s", finalError)
+	}
+	s.debugf("Found %d stat configs (cutoff time %s)", len(statConfigs), cutoffTime)
+	return statConfigs, finalError
+}
+
+// getActiveNamedConfigs returns the active configs of every stat called
+// name, like getActiveConfigs, querying for the name rather than reading
+// every active config. The query has no LastRead filter, which would need a
+// composite index, so inactive configs are skipped as they're read.
+func (s StatImplementation) getActiveNamedConfigs(name string, at time.Time, offset int) (map[string]StatConfig, error) {
+
+	cutoffTime := at.Add(time.Duration(time.Hour * 24 * -2))
+
+	q := s.ds.NewQuery(dsKindStatConfig).Filter("Name =", name)
+	statConfigs, finalError := s.queryConfigs(q, at, offset, func(sc StatConfig) bool { return sc.LastRead.After(cutoffTime) })
+	if finalError != nil {
+		s.log.Warningf("Failed iterating stat config items of %s to get active buckets: %s", name, finalError)
+	}
+	return statConfigs, finalError
+}
+
+// queryConfigs runs the StatConfig query q, retrying it like other datastore
+// calls, and returns the configs keep returns true for keyed by their bucket
+// key for the period at offset from at.
+func (s StatImplementation) queryConfigs(q appwrap.DatastoreQuery, at time.Time, offset int, keep func(StatConfig) bool) (map[string]StatConfig, error) {
+	var statConfigs map[string]StatConfig
+	err := s.retryDatastore("active stat config query", func() error {
+		statConfigs = make(map[string]StatConfig)
+		iter := q.Run()
+		for {
+			var sc StatConfig
+			_, err := iter.Next(&sc)
+			if err == appwrap.DatastoreDone {
+				return nil // end of iteration
+			} else if err != nil {
+				return err
+			}
+			if keep(sc) {
+				statConfigs[sc.BucketKey(at, offset)] = sc
+			}
+		}
+	})
+	return statConfigs, err
+}
+
+func (s StatImplementation) getBucketKey(typ, name, source string, at time.Time) (string, error) {
+	statConfig, err := s.getStatConfig(typ, name, source)
+	if err != nil {
+		return "", err
+	}
+
+	return statConfig.BucketKey(at, 0), nil
+}
+
+func (s StatImplementation) getStatConfigKeyName(typ, name, source string) string {
+	return s.getConfigKeyName(StatConfig{Type: typ, Name: name, Source: source, Version: s.sourceVersion(source)})
+}
+
+// getConfigKeyName returns the key name of sc, which may have been recorded
+// by another version (see StatOptions.VersionSource).
+func (s StatImplementation) getConfigKeyName(sc StatConfig) string {
+	return statConfigKeyName(s.opts.Service, sc.Type, sc.Name, sc.versionedSource())
+}
+
+// statConfigKeyName returns the key name of the service's StatConfig for the
+// stat; StatImplementations use their own StatOptions.Service.
+func statConfigKeyName(service, typ, name, source string) string {
+	if service != "" {
+		return fmt.Sprintf("%s/%s-%s-%s", service, typ, name, source)
+	}
+	return fmt.Sprintf("%s-%s-%s", typ, name, source)
+}
+
+func (s StatImplementation) getStatConfigMemcacheKey(typ, name, source string) string {
+	return fmt.Sprintf("ss-conf:%s", s.getStatConfigKeyName(typ, name, source))
+}
+
+func (s StatImplementation) getConfigMemcacheKey(sc StatConfig) string {
+	return fmt.Sprintf("ss-conf:%s", s.getConfigKeyName(sc))
+}
+
+func (s StatImplementation) getSourceCountMemcacheKey(service, typ, name string) string {
+	if service != "" {
+		return fmt.Sprintf("ss-sources:%s/%s-%s", service, typ, name)
+	}
+	return fmt.Sprintf("ss-sources:%s-%s", typ, name)
+}
+
+func (s StatImplementation) getStatConfigDatastoreKey(typ, name, source string) *appwrap.DatastoreKey {
+	return s.ds.NewKey(dsKindStatConfig, shardedKeyName(s.getStatConfigKeyName(typ, name, source), s.opts.ConfigKeyShards), 0, nil)
+}
+
+func (s StatImplementation) getConfigDatastoreKey(sc StatConfig) *appwrap.DatastoreKey {
+	return s.ds.NewKey(dsKindStatConfig, shardedKeyName(s.getConfigKeyName(sc), s.opts.ConfigKeyShards), 0, nil)
+}
+
+// shardedKeyName prefixes keyName with its shard, e.g. "001f:counter-foo-",
+// when shards is set.
+func shardedKeyName(keyName string, shards int) string {
+	if shards <= 0 {
+		return keyName
+	}
+	h := fnv.New32a()
+	h.Write([]byte(keyName))
+	return fmt.Sprintf("%04x:%s", h.Sum32()%uint32(shards), keyName)
+}
+
+// statRef identifies a stat by its type, name and source.
+type statRef struct {
+	typ    string
+	name   string
+	source string
+}
+
+// statConfigGetter looks up the StatConfig of a stat, like getStatConfig.
+type statConfigGetter func(typ, name, source string) (StatConfig, error)
+
+// prefetchStatConfigs looks up the cached StatConfigs of stats with a single
+// memcache call, returning a statConfigGetter which answers from them and
+// falls back to getStatConfig for the rest.
+func (s StatImplementation) prefetchStatConfigs(stats []statRef) statConfigGetter {
+	memcacheKeys := make(map[statRef]string, len(stats))
+	var keys []string
+	for _, stat := range stats {
+		if name, source, err := s.normalizeNameAndSource(stat.name, stat.source); err == nil {
+			memcacheKeys[stat] = s.getStatConfigMemcacheKey(stat.typ, name, source)
+			keys = append(keys, memcacheKeys[stat])
+		}
+	}
+	items, err := s.cache.GetMulti(keys)
+	if err != nil {
+		items = nil
+	}
+
+	return func(typ, name, source string) (StatConfig, error) {
+		if item, found := items[memcacheKeys[statRef{typ, name, source}]]; found {
+			var sc StatConfig
+			if err := s.gobUnmarshal(item.Value, &sc); err == nil {
+				return sc, nil
+			}
+		}
+		return s.getStatConfig(typ, name, source)
+	}
+}
+
+func (s StatImplementation) getStatConfig(typ, name, source string) (StatConfig, error) {
+
+	var sc StatConfig
+
+	name, source, err := s.normalizeNameAndSource(name, source)
+	if err != nil {
+		return StatConfig{}, err
+	}
 
 	// First, query memcache
 	if item, err := s.cache.Get(s.getStatConfigMemcacheKey(typ, name, source)); err == nil {
@@ -376,48 +3073,512 @@ func (s StatImplementation) getStatConfig(typ, name, source string) (StatConfig,
 		}
 	}
 
-	k := s.getStatConfigDatastoreKey(typ, name, source)
-	now := time.Now()
-	cache := true
+	if sc, found := s.getPendingConfig(typ, name, source); found {
+		return sc, nil
+	}
+
+	k := s.getStatConfigDatastoreKey(typ, name, source)
+	now := s.now()
+	cache := true
+
+	// Now query datastore
+	if err := s.retryDatastore("get stat config", func() error { return s.ds.Get(k, &sc) }); err != nil && err != appwrap.ErrNoSuchEntity {
+		if !s.opts.DegradeOnDatastoreError {
+			return StatConfig{}, err
+		}
+		s.log.Warningf("Datastore unavailable for StatConfig %s-%s-%s, using an ephemeral config: %s", typ, name, source, err)
+		return s.getEphemeralStatConfig(typ, name, source, now), nil
+	} else if err == appwrap.ErrNoSuchEntity {
+		if otherTypes := s.getOtherRegisteredTypes(typ, name, source); len(otherTypes) > 0 {
+			s.log.Warningf("Stat %s/%s is being registered as a %s, but is already registered as %s", name, source, typ, strings.Join(otherTypes, ", "))
+			if s.opts.RejectTypeMismatch {
+				return StatConfig{}, ErrStatTypeMismatch
+			}
+		}
+		if s.overSourceLimit(typ, name, source) {
+			s.log.Warningf("Metric %s/%s has more than %d sources, recording source %q as %s",
+				typ, name, s.opts.MaxSourcesPerMetric, source, OverflowSource)
+			return s.getOverflowStatConfig(typ, name, source, time.Duration(24*time.Hour))
+		}
+		if !s.allowNewConfig(source) {
+			s.log.Warningf("Too many new stat configs are being created, recording %s/%s source %q as %s",
+				typ, name, source, OverflowSource)
+			// Only cache the overflow config briefly, so the source is
+			// registered once the burst has passed
+			return s.getOverflowStatConfig(typ, name, source, degradedConfigExpiration)
+		}
+		sc.Name = name
+		sc.Source = source
+		sc.Service = s.opts.Service
+		sc.Type = typ
+		sc.Version = s.sourceVersion(source)
+	}
+
+	sc.LastRead = now
+
+	if s.opts.ConfigWriteBehind > 0 {
+		s.addPendingConfig(k, sc)
+		return sc, nil
+	}
+
+	// Store item in datastore if it needed the update
+	if err := s.retryDatastore("put stat config", func() error {
+		_, err := s.ds.Put(k, &sc)
+		return err
+	}); err != nil {
+		s.log.Warningf("Failed to update StatConfig %s: %s", sc, err)
+		cache = false
+	}
+
+	// Only attempt adding if the update was needed and succeeded
+	if cache {
+		if b, err := s.gobMarshal(&sc); err != nil {
+			s.log.Warningf("Failed to encode stat config item into memcache: %s", err)
+			return StatConfig{}, nil
+		} else {
+			s.cache.Add(&appwrap.CacheItem{
+				Key:        s.getStatConfigMemcacheKey(typ, name, source),
+				Value:      b,
+				Expiration: time.Duration(24 * time.Hour),
+			})
+		}
+	}
+
+	return sc, nil
+
+}
+
+// ConfigFor returns the StatConfig registered for the stat type/name/source,
+// or ErrStatConfigNotFound if it has never been recorded. Unlike recording a
+// value, it never registers a new config.
+func (s StatImplementation) ConfigFor(typ, name, source string) (StatConfig, error) {
+
+	var sc StatConfig
+
+	name, source, err := s.normalizeNameAndSource(name, source)
+	if err != nil {
+		return StatConfig{}, err
+	}
+
+	if item, err := s.cache.Get(s.getStatConfigMemcacheKey(typ, name, source)); err == nil {
+		if err := s.gobUnmarshal(item.Value, &sc); err == nil {
+			return sc, nil
+		}
+	}
+
+	if sc, found := s.getPendingConfig(typ, name, source); found {
+		return sc, nil
+	}
+
+	k := s.getStatConfigDatastoreKey(typ, name, source)
+	if err := s.retryDatastore("get stat config", func() error { return s.ds.Get(k, &sc) }); err == appwrap.ErrNoSuchEntity {
+		return StatConfig{}, ErrStatConfigNotFound
+	} else if err != nil {
+		return StatConfig{}, err
+	}
+	return sc, nil
+
+}
+
+// getOtherRegisteredTypes returns the stat types other than typ which
+// name/source already has a StatConfig for. It's only called when a new
+// config is registered, and looks the other types up with a single memcache
+// and a single datastore call.
+func (s StatImplementation) getOtherRegisteredTypes(typ, name, source string) []string {
+	var others, memcacheKeys []string
+	for _, other := range []string{scTypeCounter, scTypeFloatCounter, scTypeGauge, scTypeTiming, scTypeEvent, scTypeHistogram} {
+		if other != typ {
+			others = append(others, other)
+			memcacheKeys = append(memcacheKeys, s.getStatConfigMemcacheKey(other, name, source))
+		}
+	}
+	items, err := s.cache.GetMulti(memcacheKeys)
+	if err != nil {
+		items = nil
+	}
+
+	var otherTypes, uncached []string
+	var keys []*appwrap.DatastoreKey
+	for i, other := range others {
+		if _, found := items[memcacheKeys[i]]; found {
+			otherTypes = append(otherTypes, other)
+		} else if _, found := s.getPendingConfig(other, name, source); found {
+			otherTypes = append(otherTypes, other)
+		} else {
+			uncached = append(uncached, other)
+			keys = append(keys, s.getStatConfigDatastoreKey(other, name, source))
+		}
+	}
+	if len(keys) == 0 {
+		return otherTypes
+	}
+
+	cfgs := make([]StatConfig, len(keys))
+	err = s.ds.GetMulti(keys, cfgs)
+	if multiErr, ok := err.(appwrap.MultiError); ok {
+		for i, other := range uncached {
+			if multiErr[i] == nil {
+				otherTypes = append(otherTypes, other)
+			}
+		}
+	} else if err == nil {
+		otherTypes = append(otherTypes, uncached...)
+	}
+	return otherTypes
+}
+
+// normalizeNameAndSource enforces StatOptions.MaxNameLength and
+// MaxSourceLength, truncating or rejecting names and sources which are too
+// long.
+func (s StatImplementation) normalizeNameAndSource(name, source string) (string, string, error) {
+	var err error
+	if name, err = s.limitLength(name, s.opts.MaxNameLength); err != nil {
+		return "", "", err
+	}
+	if source, err = s.limitLength(source, s.opts.MaxSourceLength); err != nil {
+		return "", "", err
+	}
+	return name, source, nil
+}
+
+// sourceVersion returns the StatConfig.Version of stats recorded with source:
+// the module and version, when StatOptions.VersionSource is set.
+func (s StatImplementation) sourceVersion(source string) string {
+	if !s.opts.VersionSource || source == OverflowSource {
+		return ""
+	}
+	module, version := s.opts.Module, s.opts.Version
+	if module == "" {
+		module = os.Getenv("GAE_SERVICE")
+	}
+	if version == "" {
+		version = os.Getenv("GAE_VERSION")
+	}
+	if module == "" && version == "" {
+		return ""
+	}
+	return module + "." + version
+}
+
+// applyVersions appends the Version of each datum's StatConfig to its
+// source, so the flushed sources tell the versions apart.
+func applyVersions(data []interface{}) {
+	for i := range data {
+		if sc, ok := statConfigOf(data[i]); ok && sc.Version != "" {
+			sc.Source, sc.Version = sc.versionedSource(), ""
+			data[i] = withStatConfig(data[i], sc)
+		}
+	}
+}
+
+// limitLength enforces a MaxNameLength or MaxSourceLength of max bytes on
+// value.
+func (s StatImplementation) limitLength(value string, max int) (string, error) {
+	if max <= 0 || len(value) <= max {
+		return value, nil
+	} else if !s.opts.TruncateLongNames {
+		s.log.Warningf("Rejecting stat name/source %q: %d characters long, limit is %d", value, len(value), max)
+		return "", ErrStatNameTooLong
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	if max <= len(suffix) {
+		return suffix[len(suffix)-max:], nil
+	}
+	// Cut on a rune boundary so the truncated value is still valid UTF-8
+	cut := max - len(suffix)
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + suffix, nil
+}
+
+func (s StatImplementation) getPendingConfig(typ, name, source string) (StatConfig, bool) {
+	return s.getPendingConfigNamed(s.getStatConfigKeyName(typ, name, source))
+}
+
+func (s StatImplementation) getPendingConfigNamed(keyName string) (StatConfig, bool) {
+	if s.opts.ConfigWriteBehind <= 0 {
+		return StatConfig{}, false
+	}
+	s.configs.mtx.Lock()
+	defer s.configs.mtx.Unlock()
+	pc, found := s.configs.pending[keyName]
+	return pc.sc, found
+}
+
+func (s StatImplementation) addPendingConfig(k *appwrap.DatastoreKey, sc StatConfig) {
+	s.configs.mtx.Lock()
+	if len(s.configs.pending) == 0 {
+		s.configs.since = s.now()
+		if s.configs.timer == nil {
+			s.configs.timer = time.AfterFunc(s.opts.ConfigWriteBehind, func() {
+				if err := s.FlushConfigs(); err != nil {
+					s.log.Errorf("Failed to store buffered stat configs: %s", err)
+				}
+			})
+		}
+	}
+	s.configs.pending[s.getConfigKeyName(sc)] = pendingConfig{k, sc}
+	due := s.now().Sub(s.configs.since) >= s.opts.ConfigWriteBehind
+	s.configs.mtx.Unlock()
+
+	if due {
+		s.FlushConfigs()
+	}
+}
 
-	// Now query datastore
-	if err := s.ds.Get(k, &sc); err != nil && err != appwrap.ErrNoSuchEntity {
-		return StatConfig{}, err
-	} else if err == appwrap.ErrNoSuchEntity {
-		sc.Name = name
-		sc.Source = source
-		sc.Type = typ
+// Close writes the counter increments and StatConfigs buffered in memory
+// because of StatOptions.CounterAccumulation and ConfigWriteBehind. Instances
+// using either must call it before they exit, or the buffered values are
+// lost. It also checks the bucket keys sampled because of
+// StatOptions.EvictionSampleRate, which would otherwise go unchecked on
+// instances which don't call UpdateBackend.
+func (s StatImplementation) Close() error {
+	countersErr := s.FlushCounters()
+	if err := s.FlushConfigs(); err != nil {
+		return err
 	}
+	if err := s.CheckEvictions(); err != nil {
+		s.log.Warningf("Failed to check for evictions on close: %s", err)
+	}
+	return countersErr
+}
 
-	sc.LastRead = now
+// FlushConfigs stores the StatConfigs buffered because of
+// StatOptions.ConfigWriteBehind with a single datastore PutMulti, and caches
+// them in memcache. Configs which fail to store are dropped from the buffer;
+// they're picked up again the next time they're recorded.
+func (s StatImplementation) FlushConfigs() error {
 
-	// Store item in datastore if it needed the update
-	if _, err := s.ds.Put(k, &sc); err != nil {
-		s.log.Warningf("Failed to update StatConfig %s: %s", sc, err)
-		cache = false
+	s.configs.mtx.Lock()
+	pending := s.configs.pending
+	s.configs.pending = make(map[string]pendingConfig)
+	if s.configs.timer != nil {
+		s.configs.timer.Stop()
+		s.configs.timer = nil
 	}
+	s.configs.mtx.Unlock()
 
-	// Only attempt adding if the update was needed and succeeded
-	if cache {
-		if b, err := s.gobMarshal(&sc); err != nil {
+	if len(pending) == 0 {
+		return nil
+	}
+
+	keys := make([]*appwrap.DatastoreKey, 0, len(pending))
+	scs := make([]StatConfig, 0, len(pending))
+	for _, pc := range pending {
+		keys = append(keys, pc.key)
+		scs = append(scs, pc.sc)
+	}
+
+	if _, err := s.ds.PutMulti(keys, scs); err != nil {
+		s.log.Warningf("Failed to store %d buffered stat configs: %s", len(scs), err)
+		return err
+	}
+
+	items := make([]*appwrap.CacheItem, 0, len(scs))
+	for i := range scs {
+		if b, err := s.gobMarshal(&scs[i]); err != nil {
 			s.log.Warningf("Failed to encode stat config item into memcache: %s", err)
-			return StatConfig{}, nil
 		} else {
-			s.cache.Add(&appwrap.CacheItem{
-				Key:        s.getStatConfigMemcacheKey(typ, name, source),
+			items = append(items, &appwrap.CacheItem{
+				Key:        s.getConfigMemcacheKey(scs[i]),
 				Value:      b,
 				Expiration: time.Duration(24 * time.Hour),
 			})
 		}
 	}
+	s.cache.AddMulti(items)
+
+	return nil
+}
+
+// overSourceLimit counts a new source for the metric and reports whether it
+// takes the metric over StatOptions.MaxSourcesPerMetric.
+func (s StatImplementation) overSourceLimit(typ, name, source string) bool {
+	if s.opts.MaxSourcesPerMetric <= 0 || source == OverflowSource {
+		return false
+	}
+
+	count, err := s.cache.Increment(s.getSourceCountMemcacheKey(s.opts.Service, typ, name), 1, 0)
+	if err != nil {
+		s.log.Warningf("Failed to count sources for %s/%s: %s", typ, name, err)
+		return false
+	}
+	return count > uint64(s.opts.MaxSourcesPerMetric)
+}
+
+// allowNewConfig takes a token from the new config rate limiter, returning
+// false if there are none left. The OverflowSource config is never limited.
+func (s StatImplementation) allowNewConfig(source string) bool {
+	if s.opts.NewConfigRate <= 0 || s.limiter == nil || source == OverflowSource {
+		return true
+	}
+
+	burst := float64(s.opts.NewConfigBurst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(s.opts.NewConfigRate))
+	}
+
+	s.limiter.mtx.Lock()
+	defer s.limiter.mtx.Unlock()
+
+	now := s.now()
+	if s.limiter.last.IsZero() {
+		s.limiter.tokens = burst
+	} else if elapsed := now.Sub(s.limiter.last); elapsed > 0 {
+		s.limiter.tokens = math.Min(burst, s.limiter.tokens+elapsed.Seconds()*s.opts.NewConfigRate)
+	}
+	s.limiter.last = now
+
+	if s.limiter.tokens < 1 {
+		return false
+	}
+	s.limiter.tokens--
+	return true
+}
+
+// getOverflowStatConfig returns the OverflowSource config for the metric, and
+// caches it under the rejected source for expiration so later values skip
+// datastore.
+func (s StatImplementation) getOverflowStatConfig(typ, name, source string, expiration time.Duration) (StatConfig, error) {
+	sc, err := s.getStatConfig(typ, name, OverflowSource)
+	if err != nil {
+		return StatConfig{}, err
+	}
 
+	if b, err := s.gobMarshal(&sc); err != nil {
+		s.log.Warningf("Failed to encode overflow stat config item into memcache: %s", err)
+	} else {
+		s.cache.Add(&appwrap.CacheItem{
+			Key:        s.getStatConfigMemcacheKey(typ, name, source),
+			Value:      b,
+			Expiration: expiration,
+		})
+	}
 	return sc, nil
+}
+
+// getEphemeralStatConfig builds a StatConfig which isn't stored in datastore.
+// It is cached briefly so a datastore outage doesn't cost a datastore round
+// trip on every recorded value.
+func (s StatImplementation) getEphemeralStatConfig(typ, name, source string, now time.Time) StatConfig {
+	sc := StatConfig{Name: name, Source: source, Service: s.opts.Service, Type: typ, LastRead: now, Version: s.sourceVersion(source)}
+	if b, err := s.gobMarshal(&sc); err != nil {
+		s.log.Warningf("Failed to encode ephemeral stat config item into memcache: %s", err)
+	} else {
+		s.cache.Add(&appwrap.CacheItem{
+			Key:        s.getStatConfigMemcacheKey(typ, name, source),
+			Value:      b,
+			Expiration: degradedConfigExpiration,
+		})
+	}
+	return sc
+}
+
+// SetDefaultSampleRate stores the sample rate used for the timing name/source
+// when it is recorded with ConfiguredSampleRate.
+func (s StatImplementation) SetDefaultSampleRate(name, source string, sampleRate float64) error {
+
+	if sampleRate <= 0 || sampleRate > 1.0 {
+		return ErrInvalidSampleRate
+	}
+
+	sc, err := s.getStatConfig(scTypeTiming, name, source)
+	if err != nil {
+		return err
+	}
+	sc.SampleRate = sampleRate
+
+	return s.storeStatConfig(sc)
+}
+
+// SetApdexThreshold stores the threshold used to compute the Apdex score of
+// the timing name/source when it's flushed. Values at or below threshold are
+// satisfied, and values up to four times it are tolerated. A threshold of
+// zero turns Apdex off for the timing.
+func (s StatImplementation) SetApdexThreshold(name, source string, threshold float64) error {
+
+	if threshold < 0 {
+		return ErrInvalidApdexThreshold
+	}
+
+	sc, err := s.getStatConfig(scTypeTiming, name, source)
+	if err != nil {
+		return err
+	}
+	sc.ApdexThreshold = threshold
+
+	return s.storeStatConfig(sc)
+}
+
+// SetCounterShards spreads the increments of the counter name/source over
+// shards memcache keys, chosen at random for each increment, so a very hot
+// counter isn't limited by the throughput of a single key. UpdateBackend
+// adds the shards back together. Increments made to shards beyond a reduced
+// shard count during the current period are lost. Sharded counters can't be
+// decremented; negative deltas return ErrShardedCounterDecrement.
+func (s StatImplementation) SetCounterShards(name, source string, shards int) error {
+
+	if shards < 1 {
+		return ErrInvalidShardCount
+	}
+
+	sc, err := s.getStatConfig(scTypeCounter, name, source)
+	if err != nil {
+		return err
+	}
+	sc.Shards = shards
+
+	return s.storeStatConfig(sc)
+}
+
+// TouchMetric refreshes the LastRead time of the stat type/name/source's
+// StatConfig without recording a value, so a stat which is only recorded
+// occasionally (e.g. by a daily cron job) stays active and keeps being
+// flushed in between. It returns ErrStatConfigNotFound for stats which have
+// never been recorded.
+func (s StatImplementation) TouchMetric(typ, name, source string) error {
+	sc, err := s.ConfigFor(typ, name, source)
+	if err != nil {
+		return err
+	}
+	sc.LastRead = s.now()
+
+	return s.storeStatConfig(sc)
+}
+
+// storeStatConfig writes a changed StatConfig through to datastore and
+// memcache.
+func (s StatImplementation) storeStatConfig(sc StatConfig) error {
+
+	k := s.getConfigDatastoreKey(sc)
+	if _, found := s.getPendingConfigNamed(s.getConfigKeyName(sc)); found {
+		s.addPendingConfig(k, sc)
+		return nil
+	}
+
+	if _, err := s.ds.Put(k, &sc); err != nil {
+		s.log.Errorf("Failed to store StatConfig %s: %s", sc, err)
+		return err
+	}
 
+	if b, err := s.gobMarshal(&sc); err != nil {
+		return err
+	} else {
+		return s.cache.Set(&appwrap.CacheItem{
+			Key:        s.getConfigMemcacheKey(sc),
+			Value:      b,
+			Expiration: time.Duration(24 * time.Hour),
+		})
+	}
 }
 
 func (s StatImplementation) peekCounter(name, source string, at time.Time) (uint64, error) {
 
-	bucketKey, err := s.getBucketKey(scTypeCounter, name, source, time.Now())
+	bucketKey, err := s.getBucketKey(scTypeCounter, name, source, s.now())
 	if err != nil {
 		return uint64(0), err
 	}
@@ -433,7 +3594,7 @@ func (s StatImplementation) peekCounter(name, source string, at time.Time) (uint
 
 func (s StatImplementation) peekGauge(name, source string, at time.Time) ([]float64, error) {
 
-	bucketKey, err := s.getBucketKey(scTypeGauge, name, source, time.Now())
+	bucketKey, err := s.getBucketKey(scTypeGauge, name, source, s.now())
 	if err != nil {
 		return nil, err
 	}
@@ -442,7 +3603,7 @@ func (s StatImplementation) peekGauge(name, source string, at time.Time) ([]floa
 	if item, err := s.cache.Get(bucketKey); err != nil {
 		return nil, err
 	} else {
-		if s.gobUnmarshal(item.Value, &gm); err != nil {
+		if err := s.decodeSamples(item.Value, &gm); err != nil {
 			s.log.Errorf("Error decoding gauge values: %s", err)
 			return nil, err
 		}
@@ -452,7 +3613,7 @@ func (s StatImplementation) peekGauge(name, source string, at time.Time) ([]floa
 
 func (s StatImplementation) peekTiming(name, source string, at time.Time) ([]float64, error) {
 
-	bucketKey, err := s.getBucketKey(scTypeTiming, name, source, time.Now())
+	bucketKey, err := s.getBucketKey(scTypeTiming, name, source, s.now())
 	if err != nil {
 		return nil, err
 	}
@@ -461,79 +3622,436 @@ func (s StatImplementation) peekTiming(name, source string, at time.Time) ([]flo
 	if item, err := s.cache.Get(bucketKey); err != nil {
 		return nil, err
 	} else {
-		if s.gobUnmarshal(item.Value, &gm); err != nil {
+		if err := s.decodeSamples(item.Value, &gm); err != nil {
 			s.log.Errorf("Error decoding timing values: %s", err)
 			return nil, err
 		}
-		return gm, nil
+		return gm, nil
+	}
+}
+
+// sample decides whether a value is recorded given its sample rate, looking
+// up the configured rate for ConfiguredSampleRate. It returns
+// ErrStatNotSampled for values which are skipped, the rate used, and whether
+// the rate was given explicitly.
+func (s StatImplementation) sample(typ, name, source string, value, sampleRate float64) (float64, bool, error) {
+	explicitRate := sampleRate >= 0
+	if !explicitRate {
+		statConfig, err := s.getStatConfig(typ, name, source)
+		if err != nil {
+			wrappedErr := NewErrStatDropped(typ, name, source, s.now(), value, err)
+			s.log.Warningf("%s (getting configured sample rate)", wrappedErr)
+			return 0, false, wrappedErr
+		}
+		sampleRate = statConfig.defaultSampleRate()
+	}
+
+	if sampleRate < 1.0 && s.rng.Float64() > sampleRate {
+		s.debugf("Not recording value due to sampling rate")
+		return sampleRate, explicitRate, ErrStatNotSampled // do nothing here, as we are sampling
+	}
+	return sampleRate, explicitRate, nil
+}
+
+// checkValue returns ErrStatInvalidValue, wrapped in an ErrStatDropped, if
+// any of the values recorded for the stat at at are NaN or infinite, which
+// would corrupt its period's min, max, sums and percentiles.
+func (s StatImplementation) checkValue(typ, name, source string, at time.Time, values ...float64) error {
+	for _, value := range values {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			wrappedErr := NewErrStatDropped(typ, name, source, at, value, ErrStatInvalidValue)
+			s.log.Warningf("%s", wrappedErr)
+			return wrappedErr
+		}
+	}
+	return nil
+}
+
+// recordGaugeOrTiming stores a value in the bucket for the period containing
+// at. Gauges keep only the last value unless gaugeHistory is given, in which
+// case up to that many of the most recent values are kept.
+func (s StatImplementation) recordGaugeOrTiming(typ, name, source string, value, sampleRate float64, gaugeHistory int, at time.Time) error {
+
+	if err := s.checkValue(typ, name, source, at, value); err != nil {
+		return err
+	}
+	return s.storeGaugeOrTiming(s.getStatConfig, typ, name, s.rollupSource(typ, name, source), value, sampleRate, gaugeHistory, at)
+}
+
+// storeGaugeOrTiming stores a value like recordGaugeOrTiming, once it's been
+// checked and its source rolled up, looking its config up with getConfig.
+func (s StatImplementation) storeGaugeOrTiming(getConfig statConfigGetter, typ, name, source string, value, sampleRate float64, gaugeHistory int, at time.Time) error {
+	s.debugf("Recording %s/%s/%s: value=%f, samplerate=%f)", typ, name, source, value, sampleRate)
+
+	if typ == scTypeTiming && value < 0 {
+		if s.opts.RejectNegativeTimings {
+			wrappedErr := NewErrStatDropped(typ, name, source, at, value, ErrStatNegativeTiming)
+			s.log.Warningf("%s", wrappedErr)
+			return wrappedErr
+		}
+		s.log.Warningf("Recording negative timing %s/%s: value=%f", name, source, value)
+	}
+
+	rate, explicitRate, err := s.sample(typ, name, source, value, sampleRate)
+	if err != nil {
+		return err
+	}
+
+	statConfig, err := getConfig(typ, name, source)
+	if err != nil {
+		wrappedErr := NewErrStatDropped(typ, name, source, at, value, err)
+		s.log.Warningf("%s (getting bucket key)", wrappedErr)
+		return wrappedErr
+	}
+
+	if explicitRate && statConfig.SampleRate > 0 && statConfig.SampleRate != sampleRate {
+		s.log.Warningf("Sample rate %f given for %s/%s/%s conflicts with its configured sample rate %f",
+			sampleRate, typ, name, source, statConfig.SampleRate)
+	}
+
+	bucketKey := statConfig.BucketKey(at, 0)
+	s.log.Debugf("record bucketKey: %s", bucketKey)
+
+	var cached []float64
+
+	cachedItem, err := s.cache.Get(bucketKey)
+	if err == appwrap.ErrCacheMiss {
+		cached = make([]float64, 0)
+		cachedItem = &appwrap.CacheItem{
+			Key:        bucketKey,
+			Expiration: s.bucketExpiration(typ),
+		}
+	} else if err != nil {
+		wrappedErr := NewErrStatDropped(typ, name, source, at, value, err)
+		s.log.Warningf("%s (getting value from memcache)", wrappedErr)
+		return wrappedErr
+	} else {
+		if err := s.decodeSamples(cachedItem.Value, &cached); err != nil {
+			wrappedErr := NewErrStatDropped(typ, name, source, at, value, err)
+			s.log.Warningf("%s (decoding value from memcache)", wrappedErr)
+			return wrappedErr
+		}
+	}
+
+	switch typ {
+	case scTypeTiming:
+		cached = append(cached, value)
+	case scTypeGauge:
+		if gaugeHistory > 0 {
+			cached = append(cached, value)
+			if len(cached) > gaugeHistory {
+				cached = cached[len(cached)-gaugeHistory:]
+			}
+		} else {
+			cached = []float64{value}
+		}
+	}
+
+	if b, err := s.encodeSamples(typ, cached); err != nil {
+		wrappedErr := NewErrStatDropped(typ, name, source, at, value, err)
+		s.log.Warningf("%s (failed to encode new value)", wrappedErr)
+		return wrappedErr
+	} else {
+		cachedItem.Value = b
+		if err := s.cache.Set(cachedItem); err != nil {
+			wrappedErr := NewErrStatDropped(typ, name, source, at, value, err)
+			s.log.Warningf("%s (failed to set value)", wrappedErr)
+			return wrappedErr
+		}
+	}
+	s.sampleWrite(bucketKey, at)
+	if typ == scTypeTiming {
+		s.addSampledWeight(bucketKey, 1, rate)
+	}
+	return nil
+}
+
+// bucketExpiration returns how long buckets of the stat type are kept in
+// memcache; see StatOptions.CounterExpiration and BucketExpiration.
+func (s StatImplementation) bucketExpiration(typ string) time.Duration {
+	expiration := s.opts.BucketExpiration
+	if typ == scTypeCounter || typ == scTypeFloatCounter {
+		expiration = s.opts.CounterExpiration
+	}
+	if min := time.Duration(2 * defaultAggregationPeriod); expiration < min {
+		expiration = min
+	}
+	// A bucket can be created as its period starts, and CatchUp can flush
+	// it MaxCatchupAge after the period ends
+	if min := s.opts.MaxCatchupAge + defaultAggregationPeriod; s.opts.MaxCatchupAge > 0 && expiration < min {
+		expiration = min
+	}
+	return expiration
+}
+
+// timingSampledKey returns the memcache key the extra weight of a timing's
+// sampled values is stored under for the timing bucket key.
+func timingSampledKey(bucketKey string) string {
+	return bucketKey + "-sampled"
+}
+
+// addSampledWeight adds the values which weight values recorded at
+// sampleRate stand for, beyond themselves, to the timing's sampled weight,
+// in thousandths (memcache can only increment integers). It's used to
+// estimate the timing's true count.
+func (s StatImplementation) addSampledWeight(bucketKey string, weight int, sampleRate float64) {
+	if sampleRate <= 0 || sampleRate >= 1 {
+		return
+	}
+	extra := int64(math.Round(float64(weight) * (1/sampleRate - 1) * 1000))
+	key := timingSampledKey(bucketKey)
+
+	_, err := s.cache.IncrementExisting(key, extra)
+	if err == appwrap.ErrCacheMiss {
+		err = s.cache.Add(&appwrap.CacheItem{
+			Key:        key,
+			Value:      []byte(strconv.FormatInt(extra, 10)),
+			Expiration: s.bucketExpiration(scTypeTiming),
+		})
+		if err == appwrap.ErrNotStored {
+			_, err = s.cache.IncrementExisting(key, extra)
+		}
+	}
+	if err != nil {
+		s.log.Warningf("Failed to add sampled weight to %s, so its estimated count will be low: %s", key, err)
+	}
+}
+
+// estimateCount sets the timing's EstimatedCount from its count and the
+// sampled weight in sampledItem, if any.
+func (s StatImplementation) estimateCount(datum StatDataTiming, sampledItem *appwrap.CacheItem) StatDataTiming {
+	datum.EstimatedCount = datum.Count
+	if sampledItem != nil {
+		if extra, err := strconv.ParseUint(string(sampledItem.Value), 10, 64); err != nil {
+			s.badItem(sampledItem.Key, "Bad sampled weight found in memcache: key %s, value %q, error: %s", sampledItem.Key, sampledItem.Value, err)
+		} else {
+			s.goodItem(sampledItem.Key)
+			datum.EstimatedCount += int(math.Round(float64(extra) / 1000))
+		}
+	}
+	return datum
+}
+
+// sampleWrite remembers the bucket key, written for the period containing at,
+// for CheckEvictions, if it's picked by StatOptions.EvictionSampleRate.
+func (s StatImplementation) sampleWrite(bucketKey string, at time.Time) {
+	if s.opts.EvictionSampleRate <= 0 || s.written == nil || rand.Float64() >= s.opts.EvictionSampleRate {
+		return
+	}
+
+	s.written.mtx.Lock()
+	defer s.written.mtx.Unlock()
+	if _, found := s.written.keys[bucketKey]; !found && len(s.written.keys) >= maxEvictionSamples {
+		return
+	}
+	// Buckets are created during their period and live for two periods
+	s.written.keys[bucketKey] = getStartOfFlushPeriod(at, 2)
+}
+
+// CheckEvictions looks up the bucket keys sampled since the last check (see
+// StatOptions.EvictionSampleRate), and adds those which have vanished before
+// they were due to expire to the statstash.eviction_suspected counter.
+func (s StatImplementation) CheckEvictions() error {
+	if s.written == nil {
+		return nil
+	}
+
+	s.written.mtx.Lock()
+	sampled := s.written.keys
+	s.written.keys = make(map[string]time.Time)
+	s.written.mtx.Unlock()
+
+	now := s.now()
+	keys := make([]string, 0, len(sampled))
+	for k, expires := range sampled {
+		if now.Before(expires) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	items, err := s.cache.GetMulti(keys)
+	if err != nil {
+		s.log.Warningf("Failed to check %d sampled buckets for evictions: %s", len(keys), err)
+		return err
+	}
+
+	evicted := 0
+	for _, k := range keys {
+		if _, found := items[k]; !found {
+			s.debugf("Bucket %s vanished before it was due to expire", k)
+			evicted++
+		}
+	}
+	if evicted == 0 {
+		return nil
+	}
+
+	s.log.Warningf("%d of %d sampled buckets vanished from memcache before they were due to expire; memcache may be evicting stats", evicted, len(keys))
+	return s.IncrementCounterBy("statstash.eviction_suspected", "", int64(evicted))
+}
+
+// RecordTimingSummary records a summary of count timing values aggregated by
+// the caller, rather than the individual values. Summaries are merged with
+// each other and with individually recorded values of the timing when
+// flushed, but only contribute to its count, min, max, sums and variance.
+func (s StatImplementation) RecordTimingSummary(name, source string, count int, min, max, sum, sumSquares float64) error {
+	return s.handleDrop(s.recordTimingSummary(name, source, timingSummary{count, min, max, sum, sumSquares}))
+}
+
+func (s StatImplementation) recordTimingSummary(name, source string, summary timingSummary) error {
+
+	if err := s.checkValue(scTypeTiming, name, source, s.now(), summary.Min, summary.Max, summary.Sum, summary.SumSquares); err != nil {
+		return err
+	}
+	source = s.rollupSource(scTypeTiming, name, source)
+	s.debugf("Recording timing summary %s/%s: %+v", name, source, summary)
+
+	if summary.Count <= 0 {
+		return nil
+	}
+
+	now := s.now()
+	statConfig, err := s.getStatConfig(scTypeTiming, name, source)
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeTiming, name, source, now, summary.Sum, err)
+		s.log.Warningf("%s (getting bucket key)", wrappedErr)
+		return wrappedErr
+	}
+	key := timingSummaryKey(statConfig.BucketKey(now, 0))
+
+	// Merge into the stored summary with compare-and-swap, so concurrent
+	// summaries aren't lost
+	err = s.casUpdate(key, s.bucketExpiration(scTypeTiming), func(item *appwrap.CacheItem, found bool) error {
+		merged := summary
+		if found {
+			var stored timingSummary
+			if err := s.gobUnmarshal(item.Value, &stored); err != nil {
+				return err
+			}
+			stored.merge(merged)
+			merged = stored
+		}
+		b, err := s.gobMarshal(&merged)
+		item.Value = b
+		return err
+	})
+
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeTiming, name, source, now, summary.Sum, err)
+		s.log.Warningf("%s (storing summary)", wrappedErr)
+		return wrappedErr
 	}
+	return nil
 }
 
-func (s StatImplementation) recordGaugeOrTiming(typ, name, source string, value, sampleRate float64) error {
+// RecordTimingWeighted records a timing value which stands for weight
+// values, such as the latency of a batch of weight requests. It counts as
+// weight values in the flushed count, sums, percentiles and Apdex, but is
+// stored only once.
+func (s StatImplementation) RecordTimingWeighted(name, source string, value float64, weight int, sampleRate float64) error {
+	return s.handleDrop(s.recordTimingWeighted(name, source, value, weight, sampleRate))
+}
 
-	s.debugf("Recording %s/%s/%s: value=%f, samplerate=%f)", typ, name, source, value, sampleRate)
+func (s StatImplementation) recordTimingWeighted(name, source string, value float64, weight int, sampleRate float64) error {
 
-	if sampleRate < 1.0 && s.randGen.Float64() > sampleRate {
-		s.debugf("Not recording value due to sampling rate")
-		return ErrStatNotSampled // do nothing here, as we are sampling
+	if err := s.checkValue(scTypeTiming, name, source, s.now(), value); err != nil {
+		return err
+	}
+	source = s.rollupSource(scTypeTiming, name, source)
+	s.debugf("Recording timing %s/%s: value=%f, weight=%d, samplerate=%f)", name, source, value, weight, sampleRate)
+
+	if weight <= 0 {
+		return nil
+	}
+	rate, _, err := s.sample(scTypeTiming, name, source, value, sampleRate)
+	if err != nil {
+		return err
 	}
 
-	now := time.Now()
-	bucketKey, err := s.getBucketKey(typ, name, source, now)
+	now := s.now()
+	statConfig, err := s.getStatConfig(scTypeTiming, name, source)
 	if err != nil {
-		wrappedErr := NewErrStatDropped(typ, name, source, now, value, err)
+		wrappedErr := NewErrStatDropped(scTypeTiming, name, source, now, value, err)
 		s.log.Warningf("%s (getting bucket key)", wrappedErr)
 		return wrappedErr
 	}
+	key := timingWeightedKey(statConfig.BucketKey(now, 0))
 
-	s.log.Debugf("record bucketKey: %s", bucketKey)
-
-	var cached []float64
-
-	cachedItem, err := s.cache.Get(bucketKey)
-	if err == appwrap.ErrCacheMiss {
-		cached = make([]float64, 0)
-		cachedItem = &appwrap.CacheItem{
-			Key:        bucketKey,
-			Expiration: time.Duration(2 * defaultAggregationPeriod),
+	err = s.casUpdate(key, s.bucketExpiration(scTypeTiming), func(item *appwrap.CacheItem, found bool) error {
+		var values []weightedValue
+		if found {
+			if err := s.gobUnmarshal(item.Value, &values); err != nil {
+				return err
+			}
 		}
-	} else if err != nil {
-		wrappedErr := NewErrStatDropped(typ, name, source, now, value, err)
-		s.log.Warningf("%s (getting value from memcache)", wrappedErr)
-		return wrappedErr
-	} else {
-		if s.gobUnmarshal(cachedItem.Value, &cached); err != nil {
-			wrappedErr := NewErrStatDropped(typ, name, source, now, value, err)
-			s.log.Warningf("%s (decoding value from memcache)", wrappedErr)
-			return wrappedErr
+		merged := false
+		for i := range values {
+			if values[i].Value == value {
+				values[i].Weight += weight
+				merged = true
+				break
+			}
 		}
-	}
+		if !merged {
+			values = append(values, weightedValue{value, weight})
+		}
+		b, err := s.gobMarshal(&values)
+		item.Value = b
+		return err
+	})
 
-	switch typ {
-	case scTypeTiming:
-		cached = append(cached, value)
-	case scTypeGauge:
-		cached = []float64{value}
+	if err != nil {
+		wrappedErr := NewErrStatDropped(scTypeTiming, name, source, now, value, err)
+		s.log.Warningf("%s (storing weighted value)", wrappedErr)
+		return wrappedErr
 	}
+	s.addSampledWeight(statConfig.BucketKey(now, 0), weight, rate)
+	return nil
+}
 
-	if b, err := s.gobMarshal(&cached); err != nil {
-		wrappedErr := NewErrStatDropped(typ, name, source, now, value, err)
-		s.log.Warningf("%s (failed to encode new value)", wrappedErr)
-		return wrappedErr
-	} else {
-		cachedItem.Value = b
-		if err := s.cache.Set(cachedItem); err != nil {
-			wrappedErr := NewErrStatDropped(typ, name, source, now, value, err)
-			s.log.Warningf("%s (failed to set value)", wrappedErr)
-			return wrappedErr
+// casUpdate changes the memcache item at key with compare-and-swap, retrying
+// when another instance changes it first. update is passed the stored item
+// (or a new one expiring after expiration, with found false) and sets its
+// new Value.
+func (s StatImplementation) casUpdate(key string, expiration time.Duration, update func(item *appwrap.CacheItem, found bool) error) error {
+	var err error
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		item, getErr := s.cache.Get(key)
+		found := getErr == nil
+		if getErr == appwrap.ErrCacheMiss {
+			item = &appwrap.CacheItem{Key: key, Expiration: expiration}
+		} else if getErr != nil {
+			return getErr
+		}
+
+		if err = update(item, found); err != nil {
+			return err
+		}
+
+		if found {
+			err = s.cache.CompareAndSwap(item)
+		} else {
+			err = s.cache.Add(item)
+		}
+		if err != appwrap.ErrNotStored && err != appwrap.ErrCASConflict {
+			return err
 		}
 	}
-	return nil
+	return err
 }
 
 func (s StatImplementation) getLastPeriodFlushed() time.Time {
+	return s.getLastPeriodFlushedFor(nil)
+}
+
+// getLastPeriodFlushedFor returns the last period flushed by unforced
+// flushes with flushConfig; see FlusherConfig.Types.
+func (s StatImplementation) getLastPeriodFlushedFor(flushConfig *FlusherConfig) time.Time {
 	var lastPeriodFlushed time.Time
-	if item, err := s.cache.Get("ss-lpf"); err != nil {
+	if item, err := s.cache.Get(flushConfig.watermarkKey()); err != nil {
 		return time.Time{}
 	} else {
 		if err := s.gobUnmarshal(item.Value, &lastPeriodFlushed); err != nil {
@@ -546,13 +4064,19 @@ func (s StatImplementation) getLastPeriodFlushed() time.Time {
 }
 
 func (s StatImplementation) updateLastPeriodFlushed(lastPeriodFlushed time.Time) error {
+	return s.updateLastPeriodFlushedFor(nil, lastPeriodFlushed)
+}
+
+// updateLastPeriodFlushedFor sets the last period flushed by unforced
+// flushes with flushConfig.
+func (s StatImplementation) updateLastPeriodFlushedFor(flushConfig *FlusherConfig, lastPeriodFlushed time.Time) error {
 	if b, err := s.gobMarshal(&lastPeriodFlushed); err != nil {
 		s.log.Errorf("Failed to set last period flushed: %s", err)
 		return err
 	} else {
 		s.log.Debugf("FOOOO")
 		return s.cache.Set(&appwrap.CacheItem{
-			Key:   "ss-lpf",
+			Key:   flushConfig.watermarkKey(),
 			Value: b,
 		})
 	}
@@ -566,8 +4090,46 @@ func getStartOfFlushPeriod(at time.Time, offset int) time.Time {
 	return startOfPeriod
 }
 
+func (s StatImplementation) now() time.Time {
+	if s.opts.Clock != nil {
+		return s.opts.Clock()
+	}
+	return time.Now()
+}
+
+// SetDebug turns debug logging on or off. It's safe to call while stats are
+// being recorded, e.g. from an admin endpoint.
+func (s StatImplementation) SetDebug(debug bool) {
+	if s.debug == nil {
+		return
+	}
+	var v int32
+	if debug {
+		v = 1
+	}
+	atomic.StoreInt32(s.debug, v)
+}
+
+// RandSeed returns the seed of the random numbers deciding which sampled
+// values are recorded, e.g. to log it so a test's sampling can be reproduced.
+func (s StatImplementation) RandSeed() int64 {
+	s.rng.mtx.Lock()
+	defer s.rng.mtx.Unlock()
+	return s.rng.seed
+}
+
+// ResetRandSeed restarts the random numbers deciding which sampled values are
+// recorded from seed, so the same sequence of sampling decisions is made
+// again. Zero picks a new seed from the current time.
+func (s StatImplementation) ResetRandSeed(seed int64) {
+	fresh := newSampleRand(seed)
+	s.rng.mtx.Lock()
+	defer s.rng.mtx.Unlock()
+	s.rng.rand, s.rng.seed = fresh.rand, fresh.seed
+}
+
 func (s StatImplementation) debugf(format string, args ...interface{}) {
-	if s.debug {
+	if s.debug != nil && atomic.LoadInt32(s.debug) != 0 {
 		s.log.Debugf(format, args...)
 	}
 }
@@ -584,9 +4146,84 @@ func (s StatImplementation) gobUnmarshal(data []byte, v interface{}) error {
 	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
 }
 
+// samplesFormatVarint is the first byte of values encoded by
+// encodeVarintSamples. Gob encodings never start with a zero byte, as they
+// start with a non-zero message length, so it tells the formats apart.
+const samplesFormatVarint byte = 0
+
+// encodeSamples encodes the values of a gauge or timing bucket: with gob,
+// or, for timings when StatOptions.TimingResolution is set, quantized to
+// varints unless the values are too large to be.
+func (s StatImplementation) encodeSamples(typ string, values []float64) ([]byte, error) {
+	if resolution := s.opts.TimingResolution; typ == scTypeTiming && resolution > 0 {
+		if b, ok := encodeVarintSamples(values, resolution); ok {
+			return b, nil
+		}
+	}
+	return s.gobMarshal(&values)
+}
+
+// decodeSamples decodes the values of a gauge or timing bucket in either of
+// the formats encodeSamples writes.
+func (s StatImplementation) decodeSamples(data []byte, values *[]float64) error {
+	if len(data) > 0 && data[0] == samplesFormatVarint {
+		decoded, err := decodeVarintSamples(data)
+		if err != nil {
+			return err
+		}
+		*values = decoded
+		return nil
+	}
+	return s.gobUnmarshal(data, values)
+}
+
+// encodeVarintSamples encodes values as the format byte, the resolution as
+// 8 bytes, then each value divided by the resolution and rounded, as a
+// varint. It returns false if a value's quotient isn't a finite int64.
+func encodeVarintSamples(values []float64, resolution float64) ([]byte, bool) {
+	b := make([]byte, 9, 9+2*len(values))
+	b[0] = samplesFormatVarint
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(resolution))
+
+	varint := make([]byte, binary.MaxVarintLen64)
+	for _, value := range values {
+		quantized := math.Round(value / resolution)
+		if math.IsNaN(quantized) || math.Abs(quantized) >= math.MaxInt64 {
+			return nil, false
+		}
+		n := binary.PutVarint(varint, int64(quantized))
+		b = append(b, varint[:n]...)
+	}
+	return b, true
+}
+
+func decodeVarintSamples(data []byte) ([]float64, error) {
+	if len(data) < 9 {
+		return nil, fmt.Errorf("varint samples too short (%d bytes)", len(data))
+	}
+	resolution := math.Float64frombits(binary.BigEndian.Uint64(data[1:9]))
+
+	values := make([]float64, 0, len(data)-9)
+	for rest := data[9:]; len(rest) > 0; {
+		quantized, n := binary.Varint(rest)
+		if n <= 0 {
+			return nil, fmt.Errorf("bad varint in samples at byte %d", len(data)-len(rest))
+		}
+		values = append(values, float64(quantized)*resolution)
+		rest = rest[n:]
+	}
+	return values, nil
+}
+
 type StatDataCounter struct {
 	StatConfig
-	Count uint64
+	Count uint64 `json:"count"`
+	// Clamped is set when a decrement during the period may have been
+	// clamped at zero, since memcache counters can't go negative, so Count
+	// may be higher than the sum of the increments.
+	Clamped bool `json:"clamped,omitempty"`
+	// PeriodStart is the start of the period the datum was aggregated for
+	PeriodStart time.Time `json:"-"`
 }
 
 func (dc StatDataCounter) String() string {
@@ -594,20 +4231,42 @@ func (dc StatDataCounter) String() string {
 		dc.Name, dc.Source, dc.Count)
 }
 
+// StatDataFloatCounter holds the total of a counter recorded with
+// RecordCounterFloat for the period.
+type StatDataFloatCounter struct {
+	StatConfig
+	Value float64 `json:"value"`
+	// PeriodStart is the start of the period the datum was aggregated for
+	PeriodStart time.Time `json:"-"`
+}
+
+func (dc StatDataFloatCounter) String() string {
+	return fmt.Sprintf("[Counter: name=%s, source=%s] Value: %f",
+		dc.Name, dc.Source, dc.Value)
+}
+
 type StatDataTiming struct {
 	StatConfig
-	Count            int
-	Min              float64
-	Max              float64
-	Sum              float64
-	SumSquares       float64
-	Median           float64
-	NinthDecileValue float64
-	NinthDecileSum   float64
-	NinthDecileCount int
-	ThreeNinesValue float64
-	ThreeNinesSum   float64
-	ThreeNinesCount int
+	Count            int     `json:"count"`
+	EstimatedCount   int     `json:"estimatedcount"`
+	Min              float64 `json:"min"`
+	Max              float64 `json:"max"`
+	Sum              float64 `json:"sum"`
+	SumSquares       float64 `json:"sumsquares"`
+	Median           float64 `json:"median"`
+	NinthDecileValue float64 `json:"ninthdecilevalue"`
+	NinthDecileSum   float64 `json:"ninthdecilesum"`
+	NinthDecileCount int     `json:"ninthdecilecount"`
+	ThreeNinesValue  float64 `json:"threeninesvalue"`
+	ThreeNinesSum    float64 `json:"threeninessum"`
+	ThreeNinesCount  int     `json:"threeninescount"`
+	// Variance is the population variance of the values recorded
+	Variance float64 `json:"variance"`
+	// Apdex is the Apdex score for the period, only computed when the timing
+	// has an ApdexThreshold, and nil otherwise
+	Apdex *float64 `json:"apdex,omitempty"`
+	// PeriodStart is the start of the period the datum was aggregated for
+	PeriodStart time.Time `json:"-"`
 }
 
 func (dt StatDataTiming) String() string {
@@ -615,9 +4274,17 @@ func (dt StatDataTiming) String() string {
 		dt.Name, dt.Source, dt.Count, dt.Min, dt.Max, dt.Sum, dt.SumSquares, dt.Median, dt.NinthDecileCount, dt.NinthDecileValue, dt.NinthDecileSum, dt.ThreeNinesCount, dt.ThreeNinesValue, dt.ThreeNinesSum)
 }
 
+// StatDataGauge holds the last value recorded for a gauge. Gauges recorded
+// with RecordGaugeWithHistory also carry the min/max over the Samples values
+// kept for the period; otherwise Samples is 1 and Min/Max equal Value.
 type StatDataGauge struct {
 	StatConfig
-	Value float64
+	Value   float64 `json:"value"`
+	Samples int     `json:"samples"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	// PeriodStart is the start of the period the datum was aggregated for
+	PeriodStart time.Time `json:"-"`
 }
 
 func (dg StatDataGauge) String() string {
@@ -625,15 +4292,564 @@ func (dg StatDataGauge) String() string {
 		dg.Name, dg.Source, dg.Value)
 }
 
+// StatDataHistogram holds the number of values recorded into each bucket of
+// a histogram with RecordHistogram. Counts[i] is the number of values at or
+// below Bounds[i] (and above Bounds[i-1]); the extra last count holds values
+// above every bound.
+type StatDataHistogram struct {
+	StatConfig
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+	// PeriodStart is the start of the period the datum was aggregated for
+	PeriodStart time.Time `json:"-"`
+}
+
+func (dh StatDataHistogram) String() string {
+	return fmt.Sprintf("[Histogram: name=%s, source=%s] Bounds: %v, Counts: %v, Sum: %f",
+		dh.Name, dh.Source, dh.Bounds, dh.Counts, dh.Sum)
+}
+
+// StatDataEvent is a discrete event recorded with RecordEvent.
+type StatDataEvent struct {
+	StatConfig
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+	// PeriodStart is the start of the period the datum was aggregated for
+	PeriodStart time.Time `json:"-"`
+}
+
+func (de StatDataEvent) String() string {
+	return fmt.Sprintf("[Event: name=%s, source=%s] Text: %s, Timestamp: %s",
+		de.Name, de.Source, de.Text, de.Timestamp)
+}
+
+// statEvent is an event as it's stored in its period's bucket.
+type statEvent struct {
+	Text      string
+	Timestamp time.Time
+}
+
+// histogramSummary approximates timing-style statistics from a histogram.
+type histogramSummary struct {
+	count       uint64
+	min         float64
+	max         float64
+	median      float64
+	ninthDecile float64
+	threeNines  float64
+}
+
+// summarize estimates the histogram's min, max and percentiles from its
+// bucket boundaries, interpolating linearly within a bucket. Values in the
+// first bucket are assumed to be no lower than zero (or the first bound, if
+// it's negative), and values above the last bound are reported at it.
+func (dh StatDataHistogram) summarize() histogramSummary {
+
+	var summary histogramSummary
+	for _, count := range dh.Counts {
+		summary.count += count
+	}
+	if summary.count == 0 || len(dh.Bounds) == 0 {
+		return summary
+	}
+
+	bucketRange := func(i int) (float64, float64) {
+		last := len(dh.Bounds) - 1
+		switch {
+		case i > last:
+			return dh.Bounds[last], dh.Bounds[last]
+		case i == 0:
+			return math.Min(0, dh.Bounds[0]), dh.Bounds[0]
+		}
+		return dh.Bounds[i-1], dh.Bounds[i]
+	}
+
+	percentile := func(p float64) float64 {
+		rank := p * float64(summary.count)
+		var seen float64
+		for i, count := range dh.Counts {
+			if count == 0 {
+				continue
+			}
+			if seen+float64(count) >= rank {
+				lower, upper := bucketRange(i)
+				return lower + (upper-lower)*(rank-seen)/float64(count)
+			}
+			seen += float64(count)
+		}
+		_, upper := bucketRange(len(dh.Counts) - 1)
+		return upper
+	}
+
+	for i, count := range dh.Counts {
+		if count > 0 {
+			summary.min, _ = bucketRange(i)
+			break
+		}
+	}
+	for i := len(dh.Counts) - 1; i >= 0; i-- {
+		if dh.Counts[i] > 0 {
+			_, summary.max = bucketRange(i)
+			break
+		}
+	}
+	summary.median = percentile(0.5)
+	summary.ninthDecile = percentile(0.9)
+	summary.threeNines = percentile(0.999)
+
+	return summary
+}
+
+// statMessage is the JSON form of a flushed datum used by the message based
+// flushers.
+type statMessage struct {
+	Period time.Time   `json:"period"`
+	Stat   interface{} `json:"stat"`
+}
+
+func marshalStatDatum(datum interface{}, period time.Time) ([]byte, error) {
+	return json.Marshal(statMessage{Period: period, Stat: datum})
+}
+
+// statConfigOf returns the StatConfig embedded in a flushed datum.
+func statConfigOf(datum interface{}) (StatConfig, bool) {
+	switch d := datum.(type) {
+	case StatDataCounter:
+		return d.StatConfig, true
+	case StatDataFloatCounter:
+		return d.StatConfig, true
+	case StatDataTiming:
+		return d.StatConfig, true
+	case StatDataGauge:
+		return d.StatConfig, true
+	case StatDataHistogram:
+		return d.StatConfig, true
+	case StatDataEvent:
+		return d.StatConfig, true
+	}
+	return StatConfig{}, false
+}
+
+// withStatConfig returns datum with its embedded StatConfig replaced by sc.
+func withStatConfig(datum interface{}, sc StatConfig) interface{} {
+	switch d := datum.(type) {
+	case StatDataCounter:
+		d.StatConfig = sc
+		return d
+	case StatDataFloatCounter:
+		d.StatConfig = sc
+		return d
+	case StatDataTiming:
+		d.StatConfig = sc
+		return d
+	case StatDataGauge:
+		d.StatConfig = sc
+		return d
+	case StatDataHistogram:
+		d.StatConfig = sc
+		return d
+	case StatDataEvent:
+		d.StatConfig = sc
+		return d
+	}
+	return datum
+}
+
+// sortStatData sorts flushed data by type (counters, float counters, gauges,
+// timings, histograms then events), then name, then source, then service,
+// then version, so flushes are in a stable order.
+func sortStatData(data []interface{}) {
+	typeRank := func(datum interface{}) int {
+		switch datum.(type) {
+		case StatDataCounter:
+			return 0
+		case StatDataFloatCounter:
+			return 1
+		case StatDataGauge:
+			return 2
+		case StatDataTiming:
+			return 3
+		case StatDataHistogram:
+			return 4
+		case StatDataEvent:
+			return 5
+		}
+		return 6
+	}
+
+	sort.SliceStable(data, func(i, j int) bool {
+		if ri, rj := typeRank(data[i]), typeRank(data[j]); ri != rj {
+			return ri < rj
+		}
+		sci, _ := statConfigOf(data[i])
+		scj, _ := statConfigOf(data[j])
+		if sci.Name != scj.Name {
+			return sci.Name < scj.Name
+		}
+		if sci.Source != scj.Source {
+			return sci.Source < scj.Source
+		}
+		if sci.Service != scj.Service {
+			return sci.Service < scj.Service
+		}
+		return sci.Version < scj.Version
+	})
+}
+
+// setPeriodStart sets the PeriodStart of each datum in data.
+func setPeriodStart(data []interface{}, periodStart time.Time) {
+	for i := range data {
+		switch d := data[i].(type) {
+		case StatDataCounter:
+			d.PeriodStart = periodStart
+			data[i] = d
+		case StatDataFloatCounter:
+			d.PeriodStart = periodStart
+			data[i] = d
+		case StatDataTiming:
+			d.PeriodStart = periodStart
+			data[i] = d
+		case StatDataGauge:
+			d.PeriodStart = periodStart
+			data[i] = d
+		case StatDataHistogram:
+			d.PeriodStart = periodStart
+			data[i] = d
+		case StatDataEvent:
+			d.PeriodStart = periodStart
+			data[i] = d
+		}
+	}
+}
+
+// periodStartOf returns the start of the period a flushed datum belongs to.
+// Data which weren't aggregated by UpdateBackend, and so have no PeriodStart,
+// are taken to be for the last complete period.
+func periodStartOf(datum interface{}) time.Time {
+	var periodStart time.Time
+	switch d := datum.(type) {
+	case StatDataCounter:
+		periodStart = d.PeriodStart
+	case StatDataFloatCounter:
+		periodStart = d.PeriodStart
+	case StatDataTiming:
+		periodStart = d.PeriodStart
+	case StatDataGauge:
+		periodStart = d.PeriodStart
+	case StatDataHistogram:
+		periodStart = d.PeriodStart
+	case StatDataEvent:
+		periodStart = d.PeriodStart
+	}
+	if periodStart.IsZero() {
+		return getStartOfFlushPeriod(time.Now(), -1)
+	}
+	return periodStart
+}
+
+// idempotencyKey returns the Idempotency-Key HTTP flushers send with data,
+// so a backend which deduplicates requests can drop a retried flush. It's
+// derived from the flusher, and the period and values of each datum, so a
+// retry of the same data has the same key, but a re-flush of a period whose
+// values have since changed, such as after late increments, doesn't.
+func idempotencyKey(flusher string, data []interface{}) string {
+	h := sha256.New()
+	io.WriteString(h, flusher)
+	for i := range data {
+		fmt.Fprintf(h, "\n%d ", periodStartOf(data[i]).Unix())
+		if encoded, err := json.Marshal(data[i]); err == nil {
+			h.Write(encoded)
+		} else {
+			fmt.Fprintf(h, "%v", data[i])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// periodKey returns a key derived from the flusher, and the period and stat
+// of each datum (not its value), so it's the same whenever the same period
+// is flushed again, for flushers which replace what they wrote before.
+func periodKey(flusher string, data []interface{}) string {
+	h := sha256.New()
+	io.WriteString(h, flusher)
+	for i := range data {
+		sc, _ := statConfigOf(data[i])
+		fmt.Fprintf(h, "\n%d %s %s %s", periodStartOf(data[i]).Unix(), sc.Type, sc.Name, sc.Source)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
 // StatsFlusher is an interface used to flush stats to various locations
 type StatsFlusher interface {
 	Flush(data []interface{}, cfg *FlusherConfig) error
 }
 
+// StatsEventEmitter is implemented by flushers whose backend can show events
+// (annotations) alongside metrics, such as deploy markers.
+type StatsEventEmitter interface {
+	EmitEvent(title, text string, tags map[string]string) error
+}
+
+// StatsFlushReporter is implemented by flushers whose backend accepts or
+// rejects each datum separately, such as bulk APIs, so
+// UpdateBackendWithReport can report what was accepted.
+type StatsFlushReporter interface {
+	StatsFlusher
+	// FlushWithStatus flushes like Flush, also returning the error for
+	// each datum the backend rejected, at the datum's index (nil for those
+	// accepted). The returned error is for failures of the whole flush.
+	FlushWithStatus(data []interface{}, cfg *FlusherConfig) ([]error, error)
+}
+
+// FlushReport holds the outcome of flushing each datum of a period; see
+// UpdateBackendWithReport. Empty is set when the period had no data, so
+// nothing was sent to the flusher, as opposed to a flush which succeeded.
+type FlushReport struct {
+	Period  time.Time
+	Results []FlushResult
+	Empty   bool
+}
+
+// FlushResult is the outcome of flushing one datum; Err is nil if the
+// backend accepted it.
+type FlushResult struct {
+	Datum interface{}
+	Err   error
+}
+
+// Rejected returns the results of the data which weren't flushed.
+func (fr FlushReport) Rejected() []FlushResult {
+	var rejected []FlushResult
+	for _, result := range fr.Results {
+		if result.Err != nil {
+			rejected = append(rejected, result)
+		}
+	}
+	return rejected
+}
+
+// EmitEvent sends an event through flusher if it's a StatsEventEmitter, and
+// does nothing otherwise.
+func EmitEvent(flusher StatsFlusher, title, text string, tags map[string]string) error {
+	if emitter, ok := flusher.(StatsEventEmitter); ok {
+		return emitter.EmitEvent(title, text, tags)
+	}
+	return nil
+}
+
+// NewDeployEventHook returns a StatOptions.OnFlush hook which emits an event
+// with the given title, text and tags through the flusher the first time the
+// StatInterface flushes, marking when the new version started reporting.
+// Failures to emit it are logged to log.
+func NewDeployEventHook(log appwrap.Logging, title, text string, tags map[string]string) func(time.Time, StatsFlusher, []interface{}) {
+	var once sync.Once
+	return func(periodStart time.Time, flusher StatsFlusher, data []interface{}) {
+		once.Do(func() {
+			if err := EmitEvent(flusher, title, text, tags); err != nil {
+				log.Errorf("Failed to emit deploy event %q: %s", title, err)
+			}
+		})
+	}
+}
+
+// HTTPDoer is the part of *http.Client used by the HTTP-based flushers, so
+// requests can be sent through tracing, retry or custom TLS middleware.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// gzipBytes returns b gzip compressed, for flushers which compress their
+// request bodies.
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// InstrumentedStatsFlusher is implemented by flushers which measure the
+// requests they make to their backend, such as the HTTP flushers, so
+// UpdateBackend can record them as self-metrics (see
+// StatOptions.SelfMetrics).
+type InstrumentedStatsFlusher interface {
+	StatsFlusher
+	// FlusherName names the backend, e.g. "librato".
+	FlusherName() string
+	// FlushWithStats flushes like Flush, also describing the requests it
+	// made, whether or not it succeeded.
+	FlushWithStats(data []interface{}, cfg *FlusherConfig) (FlushStats, error)
+}
+
+// FlushStats describes the requests a flusher made for a flush.
+type FlushStats struct {
+	Requests int
+	// Duration is the total time spent on the requests
+	Duration time.Duration
+	// Bytes is the total size of the request bodies
+	Bytes int64
+}
+
+// flushMeter measures the requests an HTTP flusher makes for the FlushStats
+// of a single flush, which may send them concurrently.
+type flushMeter struct {
+	mtx   sync.Mutex
+	stats FlushStats
+}
+
+// do sends req through client, adding it to the flush's stats.
+func (m *flushMeter) do(client HTTPDoer, req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	resp, err := client.Do(req)
+	m.mtx.Lock()
+	m.stats.Requests++
+	m.stats.Duration += time.Since(started)
+	if req.ContentLength > 0 {
+		m.stats.Bytes += req.ContentLength
+	}
+	m.mtx.Unlock()
+	return resp, err
+}
+
 type FlusherConfig struct {
 	Username string
 	Password string
 	ApiKey   string
+
+	// Interpolation is how UpdateBackend computes timing percentiles
+	Interpolation PercentileInterpolation
+
+	// RawCounts makes flushers send the number of timing values actually
+	// recorded, rather than the number estimated from their sample rates
+	// (see StatDataTiming.EstimatedCount).
+	RawCounts bool
+
+	// NameMapper, if set, returns the name flushers send each stat as, so
+	// one backend can be given different names than another (e.g. legacy
+	// dashboard names) without renaming the stat where it's recorded. The
+	// stat's own name is kept if it returns "".
+	NameMapper func(StatConfig) string
+
+	// AdvanceOnError makes UpdateBackend mark a period flushed even when
+	// flushing it fails, for best-effort backends where a failed period
+	// shouldn't be retried (or hold up CatchUp) at the cost of losing it.
+	// By default the period is left unflushed, so it's retried.
+	AdvanceOnError bool
+
+	// Types, if set, restricts UpdateBackend to flushing the stats of these
+	// types ("counter", "floatcounter", "gauge", "timing" and "event"), e.g.
+	// only counters to a billing backend. Unforced flushes with different
+	// Types keep separate last flushed watermarks, so each backend of a
+	// period flushed with one filter per backend gets its data.
+	Types []string
+}
+
+// emittedData returns the data as flushers send it: timings have their
+// EstimatedCount as their count, with their sums and percentile counts and
+// sums scaled to match so averages are unchanged, unless cfg asks for
+// RawCounts, and stats are renamed by
+// cfg's NameMapper.
+func emittedData(data []interface{}, cfg *FlusherConfig) []interface{} {
+	scaleCounts := cfg == nil || !cfg.RawCounts
+	var nameMapper func(StatConfig) string
+	if cfg != nil {
+		nameMapper = cfg.NameMapper
+	}
+	if !scaleCounts && nameMapper == nil {
+		return data
+	}
+
+	var emitted []interface{}
+	set := func(i int, datum interface{}) {
+		if emitted == nil {
+			emitted = append([]interface{}(nil), data...)
+		}
+		emitted[i] = datum
+	}
+	for i := range data {
+		if d, ok := data[i].(StatDataTiming); ok && scaleCounts && d.Count > 0 && d.EstimatedCount > d.Count {
+			scale := float64(d.EstimatedCount) / float64(d.Count)
+			d.Count = d.EstimatedCount
+			d.Sum *= scale
+			d.SumSquares *= scale
+			d.NinthDecileCount = int(math.Round(float64(d.NinthDecileCount) * scale))
+			d.NinthDecileSum *= scale
+			d.ThreeNinesCount = int(math.Round(float64(d.ThreeNinesCount) * scale))
+			d.ThreeNinesSum *= scale
+			set(i, d)
+		}
+		if nameMapper == nil {
+			continue
+		}
+		datum := data[i]
+		if emitted != nil {
+			datum = emitted[i]
+		}
+		if sc, ok := statConfigOf(datum); ok {
+			if name := nameMapper(sc); name != "" && name != sc.Name {
+				sc.Name = name
+				set(i, withStatConfig(datum, sc))
+			}
+		}
+	}
+	if emitted == nil {
+		return data
+	}
+	return emitted
+}
+
+// PercentileInterpolation is a method of computing percentiles.
+type PercentileInterpolation int
+
+const (
+	// PercentileNearestRank takes the smallest value which is greater than
+	// or equal to at least p of the values. It's the default.
+	PercentileNearestRank PercentileInterpolation = iota
+	// PercentileLinear interpolates between the two values nearest to rank
+	// p*(count-1), matching numpy's and most spreadsheets' percentiles.
+	PercentileLinear
+)
+
+func (fc *FlusherConfig) interpolation() PercentileInterpolation {
+	if fc == nil {
+		return PercentileNearestRank
+	}
+	return fc.Interpolation
+}
+
+// watermarkKey returns the memcache key of the last flushed period of
+// unforced flushes with the config; those restricted to some Types have a
+// watermark per set of types.
+func (fc *FlusherConfig) watermarkKey() string {
+	if fc == nil || len(fc.Types) == 0 {
+		return "ss-lpf"
+	}
+	types := append([]string(nil), fc.Types...)
+	sort.Strings(types)
+	return "ss-lpf:" + strings.Join(types, ",")
+}
+
+// filterTypes returns the data of the types the config's Types allows, in
+// their original order.
+func (fc *FlusherConfig) filterTypes(data []interface{}) []interface{} {
+	if fc == nil || len(fc.Types) == 0 {
+		return data
+	}
+	filtered := data[:0]
+	for _, datum := range data {
+		sc, _ := statConfigOf(datum)
+		for _, typ := range fc.Types {
+			if sc.Type == typ {
+				filtered = append(filtered, datum)
+				break
+			}
+		}
+	}
+	return filtered
 }
 
 // LogOnlyStatsFlusher is used to "flush" stats for testing and development.
@@ -652,10 +4868,19 @@ func (f LogOnlyStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error
 		switch data[i].(type) {
 		case StatDataCounter:
 			datum = data[i].(StatDataCounter)
+		case StatDataFloatCounter:
+			datum = data[i].(StatDataFloatCounter)
 		case StatDataTiming:
 			datum = data[i].(StatDataTiming)
 		case StatDataGauge:
 			datum = data[i].(StatDataGauge)
+		case StatDataHistogram:
+			datum = data[i].(StatDataHistogram)
+		case StatDataEvent:
+			datum = data[i].(StatDataEvent)
+		default:
+			f.log.Warningf("Stat of unknown type %T: %#v", data[i], data[i])
+			continue
 		}
 		f.log.Infof("%s", datum)
 	}
@@ -17,20 +17,35 @@
 package statstash
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/golang/snappy"
 	"github.com/pendo-io/appwrap"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	. "gopkg.in/check.v1"
 )
 
 type MockFlusher struct {
 	mock.Mock
 	counters []StatDataCounter
+	floats   []StatDataFloatCounter
 	timings  []StatDataTiming
 	gauges   []StatDataGauge
 }
@@ -38,12 +53,15 @@ type MockFlusher struct {
 func (m *MockFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
 	rargs := m.Called(data, cfg)
 	m.counters = make([]StatDataCounter, 0)
+	m.floats = make([]StatDataFloatCounter, 0)
 	m.timings = make([]StatDataTiming, 0)
 	m.gauges = make([]StatDataGauge, 0)
 	for i := range data {
 		switch data[i].(type) {
 		case StatDataCounter:
 			m.counters = append(m.counters, data[i].(StatDataCounter))
+		case StatDataFloatCounter:
+			m.floats = append(m.floats, data[i].(StatDataFloatCounter))
 		case StatDataTiming:
 			m.timings = append(m.timings, data[i].(StatDataTiming))
 		case StatDataGauge:
@@ -53,9 +71,61 @@ func (m *MockFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
 	return rargs.Error(0)
 }
 
+// MockEventFlusher is a MockFlusher which also records emitted events.
+type MockEventFlusher struct {
+	MockFlusher
+	events  []mockEvent
+	emitErr error
+}
+
+type mockEvent struct {
+	title, text string
+	tags        map[string]string
+}
+
+func (m *MockEventFlusher) EmitEvent(title, text string, tags map[string]string) error {
+	m.events = append(m.events, mockEvent{title, text, tags})
+	return m.emitErr
+}
+
+// MockReportingFlusher is a MockFlusher which rejects the data of the stats
+// named in reject.
+type MockReportingFlusher struct {
+	MockFlusher
+	reject map[string]bool
+}
+
+func (m *MockReportingFlusher) FlushWithStatus(data []interface{}, cfg *FlusherConfig) ([]error, error) {
+	if err := m.Flush(data, cfg); err != nil {
+		return nil, err
+	}
+	statuses := make([]error, len(data))
+	for i := range data {
+		if name := mockStatName(data[i]); m.reject[name] {
+			statuses[i] = fmt.Errorf("rejected %s", name)
+		}
+	}
+	return statuses, nil
+}
+
+func mockStatName(datum interface{}) string {
+	switch d := datum.(type) {
+	case StatDataCounter:
+		return d.Name
+	case StatDataTiming:
+		return d.Name
+	case StatDataGauge:
+		return d.Name
+	}
+	return ""
+}
+
+// testAppID is the app ID of the StatImplementations tests use.
+const testAppID = "statstash-test"
+
 func (s *StatStashTest) newTestStatsStash() StatImplementation {
 	ssi := NewStatInterface(appwrap.NewWriterLogger(os.Stderr), appwrap.NewLocalDatastore(false, nil), appwrap.NewLocalMemcache(), true).(StatImplementation)
-	ssi.randGen = rand.New(rand.NewSource(time.Now().UnixNano()))
+	ssi.opts.AppID = testAppID
 	return ssi
 }
 
@@ -91,269 +161,2979 @@ func (s *StatStashTest) TestStatCounters(c *C) {
 
 }
 
-func (s *StatStashTest) TestStatGauge(c *C) {
+// racingMemcache simulates another instance creating a bucket between a
+// missed IncrementExisting and the following Add.
+type racingMemcache struct {
+	appwrap.Memcache
+	raced bool
+}
 
-	ssi := s.newTestStatsStash()
+func (m *racingMemcache) IncrementExisting(key string, amount int64) (uint64, error) {
+	if !m.raced {
+		m.raced = true
+		m.Memcache.Add(&appwrap.CacheItem{Key: key, Value: []byte("5")})
+		return 0, appwrap.ErrCacheMiss
+	}
+	return m.Memcache.IncrementExisting(key, amount)
+}
 
-	c.Assert(ssi.RecordGauge("TestStatGauge.subroutine", "A", 24.0), IsNil)
-	c.Assert(ssi.RecordGauge("TestStatGauge.subroutine", "B", 10.0), IsNil)
-	c.Assert(ssi.RecordGauge("TestStatGauge.subroutine", "B", 15.5), IsNil)
-	c.Assert(ssi.RecordGauge("TestStatGauge.grand_total", "", 7264534001), IsNil)
+func (s *StatStashTest) TestStatCountersFirstIncrement(c *C) {
 
-	now := time.Now()
+	ssi := s.newTestStatsStash()
 
-	subA, err := ssi.peekGauge("TestStatGauge.subroutine", "A", now)
+	c.Assert(ssi.IncrementCounter("TestStatCountersFirstIncrement.new", ""), IsNil)
+	count, err := ssi.peekCounter("TestStatCountersFirstIncrement.new", "", time.Now())
 	c.Assert(err, IsNil)
-	c.Assert(subA, HasLen, 1)
-	c.Check(subA[0], Equals, 24.0)
+	c.Check(count, Equals, uint64(1))
 
-	subB, err := ssi.peekGauge("TestStatGauge.subroutine", "B", now)
+	// Losing the race to create the bucket still counts the increment
+	ssi.cache = &racingMemcache{Memcache: ssi.cache}
+	c.Assert(ssi.IncrementCounter("TestStatCountersFirstIncrement.raced", ""), IsNil)
+	count, err = ssi.peekCounter("TestStatCountersFirstIncrement.raced", "", time.Now())
 	c.Assert(err, IsNil)
-	c.Assert(subB, HasLen, 1)
-	c.Check(subB[0], Equals, 15.5)
+	c.Check(count, Equals, uint64(6))
 
-	grand, err := ssi.peekGauge("TestStatGauge.grand_total", "", now)
-	c.Assert(err, IsNil)
-	c.Assert(grand, HasLen, 1)
-	c.Check(grand[0], Equals, float64(7264534001))
+}
 
-	for i := 0; i < 10; i++ {
-		c.Assert(ssi.RecordGauge("TestStatGauge.upandtotheright", "", float64(i)), IsNil)
-	}
+func (s *StatStashTest) TestCounterClamped(c *C) {
 
-	upAndToTheRight, err := ssi.peekGauge("TestStatGauge.upandtotheright", "", now)
+	ssi := s.newTestStatsStash()
+	log := &countingLogger{Logging: ssi.log}
+	ssi.log = log
+
+	c.Assert(ssi.IncrementCounterBy("TestCounterClamped.ok", "", 5), IsNil)
+	c.Assert(ssi.IncrementCounterBy("TestCounterClamped.ok", "", -2), IsNil)
+	c.Check(log.warnings, Equals, 0)
+
+	// Decrementing below zero stops at zero, with a warning
+	c.Assert(ssi.IncrementCounterBy("TestCounterClamped.under", "", 3), IsNil)
+	c.Assert(ssi.IncrementCounterBy("TestCounterClamped.under", "", -5), IsNil)
+	c.Check(log.warnings, Equals, 1)
+	count, err := ssi.peekCounter("TestCounterClamped.under", "", time.Now())
 	c.Assert(err, IsNil)
-	c.Assert(upAndToTheRight, HasLen, 1)
-	c.Check(upAndToTheRight[0], Equals, float64(9))
+	c.Check(count, Equals, uint64(0))
+
+	// as does a period starting with a decrement, rather than storing a
+	// negative count which can't be incremented or flushed
+	c.Assert(ssi.IncrementCounterBy("TestCounterClamped.first", "", -2), IsNil)
+	c.Check(log.warnings, Equals, 2)
+	c.Assert(ssi.IncrementCounter("TestCounterClamped.first", ""), IsNil)
+	count, err = ssi.peekCounter("TestCounterClamped.first", "", time.Now())
+	c.Assert(err, IsNil)
+	c.Check(count, Equals, uint64(1))
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	clamped := make(map[string]bool)
+	counts := make(map[string]uint64)
+	for _, counter := range mockFlusher.counters {
+		clamped[counter.Name], counts[counter.Name] = counter.Clamped, counter.Count
+	}
+	c.Check(clamped, DeepEquals, map[string]bool{
+		"TestCounterClamped.ok":    false,
+		"TestCounterClamped.under": true,
+		"TestCounterClamped.first": true,
+	})
+	c.Check(counts, DeepEquals, map[string]uint64{
+		"TestCounterClamped.ok":    3,
+		"TestCounterClamped.under": 0,
+		"TestCounterClamped.first": 1,
+	})
 
 }
 
-func (s *StatStashTest) TestStatTimings(c *C) {
+func (s *StatStashTest) TestSourceNone(c *C) {
 
 	ssi := s.newTestStatsStash()
 
-	c.Assert(ssi.RecordTiming("TestStatTimings.subroutine", "A", 24.0, 1.0), IsNil)
-	c.Assert(ssi.RecordTiming("TestStatTimings.subroutine", "B", 10.0, 1.0), IsNil)
-	c.Assert(ssi.RecordTiming("TestStatTimings.subroutine", "B", 15.5, 1.0), IsNil)
-	c.Assert(ssi.RecordTiming("TestStatTimings.grand_total", "", 7264534001.0, 1.0), IsNil)
+	c.Assert(ssi.IncrementCounter("TestSourceNone.bar", SourceNone), IsNil)
+	c.Assert(ssi.IncrementCounter("TestSourceNone.bar", ""), IsNil)
 
 	now := time.Now()
-
-	subA, err := ssi.peekTiming("TestStatTimings.subroutine", "A", now)
+	noneKey, err := ssi.getBucketKey("counter", "TestSourceNone.bar", SourceNone, now)
 	c.Assert(err, IsNil)
-	c.Assert(subA, HasLen, 1)
-	c.Check(subA[0], Equals, 24.0)
-
-	subB, err := ssi.peekTiming("TestStatTimings.subroutine", "B", now)
+	emptyKey, err := ssi.getBucketKey("counter", "TestSourceNone.bar", "", now)
 	c.Assert(err, IsNil)
-	c.Assert(subB, HasLen, 2)
-	c.Check(subB[0], Equals, 10.0)
-	c.Check(subB[1], Equals, 15.5)
+	c.Check(noneKey, Equals, emptyKey)
+	c.Check(noneKey, Matches, "ss-metric:counter-TestSourceNone.bar--[0-9]+")
 
-	grand, err := ssi.peekTiming("TestStatTimings.grand_total", "", now)
+	count, err := ssi.peekCounter("TestSourceNone.bar", SourceNone, now)
 	c.Assert(err, IsNil)
-	c.Assert(grand, HasLen, 1)
-	c.Check(grand[0], Equals, 7264534001.0)
+	c.Check(count, Equals, uint64(2))
 
-	for i := 0; i < 10; i++ {
-		c.Assert(ssi.RecordTiming("TestStatTimings.upandtotheright", "", float64(i), 1.0), IsNil)
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+	c.Assert(mockFlusher.counters, HasLen, 1)
+	c.Check(mockFlusher.counters[0].Source, Equals, SourceNone)
+	c.Check(mockFlusher.counters[0].Count, Equals, uint64(2))
+
+	// Flushers send stats without a source without one, or with Librato's
+	// DefaultSource in its place
+	period := getStartOfFlushPeriod(now, -1)
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "TestSourceNone.bar", Source: SourceNone, Type: scTypeCounter}, Count: 2, PeriodStart: period},
 	}
+	postdata := NewLibratoStatsFlusher(s.Context).(LibratoStatsFlusher).postData(data)
+	_, found := postdata["counters[0][source]"]
+	c.Check(found, Equals, false)
+	postdata = NewLibratoStatsFlusherWithOptions(s.Context, LibratoOptions{DefaultSource: "global"}).(LibratoStatsFlusher).postData(data)
+	c.Check(postdata.Get("counters[0][source]"), Equals, "global")
+
+	lines := s.flushToGraphite(c, GraphiteOptions{UseTags: true}, data)
+	c.Check(lines, DeepEquals, []string{fmt.Sprintf("TestSourceNone.bar 2 %d", period.Unix())})
+
+	var written map[string]float64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		c.Assert(err, IsNil)
+		written = decodeRemoteWrite(c, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	c.Assert(NewRemoteWriteStatsFlusher(s.Context, server.URL, nil).Flush(data, nil), IsNil)
+	c.Check(written, DeepEquals, map[string]float64{"__name__=TestSourceNone_bar": 2})
 
-	upAndToTheRight, err := ssi.peekTiming("TestStatTimings.upandtotheright", "", now)
-	c.Assert(err, IsNil)
-	for i, metric := range upAndToTheRight {
-		c.Check(metric, Equals, float64(i))
-	}
+}
 
+// countingDatastore counts the writes made to datastore.
+type countingDatastore struct {
+	appwrap.Datastore
+	puts      int
+	putMultis []int
 }
 
-func (s *StatStashTest) TestGetActiveConfigs(c *C) {
+func (ds *countingDatastore) Put(key *appwrap.DatastoreKey, src interface{}) (*appwrap.DatastoreKey, error) {
+	ds.puts++
+	return ds.Datastore.Put(key, src)
+}
 
-	ssi := s.newTestStatsStash()
+func (ds *countingDatastore) PutMulti(keys []*appwrap.DatastoreKey, src interface{}) ([]*appwrap.DatastoreKey, error) {
+	ds.putMultis = append(ds.putMultis, len(keys))
+	return ds.Datastore.PutMulti(keys, src)
+}
 
-	c.Assert(ssi.Purge(), IsNil)
+func (s *StatStashTest) TestConfigWriteBehind(c *C) {
 
-	c.Assert(ssi.IncrementCounter("TestGetActiveConfigs.foo", "a"), IsNil)
-	c.Assert(ssi.IncrementCounter("TestGetActiveConfigs.foo", "a"), IsNil)
-	c.Assert(ssi.IncrementCounter("TestGetActiveConfigs.foo", "b"), IsNil)
-	c.Assert(ssi.IncrementCounter("TestGetActiveConfigs.bar", ""), IsNil)
-	c.Assert(ssi.IncrementCounter("TestGetActiveConfigs.bar", ""), IsNil)
-	c.Assert(ssi.IncrementCounterBy("TestGetActiveConfigs.bar", "", int64(10)), IsNil)
+	ssi := s.newTestStatsStash()
+	ds := &countingDatastore{Datastore: ssi.ds}
+	ssi.ds = ds
+	ssi.opts.ConfigWriteBehind = time.Hour
+
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("TestConfigWriteBehind.metric%d", i)
+		c.Assert(ssi.IncrementCounter(name, ""), IsNil)
+		c.Assert(ssi.IncrementCounter(name, ""), IsNil)
+	}
 
-	now := time.Now()
-	bucketTs := getStartOfFlushPeriod(now, 0).Unix()
+	c.Check(ds.puts, Equals, 0)
+	c.Check(ds.putMultis, HasLen, 0)
 
-	cfgMap, err := ssi.getActiveConfigs(now, 0)
-	c.Assert(err, IsNil)
-	c.Assert(cfgMap, HasLen, 3)
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
 
-	for _, key := range []string{
-		fmt.Sprintf("ss-metric:counter-TestGetActiveConfigs.foo-a-%d", bucketTs),
-		fmt.Sprintf("ss-metric:counter-TestGetActiveConfigs.foo-b-%d", bucketTs),
-		fmt.Sprintf("ss-metric:counter-TestGetActiveConfigs.bar--%d", bucketTs)} {
-		_, found := cfgMap[key]
-		c.Check(found, Equals, true)
+	c.Check(ds.puts, Equals, 0)
+	c.Check(ds.putMultis, DeepEquals, []int{20})
+	c.Assert(mockFlusher.counters, HasLen, 20)
+	for _, counter := range mockFlusher.counters {
+		c.Check(counter.Count, Equals, uint64(2))
 	}
 
+	// Once stored, the configs come from memcache
+	c.Assert(ssi.IncrementCounter("TestConfigWriteBehind.metric0", ""), IsNil)
+	c.Assert(ssi.FlushConfigs(), IsNil)
+	c.Check(ds.putMultis, DeepEquals, []int{20})
+
 }
 
-func (s *StatStashTest) TestFlushToBackend(c *C) {
+func (s *StatStashTest) TestConfigWriteBehindTimer(c *C) {
 
 	ssi := s.newTestStatsStash()
+	ssi.opts.ConfigWriteBehind = 10 * time.Millisecond
+
+	// Nothing else is recorded, but the config is stored once it's due
+	c.Assert(ssi.IncrementCounter("TestConfigWriteBehindTimer.idle", ""), IsNil)
+	key := ssi.getStatConfigMemcacheKey(scTypeCounter, "TestConfigWriteBehindTimer.idle", "")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := ssi.cache.Get(key); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
 
-	mockFlusher := &MockFlusher{}
+	cfgMap, err := ssi.getActiveConfigs(time.Now(), 0)
+	c.Assert(err, IsNil)
+	c.Check(cfgMap, HasLen, 1)
+	_, pending := ssi.getPendingConfig(scTypeCounter, "TestConfigWriteBehindTimer.idle", "")
+	c.Check(pending, Equals, false)
 
-	c.Assert(ssi.Purge(), IsNil)
+}
 
-	c.Assert(ssi.IncrementCounter("TestFlushToBackend.foo", "a"), IsNil)
-	c.Assert(ssi.IncrementCounter("TestFlushToBackend.foo", "a"), IsNil)
-	c.Assert(ssi.IncrementCounter("TestFlushToBackend.foo", "b"), IsNil)
-	c.Assert(ssi.IncrementCounter("TestFlushToBackend.bar", ""), IsNil)
-	c.Assert(ssi.IncrementCounter("TestFlushToBackend.bar", ""), IsNil)
-	c.Assert(ssi.IncrementCounterBy("TestFlushToBackend.bar", "", int64(10)), IsNil)
+// countingMemcache counts the writes made to counter buckets.
+type countingMemcache struct {
+	appwrap.Memcache
+	mtx    sync.Mutex
+	writes int
+}
 
-	c.Assert(ssi.RecordGauge("TestFlushToBackend.temperature", "raleigh", 24.0), IsNil)
-	c.Assert(ssi.RecordGauge("TestFlushToBackend.temperature", "anchorage", 10.0), IsNil)
-	c.Assert(ssi.RecordGauge("TestFlushToBackend.temperature", "anchorage", 15.5), IsNil)
-	c.Assert(ssi.RecordGauge("TestFlushToBackend.temperature", "buffalo", -1.2), IsNil)
+func (mc *countingMemcache) count(key string) {
+	if strings.HasPrefix(key, "ss-metric:counter-") {
+		mc.mtx.Lock()
+		mc.writes++
+		mc.mtx.Unlock()
+	}
+}
 
-	c.Assert(ssi.RecordTiming("TestFlushToBackend.subroutine", "A", 24.0, 1.0), IsNil)
-	c.Assert(ssi.RecordTiming("TestFlushToBackend.subroutine", "B", 10.0, 1.0), IsNil)
-	c.Assert(ssi.RecordTiming("TestFlushToBackend.subroutine", "B", 15.5, 1.0), IsNil)
+func (mc *countingMemcache) Add(item *appwrap.CacheItem) error {
+	mc.count(item.Key)
+	return mc.Memcache.Add(item)
+}
 
-	for i := 0; i < 10; i++ {
-		c.Assert(ssi.RecordTiming("TestFlushToBackend.upandtotheright", "", float64(i), 1.0), IsNil)
+func (mc *countingMemcache) IncrementExisting(key string, amount int64) (uint64, error) {
+	mc.count(key)
+	return mc.Memcache.IncrementExisting(key, amount)
+}
+
+// configCountingMemcache counts the memcache calls made to look up stat
+// configs.
+type configCountingMemcache struct {
+	appwrap.Memcache
+	mtx   sync.Mutex
+	calls int
+}
+
+func (mc *configCountingMemcache) count(keys ...string) {
+	for _, key := range keys {
+		if strings.HasPrefix(key, "ss-conf:") {
+			mc.mtx.Lock()
+			mc.calls++
+			mc.mtx.Unlock()
+			return
+		}
 	}
+}
 
-	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+func (mc *configCountingMemcache) Get(key string) (*appwrap.CacheItem, error) {
+	mc.count(key)
+	return mc.Memcache.Get(key)
+}
 
-	now := time.Now()
-	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
-	mockFlusher.AssertExpectations(c)
+func (mc *configCountingMemcache) GetMulti(keys []string) (map[string]*appwrap.CacheItem, error) {
+	mc.count(keys...)
+	return mc.Memcache.GetMulti(keys)
+}
 
-	c.Check(mockFlusher.counters, HasLen, 3)
-	c.Check(mockFlusher.timings, HasLen, 3)
-	c.Check(mockFlusher.gauges, HasLen, 3)
+// batchingMemcache records the most keys fetched with one GetMulti, and the
+// most and total bytes of bucket values fetched.
+type batchingMemcache struct {
+	appwrap.Memcache
+	maxKeys    int
+	maxBytes   int
+	totalBytes int
+}
 
-	for _, counter := range mockFlusher.counters {
-		nameAndSource := fmt.Sprintf("%s-%s", counter.Name, counter.Source)
-		switch nameAndSource {
-		case "TestFlushToBackend.foo-a":
-			c.Check(counter.Count, Equals, uint64(2))
-		case "TestFlushToBackend.foo-b":
-			c.Check(counter.Count, Equals, uint64(1))
-		case "TestFlushToBackend.bar-":
-			c.Check(counter.Count, Equals, uint64(12))
+func (mc *batchingMemcache) GetMulti(keys []string) (map[string]*appwrap.CacheItem, error) {
+	if len(keys) > mc.maxKeys {
+		mc.maxKeys = len(keys)
+	}
+	items, err := mc.Memcache.GetMulti(keys)
+	var fetched int
+	for k, item := range items {
+		if strings.HasPrefix(k, "ss-metric:") {
+			fetched += len(item.Value)
 		}
 	}
+	if fetched > mc.maxBytes {
+		mc.maxBytes = fetched
+	}
+	mc.totalBytes += fetched
+	return items, err
+}
 
-	for _, timing := range mockFlusher.timings {
-		nameAndSource := fmt.Sprintf("%s-%s", timing.Name, timing.Source)
-		switch nameAndSource {
-		case "TestFlushToBackend.subroutine-A":
-			c.Check(timing.Count, Equals, 1)
-			c.Check(timing.Min, Equals, 24.0)
-			c.Check(timing.Max, Equals, 24.0)
-			c.Check(timing.Sum, Equals, 24.0)
-			c.Check(timing.SumSquares, Equals, 576.0)
-			c.Check(timing.Median, Equals, 24.0)
-			c.Check(timing.NinthDecileCount, Equals, 1)
-			c.Check(timing.NinthDecileValue, Equals, 24.0)
-			c.Check(timing.NinthDecileSum, Equals, 24.0)
-		case "TestFlushToBackend.subroutine-B":
-			c.Check(timing.Count, Equals, 2)
-			c.Check(timing.Min, Equals, 10.0)
-			c.Check(timing.Max, Equals, 15.5)
-			c.Check(timing.Sum, Equals, 25.5)
-			c.Check(timing.SumSquares, Equals, 340.25)
-			c.Check(timing.Median, Equals, 12.75)
-			c.Check(timing.NinthDecileCount, Equals, 2)
-			c.Check(timing.NinthDecileValue, Equals, 15.5)
-			c.Check(timing.NinthDecileSum, Equals, 25.5)
-		case "TestFlushToBackend.upandtotheright-":
-			c.Check(timing.Count, Equals, 10)
-			c.Check(timing.Min, Equals, 0.0)
-			c.Check(timing.Max, Equals, 9.0)
-			c.Check(timing.Sum, Equals, 45.0)
-			c.Check(timing.SumSquares, Equals, 285.0)
-			c.Check(timing.Median, Equals, 4.5)
-			c.Check(timing.NinthDecileCount, Equals, 9)
-			c.Check(timing.NinthDecileValue, Equals, 8.0)
-			c.Check(timing.NinthDecileSum, Equals, 36.0)
+func (s *StatStashTest) TestFlushAggregatesInBatches(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.AggregationBatchSize = 10
+
+	const timings, values = 35, 200
+	for i := 0; i < timings; i++ {
+		for j := 0; j < values; j++ {
+			c.Assert(ssi.RecordTiming("TestFlushAggregatesInBatches.latency", fmt.Sprintf("s%02d", i), float64(j), 1.0), IsNil)
 		}
 	}
 
-	for _, gauge := range mockFlusher.gauges {
-		nameAndSource := fmt.Sprintf("%s-%s", gauge.Name, gauge.Source)
-		switch nameAndSource {
-		case "TestFlushToBackend.foo-a":
-			c.Check(gauge, Equals, 24.0)
-		case "TestFlushToBackend.foo-b":
-			c.Check(gauge, Equals, 15.5)
-		case "TestFlushToBackend.bar-":
-			c.Check(gauge, Equals, -1.2)
-		}
+	cache := &batchingMemcache{Memcache: ssi.cache}
+	ssi.cache = cache
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.timings, HasLen, timings)
+	for i, timing := range mockFlusher.timings {
+		c.Check(timing.Source, Equals, fmt.Sprintf("s%02d", i))
+		c.Check(timing.Count, Equals, values)
 	}
+	// A timing's bucket is fetched with its summary, weighted values and
+	// sampled weight
+	c.Check(cache.maxKeys, Equals, 4*10)
 
-	// Make sure that flushing again does nothing (i.e. don't force)
-	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, false), Equals, ErrStatFlushTooSoon)
+	// Far more values were recorded than one batch holds, but only a batch
+	// of 10 timings' raw values were fetched into memory at once
+	c.Assert(cache.totalBytes > 3*cache.maxBytes, Equals, true)
+	c.Check(cache.maxBytes <= 10*cache.totalBytes/timings, Equals, true)
 
 }
 
-func (s *StatStashTest) TestPeriodStart(c *C) {
+// evictingMemcache hides the evicted keys, as if memcache had evicted them.
+type evictingMemcache struct {
+	appwrap.Memcache
+	evicted map[string]bool
+}
 
-	utc, _ := time.LoadLocation("UTC")
-	ref := time.Date(2014, 10, 4, 12, 0, 0, 0, utc)
+func (mc *evictingMemcache) GetMulti(keys []string) (map[string]*appwrap.CacheItem, error) {
+	items, err := mc.Memcache.GetMulti(keys)
+	for k := range mc.evicted {
+		delete(items, k)
+	}
+	return items, err
+}
 
-	c.Check(getStartOfFlushPeriod(ref, 0).Unix(), Equals, ref.Unix())
-	c.Check(getStartOfFlushPeriod(ref.Add(1*time.Second), 0).Unix(), Equals, ref.Unix())
+func (s *StatStashTest) TestEvictionSuspected(c *C) {
 
-	c.Check(getStartOfFlushPeriod(ref, -1).Unix(), Equals, ref.Add(defaultAggregationPeriod*time.Duration(-1)).Unix())
-	c.Check(getStartOfFlushPeriod(ref.Add(1*time.Second), -1).Unix(), Equals, ref.Add(defaultAggregationPeriod*time.Duration(-1)).Unix())
+	ssi := s.newTestStatsStash()
+	ssi.opts.EvictionSampleRate = 1
+	now := time.Now()
+
+	c.Assert(ssi.IncrementCounter("TestEvictionSuspected.hits", "a"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestEvictionSuspected.hits", "b"), IsNil)
+	c.Assert(ssi.RecordGauge("TestEvictionSuspected.depth", "", 4), IsNil)
+
+	evictedKey, err := ssi.getBucketKey(scTypeCounter, "TestEvictionSuspected.hits", "a", now)
+	c.Assert(err, IsNil)
+	ssi.cache = &evictingMemcache{Memcache: ssi.cache, evicted: map[string]bool{evictedKey: true}}
+
+	c.Assert(ssi.CheckEvictions(), IsNil)
+	count, err := ssi.peekCounter("statstash.eviction_suspected", "", now)
+	c.Assert(err, IsNil)
+	c.Check(count, Equals, uint64(1))
+
+	// Keys are only checked once
+	c.Assert(ssi.CheckEvictions(), IsNil)
+	count, err = ssi.peekCounter("statstash.eviction_suspected", "", now)
+	c.Assert(err, IsNil)
+	c.Check(count, Equals, uint64(1))
+
+	// Closing an instance checks the keys it sampled since
+	c.Assert(ssi.IncrementCounter("TestEvictionSuspected.hits", "a"), IsNil)
+	c.Assert(ssi.Close(), IsNil)
+	count, err = ssi.peekCounter("statstash.eviction_suspected", "", now)
+	c.Assert(err, IsNil)
+	c.Check(count, Equals, uint64(2))
 
 }
 
-type StatSamplingTestImplementation struct {
-	randGen *rand.Rand
+// expirationMemcache records the expiration of the items it adds or sets.
+type expirationMemcache struct {
+	appwrap.Memcache
+	expirations map[string]time.Duration
 }
 
-func (c StatSamplingTestImplementation) IncrementCounter(name, source string) error { return nil }
-func (c StatSamplingTestImplementation) IncrementCounterBy(name, source string, delta int64) error {
-	return nil
+func (mc *expirationMemcache) Add(item *appwrap.CacheItem) error {
+	mc.expirations[item.Key] = item.Expiration
+	return mc.Memcache.Add(item)
 }
-func (c StatSamplingTestImplementation) RecordGauge(name, source string, value float64) error {
-	return nil
+
+func (mc *expirationMemcache) Set(item *appwrap.CacheItem) error {
+	mc.expirations[item.Key] = item.Expiration
+	return mc.Memcache.Set(item)
 }
-func (c StatSamplingTestImplementation) RecordTiming(name, source string, value, sampleRate float64) error {
 
-	// We use this code copied from the other code to prevent actually having to
-	// use memcache and blowing up the test suite.
-	if sampleRate < 1.0 && c.randGen.Float64() > sampleRate {
-		return ErrStatNotSampled // do nothing here, as we are sampling
+func (s *StatStashTest) TestBucketExpiration(c *C) {
+
+	ssi := s.newTestStatsStash()
+	cache := &expirationMemcache{Memcache: ssi.cache, expirations: make(map[string]time.Duration)}
+	ssi.cache = cache
+	ssi.opts.CounterExpiration = 30 * time.Minute
+	ssi.opts.BucketExpiration = time.Hour
+	now := time.Now()
+
+	bucketExpiration := func(typ, name string) time.Duration {
+		bucketKey, err := ssi.getBucketKey(typ, name, "", now)
+		c.Assert(err, IsNil)
+		return cache.expirations[bucketKey]
 	}
+
+	c.Assert(ssi.IncrementCounter("TestBucketExpiration.hits", ""), IsNil)
+	c.Assert(ssi.RecordCounterFloat("TestBucketExpiration.cost", "", 0.5), IsNil)
+	c.Assert(ssi.RecordGauge("TestBucketExpiration.depth", "", 2), IsNil)
+	c.Assert(ssi.RecordTiming("TestBucketExpiration.latency", "", 5, 1), IsNil)
+	c.Check(bucketExpiration(scTypeCounter, "TestBucketExpiration.hits"), Equals, 30*time.Minute)
+	c.Check(bucketExpiration(scTypeFloatCounter, "TestBucketExpiration.cost"), Equals, 30*time.Minute)
+	c.Check(bucketExpiration(scTypeGauge, "TestBucketExpiration.depth"), Equals, time.Hour)
+	c.Check(bucketExpiration(scTypeTiming, "TestBucketExpiration.latency"), Equals, time.Hour)
+
+	// Buckets must outlive the catch-up age, and two periods
+	ssi.opts.MaxCatchupAge = 45 * time.Minute
+	ssi.opts.BucketExpiration = time.Minute
+	c.Assert(ssi.IncrementCounter("TestBucketExpiration.misses", ""), IsNil)
+	c.Check(bucketExpiration(scTypeCounter, "TestBucketExpiration.misses"), Equals, 45*time.Minute+defaultAggregationPeriod)
+	ssi.opts.MaxCatchupAge = 0
+	c.Check(ssi.bucketExpiration(scTypeTiming), Equals, 2*defaultAggregationPeriod)
+
+}
+
+func (s *StatStashTest) TestCounterAccumulationTimer(c *C) {
+
+	ssi := s.newTestStatsStash()
+	log := &countingLogger{Logging: ssi.log}
+	ssi.log = log
+	ssi.opts.CounterAccumulation = 10 * time.Millisecond
+
+	// Nothing else is recorded, but the sum is written once it's due
+	c.Assert(ssi.IncrementCounterBy("TestCounterAccumulationTimer.idle", "", 3), IsNil)
+	deadline := time.Now().Add(5 * time.Second)
+	var count uint64
+	for count == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		count, _ = ssi.peekCounter("TestCounterAccumulationTimer.idle", "", time.Now())
+	}
+	c.Check(count, Equals, uint64(3))
+	c.Check(log.warnings, Equals, 0)
+
+	// Sums written to a period which was already flushed are logged
+	ssi.opts.CounterAccumulation = time.Hour
+	c.Assert(ssi.updateLastPeriodFlushed(getStartOfFlushPeriod(time.Now(), 0)), IsNil)
+	c.Assert(ssi.IncrementCounter("TestCounterAccumulationTimer.idle", ""), IsNil)
+	c.Assert(ssi.FlushCounters(), IsNil)
+	c.Check(log.warnings, Equals, 1)
+
+}
+
+func (s *StatStashTest) TestCounterAccumulation(c *C) {
+
+	ssi := s.newTestStatsStash()
+	cache := &countingMemcache{Memcache: ssi.cache}
+	ssi.cache = cache
+	ssi.opts.CounterAccumulation = time.Hour
+
+	const goroutines, increments = 20, 500
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				ssi.IncrementCounter("TestCounterAccumulation.hot", "")
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.Check(cache.writes, Equals, 0)
+	c.Assert(ssi.Close(), IsNil)
+	// one increment, which misses, then the Add creating the bucket
+	c.Check(cache.writes, Equals, 2)
+
+	hot, err := ssi.peekCounter("TestCounterAccumulation.hot", "", time.Now())
+	c.Assert(err, IsNil)
+	c.Check(hot, Equals, uint64(goroutines*increments))
+
+	// Flushing to the backend drains the accumulated increments first
+	c.Assert(ssi.IncrementCounterBy("TestCounterAccumulation.hot", "", 5), IsNil)
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+	c.Assert(mockFlusher.counters, HasLen, 1)
+	c.Check(mockFlusher.counters[0].Count, Equals, uint64(goroutines*increments+5))
+
+}
+
+func (s *StatStashTest) TestCloseStoresBufferedConfigs(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ds := &countingDatastore{Datastore: ssi.ds}
+	ssi.ds = ds
+	ssi.opts.ConfigWriteBehind = time.Hour
+
+	c.Assert(ssi.IncrementCounter("TestCloseStoresBufferedConfigs.foo", ""), IsNil)
+	c.Assert(ssi.RecordGauge("TestCloseStoresBufferedConfigs.bar", "", 1.0), IsNil)
+	c.Check(ds.putMultis, HasLen, 0)
+
+	c.Assert(ssi.Close(), IsNil)
+	c.Check(ds.putMultis, DeepEquals, []int{2})
+
+	cfgs, err := ssi.getAllConfigs()
+	c.Assert(err, IsNil)
+	c.Check(cfgs, HasLen, 2)
+
+}
+
+// unwritableMemcache fails every write, like a memcache outage.
+type unwritableMemcache struct {
+	appwrap.Memcache
+}
+
+var errMemcacheUnavailable = errors.New("memcache unavailable")
+
+func (m unwritableMemcache) Set(item *appwrap.CacheItem) error {
+	return errMemcacheUnavailable
+}
+
+func (m unwritableMemcache) IncrementExisting(key string, amount int64) (uint64, error) {
+	return 0, errMemcacheUnavailable
+}
+
+func (s *StatStashTest) TestOnDrop(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.cache = unwritableMemcache{ssi.cache}
+
+	err := ssi.RecordGauge("TestOnDrop.temperature", "", 24.0)
+	c.Assert(err, FitsTypeOf, &ErrStatDropped{})
+
+	var dropped []error
+	ssi.opts.OnDrop = func(err error) { dropped = append(dropped, err) }
+
+	c.Assert(ssi.RecordGauge("TestOnDrop.temperature", "", 24.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestOnDrop.latency", "", 10.0, 1.0), IsNil)
+	c.Assert(ssi.IncrementCounter("TestOnDrop.requests", ""), IsNil)
+
+	c.Assert(dropped, HasLen, 3)
+	for _, err := range dropped {
+		c.Assert(err, FitsTypeOf, &ErrStatDropped{})
+		c.Check(err.(*ErrStatDropped).Unwrap(), Equals, errMemcacheUnavailable)
+	}
+	c.Check(dropped[0].(*ErrStatDropped).name, Equals, "TestOnDrop.temperature")
+	c.Check(dropped[2].(*ErrStatDropped).typ, Equals, scTypeCounter)
+
+}
+
+// unavailableDatastore fails every read and write, like a datastore outage.
+type unavailableDatastore struct {
+	appwrap.Datastore
+}
+
+var errDatastoreUnavailable = errors.New("datastore unavailable")
+
+func (ds unavailableDatastore) Get(key *appwrap.DatastoreKey, dst interface{}) error {
+	return errDatastoreUnavailable
+}
+
+func (ds unavailableDatastore) Put(key *appwrap.DatastoreKey, src interface{}) (*appwrap.DatastoreKey, error) {
+	return nil, errDatastoreUnavailable
+}
+
+// flakyDatastore fails the first call of each of Get, Put and DeleteMulti
+// with an aborted error, like datastore contention.
+type flakyDatastore struct {
+	appwrap.Datastore
+	failures map[string]int
+}
+
+var errDatastoreAborted = status.Error(codes.Aborted, "too much contention")
+
+func (ds *flakyDatastore) fail(op string) bool {
+	ds.failures[op]++
+	return ds.failures[op] == 1
+}
+
+func (ds *flakyDatastore) Get(key *appwrap.DatastoreKey, dst interface{}) error {
+	if ds.fail("Get") {
+		return errDatastoreAborted
+	}
+	return ds.Datastore.Get(key, dst)
+}
+
+func (ds *flakyDatastore) Put(key *appwrap.DatastoreKey, src interface{}) (*appwrap.DatastoreKey, error) {
+	if ds.fail("Put") {
+		return nil, errDatastoreAborted
+	}
+	return ds.Datastore.Put(key, src)
+}
+
+func (ds *flakyDatastore) DeleteMulti(keys []*appwrap.DatastoreKey) error {
+	if ds.fail("DeleteMulti") {
+		return errDatastoreAborted
+	}
+	return ds.Datastore.DeleteMulti(keys)
+}
+
+func (s *StatStashTest) TestDatastoreRetries(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.ds = &flakyDatastore{ssi.ds, make(map[string]int)}
+
+	c.Assert(ssi.IncrementCounter("TestDatastoreRetries.foo", "a"), Equals, errDatastoreAborted)
+
+	ssi = s.newTestStatsStash()
+	ds := &flakyDatastore{ssi.ds, make(map[string]int)}
+	ssi.ds = ds
+	ssi.opts.DatastoreRetries = 2
+	ssi.opts.DatastoreBackoff = time.Millisecond
+
+	c.Assert(ssi.IncrementCounter("TestDatastoreRetries.foo", "a"), IsNil)
+	c.Check(ds.failures["Get"], Equals, 2)
+	c.Check(ds.failures["Put"], Equals, 2)
+
+	fooA, err := ssi.peekCounter("TestDatastoreRetries.foo", "a", time.Now())
+	c.Assert(err, IsNil)
+	c.Check(fooA, Equals, uint64(1))
+
+	c.Assert(ssi.Purge(NewPurgeToken(testAppID)), IsNil)
+	c.Check(ds.failures["DeleteMulti"], Equals, 2)
+
+	// Errors which aren't retryable fail right away
+	ssi.ds = unavailableDatastore{ssi.ds}
+	c.Assert(ssi.IncrementCounter("TestDatastoreRetries.bar", "a"), Equals, errDatastoreUnavailable)
+
+}
+
+func (s *StatStashTest) TestStatCountersDatastoreUnavailable(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.ds = unavailableDatastore{ssi.ds}
+
+	c.Assert(ssi.IncrementCounter("TestStatCountersDatastoreUnavailable.foo", "a"), Equals, errDatastoreUnavailable)
+
+	ssi.opts.DegradeOnDatastoreError = true
+
+	c.Assert(ssi.IncrementCounter("TestStatCountersDatastoreUnavailable.foo", "a"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestStatCountersDatastoreUnavailable.foo", "a"), IsNil)
+
+	fooA, err := ssi.peekCounter("TestStatCountersDatastoreUnavailable.foo", "a", time.Now())
+	c.Assert(err, IsNil)
+	c.Check(fooA, Equals, uint64(2))
+
+}
+
+func (s *StatStashTest) TestStatCountersSourceOverflow(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.MaxSourcesPerMetric = 3
+
+	for i := 0; i < 10; i++ {
+		source := fmt.Sprintf("request-%d", i)
+		c.Assert(ssi.IncrementCounter("TestStatCountersSourceOverflow.foo", source), IsNil)
+		c.Assert(ssi.IncrementCounter("TestStatCountersSourceOverflow.foo", source), IsNil)
+	}
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		count, err := ssi.peekCounter("TestStatCountersSourceOverflow.foo", fmt.Sprintf("request-%d", i), now)
+		c.Assert(err, IsNil)
+		c.Check(count, Equals, uint64(2))
+	}
+
+	overflow, err := ssi.peekCounter("TestStatCountersSourceOverflow.foo", OverflowSource, now)
+	c.Assert(err, IsNil)
+	c.Check(overflow, Equals, uint64(14))
+
+	cfgMap, err := ssi.getActiveConfigs(now, 0)
+	c.Assert(err, IsNil)
+	c.Check(cfgMap, HasLen, 4)
+
+	// Other metrics have their own cap
+	c.Assert(ssi.IncrementCounter("TestStatCountersSourceOverflow.bar", "request-9"), IsNil)
+	bar, err := ssi.peekCounter("TestStatCountersSourceOverflow.bar", "request-9", now)
+	c.Assert(err, IsNil)
+	c.Check(bar, Equals, uint64(1))
+
+}
+
+func (s *StatStashTest) TestStatConfigCreationRateLimit(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.NewConfigRate = 1
+	ssi.opts.NewConfigBurst = 5
+	clock := getStartOfFlushPeriod(time.Now(), 0).Add(time.Second)
+	ssi.opts.Clock = func() time.Time { return clock }
+
+	// A burst of new sources only creates configs until the bucket is empty
+	for i := 0; i < 20; i++ {
+		c.Assert(ssi.IncrementCounter("TestStatConfigCreationRateLimit.foo", fmt.Sprintf("request-%d", i)), IsNil)
+	}
+
+	for i := 0; i < 5; i++ {
+		count, err := ssi.peekCounter("TestStatConfigCreationRateLimit.foo", fmt.Sprintf("request-%d", i), clock)
+		c.Assert(err, IsNil)
+		c.Check(count, Equals, uint64(1))
+	}
+	overflow, err := ssi.peekCounter("TestStatConfigCreationRateLimit.foo", OverflowSource, clock)
+	c.Assert(err, IsNil)
+	c.Check(overflow, Equals, uint64(15))
+
+	cfgMap, err := ssi.getActiveConfigs(clock, 0)
+	c.Assert(err, IsNil)
+	c.Check(cfgMap, HasLen, 6)
+
+	// The bucket refills at the configured rate
+	clock = clock.Add(3 * time.Second)
+	for i := 0; i < 5; i++ {
+		c.Assert(ssi.IncrementCounter("TestStatConfigCreationRateLimit.foo", fmt.Sprintf("later-%d", i)), IsNil)
+	}
+
+	cfgMap, err = ssi.getActiveConfigs(clock, 0)
+	c.Assert(err, IsNil)
+	c.Check(cfgMap, HasLen, 9)
+
+	overflow, err = ssi.peekCounter("TestStatConfigCreationRateLimit.foo", OverflowSource, clock)
+	c.Assert(err, IsNil)
+	c.Check(overflow, Equals, uint64(17))
+
+}
+
+func (s *StatStashTest) TestConfigFor(c *C) {
+
+	ssi := s.newTestStatsStash()
+	clock := time.Now().Truncate(time.Second)
+	ssi.opts.Clock = func() time.Time { return clock }
+
+	c.Assert(ssi.RecordGauge("TestConfigFor.foo", "a", 1.0), IsNil)
+
+	sc, err := ssi.ConfigFor(scTypeGauge, "TestConfigFor.foo", "a")
+	c.Assert(err, IsNil)
+	c.Check(sc.Type, Equals, scTypeGauge)
+	c.Check(sc.Name, Equals, "TestConfigFor.foo")
+	c.Check(sc.Source, Equals, "a")
+	c.Check(sc.LastRead.Equal(clock), Equals, true)
+
+	// Read from datastore when it's no longer in memcache
+	c.Assert(ssi.cache.Flush(), IsNil)
+	sc, err = ssi.ConfigFor(scTypeGauge, "TestConfigFor.foo", "a")
+	c.Assert(err, IsNil)
+	c.Check(sc.Type, Equals, scTypeGauge)
+	c.Check(sc.LastRead.Equal(clock), Equals, true)
+
+	// Looking up other types doesn't register them
+	_, err = ssi.ConfigFor(scTypeCounter, "TestConfigFor.foo", "a")
+	c.Check(err, Equals, ErrStatConfigNotFound)
+	_, err = ssi.ConfigFor(scTypeCounter, "TestConfigFor.foo", "a")
+	c.Check(err, Equals, ErrStatConfigNotFound)
+
+}
+
+func (s *StatStashTest) TestSetDebug(c *C) {
+
+	ssi := s.newTestStatsStash()
+	buf := &bytes.Buffer{}
+	ssi.log = appwrap.NewWriterLogger(buf)
+
+	ssi.SetDebug(false)
+	ssi.debugf("not logged")
+	c.Check(buf.String(), Equals, "")
+
+	// Copies of the implementation share the setting
+	other := ssi
+	other.SetDebug(true)
+	ssi.debugf("logged %d", 1)
+	c.Check(buf.String(), Matches, "(?s).*logged 1.*")
+
+	ssi.SetDebug(false)
+	buf.Reset()
+	other.debugf("not logged")
+	c.Check(buf.String(), Equals, "")
+
+}
+
+func (s *StatStashTest) TestDeriveRatio(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.DeriveRatio("TestDeriveRatio.error_rate", "TestDeriveRatio.errors", "TestDeriveRatio.requests", "api")
+	ssi.DeriveRatio("TestDeriveRatio.error_rate", "TestDeriveRatio.errors", "TestDeriveRatio.requests", "web")
+	ssi.DeriveRatio("TestDeriveRatio.error_rate", "TestDeriveRatio.errors", "TestDeriveRatio.requests", "idle")
+
+	c.Assert(ssi.IncrementCounterBy("TestDeriveRatio.requests", "api", 40), IsNil)
+	c.Assert(ssi.IncrementCounterBy("TestDeriveRatio.errors", "api", 10), IsNil)
+	// No errors at all are a zero error rate
+	c.Assert(ssi.IncrementCounterBy("TestDeriveRatio.requests", "web", 5), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Check(mockFlusher.counters, HasLen, 3)
+	c.Assert(mockFlusher.gauges, HasLen, 2)
+	for _, gauge := range mockFlusher.gauges {
+		c.Check(gauge.Name, Equals, "TestDeriveRatio.error_rate")
+		switch gauge.Source {
+		case "api":
+			c.Check(gauge.Value, Equals, 0.25)
+		case "web":
+			c.Check(gauge.Value, Equals, 0.0)
+		default:
+			c.Errorf("unexpected gauge %s", gauge)
+		}
+	}
+
+}
+
+func (s *StatStashTest) TestFlushOrderIsStable(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	c.Assert(ssi.RecordTiming("TestFlushOrderIsStable.b", "", 1.0, 1.0), IsNil)
+	c.Assert(ssi.RecordGauge("TestFlushOrderIsStable.b", "y", 1.0), IsNil)
+	c.Assert(ssi.IncrementCounter("TestFlushOrderIsStable.b", ""), IsNil)
+	c.Assert(ssi.RecordGauge("TestFlushOrderIsStable.b", "x", 1.0), IsNil)
+	c.Assert(ssi.IncrementCounter("TestFlushOrderIsStable.a", "z"), IsNil)
+	c.Assert(ssi.RecordTiming("TestFlushOrderIsStable.a", "", 1.0, 1.0), IsNil)
+	c.Assert(ssi.IncrementCounter("TestFlushOrderIsStable.a", "y"), IsNil)
+
+	expected := []string{
+		"counter TestFlushOrderIsStable.a/y",
+		"counter TestFlushOrderIsStable.a/z",
+		"counter TestFlushOrderIsStable.b/",
+		"gauge TestFlushOrderIsStable.b/x",
+		"gauge TestFlushOrderIsStable.b/y",
+		"timing TestFlushOrderIsStable.a/",
+		"timing TestFlushOrderIsStable.b/",
+	}
+
+	for i := 0; i < 5; i++ {
+		var order []string
+		mockFlusher := &MockFlusher{}
+		mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+			for _, datum := range args.Get(0).([]interface{}) {
+				sc, _ := statConfigOf(datum)
+				order = append(order, fmt.Sprintf("%s %s/%s", sc.Type, sc.Name, sc.Source))
+			}
+		}).Once()
+		c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+		mockFlusher.AssertExpectations(c)
+		c.Check(order, DeepEquals, expected)
+	}
+
+}
+
+func (s *StatStashTest) TestSelfMetrics(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.SelfMetrics = true
+	ssi.opts.SkipUnchangedGauges = true
+
+	c.Assert(ssi.IncrementCounter("TestSelfMetrics.foo", ""), IsNil)
+	c.Assert(ssi.RecordGauge("TestSelfMetrics.bar", "", 2), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Times(3)
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+
+	gauges := func() map[string]float64 {
+		values := make(map[string]float64)
+		for _, gauge := range mockFlusher.gauges {
+			values[gauge.Name] = gauge.Value
+		}
+		return values
+	}
+
+	values := gauges()
+	c.Check(mockFlusher.counters, HasLen, 1)
+	c.Check(values[selfMetricHeartbeat], Equals, 1.0)
+	c.Check(values[selfMetricCount], Equals, 2.0)
+	c.Check(values[selfMetricDuration] >= 0, Equals, true)
+	c.Check(values["TestSelfMetrics.bar"], Equals, 2.0)
+
+	// The heartbeat is still flushed when there's nothing else to flush
+	c.Assert(ssi.UpdateBackend(getStartOfFlushPeriod(time.Now(), 2), mockFlusher, nil, true), IsNil)
+	values = gauges()
+	c.Check(mockFlusher.counters, HasLen, 0)
+	c.Check(values[selfMetricHeartbeat], Equals, 1.0)
+	c.Check(values[selfMetricCount], Equals, 0.0)
+
+	// And isn't without SelfMetrics
+	ssi.opts.SelfMetrics = false
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+	_, found := gauges()[selfMetricHeartbeat]
+	c.Check(found, Equals, false)
+
+}
+
+func (s *StatStashTest) TestStatFloatCounters(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	for _, delta := range []float64{0.25, 1.10, -0.35, 0.004} {
+		c.Assert(ssi.RecordCounterFloat("TestStatFloatCounters.cost", "a", delta), IsNil)
+	}
+	c.Assert(ssi.RecordCounterFloat("TestStatFloatCounters.cost", "b", -2.5), IsNil)
+	// Integer counters keep their own type
+	c.Assert(ssi.IncrementCounter("TestStatFloatCounters.cost", "a"), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Check(mockFlusher.counters, HasLen, 1)
+	c.Assert(mockFlusher.floats, HasLen, 2)
+	c.Check(mockFlusher.floats[0].Source, Equals, "a")
+	c.Check(math.Abs(mockFlusher.floats[0].Value-1.004) < 1e-9, Equals, true, Commentf("value %f", mockFlusher.floats[0].Value))
+	c.Check(mockFlusher.floats[1].Source, Equals, "b")
+	c.Check(mockFlusher.floats[1].Value, Equals, -2.5)
+
+}
+
+func (s *StatStashTest) TestVersionSource(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.VersionSource = true
+	ssi.opts.Module = "default"
+	ssi.opts.Version = "v12"
+
+	c.Assert(ssi.IncrementCounter("TestVersionSource.requests", "api"), IsNil)
+	c.Assert(ssi.RecordGauge("TestVersionSource.depth", "", 3), IsNil)
+
+	// Values recorded by another version are kept apart
+	other := ssi
+	other.opts.Version = "v13"
+	c.Assert(other.IncrementCounter("TestVersionSource.requests", "api"), IsNil)
+
+	// The version is kept in the config, and only appended when flushed
+	sc, err := ssi.ConfigFor(scTypeCounter, "TestVersionSource.requests", "api")
+	c.Assert(err, IsNil)
+	c.Check(sc.Source, Equals, "api")
+	c.Check(sc.Version, Equals, "default.v12")
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.counters, HasLen, 2)
+	c.Check(mockFlusher.counters[0].Source, Equals, "api:default.v12")
+	c.Check(mockFlusher.counters[1].Source, Equals, "api:default.v13")
+	c.Assert(mockFlusher.gauges, HasLen, 1)
+	c.Check(mockFlusher.gauges[0].Source, Equals, "default.v12")
+
+}
+
+func (s *StatStashTest) TestRecordOperation(c *C) {
+
+	ssi := s.newTestStatsStash()
+	clock := time.Now()
+	ssi.opts.Clock = func() time.Time { return clock }
+
+	c.Assert(ssi.RecordOperation("TestRecordOperation.request", "api", clock.Add(-250*time.Millisecond), nil), IsNil)
+	c.Assert(ssi.RecordOperation("TestRecordOperation.request", "api", clock.Add(-50*time.Millisecond), errors.New("failed")), IsNil)
+
+	// Once the configs are cached, they're looked up with one call
+	cache := &configCountingMemcache{Memcache: ssi.cache}
+	ssi.cache = cache
+	c.Assert(ssi.RecordOperation("TestRecordOperation.request", "api", clock.Add(-100*time.Millisecond), errors.New("failed")), IsNil)
+	c.Check(cache.calls, Equals, 1)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(clock, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.counters, HasLen, 2)
+	c.Check(mockFlusher.counters[0].Name, Equals, "TestRecordOperation.request.count")
+	c.Check(mockFlusher.counters[0].Source, Equals, "api")
+	c.Check(mockFlusher.counters[0].Count, Equals, uint64(3))
+	c.Check(mockFlusher.counters[1].Name, Equals, "TestRecordOperation.request.errors")
+	c.Check(mockFlusher.counters[1].Count, Equals, uint64(2))
+
+	c.Assert(mockFlusher.timings, HasLen, 1)
+	c.Check(mockFlusher.timings[0].Name, Equals, "TestRecordOperation.request.latency")
+	c.Check(mockFlusher.timings[0].Count, Equals, 3)
+	c.Check(mockFlusher.timings[0].Min, Equals, 50.0)
+	c.Check(mockFlusher.timings[0].Max, Equals, 250.0)
+
+}
+
+func (s *StatStashTest) TestShardedCounters(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+
+	c.Check(ssi.SetCounterShards("TestShardedCounters.hits", "", 0), Equals, ErrInvalidShardCount)
+	c.Assert(ssi.SetCounterShards("TestShardedCounters.hits", "", 8), IsNil)
+	c.Check(ssi.IncrementCounterBy("TestShardedCounters.hits", "", -1), Equals, ErrShardedCounterDecrement)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				c.Check(ssi.IncrementCounterBy("TestShardedCounters.hits", "", 2), IsNil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The increments are spread over more than one key
+	cfg, err := ssi.ConfigFor(scTypeCounter, "TestShardedCounters.hits", "")
+	c.Assert(err, IsNil)
+	c.Check(cfg.Shards, Equals, 8)
+	used := 0
+	for _, k := range cfg.shardKeys(cfg.BucketKey(now, 0)) {
+		if _, err := ssi.cache.Get(k); err == nil {
+			used++
+		}
+	}
+	c.Check(used > 1, Equals, true, Commentf("%d shards used", used))
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.counters, HasLen, 1)
+	c.Check(mockFlusher.counters[0].Count, Equals, uint64(400))
+
+}
+
+func (s *StatStashTest) TestStatGauge(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	c.Assert(ssi.RecordGauge("TestStatGauge.subroutine", "A", 24.0), IsNil)
+	c.Assert(ssi.RecordGauge("TestStatGauge.subroutine", "B", 10.0), IsNil)
+	c.Assert(ssi.RecordGauge("TestStatGauge.subroutine", "B", 15.5), IsNil)
+	c.Assert(ssi.RecordGauge("TestStatGauge.grand_total", "", 7264534001), IsNil)
+
+	now := time.Now()
+
+	subA, err := ssi.peekGauge("TestStatGauge.subroutine", "A", now)
+	c.Assert(err, IsNil)
+	c.Assert(subA, HasLen, 1)
+	c.Check(subA[0], Equals, 24.0)
+
+	subB, err := ssi.peekGauge("TestStatGauge.subroutine", "B", now)
+	c.Assert(err, IsNil)
+	c.Assert(subB, HasLen, 1)
+	c.Check(subB[0], Equals, 15.5)
+
+	grand, err := ssi.peekGauge("TestStatGauge.grand_total", "", now)
+	c.Assert(err, IsNil)
+	c.Assert(grand, HasLen, 1)
+	c.Check(grand[0], Equals, float64(7264534001))
+
+	for i := 0; i < 10; i++ {
+		c.Assert(ssi.RecordGauge("TestStatGauge.upandtotheright", "", float64(i)), IsNil)
+	}
+
+	upAndToTheRight, err := ssi.peekGauge("TestStatGauge.upandtotheright", "", now)
+	c.Assert(err, IsNil)
+	c.Assert(upAndToTheRight, HasLen, 1)
+	c.Check(upAndToTheRight[0], Equals, float64(9))
+
+}
+
+func (s *StatStashTest) TestAdjustGauge(c *C) {
+
+	ssi := s.newTestStatsStash()
+	clock := getStartOfFlushPeriod(time.Now(), -1).Add(time.Second)
+	ssi.opts.Clock = func() time.Time { return clock }
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*30)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				errs <- ssi.AdjustGauge("TestAdjustGauge.connections", "a", 1)
+			}
+			for j := 0; j < 10; j++ {
+				errs <- ssi.AdjustGauge("TestAdjustGauge.connections", "a", -1)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, IsNil)
+	}
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Times(3)
+	c.Assert(ssi.UpdateBackend(getStartOfFlushPeriod(clock, 0), mockFlusher, nil, true), IsNil)
+	c.Assert(mockFlusher.gauges, HasLen, 1)
+	c.Check(mockFlusher.gauges[0].Value, Equals, 80.0)
+
+	// The level carries over into the next period
+	clock = clock.Add(defaultAggregationPeriod)
+	c.Assert(ssi.AdjustGauge("TestAdjustGauge.connections", "a", -0.5), IsNil)
+	c.Assert(ssi.UpdateBackend(getStartOfFlushPeriod(clock, 0), mockFlusher, nil, true), IsNil)
+	c.Assert(mockFlusher.gauges, HasLen, 1)
+	c.Check(mockFlusher.gauges[0].Value, Equals, 79.5)
+
+	// and is flushed in a period it isn't adjusted in
+	clock = clock.Add(defaultAggregationPeriod)
+	c.Assert(ssi.UpdateBackend(getStartOfFlushPeriod(clock, 0), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+	c.Assert(mockFlusher.gauges, HasLen, 1)
+	c.Check(mockFlusher.gauges[0].Value, Equals, 79.5)
+
+}
+
+func (s *StatStashTest) TestStatGaugeWithHistory(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	for _, value := range []float64{12.0, 3.5, 40.0, 18.0} {
+		c.Assert(ssi.RecordGaugeWithHistory("TestStatGaugeWithHistory.connections", "", value), IsNil)
+	}
+	c.Assert(ssi.RecordGauge("TestStatGaugeWithHistory.temperature", "", 24.0), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.gauges, HasLen, 2)
+	for _, gauge := range mockFlusher.gauges {
+		switch gauge.Name {
+		case "TestStatGaugeWithHistory.connections":
+			c.Check(gauge.Value, Equals, 18.0)
+			c.Check(gauge.Samples, Equals, 4)
+			c.Check(gauge.Min, Equals, 3.5)
+			c.Check(gauge.Max, Equals, 40.0)
+		case "TestStatGaugeWithHistory.temperature":
+			c.Check(gauge.Value, Equals, 24.0)
+			c.Check(gauge.Samples, Equals, 1)
+			c.Check(gauge.Min, Equals, 24.0)
+			c.Check(gauge.Max, Equals, 24.0)
+		}
+	}
+
+}
+
+func (s *StatStashTest) TestStatTimings(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	c.Assert(ssi.RecordTiming("TestStatTimings.subroutine", "A", 24.0, 1.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestStatTimings.subroutine", "B", 10.0, 1.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestStatTimings.subroutine", "B", 15.5, 1.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestStatTimings.grand_total", "", 7264534001.0, 1.0), IsNil)
+
+	now := time.Now()
+
+	subA, err := ssi.peekTiming("TestStatTimings.subroutine", "A", now)
+	c.Assert(err, IsNil)
+	c.Assert(subA, HasLen, 1)
+	c.Check(subA[0], Equals, 24.0)
+
+	subB, err := ssi.peekTiming("TestStatTimings.subroutine", "B", now)
+	c.Assert(err, IsNil)
+	c.Assert(subB, HasLen, 2)
+	c.Check(subB[0], Equals, 10.0)
+	c.Check(subB[1], Equals, 15.5)
+
+	grand, err := ssi.peekTiming("TestStatTimings.grand_total", "", now)
+	c.Assert(err, IsNil)
+	c.Assert(grand, HasLen, 1)
+	c.Check(grand[0], Equals, 7264534001.0)
+
+	for i := 0; i < 10; i++ {
+		c.Assert(ssi.RecordTiming("TestStatTimings.upandtotheright", "", float64(i), 1.0), IsNil)
+	}
+
+	upAndToTheRight, err := ssi.peekTiming("TestStatTimings.upandtotheright", "", now)
+	c.Assert(err, IsNil)
+	for i, metric := range upAndToTheRight {
+		c.Check(metric, Equals, float64(i))
+	}
+
+}
+
+func (s *StatStashTest) TestStatTimingsInterpolation(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+
+	for _, v := range []float64{35, 15, 50, 20, 40} {
+		c.Assert(ssi.RecordTiming("TestStatTimingsInterpolation.latency", "", v, 1), IsNil)
+	}
+
+	flush := func(cfg *FlusherConfig) StatDataTiming {
+		mockFlusher := &MockFlusher{}
+		mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+		c.Assert(ssi.UpdateBackend(now, mockFlusher, cfg, true), IsNil)
+		mockFlusher.AssertExpectations(c)
+		c.Assert(mockFlusher.timings, HasLen, 1)
+		return mockFlusher.timings[0]
+	}
+
+	// Nearest rank is the default
+	nearest := flush(nil)
+	c.Check(nearest.NinthDecileValue, Equals, 50.0)
+	c.Check(nearest.ThreeNinesValue, Equals, 50.0)
+
+	// numpy.percentile([15, 20, 35, 40, 50], [90, 99.9]) == [46, 49.96]
+	linear := flush(&FlusherConfig{Interpolation: PercentileLinear})
+	c.Check(math.Abs(linear.NinthDecileValue-46) < 1e-9, Equals, true, Commentf("value %f", linear.NinthDecileValue))
+	c.Check(math.Abs(linear.ThreeNinesValue-49.96) < 1e-9, Equals, true, Commentf("value %f", linear.ThreeNinesValue))
+	c.Check(linear.Median, Equals, 35.0)
+	c.Check(linear.NinthDecileCount, Equals, nearest.NinthDecileCount)
+	c.Check(linear.NinthDecileSum, Equals, nearest.NinthDecileSum)
+
+}
+
+func (s *StatStashTest) TestStatTimingSummaries(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	c.Assert(ssi.RecordTimingSummary("TestStatTimingSummaries.batch", "a", 3, 1.0, 4.0, 7.0, 21.0), IsNil)
+	c.Assert(ssi.RecordTimingSummary("TestStatTimingSummaries.batch", "a", 2, 0.5, 3.0, 3.5, 9.25), IsNil)
+
+	// Summaries are merged with individually recorded values, too
+	c.Assert(ssi.RecordTimingSummary("TestStatTimingSummaries.batch", "b", 2, 2.0, 6.0, 8.0, 40.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestStatTimingSummaries.batch", "b", 10.0, 1.0), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.timings, HasLen, 2)
+	for _, timing := range mockFlusher.timings {
+		switch timing.Source {
+		case "a":
+			c.Check(timing.Count, Equals, 5)
+			c.Check(timing.Min, Equals, 0.5)
+			c.Check(timing.Max, Equals, 4.0)
+			c.Check(timing.Sum, Equals, 10.5)
+			c.Check(timing.SumSquares, Equals, 30.25)
+			c.Check(math.Abs(timing.Variance-1.64) < 1e-9, Equals, true)
+		case "b":
+			c.Check(timing.Count, Equals, 3)
+			c.Check(timing.Min, Equals, 2.0)
+			c.Check(timing.Max, Equals, 10.0)
+			c.Check(timing.Sum, Equals, 18.0)
+			c.Check(timing.SumSquares, Equals, 140.0)
+			c.Check(timing.Median, Equals, 10.0)
+		default:
+			c.Errorf("unexpected timing %s", timing)
+		}
+	}
+
+}
+
+func (s *StatStashTest) TestStatTimingsWeighted(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	c.Assert(ssi.RecordTimingWeighted("TestStatTimingsWeighted.batch", "", 1.0, 30, 1.0), IsNil)
+	c.Assert(ssi.RecordTimingWeighted("TestStatTimingsWeighted.batch", "", 1.0, 20, 1.0), IsNil)
+	c.Assert(ssi.RecordTimingWeighted("TestStatTimingsWeighted.batch", "", 10.0, 1, 1.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestStatTimingsWeighted.batch", "", 5.0, 1.0), IsNil)
+
+	// Equal values are stored once, with their weights added
+	sc, err := ssi.getStatConfig(scTypeTiming, "TestStatTimingsWeighted.batch", "")
+	c.Assert(err, IsNil)
+	item, err := ssi.cache.Get(timingWeightedKey(sc.BucketKey(time.Now(), 0)))
+	c.Assert(err, IsNil)
+	var stored []weightedValue
+	c.Assert(ssi.gobUnmarshal(item.Value, &stored), IsNil)
+	c.Check(stored, DeepEquals, []weightedValue{{1.0, 50}, {10.0, 1}})
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.timings, HasLen, 1)
+	timing := mockFlusher.timings[0]
+	c.Check(timing.Count, Equals, 52)
+	c.Check(timing.Sum, Equals, 65.0)
+	c.Check(timing.Min, Equals, 1.0)
+	c.Check(timing.Max, Equals, 10.0)
+	c.Check(timing.Median, Equals, 1.0)
+
+}
+
+func (s *StatStashTest) TestStatTimingsApdex(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	c.Check(ssi.SetApdexThreshold("TestStatTimingsApdex.request", "", -1), Equals, ErrInvalidApdexThreshold)
+	c.Assert(ssi.SetApdexThreshold("TestStatTimingsApdex.request", "", 1.0), IsNil)
+
+	// 6 satisfied, 3 tolerating (including exactly 4x the threshold), 1 frustrated
+	for _, latency := range []float64{0.1, 0.2, 0.3, 0.4, 0.5, 1.0, 2.0, 3.0, 4.0, 10.0} {
+		c.Assert(ssi.RecordTiming("TestStatTimingsApdex.request", "", latency, 1.0), IsNil)
+	}
+	c.Assert(ssi.RecordTiming("TestStatTimingsApdex.other", "", 10.0, 1.0), IsNil)
+
+	// Every value is frustrated, so the score is a genuine zero
+	c.Assert(ssi.SetApdexThreshold("TestStatTimingsApdex.slow", "", 1.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestStatTimingsApdex.slow", "", 10.0, 1.0), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.timings, HasLen, 3)
+	for _, timing := range mockFlusher.timings {
+		encoded, err := json.Marshal(timing)
+		c.Assert(err, IsNil)
+		switch timing.Name {
+		case "TestStatTimingsApdex.request":
+			c.Assert(timing.Apdex, NotNil)
+			c.Check(*timing.Apdex, Equals, 0.75)
+		case "TestStatTimingsApdex.slow":
+			c.Assert(timing.Apdex, NotNil)
+			c.Check(*timing.Apdex, Equals, 0.0)
+			c.Check(string(encoded), Matches, `.*"apdex":0[,}].*`)
+		case "TestStatTimingsApdex.other":
+			c.Check(timing.Apdex, IsNil)
+			c.Check(strings.Contains(string(encoded), "apdex\""), Equals, false)
+		default:
+			c.Errorf("unexpected timing %s", timing)
+		}
+	}
+
+}
+
+func (s *StatStashTest) TestRandSeed(c *C) {
+
+	ssi := NewStatInterfaceWithOptions(appwrap.NewWriterLogger(os.Stderr), appwrap.NewLocalDatastore(false, nil), appwrap.NewLocalMemcache(), false,
+		StatOptions{RandSeed: 42}).(StatImplementation)
+	c.Check(ssi.RandSeed(), Equals, int64(42))
+
+	sampled := func() []bool {
+		var outcomes []bool
+		for i := 0; i < 10; i++ {
+			err := ssi.RecordTiming("TestRandSeed.latency", "", float64(i), 0.5)
+			if err != nil && err != ErrStatNotSampled {
+				c.Fatalf("unexpected error %s", err)
+			}
+			outcomes = append(outcomes, err == nil)
+		}
+		return outcomes
+	}
+
+	// rand.New(rand.NewSource(42)).Float64() <= 0.5 for these draws
+	expected := []bool{true, true, false, true, true, true, false, true, true, false}
+	c.Check(sampled(), DeepEquals, expected)
+
+	// Resetting the seed replays the same decisions
+	ssi.ResetRandSeed(42)
+	c.Check(sampled(), DeepEquals, expected)
+
+	ssi.ResetRandSeed(0)
+	c.Check(ssi.RandSeed(), Not(Equals), int64(42))
+
+}
+
+func (s *StatStashTest) TestStatTimingsEstimatedCount(c *C) {
+
+	// A fixed seed so the weighted value below is sampled
+	ssi := s.newTestStatsStash()
+	ssi.ResetRandSeed(1)
+	now := time.Now()
+
+	recorded := 0
+	for i := 0; i < 400; i++ {
+		if err := ssi.RecordTiming("TestStatTimingsEstimatedCount.latency", "", 10, 0.25); err == nil {
+			recorded++
+		} else {
+			c.Assert(err, Equals, ErrStatNotSampled)
+		}
+	}
+	c.Assert(ssi.RecordTiming("TestStatTimingsEstimatedCount.latency", "", 10, 1), IsNil)
+	c.Assert(ssi.RecordTimingWeighted("TestStatTimingsEstimatedCount.latency", "", 10, 5, 0.5), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.timings, HasLen, 1)
+	timing := mockFlusher.timings[0]
+	c.Check(timing.Count, Equals, recorded+1+5)
+	c.Check(timing.EstimatedCount, Equals, 4*recorded+1+10)
+
+	// Flushers send the estimated count unless asked for raw counts
+	data := []interface{}{timing}
+	estimated := emittedData(data, nil)[0].(StatDataTiming)
+	c.Check(estimated.Count, Equals, timing.EstimatedCount)
+	c.Check(estimated.Sum, Equals, 10*float64(timing.EstimatedCount))
+	scale := float64(timing.EstimatedCount) / float64(timing.Count)
+	c.Check(estimated.NinthDecileCount, Equals, int(math.Round(float64(timing.NinthDecileCount)*scale)))
+	c.Check(estimated.NinthDecileSum, Equals, timing.NinthDecileSum*scale)
+	c.Check(estimated.ThreeNinesCount, Equals, int(math.Round(float64(timing.ThreeNinesCount)*scale)))
+	c.Check(estimated.ThreeNinesSum, Equals, timing.ThreeNinesSum*scale)
+	raw := emittedData(data, &FlusherConfig{RawCounts: true})[0].(StatDataTiming)
+	c.Check(raw.Count, Equals, timing.Count)
+	c.Check(raw.Sum, Equals, 10*float64(timing.Count))
+	c.Check(raw.NinthDecileCount, Equals, timing.NinthDecileCount)
+
+}
+
+func (s *StatStashTest) TestStatTimingsConfiguredSampleRate(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	c.Check(ssi.SetDefaultSampleRate("TestStatTimingsConfiguredSampleRate.rare", "", 0), Equals, ErrInvalidSampleRate)
+	c.Check(ssi.SetDefaultSampleRate("TestStatTimingsConfiguredSampleRate.rare", "", 1.5), Equals, ErrInvalidSampleRate)
+	c.Assert(ssi.SetDefaultSampleRate("TestStatTimingsConfiguredSampleRate.rare", "", 1e-12), IsNil)
+
+	sc, err := ssi.getStatConfig(scTypeTiming, "TestStatTimingsConfiguredSampleRate.rare", "")
+	c.Assert(err, IsNil)
+	c.Check(sc.SampleRate, Equals, 1e-12)
+
+	for i := 0; i < 10; i++ {
+		c.Check(ssi.RecordTiming("TestStatTimingsConfiguredSampleRate.rare", "", float64(i), ConfiguredSampleRate), Equals, ErrStatNotSampled)
+	}
+
+	// Metrics without a configured rate aren't sampled
+	for i := 0; i < 10; i++ {
+		c.Assert(ssi.RecordTiming("TestStatTimingsConfiguredSampleRate.all", "", float64(i), ConfiguredSampleRate), IsNil)
+	}
+
+	all, err := ssi.peekTiming("TestStatTimingsConfiguredSampleRate.all", "", time.Now())
+	c.Assert(err, IsNil)
+	c.Check(all, HasLen, 10)
+
+	// An explicit rate still overrides the configured one
+	c.Assert(ssi.RecordTiming("TestStatTimingsConfiguredSampleRate.rare", "", 1.0, 1.0), IsNil)
+
+}
+
+func (s *StatStashTest) TestClearBuckets(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+
+	c.Assert(ssi.SetCounterShards("TestClearBuckets.hits", "", 4), IsNil)
+	for i := 0; i < 20; i++ {
+		c.Assert(ssi.IncrementCounter("TestClearBuckets.hits", ""), IsNil)
+	}
+	c.Assert(ssi.AdjustGauge("TestClearBuckets.connections", "", 3), IsNil)
+	c.Assert(ssi.RecordTiming("TestClearBuckets.latency", "", 12, 1), IsNil)
+	c.Assert(ssi.RecordTimingSummary("TestClearBuckets.latency", "", 2, 1, 5, 6, 26), IsNil)
+
+	c.Assert(ssi.ClearBuckets(NewPurgeToken(testAppID)), IsNil)
+
+	// The configs, and their settings, survive
+	cfg, err := ssi.ConfigFor(scTypeCounter, "TestClearBuckets.hits", "")
+	c.Assert(err, IsNil)
+	c.Check(cfg.Shards, Equals, 4)
+	_, err = ssi.ConfigFor(scTypeTiming, "TestClearBuckets.latency", "")
+	c.Check(err, IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	ssi.opts.ZeroFill = true
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.counters, HasLen, 1)
+	c.Check(mockFlusher.counters[0].Count, Equals, uint64(0))
+	c.Assert(mockFlusher.gauges, HasLen, 1)
+	c.Check(mockFlusher.gauges[0].Value, Equals, 0.0)
+	c.Check(mockFlusher.timings, HasLen, 0)
+
+	// Adjustments start again from zero
+	c.Assert(ssi.AdjustGauge("TestClearBuckets.connections", "", 1), IsNil)
+	gauge, err := ssi.peekGauge("TestClearBuckets.connections", "", now)
+	c.Assert(err, IsNil)
+	c.Check(gauge, DeepEquals, []float64{1})
+
+}
+
+func (s *StatStashTest) TestRecordHistogram(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+	bounds := []float64{10, 20, 50}
+
+	for _, value := range []float64{1, 5, 10, 15, 45, 100} {
+		c.Assert(ssi.RecordHistogram("TestRecordHistogram.latency", "api", value, bounds), IsNil)
+	}
+	err := ssi.RecordHistogram("TestRecordHistogram.latency", "api", 1, []float64{10, 100})
+	c.Check(err, ErrorMatches, ".*different bounds.*")
+	c.Check(ssi.RecordHistogram("TestRecordHistogram.latency", "api", 1, []float64{20, 10}), Equals, ErrInvalidHistogramBounds)
+	c.Check(ssi.RecordHistogram("TestRecordHistogram.latency", "api", 1, nil), Equals, ErrInvalidHistogramBounds)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	data := mockFlusher.Calls[0].Arguments.Get(0).([]interface{})
+	c.Assert(data, HasLen, 1)
+	histogram := data[0].(StatDataHistogram)
+	c.Check(histogram.Name, Equals, "TestRecordHistogram.latency")
+	c.Check(histogram.Source, Equals, "api")
+	c.Check(histogram.Bounds, DeepEquals, bounds)
+	c.Check(histogram.Counts, DeepEquals, []uint64{3, 1, 1, 1})
+	c.Check(histogram.Sum, Equals, 176.0)
+
+	// It's flushed to Librato as a summary gauge and percentiles
+	postdata := NewLibratoStatsFlusher(s.Context).(LibratoStatsFlusher).postData(data)
+	c.Check(postdata.Get("gauges[0][name]"), Equals, "TestRecordHistogram.latency")
+	c.Check(postdata.Get("gauges[0][count]"), Equals, "6")
+	c.Check(postdata.Get("gauges[0][sum]"), Equals, "176")
+	c.Check(postdata.Get("gauges[1][name]"), Equals, "TestRecordHistogram.latency.50")
+
+}
+
+func (s *StatStashTest) TestGetActiveConfigs(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	c.Assert(ssi.Purge(NewPurgeToken(testAppID)), IsNil)
+
+	c.Assert(ssi.IncrementCounter("TestGetActiveConfigs.foo", "a"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestGetActiveConfigs.foo", "a"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestGetActiveConfigs.foo", "b"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestGetActiveConfigs.bar", ""), IsNil)
+	c.Assert(ssi.IncrementCounter("TestGetActiveConfigs.bar", ""), IsNil)
+	c.Assert(ssi.IncrementCounterBy("TestGetActiveConfigs.bar", "", int64(10)), IsNil)
+
+	now := time.Now()
+	bucketTs := getStartOfFlushPeriod(now, 0).Unix()
+
+	cfgMap, err := ssi.getActiveConfigs(now, 0)
+	c.Assert(err, IsNil)
+	c.Assert(cfgMap, HasLen, 3)
+
+	for _, key := range []string{
+		fmt.Sprintf("ss-metric:counter-TestGetActiveConfigs.foo-a-%d", bucketTs),
+		fmt.Sprintf("ss-metric:counter-TestGetActiveConfigs.foo-b-%d", bucketTs),
+		fmt.Sprintf("ss-metric:counter-TestGetActiveConfigs.bar--%d", bucketTs)} {
+		_, found := cfgMap[key]
+		c.Check(found, Equals, true)
+	}
+
+}
+
+func (s *StatStashTest) TestActiveBucketKeys(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	c.Assert(ssi.Purge(NewPurgeToken(testAppID)), IsNil)
+
+	c.Assert(ssi.IncrementCounter("TestActiveBucketKeys.foo", "b"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestActiveBucketKeys.foo", "a"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestActiveBucketKeys.bar", ""), IsNil)
+
+	now := time.Now()
+	bucketTs := getStartOfFlushPeriod(now, 0).Unix()
+
+	// The keys are sorted
+	bucketKeys, err := ssi.ActiveBucketKeys(now, 0)
+	c.Assert(err, IsNil)
+	c.Check(bucketKeys, DeepEquals, []string{
+		fmt.Sprintf("ss-metric:counter-TestActiveBucketKeys.bar--%d", bucketTs),
+		fmt.Sprintf("ss-metric:counter-TestActiveBucketKeys.foo-a-%d", bucketTs),
+		fmt.Sprintf("ss-metric:counter-TestActiveBucketKeys.foo-b-%d", bucketTs)})
+
+}
+
+func (s *StatStashTest) TestFlushToBackend(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	mockFlusher := &MockFlusher{}
+
+	c.Assert(ssi.Purge(NewPurgeToken(testAppID)), IsNil)
+
+	c.Assert(ssi.IncrementCounter("TestFlushToBackend.foo", "a"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestFlushToBackend.foo", "a"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestFlushToBackend.foo", "b"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestFlushToBackend.bar", ""), IsNil)
+	c.Assert(ssi.IncrementCounter("TestFlushToBackend.bar", ""), IsNil)
+	c.Assert(ssi.IncrementCounterBy("TestFlushToBackend.bar", "", int64(10)), IsNil)
+
+	c.Assert(ssi.RecordGauge("TestFlushToBackend.temperature", "raleigh", 24.0), IsNil)
+	c.Assert(ssi.RecordGauge("TestFlushToBackend.temperature", "anchorage", 10.0), IsNil)
+	c.Assert(ssi.RecordGauge("TestFlushToBackend.temperature", "anchorage", 15.5), IsNil)
+	c.Assert(ssi.RecordGauge("TestFlushToBackend.temperature", "buffalo", -1.2), IsNil)
+
+	c.Assert(ssi.RecordTiming("TestFlushToBackend.subroutine", "A", 24.0, 1.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestFlushToBackend.subroutine", "B", 10.0, 1.0), IsNil)
+	c.Assert(ssi.RecordTiming("TestFlushToBackend.subroutine", "B", 15.5, 1.0), IsNil)
+
+	for i := 0; i < 10; i++ {
+		c.Assert(ssi.RecordTiming("TestFlushToBackend.upandtotheright", "", float64(i), 1.0), IsNil)
+	}
+
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+
+	now := time.Now()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Check(mockFlusher.counters, HasLen, 3)
+	c.Check(mockFlusher.timings, HasLen, 3)
+	c.Check(mockFlusher.gauges, HasLen, 3)
+
+	for _, counter := range mockFlusher.counters {
+		nameAndSource := fmt.Sprintf("%s-%s", counter.Name, counter.Source)
+		switch nameAndSource {
+		case "TestFlushToBackend.foo-a":
+			c.Check(counter.Count, Equals, uint64(2))
+		case "TestFlushToBackend.foo-b":
+			c.Check(counter.Count, Equals, uint64(1))
+		case "TestFlushToBackend.bar-":
+			c.Check(counter.Count, Equals, uint64(12))
+		}
+	}
+
+	for _, timing := range mockFlusher.timings {
+		nameAndSource := fmt.Sprintf("%s-%s", timing.Name, timing.Source)
+		switch nameAndSource {
+		case "TestFlushToBackend.subroutine-A":
+			c.Check(timing.Count, Equals, 1)
+			c.Check(timing.Min, Equals, 24.0)
+			c.Check(timing.Max, Equals, 24.0)
+			c.Check(timing.Sum, Equals, 24.0)
+			c.Check(timing.SumSquares, Equals, 576.0)
+			c.Check(timing.Median, Equals, 24.0)
+			c.Check(timing.NinthDecileCount, Equals, 1)
+			c.Check(timing.NinthDecileValue, Equals, 24.0)
+			c.Check(timing.NinthDecileSum, Equals, 24.0)
+		case "TestFlushToBackend.subroutine-B":
+			c.Check(timing.Count, Equals, 2)
+			c.Check(timing.Min, Equals, 10.0)
+			c.Check(timing.Max, Equals, 15.5)
+			c.Check(timing.Sum, Equals, 25.5)
+			c.Check(timing.SumSquares, Equals, 340.25)
+			c.Check(timing.Median, Equals, 12.75)
+			c.Check(timing.Variance, Equals, 7.5625)
+			c.Check(timing.NinthDecileCount, Equals, 2)
+			c.Check(timing.NinthDecileValue, Equals, 15.5)
+			c.Check(timing.NinthDecileSum, Equals, 25.5)
+		case "TestFlushToBackend.upandtotheright-":
+			c.Check(timing.Count, Equals, 10)
+			c.Check(timing.Min, Equals, 0.0)
+			c.Check(timing.Max, Equals, 9.0)
+			c.Check(timing.Sum, Equals, 45.0)
+			c.Check(timing.SumSquares, Equals, 285.0)
+			c.Check(timing.Median, Equals, 4.5)
+			c.Check(timing.NinthDecileCount, Equals, 9)
+			c.Check(timing.NinthDecileValue, Equals, 8.0)
+			c.Check(timing.NinthDecileSum, Equals, 36.0)
+		}
+	}
+
+	for _, gauge := range mockFlusher.gauges {
+		nameAndSource := fmt.Sprintf("%s-%s", gauge.Name, gauge.Source)
+		switch nameAndSource {
+		case "TestFlushToBackend.foo-a":
+			c.Check(gauge, Equals, 24.0)
+		case "TestFlushToBackend.foo-b":
+			c.Check(gauge, Equals, 15.5)
+		case "TestFlushToBackend.bar-":
+			c.Check(gauge, Equals, -1.2)
+		}
+	}
+
+	// Make sure that flushing again does nothing (i.e. don't force)
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, false), Equals, ErrStatFlushTooSoon)
+
+}
+
+func (s *StatStashTest) TestFlushSkipsBadBuckets(c *C) {
+
+	ssi := s.newTestStatsStash()
+	logged := &bytes.Buffer{}
+	ssi.log = appwrap.NewWriterLogger(logged)
+	mockFlusher := &MockFlusher{}
+	now := time.Now()
+
+	c.Assert(ssi.IncrementCounter("TestFlushSkipsBadBuckets.good", ""), IsNil)
+
+	// A gauge whose bucket holds an empty list
+	emptyCfg, err := ssi.getStatConfig(scTypeGauge, "TestFlushSkipsBadBuckets.empty", "")
+	c.Assert(err, IsNil)
+	emptyList, err := ssi.gobMarshal([]float64{})
+	c.Assert(err, IsNil)
+	c.Assert(ssi.cache.Set(&appwrap.CacheItem{Key: emptyCfg.BucketKey(now, 0), Value: emptyList}), IsNil)
+
+	// A counter whose bucket doesn't hold a number
+	badCounterCfg, err := ssi.getStatConfig(scTypeCounter, "TestFlushSkipsBadBuckets.garbled", "")
+	c.Assert(err, IsNil)
+	c.Assert(ssi.cache.Set(&appwrap.CacheItem{Key: badCounterCfg.BucketKey(now, 0), Value: []byte("\x03\x04not a number")}), IsNil)
+
+	// A config of a type we know nothing about
+	unknownCfg, err := ssi.getStatConfig("bogus", "TestFlushSkipsBadBuckets.unknown", "")
+	c.Assert(err, IsNil)
+	c.Assert(ssi.cache.Set(&appwrap.CacheItem{Key: unknownCfg.BucketKey(now, 0), Value: []byte("1")}), IsNil)
+
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	err = ssi.UpdateBackend(now, mockFlusher, nil, true)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(err, FitsTypeOf, FlushErrors{})
+	c.Check(err.(FlushErrors), HasLen, 3)
+	c.Check(logged.String(), Matches, "(?s).*Bad counter value found in memcache: key ss-metric:counter-TestFlushSkipsBadBuckets.garbled-.*")
+
+	c.Assert(mockFlusher.counters, HasLen, 1)
+	c.Check(mockFlusher.counters[0].Name, Equals, "TestFlushSkipsBadBuckets.good")
+	c.Check(mockFlusher.gauges, HasLen, 0)
+	c.Check(ssi.getLastPeriodFlushed().Equal(now), Equals, true)
+
+}
+
+func (s *StatStashTest) TestStatTypeMismatch(c *C) {
+
+	ssi := s.newTestStatsStash()
+	logged := &bytes.Buffer{}
+	ssi.log = appwrap.NewWriterLogger(logged)
+
+	c.Assert(ssi.IncrementCounter("TestStatTypeMismatch.foo", "a"), IsNil)
+	c.Assert(ssi.RecordGauge("TestStatTypeMismatch.foo", "b", 1.0), IsNil)
+	c.Check(logged.String(), Not(Matches), "(?s).*already registered.*")
+
+	c.Assert(ssi.RecordGauge("TestStatTypeMismatch.foo", "a", 1.0), IsNil)
+	c.Check(logged.String(), Matches, "(?s).*TestStatTypeMismatch.foo/a is being registered as a gauge, but is already registered as counter.*")
+
+	ssi.opts.RejectTypeMismatch = true
+	err := ssi.RecordTiming("TestStatTypeMismatch.foo", "a", 1.0, 1.0)
+	c.Assert(err, FitsTypeOf, &ErrStatDropped{})
+	c.Check(err.(*ErrStatDropped).Unwrap(), Equals, ErrStatTypeMismatch)
+
+	// Recording under an already registered type still works
+	c.Assert(ssi.IncrementCounter("TestStatTypeMismatch.foo", "a"), IsNil)
+
+}
+
+func (s *StatStashTest) TestStatNameLengthLimit(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.MaxNameLength = 20
+	ssi.opts.MaxSourceLength = 10
+
+	underLimit := strings.Repeat("a", 19)
+	atLimit := strings.Repeat("b", 20)
+	overLimit := strings.Repeat("c", 21)
+
+	c.Assert(ssi.IncrementCounter(underLimit, ""), IsNil)
+	c.Assert(ssi.IncrementCounter(atLimit, "0123456789"), IsNil)
+
+	c.Assert(ssi.IncrementCounter(overLimit, ""), Equals, ErrStatNameTooLong)
+	err := ssi.RecordGauge(underLimit, "0123456789a", 1.0)
+	c.Assert(err, FitsTypeOf, &ErrStatDropped{})
+	c.Check(err.(*ErrStatDropped).Unwrap(), Equals, ErrStatNameTooLong)
+
+	ssi.opts.TruncateLongNames = true
+	c.Assert(ssi.IncrementCounter(overLimit, ""), IsNil)
+	c.Assert(ssi.IncrementCounter(overLimit, ""), IsNil)
+	c.Assert(ssi.IncrementCounter(overLimit+"d", ""), IsNil)
+	c.Assert(ssi.IncrementCounter(atLimit, "0123456789a"), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	counts := make(map[string]uint64)
+	for _, counter := range mockFlusher.counters {
+		c.Check(len(counter.Name) <= 20, Equals, true)
+		c.Check(len(counter.Source) <= 10, Equals, true)
+		counts[counter.Name+"/"+counter.Source] = counter.Count
+	}
+	c.Assert(counts, HasLen, 5)
+	c.Check(counts[underLimit+"/"], Equals, uint64(1))
+	c.Check(counts[atLimit+"/0123456789"], Equals, uint64(1))
+
+	truncated, _ := ssi.limitLength(overLimit, 20)
+	c.Check(truncated, Matches, "ccccccccccc-[0-9a-f]{8}")
+	c.Check(counts[truncated+"/"], Equals, uint64(2))
+
+	// Non-ASCII names are cut on a rune boundary
+	truncated, err = ssi.limitLength(strings.Repeat("é", 15), 20)
+	c.Assert(err, IsNil)
+	c.Check(utf8.ValidString(truncated), Equals, true)
+	c.Check(truncated, Matches, "ééééé-[0-9a-f]{8}")
+
+}
+
+func (s *StatStashTest) TestFlushZeroFill(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.ZeroFill = true
+
+	mockFlusher := &MockFlusher{}
+
+	c.Assert(ssi.IncrementCounter("TestFlushZeroFill.active", ""), IsNil)
+
+	// Register configs without recording anything for them
+	for _, typ := range []string{scTypeCounter, scTypeGauge, scTypeTiming} {
+		_, err := ssi.getStatConfig(typ, "TestFlushZeroFill.idle", "")
+		c.Assert(err, IsNil)
+	}
+
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(time.Now(), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.counters, HasLen, 2)
+	for _, counter := range mockFlusher.counters {
+		switch counter.Name {
+		case "TestFlushZeroFill.active":
+			c.Check(counter.Count, Equals, uint64(1))
+		case "TestFlushZeroFill.idle":
+			c.Check(counter.Count, Equals, uint64(0))
+		default:
+			c.Errorf("unexpected counter %s", counter)
+		}
+	}
+	c.Assert(mockFlusher.gauges, HasLen, 1)
+	c.Check(mockFlusher.gauges[0].Name, Equals, "TestFlushZeroFill.idle")
+	c.Check(mockFlusher.gauges[0].Value, Equals, 0.0)
+	c.Check(mockFlusher.timings, HasLen, 0)
+
+}
+
+func (s *StatStashTest) TestDeadLetter(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.DeadLetter = true
+	periodStart := getStartOfFlushPeriod(time.Now(), 0)
+
+	c.Assert(ssi.IncrementCounterBy("TestDeadLetter.requests", "api", 7), IsNil)
+	for _, v := range []float64{10, 20, 30} {
+		c.Assert(ssi.RecordTiming("TestDeadLetter.latency", "api", v, 1), IsNil)
+	}
+
+	flushErr := errors.New("backend down")
+	failing := &MockFlusher{}
+	failing.On("Flush", mock.Anything, mock.Anything).Return(flushErr).Times(4)
+	c.Assert(ssi.UpdateBackend(periodStart, failing, nil, true), Equals, flushErr)
+	// Retrying the period replaces its dead letter
+	c.Assert(ssi.IncrementCounterBy("TestDeadLetter.requests", "api", 1), IsNil)
+	c.Assert(ssi.UpdateBackend(periodStart, failing, nil, true), Equals, flushErr)
+
+	var letters []deadLetter
+	_, err := ssi.ds.NewQuery(dsKindDeadLetter).GetAll(&letters)
+	c.Assert(err, IsNil)
+	c.Assert(letters, HasLen, 1)
+	c.Check(letters[0].Period.Equal(periodStart), Equals, true)
+
+	// A failed replay keeps the dead letter
+	c.Assert(ssi.ReplayDeadLetter(failing, nil), Equals, flushErr)
+
+	// Other flushers and services don't replay it
+	other := &MockEventFlusher{}
+	c.Assert(ssi.ReplayDeadLetter(other, nil), IsNil)
+	otherService := ssi
+	otherService.opts.Service = "billing"
+	c.Assert(otherService.ReplayDeadLetter(failing, nil), IsNil)
+	other.AssertExpectations(c)
+
+	replay := &MockFlusher{}
+	replay.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.ReplayDeadLetter(replay, nil), IsNil)
+	replay.AssertExpectations(c)
+
+	c.Assert(replay.counters, HasLen, 1)
+	c.Check(replay.counters[0].Count, Equals, uint64(8))
+	c.Check(replay.counters[0].PeriodStart.Equal(periodStart), Equals, true)
+	c.Assert(replay.timings, HasLen, 1)
+	c.Check(replay.timings[0].Count, Equals, 3)
+	c.Check(replay.timings[0].Sum, Equals, 60.0)
+
+	// Replayed letters are deleted
+	letters = nil
+	_, err = ssi.ds.NewQuery(dsKindDeadLetter).GetAll(&letters)
+	c.Assert(err, IsNil)
+	c.Check(letters, HasLen, 0)
+
+	// as are those of periods which flush successfully when retried
+	c.Assert(ssi.UpdateBackend(periodStart, failing, nil, true), Equals, flushErr)
+	failing.AssertExpectations(c)
+	succeeding := &MockFlusher{}
+	succeeding.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(periodStart, succeeding, nil, true), IsNil)
+	letters = nil
+	_, err = ssi.ds.NewQuery(dsKindDeadLetter).GetAll(&letters)
+	c.Assert(err, IsNil)
+	c.Check(letters, HasLen, 0)
+
+}
+
+func (s *StatStashTest) TestLogOnlyFlusherUnknownType(c *C) {
+
+	buf := &bytes.Buffer{}
+	flusher := NewLogOnlyStatsFlusher(appwrap.NewWriterLogger(buf))
+
+	type statDataSet struct {
+		StatConfig
+		Members int
+	}
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "TestLogOnlyFlusherUnknownType.hits", Type: scTypeCounter}, Count: 3},
+		statDataSet{StatConfig: StatConfig{Name: "TestLogOnlyFlusherUnknownType.users"}, Members: 7},
+	}
+	c.Assert(flusher.Flush(data, nil), IsNil)
+
+	c.Check(buf.String(), Matches, `(?s).*\[Counter: name=TestLogOnlyFlusherUnknownType.hits, source=\] Value: 3.*`)
+	c.Check(buf.String(), Matches, `(?s).*Stat of unknown type statstash.statDataSet: .*TestLogOnlyFlusherUnknownType.users.*Members:7.*`)
+	c.Check(strings.Contains(buf.String(), "%!s(<nil>)"), Equals, false)
+
+}
+
+func (s *StatStashTest) TestFlushSkipUnchangedGauges(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.SkipUnchangedGauges = true
+	ssi.opts.GaugeKeepalive = 2 * defaultAggregationPeriod
+
+	clock := getStartOfFlushPeriod(time.Now(), 0).Add(time.Minute)
+	ssi.opts.Clock = func() time.Time { return clock }
+
+	flush := func(steady, changing float64) []StatDataGauge {
+		c.Assert(ssi.RecordGauge("TestFlushSkipUnchangedGauges.steady", "", steady), IsNil)
+		c.Assert(ssi.RecordGauge("TestFlushSkipUnchangedGauges.changing", "", changing), IsNil)
+		mockFlusher := &MockFlusher{}
+		mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+		c.Assert(ssi.UpdateBackend(clock, mockFlusher, nil, true), IsNil)
+		mockFlusher.AssertExpectations(c)
+		clock = clock.Add(defaultAggregationPeriod)
+		return mockFlusher.gauges
+	}
+
+	gauges := flush(24.0, 1.0)
+	c.Check(gauges, HasLen, 2)
+
+	// The steady gauge is left out until the keepalive interval passes
+	gauges = flush(24.0, 2.0)
+	c.Assert(gauges, HasLen, 1)
+	c.Check(gauges[0].Name, Equals, "TestFlushSkipUnchangedGauges.changing")
+	c.Check(gauges[0].Value, Equals, 2.0)
+
+	gauges = flush(24.0, 3.0)
+	c.Check(gauges, HasLen, 2)
+
+}
+
+func (s *StatStashTest) TestForceFlushNow(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	clock := getStartOfFlushPeriod(time.Now(), 0).Add(time.Minute)
+	ssi.opts.Clock = func() time.Time { return clock }
+
+	c.Assert(ssi.IncrementCounterBy("TestForceFlushNow.foo", "a", 3), IsNil)
+
+	// The regular flush of the previous period doesn't see the current one
+	mockFlusher := &MockFlusher{}
+	c.Assert(ssi.UpdateBackend(getStartOfFlushPeriod(clock, -1), mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertNotCalled(c, "Flush", mock.Anything, mock.Anything)
+
+	c.Assert(ssi.updateLastPeriodFlushed(getStartOfFlushPeriod(clock, 0)), IsNil)
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.ForceFlushNow(mockFlusher, nil), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.counters, HasLen, 1)
+	c.Check(mockFlusher.counters[0].Count, Equals, uint64(3))
+
+}
+
+func (s *StatStashTest) TestDeployEventOnFlush(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.OnFlush = NewDeployEventHook(ssi.log, "Deployed v42", "Rolled out by CI", map[string]string{"source": "web"})
+
+	flusher := &MockEventFlusher{}
+	flusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Twice()
+
+	for i := 0; i < 2; i++ {
+		c.Assert(ssi.IncrementCounter("TestDeployEventOnFlush.foo", ""), IsNil)
+		c.Assert(ssi.UpdateBackend(time.Now(), flusher, nil, true), IsNil)
+	}
+	flusher.AssertExpectations(c)
+
+	// Only the first flush emits the event
+	c.Assert(flusher.events, HasLen, 1)
+	c.Check(flusher.events[0], DeepEquals, mockEvent{"Deployed v42", "Rolled out by CI", map[string]string{"source": "web"}})
+
+	// Flushers which can't emit events are left alone
+	c.Check(EmitEvent(&MockFlusher{}, "title", "text", nil), IsNil)
+
+	// Failures to emit it are logged
+	log := &countingLogger{Logging: ssi.log}
+	hook := NewDeployEventHook(log, "Deployed v43", "", nil)
+	hook(time.Now(), &MockEventFlusher{emitErr: errors.New("backend down")}, nil)
+	c.Check(log.errors, Equals, 1)
+
+}
+
+func (s *StatStashTest) TestFlushWithFutureWatermark(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	mockFlusher := &MockFlusher{}
+
+	c.Assert(ssi.IncrementCounter("TestFlushWithFutureWatermark.foo", "a"), IsNil)
+
+	now := time.Now()
+	c.Assert(ssi.updateLastPeriodFlushed(now.Add(24*time.Hour)), IsNil)
+
+	// Without self-healing, the bogus watermark blocks the flush
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, false), Equals, ErrStatFlushTooSoon)
+
+	ssi.opts.ResetFutureWatermark = true
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, false), IsNil)
+	mockFlusher.AssertExpectations(c)
+	c.Check(mockFlusher.counters, HasLen, 1)
+
+	// The watermark now tracks the flushed period again
+	c.Check(ssi.getLastPeriodFlushed().Equal(now), Equals, true)
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, false), Equals, ErrStatFlushTooSoon)
+
+}
+
+func (s *StatStashTest) TestMinFlushInterval(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.MinFlushInterval = 3 * defaultAggregationPeriod
+
+	first := getStartOfFlushPeriod(time.Now(), -4)
+	var clock time.Time
+	ssi.opts.Clock = func() time.Time { return clock }
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Maybe()
+	flush := func(period time.Time) error {
+		clock = period.Add(time.Minute)
+		c.Assert(ssi.IncrementCounter("TestMinFlushInterval.hits", ""), IsNil)
+		return ssi.UpdateBackend(period, mockFlusher, nil, false)
+	}
+
+	c.Assert(flush(first), IsNil)
+	c.Check(mockFlusher.counters, HasLen, 1)
+	// New aggregation periods have started, but the interval hasn't passed
+	c.Check(flush(first.Add(defaultAggregationPeriod)), Equals, ErrStatFlushTooSoon)
+	c.Check(flush(first.Add(2*defaultAggregationPeriod)), Equals, ErrStatFlushTooSoon)
+	c.Check(ssi.getLastPeriodFlushed().Equal(first), Equals, true)
+
+	// The skipped periods are flushed along with the next allowed one
+	c.Assert(flush(first.Add(3*defaultAggregationPeriod)), IsNil)
+	c.Check(ssi.getLastPeriodFlushed().Equal(first.Add(3*defaultAggregationPeriod)), Equals, true)
+	c.Assert(mockFlusher.counters, HasLen, 3)
+	for i, counter := range mockFlusher.counters {
+		c.Check(counter.PeriodStart.Equal(first.Add(time.Duration(i+1)*defaultAggregationPeriod)), Equals, true)
+		c.Check(counter.Count, Equals, uint64(1))
+	}
+
+}
+
+func (s *StatStashTest) TestSnapshotRange(c *C) {
+
+	ssi := s.newTestStatsStash()
+
+	previous := getStartOfFlushPeriod(time.Now(), -1).Add(time.Minute)
+	current := previous.Add(defaultAggregationPeriod)
+
+	clock := previous
+	ssi.opts.Clock = func() time.Time { return clock }
+
+	c.Assert(ssi.IncrementCounterBy("TestSnapshotRange.foo", "a", 3), IsNil)
+	c.Assert(ssi.RecordGauge("TestSnapshotRange.temperature", "raleigh", 24.0), IsNil)
+
+	clock = current
+	c.Assert(ssi.IncrementCounterBy("TestSnapshotRange.foo", "a", 5), IsNil)
+
+	data, err := ssi.Snapshot(current)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 1)
+	c.Check(data[0].(StatDataCounter).Count, Equals, uint64(5))
+
+	snapshots, err := ssi.SnapshotRange(current, 3)
+	c.Assert(err, IsNil)
+	c.Assert(snapshots, HasLen, 2)
+
+	c.Assert(snapshots[getStartOfFlushPeriod(current, 0)], HasLen, 1)
+	c.Check(snapshots[getStartOfFlushPeriod(current, 0)][0].(StatDataCounter).Count, Equals, uint64(5))
+
+	previousData := snapshots[getStartOfFlushPeriod(previous, 0)]
+	c.Assert(previousData, HasLen, 2)
+	for _, datum := range previousData {
+		switch d := datum.(type) {
+		case StatDataCounter:
+			c.Check(d.Count, Equals, uint64(3))
+		case StatDataGauge:
+			c.Check(d.Value, Equals, 24.0)
+		default:
+			c.Errorf("unexpected datum %s", datum)
+		}
+	}
+
+}
+
+func (s *StatStashTest) TestPeriodStart(c *C) {
+
+	utc, _ := time.LoadLocation("UTC")
+	ref := time.Date(2014, 10, 4, 12, 0, 0, 0, utc)
+
+	c.Check(getStartOfFlushPeriod(ref, 0).Unix(), Equals, ref.Unix())
+	c.Check(getStartOfFlushPeriod(ref.Add(1*time.Second), 0).Unix(), Equals, ref.Unix())
+
+	c.Check(getStartOfFlushPeriod(ref, -1).Unix(), Equals, ref.Add(defaultAggregationPeriod*time.Duration(-1)).Unix())
+	c.Check(getStartOfFlushPeriod(ref.Add(1*time.Second), -1).Unix(), Equals, ref.Add(defaultAggregationPeriod*time.Duration(-1)).Unix())
+
+}
+
+type StatSamplingTestImplementation struct {
+	randGen *rand.Rand
+}
+
+func (c StatSamplingTestImplementation) IncrementCounter(name, source string) error { return nil }
+func (c StatSamplingTestImplementation) IncrementCounterBy(name, source string, delta int64) error {
+	return nil
+}
+func (c StatSamplingTestImplementation) RecordGauge(name, source string, value float64) error {
+	return nil
+}
+func (c StatSamplingTestImplementation) RecordTiming(name, source string, value, sampleRate float64) error {
+
+	// We use this code copied from the other code to prevent actually having to
+	// use memcache and blowing up the test suite.
+	if sampleRate < 1.0 && c.randGen.Float64() > sampleRate {
+		return ErrStatNotSampled // do nothing here, as we are sampling
+	}
+	return nil
+}
+func (c StatSamplingTestImplementation) UpdateBackend(periodStart time.Time, flusher StatsFlusher, cfg *FlusherConfig, force bool) error {
 	return nil
 }
-func (c StatSamplingTestImplementation) UpdateBackend(periodStart time.Time, flusher StatsFlusher, cfg *FlusherConfig, force bool) error {
-	return nil
+func (c StatSamplingTestImplementation) UpdateBackendWithReport(periodStart time.Time, flusher StatsFlusher, cfg *FlusherConfig, force bool) (FlushReport, error) {
+	return FlushReport{Period: periodStart, Empty: true}, nil
+}
+
+func (s *StatStashTest) TestTimingSampling(c *C) {
+	ssi := StatSamplingTestImplementation{rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+	// Let's record a million timings at a sample rate of 0.0001.
+	// We'll expect 100 samples, give or take 50
+	statsSampled := 0
+	for i := 0; i < 1000000; i++ {
+		if err := ssi.RecordTiming("yowza", "fast", 1, 0.0001); err == ErrStatNotSampled {
+			continue
+		} else if err != nil {
+			// unexpected error, fail
+			c.Fail()
+		} else {
+			statsSampled++
+		}
+	}
+	fmt.Printf("Stats sampled %d\n", statsSampled)
+	c.Assert(math.Abs(100.0-float64(statsSampled)) <= 50.0, Equals, true)
+
+}
+
+func (s *StatStashTest) TestUpdateBackendWithReport(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+
+	c.Assert(ssi.IncrementCounter("TestUpdateBackendWithReport.hits", ""), IsNil)
+	c.Assert(ssi.RecordTiming("TestUpdateBackendWithReport.latency", "", 12, 1), IsNil)
+
+	flusher := &MockReportingFlusher{reject: map[string]bool{"TestUpdateBackendWithReport.latency": true}}
+	flusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	report, err := ssi.UpdateBackendWithReport(now, flusher, nil, true)
+	c.Assert(err, IsNil)
+	flusher.AssertExpectations(c)
+
+	c.Check(report.Period, Equals, now)
+	c.Assert(report.Results, HasLen, 2)
+	rejected := report.Rejected()
+	c.Assert(rejected, HasLen, 1)
+	c.Check(mockStatName(rejected[0].Datum), Equals, "TestUpdateBackendWithReport.latency")
+	c.Check(rejected[0].Err, ErrorMatches, "rejected TestUpdateBackendWithReport.latency")
+
+	// Flushers which can't report have every datum share the flush's outcome
+	c.Assert(ssi.IncrementCounter("TestUpdateBackendWithReport.hits", ""), IsNil)
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(errors.New("unavailable")).Once()
+	report, err = ssi.UpdateBackendWithReport(now, mockFlusher, nil, true)
+	c.Assert(err, ErrorMatches, "unavailable")
+	c.Assert(report.Results, HasLen, 2)
+	c.Check(report.Rejected(), HasLen, 2)
+	c.Check(report.Empty, Equals, false)
+
+}
+
+func (s *StatStashTest) TestUpdateBackendWithReportEmpty(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+
+	// Nothing recorded, so the flusher isn't called
+	report, err := ssi.UpdateBackendWithReport(now, &MockFlusher{}, nil, true)
+	c.Assert(err, IsNil)
+	c.Check(report.Empty, Equals, true)
+	c.Check(report.Results, HasLen, 0)
+
+	c.Assert(ssi.IncrementCounter("TestUpdateBackendWithReportEmpty.hits", ""), IsNil)
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	report, err = ssi.UpdateBackendWithReport(now, mockFlusher, nil, true)
+	c.Assert(err, IsNil)
+	mockFlusher.AssertExpectations(c)
+	c.Check(report.Empty, Equals, false)
+	c.Check(report.Results, HasLen, 1)
+
+	report, err = NewNullStatImplementation().UpdateBackendWithReport(now, &MockFlusher{}, nil, false)
+	c.Assert(err, IsNil)
+	c.Check(report.Empty, Equals, true)
+
+}
+
+func (s *StatStashTest) TestRecordAt(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+	ssi.opts.Clock = func() time.Time { return now }
+	previous := getStartOfFlushPeriod(now, -1).Add(30 * time.Second)
+
+	c.Assert(ssi.IncrementCounterAt("TestRecordAt.hits", "", 3, previous), IsNil)
+	c.Assert(ssi.IncrementCounterAt("TestRecordAt.hits", "", 2, previous), IsNil)
+	c.Assert(ssi.RecordTimingAt("TestRecordAt.latency", "", 12, 1, previous), IsNil)
+	c.Assert(ssi.RecordGaugeAt("TestRecordAt.connections", "", 7, previous), IsNil)
+	c.Assert(ssi.IncrementCounter("TestRecordAt.hits", ""), IsNil)
+
+	data, err := ssi.Snapshot(previous)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 3)
+	c.Check(data[0].(StatDataCounter).Count, Equals, uint64(5))
+	c.Check(data[1].(StatDataGauge).Value, Equals, 7.0)
+	c.Check(data[2].(StatDataTiming).Sum, Equals, 12.0)
+
+	data, err = ssi.Snapshot(now)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 1)
+	c.Check(data[0].(StatDataCounter).Count, Equals, uint64(1))
+
+	// Periods whose buckets have expired, and future ones, are rejected
+	c.Check(ssi.IncrementCounterAt("TestRecordAt.hits", "", 1, now.Add(-time.Hour)), Equals, ErrStatTimeOutOfRange)
+	c.Check(ssi.RecordTimingAt("TestRecordAt.latency", "", 12, 1, now.Add(-time.Hour)), Equals, ErrStatTimeOutOfRange)
+	c.Check(ssi.RecordGaugeAt("TestRecordAt.connections", "", 1, getStartOfFlushPeriod(now, 1)), Equals, ErrStatTimeOutOfRange)
+
+}
+
+func (s *StatStashTest) TestRecordEvent(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+
+	c.Assert(ssi.RecordEvent("TestRecordEvent.deploy", "api", "v1.2.3"), IsNil)
+	c.Assert(ssi.RecordEvent("TestRecordEvent.deploy", "api", "v1.2.4"), IsNil)
+	c.Assert(ssi.RecordEvent("TestRecordEvent.config", "", "flag on"), IsNil)
+	c.Assert(ssi.IncrementCounter("TestRecordEvent.hits", ""), IsNil)
+
+	data, err := ssi.Snapshot(now)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 4)
+	event := data[2].(StatDataEvent)
+	c.Check(event.Name, Equals, "TestRecordEvent.deploy")
+	c.Check(event.Source, Equals, "api")
+	c.Check(event.Text, Equals, "v1.2.3")
+	c.Check(event.Timestamp.IsZero(), Equals, false)
+
+	// Events are emitted as annotations, and not flushed with the metrics
+	mockFlusher := &MockEventFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Check(mockFlusher.counters, HasLen, 1)
+	c.Assert(mockFlusher.events, HasLen, 3)
+	c.Check(mockFlusher.events[0], DeepEquals, mockEvent{"TestRecordEvent.config", "flag on", nil})
+	c.Check(mockFlusher.events[1], DeepEquals, mockEvent{"TestRecordEvent.deploy", "v1.2.3", map[string]string{"source": "api"}})
+	c.Check(mockFlusher.events[2], DeepEquals, mockEvent{"TestRecordEvent.deploy", "v1.2.4", map[string]string{"source": "api"}})
+
+	// Flushers which can't emit them only get the metrics
+	plainFlusher := &MockFlusher{}
+	plainFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, plainFlusher, nil, true), IsNil)
+	plainFlusher.AssertExpectations(c)
+	c.Check(plainFlusher.Calls[0].Arguments.Get(0), HasLen, 1)
+
 }
 
-func (s *StatStashTest) TestTimingSampling(c *C) {
-	ssi := StatSamplingTestImplementation{rand.New(rand.NewSource(time.Now().UnixNano()))}
+func (s *StatStashTest) TestTimingSampleEncodings(c *C) {
 
-	// Let's record a million timings at a sample rate of 0.0001.
-	// We'll expect 100 samples, give or take 50
-	statsSampled := 0
-	for i := 0; i < 1000000; i++ {
-		if err := ssi.RecordTiming("yowza", "fast", 1, 0.0001); err == ErrStatNotSampled {
-			continue
-		} else if err != nil {
-			// unexpected error, fail
-			c.Fail()
+	ssi := s.newTestStatsStash()
+	values := []float64{0, 1, 12.4, 12.6, 250, -3.2, 7264534001, 0.049}
+
+	gobEncoded, err := ssi.encodeSamples(scTypeTiming, values)
+	c.Assert(err, IsNil)
+	var decoded []float64
+	c.Assert(ssi.decodeSamples(gobEncoded, &decoded), IsNil)
+	c.Check(decoded, DeepEquals, values)
+
+	ssi.opts.TimingResolution = 0.1
+	varintEncoded, err := ssi.encodeSamples(scTypeTiming, values)
+	c.Assert(err, IsNil)
+	c.Check(varintEncoded[0], Equals, samplesFormatVarint)
+	c.Check(len(varintEncoded) < len(gobEncoded), Equals, true)
+	decoded = nil
+	c.Assert(ssi.decodeSamples(varintEncoded, &decoded), IsNil)
+	c.Assert(decoded, HasLen, len(values))
+	for i := range values {
+		c.Check(math.Abs(decoded[i]-values[i]) <= 0.05+1e-9, Equals, true, Commentf("%f decoded as %f", values[i], decoded[i]))
+	}
+
+	// Gauges, and values too large to quantize, stay gob encoded
+	gaugeEncoded, err := ssi.encodeSamples(scTypeGauge, values)
+	c.Assert(err, IsNil)
+	c.Check(gaugeEncoded, DeepEquals, gobEncoded)
+	hugeEncoded, err := ssi.encodeSamples(scTypeTiming, []float64{1e300})
+	c.Assert(err, IsNil)
+	c.Check(hugeEncoded[0], Not(Equals), samplesFormatVarint)
+
+	// Buckets written in either format aggregate together
+	ssi.opts.TimingResolution = 0
+	c.Assert(ssi.RecordTiming("TestTimingSampleEncodings.latency", "", 10.2, 1), IsNil)
+	ssi.opts.TimingResolution = 1
+	c.Assert(ssi.RecordTiming("TestTimingSampleEncodings.latency", "", 20.4, 1), IsNil)
+	data, err := ssi.Snapshot(time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 1)
+	c.Check(data[0].(StatDataTiming).Count, Equals, 2)
+	c.Check(data[0].(StatDataTiming).Sum, Equals, 30.0)
+
+}
+
+func (s *StatStashTest) TestServiceDimension(c *C) {
+
+	billing := s.newTestStatsStash()
+	billing.opts.Service = "billing"
+	search := billing
+	search.opts.Service = "search"
+	now := time.Now()
+
+	c.Assert(billing.IncrementCounterBy("TestServiceDimension.requests", "api", 3), IsNil)
+	c.Assert(search.IncrementCounterBy("TestServiceDimension.requests", "api", 5), IsNil)
+	c.Assert(search.IncrementCounter("TestServiceDimension.requests", "api"), IsNil)
+
+	data, err := billing.Snapshot(now)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 2)
+	c.Check(data[0].(StatDataCounter).Service, Equals, "billing")
+	c.Check(data[0].(StatDataCounter).Count, Equals, uint64(3))
+	c.Check(data[1].(StatDataCounter).Service, Equals, "search")
+	c.Check(data[1].(StatDataCounter).Count, Equals, uint64(6))
+
+	// Tag-aware backends get a service tag; others a prefixed name
+	var buf bytes.Buffer
+	writePrometheusText(&buf, data, true)
+	c.Check(buf.String(), Matches, `(?s).*TestServiceDimension_requests\{source="api",service="billing"\} 3\n.*`)
+	c.Check(buf.String(), Matches, `(?s).*TestServiceDimension_requests\{source="api",service="search"\} 6\n.*`)
+
+	postdata := NewLibratoStatsFlusher(s.Context).(LibratoStatsFlusher).postData(data)
+	c.Check(postdata.Get("counters[0][name]"), Equals, "billing.TestServiceDimension.requests")
+	c.Check(postdata.Get("counters[1][name]"), Equals, "search.TestServiceDimension.requests")
+
+	// Each service keeps its own gauge levels
+	c.Assert(billing.AdjustGauge("TestServiceDimension.connections", "api", 2), IsNil)
+	c.Assert(search.AdjustGauge("TestServiceDimension.connections", "api", 7), IsNil)
+	gauges, err := billing.SnapshotMetric(scTypeGauge, "TestServiceDimension.connections", now)
+	c.Assert(err, IsNil)
+	c.Check(gauges["api"].(StatDataGauge).Value, Equals, 2.0)
+	gauges, err = search.SnapshotMetric(scTypeGauge, "TestServiceDimension.connections", now)
+	c.Assert(err, IsNil)
+	c.Check(gauges["api"].(StatDataGauge).Value, Equals, 7.0)
+
+	// Either service can purge every service's configs
+	c.Assert(billing.Purge(NewPurgeToken(testAppID)), IsNil)
+	configs, err := search.getAllConfigs()
+	c.Assert(err, IsNil)
+	c.Check(configs, HasLen, 0)
+
+}
+
+func (s *StatStashTest) TestPurgeToken(c *C) {
+
+	ssi := s.newTestStatsStash()
+	c.Assert(ssi.IncrementCounter("TestPurgeToken.foo", ""), IsNil)
+
+	c.Check(ssi.Purge(PurgeToken{}), Equals, ErrPurgeNotConfirmed)
+	c.Check(ssi.Purge(NewPurgeToken("some-other-app")), Equals, ErrPurgeNotConfirmed)
+	c.Check(ssi.ClearBuckets(NewPurgeToken("some-other-app")), Equals, ErrPurgeNotConfirmed)
+
+	// Without an app ID, even a token for an empty one confirms nothing
+	project, hadProject := os.LookupEnv("GOOGLE_CLOUD_PROJECT")
+	os.Unsetenv("GOOGLE_CLOUD_PROJECT")
+	unknown := ssi
+	unknown.opts.AppID = ""
+	c.Check(unknown.Purge(NewPurgeToken("")), Equals, ErrPurgeNotConfirmed)
+	c.Check(unknown.ClearBuckets(NewPurgeToken("")), Equals, ErrPurgeNotConfirmed)
+	if hadProject {
+		os.Setenv("GOOGLE_CLOUD_PROJECT", project)
+	}
+
+	// Nothing was deleted
+	configs, err := ssi.getAllConfigs()
+	c.Assert(err, IsNil)
+	c.Check(configs, HasLen, 1)
+	count, err := ssi.peekCounter("TestPurgeToken.foo", "", time.Now())
+	c.Assert(err, IsNil)
+	c.Check(count, Equals, uint64(1))
+
+	c.Assert(ssi.Purge(NewPurgeToken(testAppID)), IsNil)
+	configs, err = ssi.getAllConfigs()
+	c.Assert(err, IsNil)
+	c.Check(configs, HasLen, 0)
+
+}
+
+func (s *StatStashTest) TestTouchMetric(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now().Truncate(time.Second)
+	clock := now.Add(-3 * 24 * time.Hour)
+	ssi.opts.Clock = func() time.Time { return clock }
+
+	c.Assert(ssi.IncrementCounter("TestTouchMetric.foo", ""), IsNil)
+
+	// Not recorded in the last two days, so the config is no longer active
+	clock = now
+	cfgMap, err := ssi.getActiveConfigs(now, 0)
+	c.Assert(err, IsNil)
+	c.Check(cfgMap, HasLen, 0)
+
+	c.Assert(ssi.TouchMetric(scTypeCounter, "TestTouchMetric.foo", ""), IsNil)
+
+	sc, err := ssi.ConfigFor(scTypeCounter, "TestTouchMetric.foo", "")
+	c.Assert(err, IsNil)
+	c.Check(sc.LastRead.Equal(now), Equals, true)
+
+	cfgMap, err = ssi.getActiveConfigs(now, 0)
+	c.Assert(err, IsNil)
+	c.Check(cfgMap, HasLen, 1)
+
+	// Touching never creates a config
+	c.Check(ssi.TouchMetric(scTypeCounter, "TestTouchMetric.bar", ""), Equals, ErrStatConfigNotFound)
+	configs, err := ssi.getAllConfigs()
+	c.Assert(err, IsNil)
+	c.Check(configs, HasLen, 1)
+
+}
+
+func (s *StatStashTest) TestTopSources(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.TopSources = 2
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		c.Assert(ssi.IncrementCounter("TestTopSources.foo", "dominant"), IsNil)
+	}
+	for i := 0; i < 3; i++ {
+		c.Assert(ssi.IncrementCounter("TestTopSources.foo", "second"), IsNil)
+	}
+	for i := 0; i < 20; i++ {
+		c.Assert(ssi.IncrementCounter("TestTopSources.foo", fmt.Sprintf("rare-%d", i)), IsNil)
+	}
+
+	for source, expected := range map[string]uint64{"dominant": 10, "second": 3, OtherSource: 20} {
+		count, err := ssi.peekCounter("TestTopSources.foo", source, now)
+		c.Assert(err, IsNil)
+		c.Check(count, Equals, expected, Commentf("source %s", source))
+	}
+	configs, err := ssi.getAllConfigs()
+	c.Assert(err, IsNil)
+	c.Check(configs, HasLen, 3)
+
+	// A rare source which becomes more frequent than the least frequent
+	// kept source displaces it once its count passes 3
+	for i := 0; i < 5; i++ {
+		c.Assert(ssi.IncrementCounter("TestTopSources.foo", "rare-0"), IsNil)
+	}
+	count, err := ssi.peekCounter("TestTopSources.foo", "rare-0", now)
+	c.Assert(err, IsNil)
+	c.Check(count, Equals, uint64(3))
+	c.Assert(ssi.IncrementCounter("TestTopSources.foo", "second"), IsNil)
+	count, err = ssi.peekCounter("TestTopSources.foo", OtherSource, now)
+	c.Assert(err, IsNil)
+	c.Check(count, Equals, uint64(23))
+
+	// Other metrics rank their sources separately
+	c.Assert(ssi.RecordGauge("TestTopSources.bar", "rare-1", 1), IsNil)
+	_, err = ssi.ConfigFor(scTypeGauge, "TestTopSources.bar", "rare-1")
+	c.Check(err, IsNil)
+
+}
+
+func (s *StatStashTest) TestRecordDeadlineUsage(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+	ssi.opts.Clock = func() time.Time { return now }
+	start := now.Add(-300 * time.Millisecond)
+
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(time.Second))
+	defer cancel()
+	c.Assert(ssi.RecordDeadlineUsage(ctx, "TestRecordDeadlineUsage.rpc", "", start), IsNil)
+
+	values, err := ssi.peekGauge("TestRecordDeadlineUsage.rpc", "", now)
+	c.Assert(err, IsNil)
+	c.Assert(values, HasLen, 1)
+	c.Check(math.Abs(values[0]-0.3) < 1e-9, Equals, true, Commentf("recorded %f", values[0]))
+
+	// Contexts without a deadline record nothing
+	c.Assert(ssi.RecordDeadlineUsage(context.Background(), "TestRecordDeadlineUsage.nodeadline", "", start), IsNil)
+	_, err = ssi.ConfigFor(scTypeGauge, "TestRecordDeadlineUsage.nodeadline", "")
+	c.Check(err, Equals, ErrStatConfigNotFound)
+
+}
+
+func (s *StatStashTest) TestConfigKeyShards(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.ConfigKeyShards = 16
+	now := time.Now()
+
+	c.Assert(ssi.IncrementCounter("TestConfigKeyShards.foo", "a"), IsNil)
+	c.Assert(ssi.RecordGauge("TestConfigKeyShards.bar", "", 2), IsNil)
+
+	keys, configs, err := ssi.getAllConfigsWithKeys()
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+	for i, key := range keys {
+		sc := configs[i]
+		c.Check(key.StringID(), Matches, "[0-9a-f]{4}:"+sc.Type+"-"+sc.Name+"-"+sc.Source)
+		c.Check(key.StringID(), Equals, shardedKeyName(ssi.getStatConfigKeyName(sc.Type, sc.Name, sc.Source), 16))
+	}
+
+	// Sharded configs are found by the active config query and by key
+	cfgMap, err := ssi.getActiveConfigs(now, 0)
+	c.Assert(err, IsNil)
+	c.Check(cfgMap, HasLen, 2)
+	_, found := cfgMap[fmt.Sprintf("ss-metric:counter-TestConfigKeyShards.foo-a-%d", getStartOfFlushPeriod(now, 0).Unix())]
+	c.Check(found, Equals, true)
+
+	var sc StatConfig
+	c.Assert(ssi.ds.Get(ssi.getStatConfigDatastoreKey(scTypeCounter, "TestConfigKeyShards.foo", "a"), &sc), IsNil)
+	c.Check(sc.Name, Equals, "TestConfigKeyShards.foo")
+
+	c.Assert(ssi.Purge(NewPurgeToken(testAppID)), IsNil)
+	configs, err = ssi.getAllConfigs()
+	c.Assert(err, IsNil)
+	c.Check(configs, HasLen, 0)
+
+}
+
+func (s *StatStashTest) TestTimingGroup(c *C) {
+
+	ssi := s.newTestStatsStash()
+	ssi.opts.TimingGroup = func(sc StatConfig) string {
+		if strings.HasPrefix(sc.Name, "TestTimingGroup.api.") {
+			return "TestTimingGroup.api"
+		}
+		return ""
+	}
+	now := time.Now()
+
+	for _, value := range []float64{10, 20, 30} {
+		c.Assert(ssi.RecordTiming("TestTimingGroup.api.users", "", value, 1), IsNil)
+	}
+	for _, value := range []float64{5, 50} {
+		c.Assert(ssi.RecordTiming("TestTimingGroup.api.orders", "eu", value, 1), IsNil)
+	}
+	c.Assert(ssi.RecordTiming("TestTimingGroup.db", "", 100, 1), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.timings, HasLen, 4)
+	var group StatDataTiming
+	for _, timing := range mockFlusher.timings {
+		if timing.Name == "TestTimingGroup.api" {
+			group = timing
+		}
+	}
+	c.Check(group.Source, Equals, "")
+	c.Check(group.Count, Equals, 5)
+	c.Check(group.EstimatedCount, Equals, 5)
+	c.Check(group.Min, Equals, 5.0)
+	c.Check(group.Max, Equals, 50.0)
+	c.Check(group.Sum, Equals, 115.0)
+	c.Check(group.SumSquares, Equals, 3925.0)
+	c.Check(math.Abs(group.Variance-(3925.0/5-23*23)) < 1e-9, Equals, true)
+	// The percentiles are of all five values
+	c.Check(group.Median, Equals, 20.0)
+	c.Check(group.NinthDecileValue, Equals, 50.0)
+	c.Check(group.NinthDecileCount, Equals, 5)
+	c.Check(group.ThreeNinesValue, Equals, 50.0)
+
+}
+
+func (s *StatStashTest) TestSnapshotMetric(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+
+	for i, source := range []string{"a", "b", "c"} {
+		c.Assert(ssi.RecordGauge("TestSnapshotMetric.queue", source, float64(i+1)), IsNil)
+	}
+	c.Assert(ssi.RecordGauge("TestSnapshotMetric.other", "a", 10), IsNil)
+	c.Assert(ssi.IncrementCounter("TestSnapshotMetric.queue", "d"), IsNil)
+
+	bySource, err := ssi.SnapshotMetric(scTypeGauge, "TestSnapshotMetric.queue", now)
+	c.Assert(err, IsNil)
+	c.Assert(bySource, HasLen, 3)
+	for i, source := range []string{"a", "b", "c"} {
+		gauge, ok := bySource[source].(StatDataGauge)
+		c.Assert(ok, Equals, true, Commentf("source %s", source))
+		c.Check(gauge.Name, Equals, "TestSnapshotMetric.queue")
+		c.Check(gauge.Value, Equals, float64(i+1))
+	}
+
+	bySource, err = ssi.SnapshotMetric(scTypeGauge, "TestSnapshotMetric.missing", now)
+	c.Assert(err, IsNil)
+	c.Check(bySource, HasLen, 0)
+
+}
+
+func (s *StatStashTest) TestRecordMonotonicGauge(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+	ssi.opts.Clock = func() time.Time { return now }
+
+	// One reset, after which the gauge climbs again
+	for _, value := range []float64{100, 150, 20, 40} {
+		c.Assert(ssi.RecordMonotonicGauge("TestRecordMonotonicGauge.offset", "worker", value), IsNil)
+	}
+
+	values, err := ssi.peekGauge("TestRecordMonotonicGauge.offset", "worker", now)
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, []float64{150})
+
+	resets, err := ssi.peekCounter("TestRecordMonotonicGauge.offset.resets", "worker", now)
+	c.Assert(err, IsNil)
+	c.Check(resets, Equals, uint64(1))
+
+	// Readings are compared across periods, but the next period's gauge
+	// only keeps its own highest reading
+	now = getStartOfFlushPeriod(now, 1)
+	for _, value := range []float64{30, 50} {
+		c.Assert(ssi.RecordMonotonicGauge("TestRecordMonotonicGauge.offset", "worker", value), IsNil)
+	}
+	values, err = ssi.peekGauge("TestRecordMonotonicGauge.offset", "worker", now)
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, []float64{50})
+	resets, err = ssi.peekCounter("TestRecordMonotonicGauge.offset.resets", "worker", now)
+	c.Assert(err, IsNil)
+	c.Check(resets, Equals, uint64(1))
+
+}
+
+func (s *StatStashTest) TestInvalidValues(c *C) {
+
+	ssi := s.newTestStatsStash()
+	logged := &bytes.Buffer{}
+	ssi.log = appwrap.NewWriterLogger(logged)
+	now := time.Now()
+
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		err := ssi.RecordTiming("TestInvalidValues.latency", "", value, 1)
+		c.Assert(err, FitsTypeOf, &ErrStatDropped{})
+		c.Check(err.(*ErrStatDropped).Unwrap(), Equals, ErrStatInvalidValue)
+		for _, err := range []error{
+			ssi.RecordGauge("TestInvalidValues.queue", "", value),
+			ssi.RecordTimingWeighted("TestInvalidValues.latency", "", value, 2, 1),
+			ssi.RecordTimingSummary("TestInvalidValues.latency", "", 2, 0, value, value, value),
+			ssi.AdjustGauge("TestInvalidValues.connections", "", value),
+			ssi.RecordMonotonicGauge("TestInvalidValues.offset", "", value),
+			ssi.RecordCounterFloat("TestInvalidValues.cost", "", value),
+		} {
+			c.Assert(err, FitsTypeOf, &ErrStatDropped{})
+			c.Check(err.(*ErrStatDropped).Unwrap(), Equals, ErrStatInvalidValue)
+		}
+	}
+	configs, err := ssi.getAllConfigs()
+	c.Assert(err, IsNil)
+	c.Check(configs, HasLen, 0)
+
+	// Negative timings are kept with a warning by default
+	c.Assert(ssi.RecordTiming("TestInvalidValues.latency", "", -5, 1), IsNil)
+	c.Check(logged.String(), Matches, "(?s).*WARN: Recording negative timing TestInvalidValues.latency/: value=-5.000000.*")
+	values, err := ssi.peekTiming("TestInvalidValues.latency", "", now)
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, []float64{-5})
+
+	ssi.opts.RejectNegativeTimings = true
+	err = ssi.RecordTiming("TestInvalidValues.latency", "", -7, 1)
+	c.Assert(err, FitsTypeOf, &ErrStatDropped{})
+	c.Check(err.(*ErrStatDropped).Unwrap(), Equals, ErrStatNegativeTiming)
+	values, err = ssi.peekTiming("TestInvalidValues.latency", "", now)
+	c.Assert(err, IsNil)
+	c.Check(values, DeepEquals, []float64{-5})
+
+	// Negative gauges are fine
+	c.Assert(ssi.RecordGauge("TestInvalidValues.temperature", "", -5), IsNil)
+
+}
+
+func (s *StatStashTest) TestSampledCounter(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+	ssi.opts.Clock = func() time.Time { return now }
+
+	// Two producers' sampled contributions merge into one payload
+	c.Assert(ssi.addSampledCounter("TestSampledCounter.hits", "", sampledCounter{3, 0.5}, now), IsNil)
+	c.Assert(ssi.addSampledCounter("TestSampledCounter.hits", "", sampledCounter{2, 0.25}, now), IsNil)
+	item, err := ssi.cache.Get(counterSampledKey(fmt.Sprintf("ss-metric:counter-TestSampledCounter.hits--%d", getStartOfFlushPeriod(now, 0).Unix())))
+	c.Assert(err, IsNil)
+	merged, err := decodeSampledCounter(item.Value)
+	c.Assert(err, IsNil)
+	c.Check(merged.Value, Equals, int64(5))
+	c.Check(math.Abs(merged.estimate()-14) < 1e-9, Equals, true)
+
+	// Unsampled increments take the plain increment path, and are added to
+	// the scaled total
+	c.Assert(ssi.IncrementCounterSampled("TestSampledCounter.hits", "", 1, 1), IsNil)
+	count, err := ssi.peekCounter("TestSampledCounter.hits", "", now)
+	c.Assert(err, IsNil)
+	c.Check(count, Equals, uint64(1))
+
+	c.Check(ssi.IncrementCounterSampled("TestSampledCounter.hits", "", 1, 0), Equals, ErrInvalidSampleRate)
+	c.Check(ssi.IncrementCounterSampled("TestSampledCounter.hits", "", 1, 1.5), Equals, ErrInvalidSampleRate)
+
+	// Counters which were only sampled are flushed too
+	c.Assert(ssi.addSampledCounter("TestSampledCounter.rare", "", sampledCounter{1, 0.1}, now), IsNil)
+
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+	c.Assert(mockFlusher.counters, HasLen, 2)
+	c.Check(mockFlusher.counters[0].Name, Equals, "TestSampledCounter.hits")
+	c.Check(mockFlusher.counters[0].Count, Equals, uint64(15))
+	c.Check(mockFlusher.counters[1].Name, Equals, "TestSampledCounter.rare")
+	c.Check(mockFlusher.counters[1].Count, Equals, uint64(10))
+
+}
+
+func (s *StatStashTest) TestAdvanceOnError(c *C) {
+
+	for _, advance := range []bool{false, true} {
+		ssi := s.newTestStatsStash()
+		c.Assert(ssi.Purge(NewPurgeToken(testAppID)), IsNil)
+		ssi.updateLastPeriodFlushed(time.Time{})
+		cfg := &FlusherConfig{AdvanceOnError: advance}
+
+		now := time.Now()
+		ssi.opts.Clock = func() time.Time { return now }
+		period := getStartOfFlushPeriod(now, 0)
+		c.Assert(ssi.IncrementCounter("TestAdvanceOnError.hits", ""), IsNil)
+
+		failing := &MockFlusher{}
+		failing.On("Flush", mock.Anything, mock.Anything).Return(errors.New("backend down")).Once()
+		c.Check(ssi.UpdateBackend(period, failing, cfg, false), ErrorMatches, "backend down")
+		failing.AssertExpectations(c)
+
+		retry := &MockFlusher{}
+		if advance {
+			// The period is given up on
+			c.Check(ssi.getLastPeriodFlushed().Equal(period), Equals, true)
+			c.Check(ssi.UpdateBackend(period, retry, cfg, false), Equals, ErrStatFlushTooSoon)
 		} else {
-			statsSampled++
+			// The period is retried
+			c.Check(ssi.getLastPeriodFlushed().IsZero(), Equals, true)
+			retry.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+			c.Check(ssi.UpdateBackend(period, retry, cfg, false), IsNil)
+			c.Assert(retry.counters, HasLen, 1)
+			c.Check(retry.counters[0].Count, Equals, uint64(1))
 		}
+		retry.AssertExpectations(c)
 	}
-	fmt.Printf("Stats sampled %d\n", statsSampled)
-	c.Assert(math.Abs(100.0-float64(statsSampled)) <= 50.0, Equals, true)
+
+}
+
+func (s *StatStashTest) TestFlusherConfigTypes(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+
+	c.Assert(ssi.IncrementCounter("TestFlusherConfigTypes.hits", ""), IsNil)
+	c.Assert(ssi.RecordGauge("TestFlusherConfigTypes.queue", "", 3), IsNil)
+	c.Assert(ssi.RecordTiming("TestFlusherConfigTypes.latency", "", 12, 1), IsNil)
+	c.Assert(ssi.RecordCounterFloat("TestFlusherConfigTypes.cost", "", 0.5), IsNil)
+
+	counters := &MockFlusher{}
+	counters.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, counters, &FlusherConfig{Types: []string{"counter"}}, true), IsNil)
+	counters.AssertExpectations(c)
+	c.Check(counters.counters, HasLen, 1)
+	c.Check(counters.floats, HasLen, 0)
+	c.Check(counters.gauges, HasLen, 0)
+	c.Check(counters.timings, HasLen, 0)
+
+	timings := &MockFlusher{}
+	timings.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, timings, &FlusherConfig{Types: []string{"timing", "gauge"}}, true), IsNil)
+	timings.AssertExpectations(c)
+	c.Check(timings.counters, HasLen, 0)
+	c.Check(timings.gauges, HasLen, 1)
+	c.Check(timings.timings, HasLen, 1)
+
+	// Nothing of the types is flushed as an empty period
+	report, err := ssi.UpdateBackendWithReport(now, &MockFlusher{}, &FlusherConfig{Types: []string{"event"}}, true)
+	c.Assert(err, IsNil)
+	c.Check(report.Empty, Equals, true)
+
+}
+
+func (s *StatStashTest) TestFlusherConfigTypesUnforced(c *C) {
+
+	ssi := s.newTestStatsStash()
+	period := getStartOfFlushPeriod(time.Now(), -1)
+	ssi.opts.Clock = func() time.Time { return period.Add(time.Minute) }
+
+	c.Assert(ssi.IncrementCounter("TestFlusherConfigTypesUnforced.hits", ""), IsNil)
+	c.Assert(ssi.RecordTiming("TestFlusherConfigTypesUnforced.latency", "", 12, 1), IsNil)
+
+	// Each filtered flush of the period gets its data, since they keep
+	// separate watermarks
+	counters := &MockFlusher{}
+	counters.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(period, counters, &FlusherConfig{Types: []string{"counter"}}, false), IsNil)
+	counters.AssertExpectations(c)
+	c.Check(counters.counters, HasLen, 1)
+
+	timings := &MockFlusher{}
+	timings.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(period, timings, &FlusherConfig{Types: []string{"timing"}}, false), IsNil)
+	timings.AssertExpectations(c)
+	c.Check(timings.timings, HasLen, 1)
+
+	// but each flushes the period only once
+	c.Check(ssi.UpdateBackend(period, counters, &FlusherConfig{Types: []string{"counter"}}, false), Equals, ErrStatFlushTooSoon)
+	c.Check(ssi.getLastPeriodFlushedFor(&FlusherConfig{Types: []string{"timing"}}).Equal(period), Equals, true)
+	c.Check(ssi.getLastPeriodFlushed().IsZero(), Equals, true)
+
+}
+
+func (s *StatStashTest) TestRegisterDerivedGauge(c *C) {
+
+	ssi := s.newTestStatsStash()
+	now := time.Now()
+
+	hitRatio := func(snapshot map[string]interface{}) (float64, bool) {
+		hits, _ := snapshot["TestRegisterDerivedGauge.hits/web"].(StatDataCounter)
+		misses, _ := snapshot["TestRegisterDerivedGauge.misses/web"].(StatDataCounter)
+		if hits.Count+misses.Count == 0 {
+			return 0, false
+		}
+		return float64(hits.Count) / float64(hits.Count+misses.Count), true
+	}
+	ssi.RegisterDerivedGauge("TestRegisterDerivedGauge.hit_ratio", hitRatio, "web")
+
+	// Nothing to derive from, so no gauge
+	c.Assert(ssi.IncrementCounter("TestRegisterDerivedGauge.other", ""), IsNil)
+	mockFlusher := &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	c.Check(mockFlusher.gauges, HasLen, 0)
+
+	c.Assert(ssi.IncrementCounterBy("TestRegisterDerivedGauge.hits", "web", 3), IsNil)
+	c.Assert(ssi.IncrementCounter("TestRegisterDerivedGauge.misses", "web"), IsNil)
+	mockFlusher = &MockFlusher{}
+	mockFlusher.On("Flush", mock.Anything, mock.Anything).Return(nil).Once()
+	c.Assert(ssi.UpdateBackend(now, mockFlusher, nil, true), IsNil)
+	mockFlusher.AssertExpectations(c)
+
+	c.Assert(mockFlusher.gauges, HasLen, 1)
+	c.Check(mockFlusher.gauges[0].Name, Equals, "TestRegisterDerivedGauge.hit_ratio")
+	c.Check(mockFlusher.gauges[0].Source, Equals, "web")
+	c.Check(mockFlusher.gauges[0].Value, Equals, 0.75)
+
+	// Stats of a service are keyed with it, and invalid values are dropped
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "hits", Source: "web", Service: "billing"}, Count: 1},
+		StatDataCounter{StatConfig: StatConfig{Name: "hits", Source: "web"}, Count: 2},
+	}
+	ssi = s.newTestStatsStash()
+	ssi.RegisterDerivedGauge("billing_hits", func(snapshot map[string]interface{}) (float64, bool) {
+		hits, ok := snapshot["billing/hits/web"].(StatDataCounter)
+		return float64(hits.Count), ok
+	}, "")
+	ssi.RegisterDerivedGauge("infinite", func(snapshot map[string]interface{}) (float64, bool) {
+		return math.Inf(1), true
+	}, "")
+	derived := ssi.deriveGauges(data)
+	c.Assert(derived, HasLen, 1)
+	c.Check(derived[0].(StatDataGauge).Name, Equals, "billing_hits")
+	c.Check(derived[0].(StatDataGauge).Value, Equals, 1.0)
+
+}
+
+func (s *StatStashTest) TestFlusherNameMapper(c *C) {
+
+	data := []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "http.requests", Type: scTypeCounter}, Count: 12},
+		StatDataGauge{StatConfig: StatConfig{Name: "http.connections", Type: scTypeGauge}, Value: 3},
+	}
+
+	// Librato keeps the dotted names, except for a legacy dashboard's one
+	rt := &recordingRoundTripper{}
+	libratoConfig := &FlusherConfig{Username: "user", Password: "secret", NameMapper: func(sc StatConfig) string {
+		if sc.Name == "http.connections" {
+			return "legacy.connections"
+		}
+		return ""
+	}}
+	c.Assert(NewLibratoStatsFlusherWithClient(s.Context, &http.Client{Transport: rt}).Flush(data, libratoConfig), IsNil)
+	c.Assert(rt.bodies, HasLen, 1)
+	values, err := url.ParseQuery(rt.bodies[0])
+	c.Assert(err, IsNil)
+	c.Check(values.Get("counters[0][name]"), Equals, "http.requests")
+	c.Check(values.Get("gauges[0][name]"), Equals, "legacy.connections")
+
+	// Prometheus gets conventional counter names
+	var pushed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		pushed = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	promConfig := &FlusherConfig{NameMapper: func(sc StatConfig) string {
+		if sc.Type == scTypeCounter {
+			return sc.Name + "_total"
+		}
+		return ""
+	}}
+	c.Assert(NewPushgatewayStatsFlusher(s.Context, server.URL, "web", "a").Flush(data, promConfig), IsNil)
+	c.Check(pushed, Equals,
+		"# TYPE http_requests_total gauge\n"+
+			"http_requests_total 12\n"+
+			"# TYPE http_connections gauge\n"+
+			"http_connections 3\n")
+
+	// and so do message queue flushers
+	conn := &fakeNATSConn{published: make(map[string][][]byte)}
+	c.Assert(NewNATSStatsFlusher(s.Context, conn, "stats").Flush(data, promConfig), IsNil)
+	c.Check(conn.published["stats.counter.http.requests_total"], HasLen, 1)
+	c.Check(conn.published["stats.gauge.http.connections"], HasLen, 1)
+
+	// The data itself is untouched
+	c.Check(data[0].(StatDataCounter).Name, Equals, "http.requests")
 
 }
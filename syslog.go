@@ -0,0 +1,129 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"golang.org/x/net/context"
+)
+
+const (
+	syslogAppName = "statstash"
+	// syslogSDID is the structured data ID stat fields are sent under; 32473
+	// is the private enterprise number reserved for examples by RFC 5612
+	syslogSDID = "stat@32473"
+)
+
+// SyslogStatsFlusher is used to flush stats to a syslog server. Each datum is
+// sent as an RFC 5424 message carrying its type, name, source and value as
+// structured data, with the datum's JSON as the message. Messages are sent
+// one per datagram over UDP, and with octet counting framing (RFC 6587) over
+// TCP.
+type SyslogStatsFlusher struct {
+	log      appwrap.Logging
+	network  string
+	addr     string
+	priority int
+	hostname string
+}
+
+// NewSyslogStatsFlusher returns a flusher sending to the syslog server at addr
+// over network ("udp" or "tcp"), with the given facility and severity codes
+// (e.g. 16 for local0 and 6 for informational).
+func NewSyslogStatsFlusher(c context.Context, network, addr string, facility, severity int) StatsFlusher {
+	log := appwrap.NewStackdriverLogging(c)
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return SyslogStatsFlusher{log, network, addr, facility*8 + severity, hostname}
+}
+
+// syslogParamValue escapes the characters RFC 5424 doesn't allow unescaped
+// in structured data parameter values.
+func syslogParamValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// syslogStructuredData renders the structured data element for a datum.
+func syslogStructuredData(sc StatConfig, datum interface{}) string {
+	params := []string{"type", sc.Type, "name", sc.Name, "source", sc.Source}
+	if sc.Service != "" {
+		params = append(params, "service", sc.Service)
+	}
+	switch d := datum.(type) {
+	case StatDataCounter:
+		params = append(params, "value", strconv.FormatUint(d.Count, 10))
+	case StatDataFloatCounter:
+		params = append(params, "value", strconv.FormatFloat(d.Value, 'g', -1, 64))
+	case StatDataGauge:
+		params = append(params, "value", strconv.FormatFloat(d.Value, 'g', -1, 64))
+	case StatDataTiming:
+		params = append(params, "count", strconv.Itoa(d.Count), "value", strconv.FormatFloat(d.Median, 'g', -1, 64))
+	case StatDataHistogram:
+		params = append(params, "sum", strconv.FormatFloat(d.Sum, 'g', -1, 64))
+	}
+
+	sd := "[" + syslogSDID
+	for i := 0; i < len(params); i += 2 {
+		sd += fmt.Sprintf(` %s="%s"`, params[i], syslogParamValue(params[i+1]))
+	}
+	return sd + "]"
+}
+
+func (sf SyslogStatsFlusher) Flush(data []interface{}, cfg *FlusherConfig) error {
+
+	now := time.Now()
+
+	conn, err := net.Dial(sf.network, sf.addr)
+	if err != nil {
+		sf.log.Errorf("Failed to connect to syslog server %s/%s: %s", sf.network, sf.addr, err)
+		return err
+	}
+	defer conn.Close()
+
+	emitted := emittedData(data, cfg)
+	for i := range emitted {
+		sc, ok := statConfigOf(emitted[i])
+		if !ok {
+			sf.log.Warningf("Skipping stat of unknown type %T", emitted[i])
+			continue
+		}
+		body, err := marshalStatDatum(emitted[i], periodStartOf(emitted[i]))
+		if err != nil {
+			return err
+		}
+
+		msg := fmt.Sprintf("<%d>1 %s %s %s %d - %s %s", sf.priority, now.UTC().Format(time.RFC3339),
+			sf.hostname, syslogAppName, os.Getpid(), syslogStructuredData(sc, emitted[i]), body)
+		if strings.HasPrefix(sf.network, "tcp") {
+			msg = strconv.Itoa(len(msg)) + " " + msg
+		}
+
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			sf.log.Errorf("Failed to write stats to syslog server %s/%s: %s", sf.network, sf.addr, err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func syslogTestData() []interface{} {
+	return []interface{}{
+		StatDataCounter{StatConfig: StatConfig{Name: "requests", Source: "api", Type: scTypeCounter}, Count: 12},
+		StatDataGauge{StatConfig: StatConfig{Name: "queue]depth", Type: scTypeGauge}, Value: 2.5},
+	}
+}
+
+func (s *StatStashTest) TestSyslogStatsFlusherUDP(c *C) {
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	// local0.info
+	flusher := NewSyslogStatsFlusher(s.Context, "udp", listener.LocalAddr().String(), 16, 6)
+	c.Assert(flusher.Flush(syslogTestData(), nil), IsNil)
+
+	var msgs []string
+	buf := make([]byte, 4096)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(msgs) < 2 {
+		n, _, err := listener.ReadFrom(buf)
+		c.Assert(err, IsNil)
+		msgs = append(msgs, string(buf[:n]))
+	}
+
+	c.Check(msgs[0], Matches, `<134>1 \S+ \S+ statstash \d+ - \[stat@32473 type="counter" name="requests" source="api" value="12"\] \{.*"count":12.*\}`)
+	c.Check(msgs[1], Matches, `<134>1 .* \[stat@32473 type="gauge" name="queue\\\]depth" source="" value="2.5"\] \{.*\}`)
+
+	// Both the structured data and the body carry the mapped name
+	mapper := func(sc StatConfig) string { return "app." + sc.Name }
+	c.Assert(flusher.Flush(syslogTestData()[:1], &FlusherConfig{NameMapper: mapper}), IsNil)
+	n, _, err := listener.ReadFrom(buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf[:n]), Matches, `<134>1 .* \[stat@32473 type="counter" name="app.requests" source="api" value="12"\] \{.*"name":"app.requests".*\}`)
+
+}
+
+func (s *StatStashTest) TestSyslogStatsFlusherTCP(c *C) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		var msgs []string
+		r := bufio.NewReader(conn)
+		for {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				break
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				break
+			}
+			msgs = append(msgs, string(msg))
+		}
+		received <- msgs
+	}()
+
+	flusher := NewSyslogStatsFlusher(s.Context, "tcp", listener.Addr().String(), 16, 6)
+	c.Assert(flusher.Flush(syslogTestData(), nil), IsNil)
+
+	msgs := <-received
+	c.Assert(msgs, HasLen, 2)
+	c.Check(msgs[0], Matches, `<134>1 .* \[stat@32473 type="counter" name="requests" source="api" value="12"\] .*`)
+
+	// Nothing is listening any more, so connecting fails
+	listener.Close()
+	c.Check(flusher.Flush(syslogTestData(), nil), NotNil)
+
+}
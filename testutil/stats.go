@@ -0,0 +1,75 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"github.com/pendo-io/statstash"
+)
+
+// Clock is a clock tests can set and advance, to control which period
+// values are recorded into.
+type Clock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a Clock stopped at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the clock's time.
+func (c *Clock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// Set moves the clock to now.
+func (c *Clock) Set(now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// NewTestStatInterface returns a StatInterface backed by in-memory datastore
+// and memcache, so code recording stats can be tested with plain go test and
+// no App Engine stub context, and the Clock it records values by. The clock
+// starts at the current time. Memcache expires items by the real time, so
+// tests shouldn't expect values to age out by advancing the clock.
+func NewTestStatInterface() (statstash.StatInterface, *Clock) {
+	return NewTestStatInterfaceWithOptions(statstash.StatOptions{})
+}
+
+// NewTestStatInterfaceWithOptions is like NewTestStatInterface, but with the
+// given options. Any Clock in them is replaced with the returned one.
+func NewTestStatInterfaceWithOptions(opts statstash.StatOptions) (statstash.StatInterface, *Clock) {
+	clock := NewClock(time.Now())
+	opts.Clock = clock.Now
+	stats := statstash.NewStatInterfaceWithOptions(appwrap.NewWriterLogger(os.Stderr), appwrap.NewLocalDatastore(false, nil), appwrap.NewLocalMemcache(), false, opts)
+	return stats, clock
+}
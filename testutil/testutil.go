@@ -0,0 +1,188 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutil has helpers for testing code which records stats with
+// statstash.
+package testutil
+
+import (
+	"sync"
+
+	"github.com/pendo-io/statstash"
+)
+
+// RecordingFlusher is a StatsFlusher which keeps everything flushed to it, so
+// tests can assert on what was flushed. Data from every flush is kept, in
+// order, until Reset is called.
+type RecordingFlusher struct {
+	mtx        sync.Mutex
+	counters   []statstash.StatDataCounter
+	floats     []statstash.StatDataFloatCounter
+	gauges     []statstash.StatDataGauge
+	timings    []statstash.StatDataTiming
+	histograms []statstash.StatDataHistogram
+	flushes    int
+
+	// Err, if set, is returned by Flush after the data is recorded.
+	Err error
+}
+
+// NewRecordingFlusher returns an empty RecordingFlusher.
+func NewRecordingFlusher() *RecordingFlusher {
+	return &RecordingFlusher{}
+}
+
+func (rf *RecordingFlusher) Flush(data []interface{}, cfg *statstash.FlusherConfig) error {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+
+	rf.flushes++
+	for i := range data {
+		switch d := data[i].(type) {
+		case statstash.StatDataCounter:
+			rf.counters = append(rf.counters, d)
+		case statstash.StatDataFloatCounter:
+			rf.floats = append(rf.floats, d)
+		case statstash.StatDataGauge:
+			rf.gauges = append(rf.gauges, d)
+		case statstash.StatDataTiming:
+			rf.timings = append(rf.timings, d)
+		case statstash.StatDataHistogram:
+			rf.histograms = append(rf.histograms, d)
+		}
+	}
+	return rf.Err
+}
+
+// Reset forgets everything flushed so far.
+func (rf *RecordingFlusher) Reset() {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+
+	rf.counters, rf.floats, rf.gauges, rf.timings, rf.histograms = nil, nil, nil, nil, nil
+	rf.flushes = 0
+}
+
+// Flushes returns how many times Flush has been called.
+func (rf *RecordingFlusher) Flushes() int {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	return rf.flushes
+}
+
+// Counters returns every counter flushed, in the order they were flushed.
+func (rf *RecordingFlusher) Counters() []statstash.StatDataCounter {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	return append([]statstash.StatDataCounter(nil), rf.counters...)
+}
+
+// FloatCounters returns every float counter flushed, in the order they were
+// flushed.
+func (rf *RecordingFlusher) FloatCounters() []statstash.StatDataFloatCounter {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	return append([]statstash.StatDataFloatCounter(nil), rf.floats...)
+}
+
+// Gauges returns every gauge flushed, in the order they were flushed.
+func (rf *RecordingFlusher) Gauges() []statstash.StatDataGauge {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	return append([]statstash.StatDataGauge(nil), rf.gauges...)
+}
+
+// Timings returns every timing flushed, in the order they were flushed.
+func (rf *RecordingFlusher) Timings() []statstash.StatDataTiming {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	return append([]statstash.StatDataTiming(nil), rf.timings...)
+}
+
+// Histograms returns every histogram flushed, in the order they were flushed.
+func (rf *RecordingFlusher) Histograms() []statstash.StatDataHistogram {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	return append([]statstash.StatDataHistogram(nil), rf.histograms...)
+}
+
+// Counter returns the last flushed counter with the given name and source,
+// or a zero StatDataCounter if there wasn't one.
+func (rf *RecordingFlusher) Counter(name, source string) statstash.StatDataCounter {
+	counter, _ := rf.FindCounter(name, source)
+	return counter
+}
+
+// FindCounter is like Counter, but also returns whether it was flushed.
+func (rf *RecordingFlusher) FindCounter(name, source string) (statstash.StatDataCounter, bool) {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	for i := len(rf.counters) - 1; i >= 0; i-- {
+		if rf.counters[i].Name == name && rf.counters[i].Source == source {
+			return rf.counters[i], true
+		}
+	}
+	return statstash.StatDataCounter{}, false
+}
+
+// FloatCounter returns the last flushed float counter with the given name
+// and source, or a zero StatDataFloatCounter if there wasn't one.
+func (rf *RecordingFlusher) FloatCounter(name, source string) statstash.StatDataFloatCounter {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	for i := len(rf.floats) - 1; i >= 0; i-- {
+		if rf.floats[i].Name == name && rf.floats[i].Source == source {
+			return rf.floats[i]
+		}
+	}
+	return statstash.StatDataFloatCounter{}
+}
+
+// Gauge returns the last flushed gauge with the given name and source, or a
+// zero StatDataGauge if there wasn't one.
+func (rf *RecordingFlusher) Gauge(name, source string) statstash.StatDataGauge {
+	gauge, _ := rf.FindGauge(name, source)
+	return gauge
+}
+
+// FindGauge is like Gauge, but also returns whether it was flushed.
+func (rf *RecordingFlusher) FindGauge(name, source string) (statstash.StatDataGauge, bool) {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	for i := len(rf.gauges) - 1; i >= 0; i-- {
+		if rf.gauges[i].Name == name && rf.gauges[i].Source == source {
+			return rf.gauges[i], true
+		}
+	}
+	return statstash.StatDataGauge{}, false
+}
+
+// Timing returns the last flushed timing with the given name and source, or
+// a zero StatDataTiming if there wasn't one.
+func (rf *RecordingFlusher) Timing(name, source string) statstash.StatDataTiming {
+	timing, _ := rf.FindTiming(name, source)
+	return timing
+}
+
+// FindTiming is like Timing, but also returns whether it was flushed.
+func (rf *RecordingFlusher) FindTiming(name, source string) (statstash.StatDataTiming, bool) {
+	rf.mtx.Lock()
+	defer rf.mtx.Unlock()
+	for i := len(rf.timings) - 1; i >= 0; i-- {
+		if rf.timings[i].Name == name && rf.timings[i].Source == source {
+			return rf.timings[i], true
+		}
+	}
+	return statstash.StatDataTiming{}, false
+}
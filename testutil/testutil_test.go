@@ -0,0 +1,120 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pendo-io/appwrap"
+	"github.com/pendo-io/statstash"
+	. "gopkg.in/check.v1"
+)
+
+type TestUtilTest struct{}
+
+var _ = Suite(&TestUtilTest{})
+
+func TestTestUtil(t *testing.T) { TestingT(t) }
+
+func (s *TestUtilTest) TestRecordingFlusher(c *C) {
+
+	rf := NewRecordingFlusher()
+
+	c.Assert(rf.Flush([]interface{}{
+		statstash.StatDataCounter{StatConfig: statstash.StatConfig{Name: "requests", Source: "a"}, Count: 3},
+		statstash.StatDataGauge{StatConfig: statstash.StatConfig{Name: "queue.depth"}, Value: 7},
+	}, nil), IsNil)
+	c.Assert(rf.Flush([]interface{}{
+		statstash.StatDataCounter{StatConfig: statstash.StatConfig{Name: "requests", Source: "a"}, Count: 5},
+		statstash.StatDataTiming{StatConfig: statstash.StatConfig{Name: "latency", Source: "a"}, Count: 2, Sum: 12.5},
+	}, nil), IsNil)
+
+	c.Check(rf.Flushes(), Equals, 2)
+	c.Check(rf.Counters(), HasLen, 2)
+	c.Check(rf.Counter("requests", "a").Count, Equals, uint64(5))
+	c.Check(rf.Gauge("queue.depth", "").Value, Equals, 7.0)
+	c.Check(rf.Timing("latency", "a").Sum, Equals, 12.5)
+
+	_, found := rf.FindCounter("requests", "b")
+	c.Check(found, Equals, false)
+	c.Check(rf.Counter("requests", "b").Count, Equals, uint64(0))
+
+	rf.Reset()
+	c.Check(rf.Flushes(), Equals, 0)
+	c.Check(rf.Counters(), HasLen, 0)
+
+	rf.Err = errors.New("backend down")
+	c.Check(rf.Flush(nil, nil), Equals, rf.Err)
+
+}
+
+func (s *TestUtilTest) TestRecordingFlusherWithStats(c *C) {
+
+	stats := statstash.NewStatInterface(appwrap.NewWriterLogger(os.Stderr), appwrap.NewLocalDatastore(false, nil), appwrap.NewLocalMemcache(), false)
+	c.Assert(stats.IncrementCounterBy("requests", "a", 4), IsNil)
+	c.Assert(stats.RecordTiming("latency", "a", 10.0, 1.0), IsNil)
+
+	rf := NewRecordingFlusher()
+	c.Assert(stats.UpdateBackend(time.Now(), rf, nil, true), IsNil)
+
+	c.Check(rf.Counter("requests", "a").Count, Equals, uint64(4))
+	c.Check(rf.Timing("latency", "a").Count, Equals, 1)
+
+}
+
+func (s *TestUtilTest) TestNewTestStatInterface(c *C) {
+
+	stats, clock := NewTestStatInterface()
+	c.Assert(stats.IncrementCounterBy("requests", "a", 4), IsNil)
+	c.Assert(stats.RecordGauge("queue.depth", "", 7), IsNil)
+	c.Assert(stats.RecordTiming("latency", "a", 10.0, 1.0), IsNil)
+
+	rf := NewRecordingFlusher()
+	c.Assert(stats.UpdateBackend(clock.Now(), rf, nil, true), IsNil)
+	c.Check(rf.Counter("requests", "a").Count, Equals, uint64(4))
+	c.Check(rf.Gauge("queue.depth", "").Value, Equals, 7.0)
+	c.Check(rf.Timing("latency", "a").Count, Equals, 1)
+
+	// Values recorded after the clock moves on land in the next period
+	first := clock.Now()
+	clock.Advance(10 * time.Minute)
+	c.Assert(stats.IncrementCounter("requests", "a"), IsNil)
+
+	rf.Reset()
+	c.Assert(stats.UpdateBackend(first, rf, nil, true), IsNil)
+	c.Check(rf.Counter("requests", "a").Count, Equals, uint64(4))
+
+	rf.Reset()
+	c.Assert(stats.UpdateBackend(clock.Now(), rf, nil, true), IsNil)
+	c.Check(rf.Counter("requests", "a").Count, Equals, uint64(1))
+	_, found := rf.FindGauge("queue.depth", "")
+	c.Check(found, Equals, false)
+
+}
+
+func (s *TestUtilTest) TestClock(c *C) {
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+	c.Check(clock.Now(), Equals, start)
+	clock.Advance(time.Minute)
+	c.Check(clock.Now(), Equals, start.Add(time.Minute))
+	clock.Set(start)
+	c.Check(clock.Now(), Equals, start)
+
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 pendo.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statstash
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+)
+
+// OtherSource is the source values are recorded under when
+// StatOptions.TopSources is set and their source isn't one of the metric's
+// most frequent.
+const OtherSource = "other"
+
+// The dimensions of each metric's count-min sketch. Estimates are only ever
+// too high, by at most about 1% of the values recorded (e/sketchWidth) with
+// 98% confidence (1-e^-sketchDepth).
+const (
+	sketchDepth = 4
+	sketchWidth = 256
+)
+
+// sourceRanker keeps approximate source frequencies for each metric when
+// StatOptions.TopSources is set.
+type sourceRanker struct {
+	mtx     sync.Mutex
+	metrics map[string]*sourceSketch
+}
+
+// sourceSketch is a count-min sketch of how often each source of a metric
+// has been recorded, along with the sources currently kept distinct.
+type sourceSketch struct {
+	counts [sketchDepth][sketchWidth]uint32
+	top    map[string]struct{}
+}
+
+// add counts source once, returning its estimated count.
+func (sk *sourceSketch) add(source string) uint32 {
+	est := ^uint32(0)
+	for row, col := range sketchColumns(source) {
+		if sk.counts[row][col] < ^uint32(0) {
+			sk.counts[row][col]++
+		}
+		if sk.counts[row][col] < est {
+			est = sk.counts[row][col]
+		}
+	}
+	return est
+}
+
+// estimate returns the estimated count of source.
+func (sk *sourceSketch) estimate(source string) uint32 {
+	est := ^uint32(0)
+	for row, col := range sketchColumns(source) {
+		if sk.counts[row][col] < est {
+			est = sk.counts[row][col]
+		}
+	}
+	return est
+}
+
+// sketchColumns hashes source to a column in each row of a sketch. The row
+// hashes are derived from the two halves of one 64-bit hash.
+func sketchColumns(source string) [sketchDepth]uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(source))
+	var sum [8]byte
+	h.Sum(sum[:0])
+	h1, h2 := binary.BigEndian.Uint32(sum[:4]), binary.BigEndian.Uint32(sum[4:])
+
+	var cols [sketchDepth]uint32
+	for row := range cols {
+		cols[row] = (h1 + uint32(row)*h2) % sketchWidth
+	}
+	return cols
+}
+
+// route counts source for the metric and returns the source to record it
+// under: source itself while it's one of the k most frequent, and
+// OtherSource otherwise. A new source displaces the least frequent kept
+// source once its estimated count is higher.
+func (r *sourceRanker) route(metric, source string, k int) string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.metrics == nil {
+		r.metrics = make(map[string]*sourceSketch)
+	}
+	sk := r.metrics[metric]
+	if sk == nil {
+		sk = &sourceSketch{top: make(map[string]struct{})}
+		r.metrics[metric] = sk
+	}
+
+	est := sk.add(source)
+	if _, kept := sk.top[source]; kept {
+		return source
+	} else if len(sk.top) < k {
+		sk.top[source] = struct{}{}
+		return source
+	}
+
+	least, leastCount := "", ^uint32(0)
+	for kept := range sk.top {
+		if count := sk.estimate(kept); count < leastCount || (count == leastCount && kept < least) {
+			least, leastCount = kept, count
+		}
+	}
+	if est <= leastCount {
+		return OtherSource
+	}
+	delete(sk.top, least)
+	sk.top[source] = struct{}{}
+	return source
+}
+
+// rollupSource returns the source a value of the stat is recorded under:
+// OtherSource for infrequent sources when StatOptions.TopSources is set, and
+// source unchanged otherwise.
+func (s StatImplementation) rollupSource(typ, name, source string) string {
+	if s.opts.TopSources <= 0 || s.sources == nil || source == OtherSource || source == OverflowSource {
+		return source
+	}
+	return s.sources.route(typ+"-"+name, source, s.opts.TopSources)
+}